@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"reward-system/internal/auth"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+)
+
+const usage = `Usage:
+  auth passwd -user ID -username NAME    set a user's username and password
+  auth revoke -user ID                   log a user out of every session
+
+passwd reads the password from the first line of standard input, e.g.
+  echo 's3cret-pw' | auth passwd -user 1 -username mom
+and logs the user out of their sessions. The database is read from DB_DSN.
+`
+
+// cmd/auth manages login credentials from the server's host, such as the
+// first guardian's before anyone can log in.
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "passwd" && os.Args[1] != "revoke") {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	userID := flags.Uint64("user", 0, "id of the user")
+	username := flags.String("username", "", "username to log in with (passwd)")
+	flags.Parse(os.Args[2:])
+	if *userID == 0 || (command == "passwd" && *username == "") {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using environment variables")
+	}
+	database, err := db.InitDB(os.Getenv("DB_DSN"))
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+
+	switch command {
+	case "passwd":
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatalf("Failed to read the password from standard input: %v", err)
+		}
+		if _, err := auth.SetCredentials(ctx, database, *userID, *username, strings.TrimRight(password, "\r\n")); err != nil {
+			log.Fatalf("Failed to set credentials: %v", err)
+		}
+		log.Printf("User %d can now log in as %q", *userID, *username)
+	case "revoke":
+		revoked, err := auth.RevokeSessions(ctx, database, *userID)
+		if err != nil {
+			log.Fatalf("Failed to revoke sessions: %v", err)
+		}
+		log.Printf("Revoked %d sessions of user %d", revoked, *userID)
+	}
+}
@@ -1,160 +1,137 @@
 package main
 
 import (
-    "database/sql"
-    "fmt"
-    "log"
-    "os"
-    "strings"
-
-    _ "github.com/go-sql-driver/mysql"
-    "github.com/joho/godotenv"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/joho/godotenv"
+	"reward-system/internal/db"
+	"reward-system/internal/migrate"
 )
 
-// Migration represents a database migration
-type Migration struct {
-	Name string
-	SQL  string
-}
+const usage = `Usage: migrate [--dry-run] <command>
 
-var migrations = []Migration{
-	{
-		Name: "001_initial_schema",
-		SQL:  readMigrationFile("migrations/001_initial_schema.sql"),
-	},
-	{
-		Name: "002_test_data",
-		SQL:  readMigrationFile("migrations/002_test_data.sql"),
-	},
-}
+Commands:
+  up        apply all pending migrations (default)
+  down N    roll back the N most recently applied migrations
+  status    list migrations and whether they are applied
+  redo      roll back the latest migration and apply it again
 
-func readMigrationFile(filename string) string {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		log.Fatalf("Failed to read migration file %s: %v", filename, err)
-	}
-	return string(content)
-}
+--dry-run prints the SQL that up, down or redo would run without running it.
+The database is read from DB_DSN; the migrations are embedded in the binary.
+`
 
+// cmd/migrate manages the schema of the database named by DB_DSN with the
+// migrations embedded in the binary, so it runs from any directory.
 func main() {
+	dryRun := false
+	var args []string
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--dry-run", "-dry-run":
+			dryRun = true
+		case "-h", "--help", "help":
+			fmt.Print(usage)
+			return
+		default:
+			args = append(args, arg)
+		}
+	}
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	// Get database connection string
-	dsn := os.Getenv("DB_DSN")
-	if dsn == "" {
-		dsn = "root:@tcp(localhost:3306)/reward_system?charset=utf8mb4&parseTime=True&loc=Local"
-	}
-
-	// Connect to database
-	db, err := sql.Open("mysql", dsn)
+	database, err := db.InitDB(os.Getenv("DB_DSN"))
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-	defer db.Close()
+	ctx := context.Background()
 
-	// Check connection
-	if err := db.Ping(); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+	if !dryRun && command != "status" {
+		if err := db.AdoptModelSchema(ctx, database); err != nil {
+			log.Fatalf("Failed to adopt the database: %v", err)
+		}
 	}
 
-	log.Println("Connected to database successfully")
-
-	// Create migrations table if not exists
-	if err := createMigrationsTable(db); err != nil {
-		log.Fatalf("Failed to create migrations table: %v", err)
+	sqlDB, err := database.DB()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
 	}
-
-	// Run migrations
-	if err := runMigrations(db); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+	migrator, err := migrate.New(sqlDB, database.Dialector.Name())
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
 	}
+	migrator.DryRun = dryRun
+	migrator.Out = os.Stdout
 
-	log.Println("All migrations completed successfully")
-}
+	verb := "Applied"
+	if dryRun {
+		verb = "Would apply"
+	}
 
-func createMigrationsTable(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS schema_migrations (
-		version VARCHAR(255) PRIMARY KEY,
-		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-	`
-	_, err := db.Exec(query)
-	return err
-}
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, version := range applied {
+			log.Printf("%s migration %s", verb, version)
+		}
+		if err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+		if len(applied) == 0 {
+			log.Println("Database schema is up to date")
+		}
 
-func runMigrations(db *sql.DB) error {
-    for _, migration := range migrations {
-		// Check if migration already applied
-		var count int
-		err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", migration.Name).Scan(&count)
+	case "down":
+		if len(args) != 1 {
+			log.Fatalf("down needs the number of migrations to roll back\n\n%s", usage)
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid migration count %q", args[0])
+		}
+		rolledBack, err := migrator.Down(ctx, n)
+		for _, version := range rolledBack {
+			if dryRun {
+				log.Printf("Would roll back migration %s", version)
+			} else {
+				log.Printf("Rolled back migration %s", version)
+			}
+		}
 		if err != nil {
-			return fmt.Errorf("failed to check migration %s: %v", migration.Name, err)
+			log.Fatalf("Failed to roll back migrations: %v", err)
 		}
 
-		if count > 0 {
-			log.Printf("Migration %s already applied, skipping", migration.Name)
-			continue
+	case "redo":
+		version, err := migrator.Redo(ctx)
+		if err != nil {
+			log.Fatalf("Failed to redo migration: %v", err)
 		}
+		log.Printf("%s migration %s again", verb, version)
 
-		log.Printf("Applying migration: %s", migration.Name)
-
-        // Execute migration statements sequentially
-        statements := splitSQLStatements(migration.SQL)
-        for _, stmt := range statements {
-            if stmt == "" {
-                continue
-            }
-            if _, err = db.Exec(stmt); err != nil {
-                return fmt.Errorf("failed to apply migration %s: %v", migration.Name, err)
-            }
-        }
-
-		// Record migration as applied
-		_, err = db.Exec("INSERT INTO schema_migrations (version) VALUES (?)", migration.Name)
+	case "status":
+		statuses, err := migrator.Status(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to record migration %s: %v", migration.Name, err)
+			log.Fatalf("Failed to read migration status: %v", err)
 		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATE\tAPPLIED AT")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status.Version, status.State, status.AppliedAt)
+		}
+		w.Flush()
 
-		log.Printf("Migration %s applied successfully", migration.Name)
+	default:
+		log.Fatalf("Unknown command %q\n\n%s", command, usage)
 	}
-
-	return nil
-}
-
-// splitSQLStatements splits a migration file into individual SQL statements.
-// It removes line comments (--) and ignores DELIMITER directives.
-func splitSQLStatements(sqlText string) []string {
-    // Normalize line endings
-    sqlText = strings.ReplaceAll(sqlText, "\r\n", "\n")
-    sqlText = strings.ReplaceAll(sqlText, "\r", "\n")
-
-    // Remove DELIMITER lines
-    lines := strings.Split(sqlText, "\n")
-    var b strings.Builder
-    for _, line := range lines {
-        trimmed := strings.TrimSpace(line)
-        if strings.HasPrefix(trimmed, "--") { // skip comments
-            continue
-        }
-        if strings.HasPrefix(strings.ToUpper(trimmed), "DELIMITER") { // skip delimiter directives
-            continue
-        }
-        b.WriteString(line)
-        b.WriteString("\n")
-    }
-
-    // Split by semicolons
-    raw := strings.Split(b.String(), ";")
-    var out []string
-    for _, s := range raw {
-        st := strings.TrimSpace(s)
-        if st != "" {
-            out = append(out, st)
-        }
-    }
-    return out
 }
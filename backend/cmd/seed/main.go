@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+	"reward-system/internal/db"
+	"reward-system/internal/seed"
+	"reward-system/internal/services"
+)
+
+// cmd/seed fills the database named by DB_DSN with demo data for
+// development and demos. It refuses to touch a database that already has
+// families unless -force is given.
+func main() {
+	defaults := seed.DefaultOptions()
+	opts := defaults
+	flag.IntVar(&opts.Families, "families", defaults.Families, "number of families")
+	flag.IntVar(&opts.Children, "children", defaults.Children, "children per family")
+	flag.IntVar(&opts.Months, "months", defaults.Months, "months of grant and spend history")
+	flag.Int64Var(&opts.Seed, "seed", defaults.Seed, "random seed; the same seed generates the same data")
+	flag.BoolVar(&opts.Force, "force", false, "add demo data even if the database already has families")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using environment variables")
+	}
+
+	database, err := db.InitDB(os.Getenv("DB_DSN"))
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+
+	summary, err := seed.Run(ctx, database, opts)
+	if errors.Is(err, seed.ErrNotEmpty) {
+		log.Fatalf("The database already has families; pass -force to add demo data anyway")
+	}
+	if err != nil {
+		log.Fatalf("Failed to seed database: %v", err)
+	}
+	log.Printf("Created %d families, %d users, %d reward types and %d transactions",
+		summary.Families, summary.Users, summary.RewardTypes, summary.Transactions)
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"log"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"reward-system/internal/api"
 	"reward-system/internal/config"
 	"reward-system/internal/db"
+	"reward-system/internal/digest"
+	"reward-system/internal/notify"
+	"reward-system/internal/webhook"
 )
 
 func main() {
@@ -15,35 +23,103 @@ func main() {
 		log.Println("No .env file found, using environment variables")
 	}
 
-    cfg := &config.Config{
-        DBDSN:      os.Getenv("DB_DSN"),
-        WechatToken: os.Getenv("WECHAT_TOKEN"),
-        APIToken:   os.Getenv("API_TOKEN"),
-        MCPURL:     os.Getenv("MCP_SERVER_URL"),
-        Port:       os.Getenv("PORT"),
-    }
+	autoMigrate := flag.Bool("migrate", os.Getenv("AUTO_MIGRATE") == "true", "apply pending database migrations on startup (env AUTO_MIGRATE)")
+	flag.Parse()
 
-    if cfg.Port == "" {
-        cfg.Port = "8080"
-    }
+	cfg := &config.Config{
+		DBDSN:       os.Getenv("DB_DSN"),
+		WechatToken: os.Getenv("WECHAT_TOKEN"),
+		APIToken:    os.Getenv("API_TOKEN"),
+		JWTSecret:   os.Getenv("JWT_SECRET"),
+		MCPURL:      os.Getenv("MCP_SERVER_URL"),
+		Port:        os.Getenv("PORT"),
 
-    if cfg.APIToken == "" {
-        cfg.APIToken = "demo-token"
-    }
+		WechatAppID:     os.Getenv("WECHAT_APP_ID"),
+		WechatAppSecret: os.Getenv("WECHAT_APP_SECRET"),
+		WechatAPIURL:    os.Getenv("WECHAT_API_URL"),
+		SMTPAddr:        os.Getenv("SMTP_ADDR"),
+		SMTPFrom:        os.Getenv("SMTP_FROM"),
+		SMTPUsername:    os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:    os.Getenv("SMTP_PASSWORD"),
+	}
+
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+
+	if ttl := os.Getenv("IDEMPOTENCY_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid IDEMPOTENCY_TTL %q: %v", ttl, err)
+		}
+		cfg.IdempotencyTTL = d
+	}
+
+	allowedNets, err := webhook.ParseAllowedNets(os.Getenv("WEBHOOK_ALLOWED_NETS"))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_ALLOWED_NETS: %v", err)
+	}
+	cfg.WebhookAllowedNets = allowedNets
+
+	// Stream tokens are signed with a secret of their own, so they cannot be
+	// forged from the API token or an access token's key. Without
+	// STREAM_SECRET one is made for this run, and a restart, or another
+	// instance, invalidates the tokens it signed.
+	cfg.StreamSecret = os.Getenv("STREAM_SECRET")
+	if cfg.StreamSecret == "" {
+		streamSecret := make([]byte, 32)
+		if _, err := rand.Read(streamSecret); err != nil {
+			log.Fatalf("Failed to generate the stream secret: %v", err)
+		}
+		cfg.StreamSecret = hex.EncodeToString(streamSecret)
+		log.Println("STREAM_SECRET is not set; stream tokens are signed with a random secret and stop working when the server restarts")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	database, err := db.InitDB(cfg.DBDSN)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	if err := db.Migrate(database); err != nil {
-		log.Fatalf("Failed to migrate database: %v", err)
+	// The schema is migrated here only when asked, or with cmd/migrate.
+	if *autoMigrate {
+		if err := db.Migrate(context.Background(), database); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
 	}
 
+	// Outbox events are delivered to the families' webhooks and notified
+	// to their users, and digests sent, in the background for as long as
+	// the server runs.
+	go webhook.NewDispatcher(database, cfg.WebhookAllowedNets).Run(context.Background())
+	channels := notifiers(cfg)
+	go notify.NewWorker(database, channels).Run(context.Background())
+	go digest.NewScheduler(database, channels).Run(context.Background())
+
 	router := api.SetupRouter(database, cfg)
-	
+
 	log.Printf("Server starting on port %s", cfg.Port)
 	if err := router.Run(":" + cfg.Port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+// notifiers returns the notification channels: the log always, WeChat and
+// email when configured.
+func notifiers(cfg *config.Config) map[string]notify.Notifier {
+	notifiers := map[string]notify.Notifier{notify.ChannelLog: &notify.Log{}}
+	if cfg.WechatAppID != "" && cfg.WechatAppSecret != "" {
+		wechat := notify.NewWeChat(cfg.WechatAppID, cfg.WechatAppSecret)
+		if cfg.WechatAPIURL != "" {
+			wechat.BaseURL = cfg.WechatAPIURL
+		}
+		notifiers[notify.ChannelWeChat] = wechat
+	}
+	if cfg.SMTPAddr != "" && cfg.SMTPFrom != "" {
+		notifiers[notify.ChannelEmail] = &notify.SMTP{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+	}
+	return notifiers
+}
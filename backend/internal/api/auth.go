@@ -1,17 +1,59 @@
 package api
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"reward-system/internal/auth"
 	"reward-system/internal/config"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
+// Gin context keys of the authenticated caller.
+const (
+	currentUserKey   = "user"
+	currentClaimsKey = "claims"
+)
+
+// publicPaths are the endpoints reachable without a credential.
+var publicPaths = map[string]bool{
+	"/api/v1/auth/login":   true,
+	"/api/v1/auth/refresh": true,
+}
+
+// AuthMiddleware requires an access token from auth.Login, puts its user in
+// the Gin context and makes them the actor of the request, whose role the
+// services authorize. The shared cfg.APIToken, when configured, is also
+// accepted for development and scripts; it identifies no user and acts as
+// the operator.
+func AuthMiddleware(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Skip auth for wechat webhook (handled separately)
-		if c.Request.URL.Path == "/api/v1/wechat" {
+		if publicPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		// WeChat cannot send a token; its signature authenticates the
+		// callback, and the sender of a message acts as themselves.
+		if c.Request.URL.Path == wechatPath {
+			if !verifyWeChatRequest(c, cfg.WechatToken, time.Now()) {
+				respondError(c, unauthorized("Invalid WeChat signature"))
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// A stream token in the URL stands in for the header on the stream,
+		// which EventSource cannot send one with; Stream checks it. The
+		// request has no actor, so it is authorized for nothing else.
+		if c.Request.URL.Path == streamPath && c.Query("token") != "" {
 			c.Next()
 			return
 		}
@@ -19,24 +61,163 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 		// Bearer token auth for API
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "Missing authorization header"})
-			c.Abort()
+			respondError(c, unauthorized("Missing authorization header"))
 			return
 		}
 
 		tokenParts := strings.Split(authHeader, " ")
 		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "Invalid authorization header format"})
-			c.Abort()
+			respondError(c, unauthorized("Invalid authorization header format"))
 			return
 		}
 
-		if tokenParts[1] != cfg.APIToken {
-			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "Invalid token"})
-			c.Abort()
+		if cfg.APIToken != "" && subtle.ConstantTimeCompare([]byte(tokenParts[1]), []byte(cfg.APIToken)) == 1 {
+			// The shared token identifies no user; changes are audited by channel.
+			c.Request = c.Request.WithContext(services.WithActor(c.Request.Context(), services.OperatorActor(services.SourceAPI)))
+			c.Next()
 			return
 		}
 
+		user, claims, err := auth.Authenticate(c.Request.Context(), database, cfg.JWTSecret, tokenParts[1])
+		if errors.Is(err, auth.ErrInvalidToken) {
+			respondError(c, unauthorized("Invalid token"))
+			return
+		}
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.Set(currentUserKey, user)
+		c.Set(currentClaimsKey, claims)
+		c.Request = c.Request.WithContext(services.WithActor(c.Request.Context(), services.UserActor(user, services.SourceAPI)))
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// currentUser returns the logged-in caller, or nil for the shared token.
+func currentUser(c *gin.Context) *db.User {
+	user, _ := c.Get(currentUserKey)
+	u, _ := user.(*db.User)
+	return u
+}
+
+// currentSessionID returns the session of the logged-in caller, or 0 for
+// the shared token.
+func currentSessionID(c *gin.Context) uint64 {
+	claims, _ := c.Get(currentClaimsKey)
+	if claims, ok := claims.(*auth.Claims); ok {
+		return claims.SessionID
+	}
+	return 0
+}
+
+// Login trades a username and password for an access and a refresh token.
+func Login(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		tokens, err := auth.Login(c.Request.Context(), database, cfg.JWTSecret, req.Username, req.Password)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			respondError(c, unauthorized("Invalid username or password"))
+			return
+		}
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": tokens})
+	}
+}
+
+// RefreshSession trades a refresh token for new tokens. Each refresh token
+// works once.
+func RefreshSession(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		tokens, err := auth.Refresh(c.Request.Context(), database, cfg.JWTSecret, req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidToken) {
+			respondError(c, unauthorized("Invalid refresh token"))
+			return
+		}
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": tokens})
+	}
+}
+
+// Logout ends the caller's session: its access and refresh tokens stop
+// working.
+func Logout(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := c.Get(currentClaimsKey)
+		if !ok {
+			respondError(c, invalidRequestf("Only a logged-in user can log out"))
+			return
+		}
+		if err := auth.Logout(c.Request.Context(), database, claims.(*auth.Claims).SessionID); err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"logged_out": true}})
+	}
+}
+
+// CurrentUser returns the logged-in caller.
+func CurrentUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		if user == nil {
+			respondError(c, invalidRequestf("The API token identifies no user"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": user})
+	}
+}
+
+// SetCredentials sets a user's username and password and logs them out of
+// their sessions.
+func SetCredentials(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		user, err := auth.SetCredentials(c.Request.Context(), database, parseUint(c.Param("id")), req.Username, req.Password)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": user})
+	}
+}
+
+// RevokeSessions logs a user out everywhere.
+func RevokeSessions(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := parseUint(c.Param("id"))
+		revoked, err := auth.RevokeSessions(c.Request.Context(), database, userID)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"user_id": userID, "revoked": revoked}})
+	}
+}
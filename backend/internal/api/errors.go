@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// apiError is a transport-level error that never reaches the services, such
+// as a malformed request body or a missing credential.
+type apiError struct {
+	status  int
+	reason  string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func invalidRequest(err error) error {
+	return &apiError{status: http.StatusBadRequest, reason: "invalid_request", message: err.Error()}
+}
+
+func invalidRequestf(message string) error {
+	return &apiError{status: http.StatusBadRequest, reason: "invalid_request", message: message}
+}
+
+func unauthorized(message string) error {
+	return &apiError{status: http.StatusUnauthorized, reason: "unauthorized", message: message}
+}
+
+// errorStatus maps a service error kind onto the HTTP status and reason
+// listed in the error-code table of 需求.md.
+func errorStatus(kind services.ErrorKind) (int, string) {
+	switch kind {
+	case services.KindNotFound:
+		return http.StatusNotFound, "not_found"
+	case services.KindForbidden:
+		return http.StatusForbidden, "forbidden"
+	case services.KindValidation:
+		return http.StatusUnprocessableEntity, "validation_failed"
+	case services.KindInsufficientBalance:
+		return http.StatusConflict, "insufficient_balance"
+	case services.KindLimitExceeded:
+		return http.StatusUnprocessableEntity, "limit_exceeded"
+	case services.KindConflict:
+		return http.StatusConflict, "conflict"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// errorBody renders err as {code, message, details}. The reason slug is
+// always present in details so clients can tell apart errors sharing a
+// status, e.g. insufficient_balance and conflict.
+func errorBody(err error) (int, gin.H) {
+	var apiErr *apiError
+	var svcErr *services.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.status, gin.H{"code": apiErr.status, "message": apiErr.message, "details": gin.H{"reason": apiErr.reason}}
+	case errors.As(err, &svcErr):
+		status, reason := errorStatus(svcErr.Kind)
+		details := gin.H{"reason": reason}
+		for k, v := range svcErr.Details {
+			details[k] = v
+		}
+		return status, gin.H{"code": status, "message": svcErr.Message, "details": details}
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, gin.H{"code": http.StatusNotFound, "message": "Resource not found", "details": gin.H{"reason": "not_found"}}
+	case errors.Is(err, gorm.ErrDuplicatedKey), errors.Is(err, storage.ErrDuplicate):
+		return http.StatusConflict, gin.H{"code": http.StatusConflict, "message": "Resource already exists", "details": gin.H{"reason": "conflict"}}
+	}
+	log.Printf("Internal error: %v", err)
+	return http.StatusInternalServerError, gin.H{"code": http.StatusInternalServerError, "message": "Internal server error", "details": gin.H{"reason": "internal_error"}}
+}
+
+// respondError writes err as the JSON error response and aborts the chain.
+func respondError(c *gin.Context, err error) {
+	status, body := errorBody(err)
+	c.AbortWithStatusJSON(status, body)
+}
+
+// errorReply renders err as a short WeChat text reply.
+func errorReply(err error) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return "指令格式错误：" + apiErr.message
+	}
+	var svcErr *services.Error
+	if !errors.As(err, &svcErr) {
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, storage.ErrNotFound) {
+			return "未找到相关记录"
+		}
+		log.Printf("Internal error: %v", err)
+		return "系统繁忙，请稍后再试"
+	}
+	switch svcErr.Kind {
+	case services.KindNotFound:
+		return "未找到：" + svcErr.Message
+	case services.KindForbidden:
+		return "没有权限执行该操作"
+	case services.KindValidation:
+		return "参数不正确：" + svcErr.Message
+	case services.KindInsufficientBalance:
+		return "余额不足"
+	case services.KindLimitExceeded:
+		return "超出限制：" + svcErr.Message
+	case services.KindConflict:
+		return "操作冲突：" + svcErr.Message
+	}
+	return "系统繁忙，请稍后再试"
+}
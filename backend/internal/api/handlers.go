@@ -1,38 +1,60 @@
 package api
 
 import (
-    "fmt"
-    "net/http"
-    "reward-system/internal/db"
-    "reward-system/internal/services"
-
-    "github.com/gin-gonic/gin"
-    "gorm.io/gorm"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reward-system/internal/backup"
+	"reward-system/internal/db"
+	"reward-system/internal/purge"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+	"reward-system/internal/units"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func CreateRewardType(database *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			FamilyID  uint64 `json:"family_id" binding:"required"`
-			Name      string `json:"name" binding:"required"`
-			UnitKind  string `json:"unit_kind" binding:"required,oneof=money time points custom"`
-			UnitLabel string `json:"unit_label"`
+			FamilyID            uint64 `json:"family_id" binding:"required"`
+			Name                string `json:"name" binding:"required"`
+			UnitKind            string `json:"unit_kind" binding:"required,oneof=money time points custom"`
+			UnitLabel           string `json:"unit_label"`
+			Currency            string `json:"currency"`
+			Scale               *int   `json:"scale"`
+			MaxValue            int64  `json:"max_value" binding:"min=0"`
+			LowBalanceThreshold int64  `json:"low_balance_threshold" binding:"min=0"`
+			ChildrenMaySpend    bool   `json:"children_may_spend"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			respondError(c, invalidRequest(err))
 			return
 		}
 
 		rewardType := &db.RewardType{
-			FamilyID:  req.FamilyID,
-			Name:      req.Name,
-			UnitKind:  req.UnitKind,
-			UnitLabel: req.UnitLabel,
+			FamilyID:            req.FamilyID,
+			Name:                req.Name,
+			UnitKind:            req.UnitKind,
+			UnitLabel:           req.UnitLabel,
+			Currency:            req.Currency,
+			Scale:               services.DefaultScale(req.UnitKind),
+			MaxValue:            req.MaxValue,
+			LowBalanceThreshold: req.LowBalanceThreshold,
+			ChildrenMaySpend:    req.ChildrenMaySpend,
+		}
+		if req.Scale != nil {
+			rewardType.Scale = *req.Scale
 		}
 
-		if err := database.Create(rewardType).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to create reward type"})
+		service := services.NewRewardService(database)
+		if err := service.CreateRewardType(c.Request.Context(), rewardType); err != nil {
+			respondError(c, err)
 			return
 		}
 
@@ -40,152 +62,278 @@ func CreateRewardType(database *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// ListRewardTypes lists the reward types of family_id; users see their own
+// family's, which is also the default.
 func ListRewardTypes(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        familyID := c.Query("family_id")
-        var types []db.RewardType
-        tx := database
-        if familyID != "" {
-            tx = tx.Where("family_id = ?", parseUint(familyID))
-        }
-        if err := tx.Order("id ASC").Find(&types).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to list reward types"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0, "data": types})
-    }
+	return func(c *gin.Context) {
+		familyID, err := services.ScopeFamily(c.Request.Context(), parseUint(c.Query("family_id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		var types []db.RewardType
+		tx := database
+		if familyID != 0 {
+			tx = tx.Where("family_id = ?", familyID)
+		}
+		if err := tx.Order("id ASC").Find(&types).Error; err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": types})
+	}
 }
 
 func UpdateRewardType(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        id := c.Param("id")
-        var req struct {
-            Name      *string `json:"name"`
-            UnitKind  *string `json:"unit_kind"`
-            UnitLabel *string `json:"unit_label"`
-        }
-        if err := c.ShouldBindJSON(&req); err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
-            return
-        }
-        updates := map[string]interface{}{}
-        if req.Name != nil { updates["name"] = *req.Name }
-        if req.UnitKind != nil { updates["unit_kind"] = *req.UnitKind }
-        if req.UnitLabel != nil { updates["unit_label"] = *req.UnitLabel }
-        if err := database.Model(&db.RewardType{}).Where("id = ?", id).Updates(updates).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to update reward type"})
-            return
-        }
-        var rt db.RewardType
-        if err := database.First(&rt, id).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to load reward type"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0, "data": rt})
-    }
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var req struct {
+			Name                *string `json:"name"`
+			UnitKind            *string `json:"unit_kind" binding:"omitempty,oneof=money time points custom"`
+			UnitLabel           *string `json:"unit_label"`
+			Currency            *string `json:"currency"`
+			Scale               *int    `json:"scale"`
+			MaxValue            *int64  `json:"max_value" binding:"omitempty,min=0"`
+			LowBalanceThreshold *int64  `json:"low_balance_threshold" binding:"omitempty,min=0"`
+			ChildrenMaySpend    *bool   `json:"children_may_spend"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		service := services.NewRewardService(database)
+		rt, err := service.UpdateRewardType(c.Request.Context(), parseUint(id), services.RewardTypeUpdate{
+			Name:                req.Name,
+			UnitKind:            req.UnitKind,
+			UnitLabel:           req.UnitLabel,
+			Currency:            req.Currency,
+			Scale:               req.Scale,
+			MaxValue:            req.MaxValue,
+			LowBalanceThreshold: req.LowBalanceThreshold,
+			ChildrenMaySpend:    req.ChildrenMaySpend,
+		})
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": rt})
+	}
 }
 
+// ListFamilies lists every family to the operator and their own to a user.
 func ListFamilies(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        var families []db.Family
-        if err := database.Order("id ASC").Find(&families).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to list families"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0, "data": families})
-    }
+	return func(c *gin.Context) {
+		familyID, err := services.ScopeFamily(c.Request.Context(), 0)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		var families []db.Family
+		tx := database
+		if familyID != 0 {
+			tx = tx.Where("id = ?", familyID)
+		}
+		if err := tx.Order("id ASC").Find(&families).Error; err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": families})
+	}
 }
 
 func CreateFamily(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        var req struct {
-            Name string `json:"name" binding:"required"`
-        }
-        if err := c.ShouldBindJSON(&req); err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
-            return
-        }
-        family := &db.Family{Name: req.Name}
-        if err := database.Create(family).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to create family"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0, "data": family})
-    }
+	return func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		family := &db.Family{Name: req.Name}
+		if err := services.NewRewardService(database).CreateFamily(c.Request.Context(), family); err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": family})
+	}
+}
+
+// ExportFamily returns the family as a backup archive, ready to be saved as
+// a file and posted to ImportFamily on another instance.
+func ExportFamily(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		familyID := parseUint(c.Param("id"))
+		archive, err := backup.Export(c.Request.Context(), database, familyID)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="family-%d.json"`, familyID))
+		c.JSON(http.StatusOK, archive)
+	}
+}
+
+// ImportFamily restores a backup archive as a new family.
+func ImportFamily(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var archive backup.Archive
+		if err := c.ShouldBindJSON(&archive); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		opts := backup.ImportOptions{ClearOpenIDs: c.Query("clear_openids") == "true"}
+		result, err := backup.Import(c.Request.Context(), database, &archive, opts)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": result})
+	}
+}
+
+// DeleteFamily deletes the family and all of its data. A call without
+// ?confirm= answers 422 with a new confirmation token in the details; while
+// other guardians have yet to confirm, confirming answers 409.
+func DeleteFamily(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("confirm") == "" {
+			// The answer carries a new confirmation token.
+			withholdIdempotentResponse(c)
+		}
+		result, err := purge.Family(c.Request.Context(), database, parseUint(c.Param("id")), c.Query("confirm"))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": result})
+	}
 }
 
+// ListUsers lists the users of family_id; users see their own family's,
+// which is also the default.
 func ListUsers(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        familyID := c.Query("family_id")
-        var users []db.User
-        tx := database
-        if familyID != "" {
-            tx = tx.Where("family_id = ?", parseUint(familyID))
-        }
-        if err := tx.Order("id ASC").Find(&users).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to list users"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0, "data": users})
-    }
+	return func(c *gin.Context) {
+		familyID, err := services.ScopeFamily(c.Request.Context(), parseUint(c.Query("family_id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		var users []db.User
+		tx := database
+		if familyID != 0 {
+			tx = tx.Where("family_id = ?", familyID)
+		}
+		if c.Query("include_archived") != "true" {
+			tx = tx.Where("archived_at IS NULL")
+		}
+		if err := tx.Order("id ASC").Find(&users).Error; err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": users})
+	}
 }
 
 func CreateUser(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        var req struct {
-            FamilyID    uint64 `json:"family_id" binding:"required"`
-            Role        string `json:"role" binding:"required,oneof=guardian child"`
-            DisplayName string `json:"display_name" binding:"required"`
-        }
-        if err := c.ShouldBindJSON(&req); err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
-            return
-        }
-        user := &db.User{FamilyID: req.FamilyID, Role: req.Role, DisplayName: req.DisplayName, IsActive: true}
-        if err := database.Create(user).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to create user"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0, "data": user})
-    }
+	return func(c *gin.Context) {
+		var req struct {
+			FamilyID    uint64 `json:"family_id" binding:"required"`
+			Role        string `json:"role" binding:"required,oneof=guardian child"`
+			DisplayName string `json:"display_name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		user := &db.User{FamilyID: req.FamilyID, Role: req.Role, DisplayName: req.DisplayName}
+		if err := services.NewRewardService(database).CreateUser(c.Request.Context(), user); err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": user})
+	}
+}
+
+// UpdateUser renames a user or changes their WeChat openid.
+func UpdateUser(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			DisplayName  *string `json:"display_name"`
+			WechatOpenID *string `json:"wechat_openid"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		service := services.NewRewardService(database)
+		user, err := service.UpdateUser(c.Request.Context(), parseUint(c.Param("id")), services.UserUpdate{
+			DisplayName:  req.DisplayName,
+			WechatOpenID: req.WechatOpenID,
+		})
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": user})
+	}
+}
+
+// userLifecycle handles the endpoints that move a user between active,
+// inactive and archived with one of the RewardService lifecycle methods.
+func userLifecycle(database *gorm.DB, change func(s *services.RewardService, ctx context.Context, userID uint64) (*db.User, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := change(services.NewRewardService(database), c.Request.Context(), parseUint(c.Param("id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": user})
+	}
+}
+
+func DeactivateUser(database *gorm.DB) gin.HandlerFunc {
+	return userLifecycle(database, (*services.RewardService).DeactivateUser)
 }
 
-func DeleteUser(database *gorm.DB) gin.HandlerFunc {
-    return func(c *gin.Context) {
-        id := c.Param("id")
-        if err := database.Delete(&db.User{}, id).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "Failed to delete user"})
-            return
-        }
-        c.JSON(http.StatusOK, gin.H{"code": 0})
-    }
+// ArchiveUser also serves DELETE /users/:id: users are archived rather than
+// deleted, so their ledger history stays intact.
+func ArchiveUser(database *gorm.DB) gin.HandlerFunc {
+	return userLifecycle(database, (*services.RewardService).ArchiveUser)
+}
+
+func ReactivateUser(database *gorm.DB) gin.HandlerFunc {
+	return userLifecycle(database, (*services.RewardService).ReactivateUser)
 }
 
 func GrantReward(database *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			FamilyID         uint64 `json:"family_id" binding:"required"`
-			ChildID          uint64 `json:"child_id" binding:"required"`
-			RewardTypeID     uint64 `json:"reward_type_id" binding:"required"`
-			Value            int64  `json:"value" binding:"required"`
-			Note             string `json:"note"`
-			IdempotencyKey   string `json:"idempotency_key"`
+			FamilyID       uint64      `json:"family_id" binding:"required"`
+			ChildID        uint64      `json:"child_id" binding:"required"`
+			RewardTypeID   uint64      `json:"reward_type_id" binding:"required"`
+			Value          json.Number `json:"value"`
+			Amount         json.Number `json:"amount"`
+			Note           string      `json:"note"`
+			IdempotencyKey string      `json:"idempotency_key"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			respondError(c, invalidRequest(err))
 			return
 		}
 
 		service := services.NewRewardService(database)
-		result, err := service.GrantReward(req.FamilyID, req.ChildID, req.RewardTypeID, req.Value, req.Note, req.IdempotencyKey)
-		
+		value, err := ledgerValue(c.Request.Context(), service, req.FamilyID, req.RewardTypeID, req.Value, req.Amount)
 		if err != nil {
-			if err.Error() == "insufficient balance" {
-				c.JSON(http.StatusConflict, gin.H{"code": 409, "message": "Insufficient balance"})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+			respondError(c, err)
+			return
+		}
+
+		result, err := service.GrantReward(c.Request.Context(), req.FamilyID, req.ChildID, req.RewardTypeID, value, req.Note, req.IdempotencyKey)
+
+		if err != nil {
+			respondError(c, err)
 			return
 		}
 
@@ -196,28 +344,31 @@ func GrantReward(database *gorm.DB) gin.HandlerFunc {
 func SpendReward(database *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			FamilyID         uint64 `json:"family_id" binding:"required"`
-			ChildID          uint64 `json:"child_id" binding:"required"`
-			RewardTypeID     uint64 `json:"reward_type_id" binding:"required"`
-			Value            int64  `json:"value" binding:"required"`
-			Note             string `json:"note"`
-			IdempotencyKey   string `json:"idempotency_key"`
+			FamilyID       uint64      `json:"family_id" binding:"required"`
+			ChildID        uint64      `json:"child_id" binding:"required"`
+			RewardTypeID   uint64      `json:"reward_type_id" binding:"required"`
+			Value          json.Number `json:"value"`
+			Amount         json.Number `json:"amount"`
+			Note           string      `json:"note"`
+			IdempotencyKey string      `json:"idempotency_key"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			respondError(c, invalidRequest(err))
 			return
 		}
 
 		service := services.NewRewardService(database)
-		result, err := service.SpendReward(req.FamilyID, req.ChildID, req.RewardTypeID, req.Value, req.Note, req.IdempotencyKey)
-		
+		value, err := ledgerValue(c.Request.Context(), service, req.FamilyID, req.RewardTypeID, req.Value, req.Amount)
 		if err != nil {
-			if err.Error() == "insufficient balance" {
-				c.JSON(http.StatusConflict, gin.H{"code": 409, "message": "Insufficient balance"})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+			respondError(c, err)
+			return
+		}
+
+		result, err := service.SpendReward(c.Request.Context(), req.FamilyID, req.ChildID, req.RewardTypeID, value, req.Note, req.IdempotencyKey)
+
+		if err != nil {
+			respondError(c, err)
 			return
 		}
 
@@ -232,19 +383,19 @@ func GetBalance(database *gorm.DB) gin.HandlerFunc {
 		rewardTypeID := c.Query("reward_type_id")
 
 		if familyID == "" || childID == "" || rewardTypeID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "Missing required parameters"})
+			respondError(c, invalidRequestf("Missing required parameters"))
 			return
 		}
 
 		service := services.NewRewardService(database)
-		balance, err := service.GetBalance(parseUint(familyID), parseUint(childID), parseUint(rewardTypeID))
-		
+		balance, err := service.GetBalance(c.Request.Context(), parseUint(familyID), parseUint(childID), parseUint(rewardTypeID))
+
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+			respondError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"balance": balance}})
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": balance})
 	}
 }
 
@@ -257,46 +408,165 @@ func ListTransactions(database *gorm.DB) gin.HandlerFunc {
 		beforeID := c.Query("before_id")
 
 		if familyID == "" || childID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "Missing required parameters"})
+			respondError(c, invalidRequestf("Missing required parameters"))
 			return
 		}
 
 		service := services.NewRewardService(database)
-		transactions, err := service.ListTransactions(parseUint(familyID), parseUint(childID), parseUint(rewardTypeID), parseInt(limit), parseUint(beforeID))
-		
+		transactions, err := service.ListTransactions(c.Request.Context(), parseUint(familyID), parseUint(childID), parseUint(rewardTypeID), parseInt(limit), parseUint(beforeID))
+
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+			respondError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"code": 0, "data": transactions})
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": transactionViews(transactions)})
 	}
 }
 
 func AdjustTransaction(database *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		transactionID := c.Param("id")
-		
+
 		var req struct {
 			NewValue *int64  `json:"new_value"`
 			NewNote  *string `json:"new_note"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			respondError(c, invalidRequest(err))
+			return
+		}
+
+		service := services.NewRewardService(database)
+		transaction, err := service.AdjustTransaction(c.Request.Context(), parseUint(transactionID), req.NewValue, req.NewNote)
+
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"id": transaction.ID}})
+	}
+}
+
+// ListAuditLogs pages backwards through a family's audit logs. Filters are
+// user_id (the actor), action, and since/until as RFC 3339 times; cursor is
+// the next_cursor of the previous page.
+func ListAuditLogs(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		familyID := c.Query("family_id")
+		if familyID == "" {
+			respondError(c, invalidRequestf("Missing required parameters"))
 			return
 		}
+		query := storage.AuditLogFilter{
+			FamilyID: parseUint(familyID),
+			UserID:   parseUint(c.Query("user_id")),
+			Action:   c.Query("action"),
+			BeforeID: parseUint(c.Query("cursor")),
+			Limit:    parseInt(c.DefaultQuery("limit", "50")),
+		}
+		for param, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+			if raw := c.Query(param); raw != "" {
+				parsed, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					respondError(c, invalidRequestf(param+" must be an RFC 3339 time"))
+					return
+				}
+				*t = parsed
+			}
+		}
 
 		service := services.NewRewardService(database)
-		err := service.AdjustTransaction(parseUint(transactionID), req.NewValue, req.NewNote)
-		
+		page, err := service.ListAuditLogs(c.Request.Context(), query)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+			respondError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"id": transactionID}})
+		views := make([]auditLogView, len(page.AuditLogs))
+		for i, auditLog := range page.AuditLogs {
+			views[i] = auditLogView{AuditLog: auditLog}
+			if auditLog.Payload != "" {
+				views[i].Payload = json.RawMessage(auditLog.Payload)
+			}
+		}
+		var nextCursor *string
+		if page.NextCursor > 0 {
+			cursor := strconv.FormatUint(page.NextCursor, 10)
+			nextCursor = &cursor
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"audit_logs": views, "next_cursor": nextCursor}})
+	}
+}
+
+// auditLogView is an audit log with its payload as JSON rather than a
+// string holding JSON.
+type auditLogView struct {
+	db.AuditLog
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// transactionView is a transaction with its value formatted for display
+// and the name of the user who recorded it, empty when no user did.
+type transactionView struct {
+	db.Transaction
+	Display     string `json:"display"`
+	CreatorName string `json:"creator_name,omitempty"`
+}
+
+// transactionViews expects the account, reward type and creator of each
+// transaction to be preloaded, as ListTransactions does.
+func transactionViews(transactions []db.Transaction) []transactionView {
+	views := make([]transactionView, len(transactions))
+	for i, t := range transactions {
+		views[i] = transactionView{Transaction: t, Display: units.For(&t.Account.RewardType).Format(t.Value)}
+		if t.Creator != nil {
+			views[i].CreatorName = t.Creator.DisplayName
+		}
+	}
+	return views
+}
+
+// ledgerValue reads the value of a grant or spend, given either as value in
+// scaled units or as a decimal amount, so $1.25 of a scale 2 type is sent as
+// {"value": 125} or {"amount": "1.25"}.
+func ledgerValue(ctx context.Context, service *services.RewardService, familyID, rewardTypeID uint64, value, amount json.Number) (int64, error) {
+	switch {
+	case value != "" && amount != "":
+		return 0, invalidRequestf("value and amount are mutually exclusive")
+	case value != "":
+		return parseLedgerValue(value)
+	case amount == "":
+		return 0, invalidRequestf("value or amount is required")
+	}
+
+	rewardType, err := service.GetRewardType(ctx, familyID, rewardTypeID)
+	if err != nil {
+		return 0, err
 	}
+	scaled, err := units.ParseDecimal(amount.String(), rewardType.Scale)
+	if err != nil {
+		return 0, services.Validationf("amount must be a positive decimal with at most %d decimal places", rewardType.Scale).WithDetails(map[string]interface{}{
+			"amount": amount.String(),
+			"scale":  rewardType.Scale,
+		})
+	}
+	return scaled, nil
+}
+
+// parseLedgerValue accepts only whole numbers: ledger values are integers
+// scaled by the reward type's scale, so 12.5 is rejected rather than
+// truncated. Decimals go through the amount field instead.
+func parseLedgerValue(raw json.Number) (int64, error) {
+	value, err := strconv.ParseInt(raw.String(), 10, 64)
+	if err != nil {
+		return 0, services.Validationf("value must be a whole number of base units, send decimals as amount").WithDetails(map[string]interface{}{
+			"value": raw.String(),
+		})
+	}
+	return value, nil
 }
 
 func parseUint(s string) uint64 {
@@ -315,4 +585,4 @@ func parseInt(s string) int {
 	var result int
 	fmt.Sscanf(s, "%d", &result)
 	return result
-}
\ No newline at end of file
+}
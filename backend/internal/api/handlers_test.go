@@ -1,12 +1,24 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reward-system/internal/config"
 	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/stream"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
@@ -17,7 +29,7 @@ func setupTestAPI(t *testing.T) (*gin.Engine, *gorm.DB) {
 	gin.SetMode(gin.TestMode)
 
 	// Setup test database
-	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
 	if err != nil {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
@@ -30,14 +42,27 @@ func setupTestAPI(t *testing.T) (*gin.Engine, *gorm.DB) {
 		&db.Account{},
 		&db.Transaction{},
 		&db.AuditLog{},
+		&db.AuditChain{},
+		&db.OutboxEvent{},
+		&db.Webhook{},
+		&db.WebhookDelivery{},
+		&db.NotificationPreference{},
+		&db.DigestSetting{},
+		&db.DigestRun{},
+		&db.Session{},
+		&db.PurgeConfirmation{},
+		&db.IdempotencyRecord{},
 	); err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
 
 	// Create test config
 	cfg := &config.Config{
-		APIToken: "test-token",
-		Port:     "8080",
+		APIToken:     "test-token",
+		JWTSecret:    "test-secret",
+		StreamSecret: "test-stream-secret",
+		WechatToken:  "test-wechat-token",
+		Port:         "8080",
 	}
 
 	// Setup router
@@ -47,11 +72,11 @@ func setupTestAPI(t *testing.T) (*gin.Engine, *gorm.DB) {
 }
 
 func TestCreateRewardType(t *testing.T) {
-	router, db := setupTestAPI(t)
+	router, database := setupTestAPI(t)
 
 	// Create test family
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -94,11 +119,11 @@ func TestCreateRewardType(t *testing.T) {
 }
 
 func TestGrantReward(t *testing.T) {
-	router, db := setupTestAPI(t)
+	router, database := setupTestAPI(t)
 
 	// Create test data
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -107,7 +132,7 @@ func TestGrantReward(t *testing.T) {
 		Role:        "child",
 		DisplayName: "Test Child",
 	}
-	if err := db.Create(child).Error; err != nil {
+	if err := database.Create(child).Error; err != nil {
 		t.Fatalf("Failed to create test child: %v", err)
 	}
 
@@ -115,18 +140,20 @@ func TestGrantReward(t *testing.T) {
 		FamilyID: family.ID,
 		Name:     "Test Reward",
 		UnitKind: "money",
+		Currency: "CNY",
+		Scale:    2,
 	}
-	if err := db.Create(rewardType).Error; err != nil {
+	if err := database.Create(rewardType).Error; err != nil {
 		t.Fatalf("Failed to create test reward type: %v", err)
 	}
 
 	// Test request body
 	body := map[string]interface{}{
-		"family_id":        family.ID,
-		"child_id":         child.ID,
-		"reward_type_id":   rewardType.ID,
-		"value":            1000,
-		"note":             "Test grant",
+		"family_id":       family.ID,
+		"child_id":        child.ID,
+		"reward_type_id":  rewardType.ID,
+		"value":           1000,
+		"note":            "Test grant",
 		"idempotency_key": "test-key-1",
 	}
 
@@ -167,14 +194,18 @@ func TestGrantReward(t *testing.T) {
 	if data["new_balance"] != float64(1000) {
 		t.Errorf("Expected new_balance to be 1000, got %v", data["new_balance"])
 	}
+
+	if data["display"] != "¥10.00" {
+		t.Errorf("Expected display to be ¥10.00, got %v", data["display"])
+	}
 }
 
 func TestGetBalance(t *testing.T) {
-	router, db := setupTestAPI(t)
+	router, database := setupTestAPI(t)
 
 	// Create test data
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -183,7 +214,7 @@ func TestGetBalance(t *testing.T) {
 		Role:        "child",
 		DisplayName: "Test Child",
 	}
-	if err := db.Create(child).Error; err != nil {
+	if err := database.Create(child).Error; err != nil {
 		t.Fatalf("Failed to create test child: %v", err)
 	}
 
@@ -191,8 +222,10 @@ func TestGetBalance(t *testing.T) {
 		FamilyID: family.ID,
 		Name:     "Test Reward",
 		UnitKind: "money",
+		Currency: "CNY",
+		Scale:    2,
 	}
-	if err := db.Create(rewardType).Error; err != nil {
+	if err := database.Create(rewardType).Error; err != nil {
 		t.Fatalf("Failed to create test reward type: %v", err)
 	}
 
@@ -203,7 +236,7 @@ func TestGetBalance(t *testing.T) {
 		RewardTypeID: rewardType.ID,
 		Balance:      2500,
 	}
-	if err := db.Create(account).Error; err != nil {
+	if err := database.Create(account).Error; err != nil {
 		t.Fatalf("Failed to create test account: %v", err)
 	}
 
@@ -237,6 +270,10 @@ func TestGetBalance(t *testing.T) {
 	if data["balance"] != float64(2500) {
 		t.Errorf("Expected balance to be 2500, got %v", data["balance"])
 	}
+
+	if data["display"] != "¥25.00" {
+		t.Errorf("Expected display to be ¥25.00, got %v", data["display"])
+	}
 }
 
 func TestAuthMiddleware(t *testing.T) {
@@ -260,4 +297,992 @@ func TestAuthMiddleware(t *testing.T) {
 	if w.Code != http.StatusUnauthorized {
 		t.Errorf("Expected status 401, got %d", w.Code)
 	}
-}
\ No newline at end of file
+}
+
+func TestSpendReward_ErrorResponses(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Test Reward", UnitKind: "money"}
+	database.Create(rewardType)
+
+	spend := func(value int) (int, map[string]interface{}) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"family_id":      family.ID,
+			"child_id":       child.ID,
+			"reward_type_id": rewardType.ID,
+			"value":          value,
+		})
+		req, _ := http.NewRequest("POST", "/api/v1/rewards/spend", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	// No account yet: 404 instead of a blanket 500
+	code, response := spend(100)
+	if code != http.StatusNotFound || response["code"] != float64(404) {
+		t.Errorf("Expected 404 for missing account, got %d: %v", code, response)
+	}
+
+	database.Create(&db.Account{FamilyID: family.ID, ChildID: child.ID, RewardTypeID: rewardType.ID, Balance: 50})
+
+	code, response = spend(100)
+	if code != http.StatusConflict {
+		t.Fatalf("Expected 409 for insufficient balance, got %d: %v", code, response)
+	}
+	details, _ := response["details"].(map[string]interface{})
+	if details["reason"] != "insufficient_balance" {
+		t.Errorf("Expected reason insufficient_balance, got %v", details["reason"])
+	}
+	if details["balance"] != float64(50) {
+		t.Errorf("Expected balance 50 in details, got %v", details["balance"])
+	}
+}
+
+func TestWeChatStructuredCommand_ErrorReplies(t *testing.T) {
+	_, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	database.Create(&db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Parent", WechatOpenID: "parent-openid"})
+	database.Create(&db.User{FamilyID: family.ID, Role: "child", DisplayName: "小明"})
+	database.Create(&db.RewardType{FamilyID: family.ID, Name: "零花钱", UnitKind: "money", UnitLabel: "分", Currency: "CNY", Scale: 2})
+
+	msg := WeChatMessage{FromUserName: "parent-openid", MsgID: 1}
+	reply := processStructuredCommand(context.Background(), database, msg, `{"action":"grant","child":"小明","type":"money","value":500}`)
+	if !strings.Contains(reply, "¥5.00") {
+		t.Errorf("Expected grant reply, got %q", reply)
+	}
+	var granted db.Transaction
+	database.Take(&granted)
+	if granted.CreatedBy == nil || *granted.CreatedBy != 1 {
+		t.Errorf("Expected the grant created by the sender, got %v", granted.CreatedBy)
+	}
+
+	msg.MsgID = 3
+	reply = processStructuredCommand(context.Background(), database, msg, `{"action":"grant","child":"小明","type":"money","amount":"1.5元"}`)
+	if !strings.HasSuffix(reply, "当前余额 ¥6.50") {
+		t.Errorf("Expected balance of ¥6.50, got %q", reply)
+	}
+
+	msg.MsgID = 2
+	reply = processStructuredCommand(context.Background(), database, msg, `{"action":"spend","child":"小明","type":"money","value":1000}`)
+	if reply != "余额不足" {
+		t.Errorf("Expected insufficient balance reply, got %q", reply)
+	}
+
+	msg.FromUserName = "unknown-openid"
+	reply = processStructuredCommand(context.Background(), database, msg, `{"action":"query","child":"小明","type":"money"}`)
+	if !strings.HasPrefix(reply, "未找到") {
+		t.Errorf("Expected not found reply, got %q", reply)
+	}
+}
+
+func TestWeChatSignature(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	database.Create(&db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Parent", WechatOpenID: "parent-openid"})
+	database.Create(&db.User{FamilyID: family.ID, Role: "child", DisplayName: "小明"})
+	database.Create(&db.RewardType{FamilyID: family.ID, Name: "积分", UnitKind: "points", UnitLabel: "分"})
+
+	sign := func(token string, timestamp time.Time) string {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		params := []string{token, ts, "nonce"}
+		sort.Strings(params)
+		sum := sha1.Sum([]byte(strings.Join(params, "")))
+		return "?signature=" + hex.EncodeToString(sum[:]) + "&timestamp=" + ts + "&nonce=nonce"
+	}
+	do := func(router *gin.Engine, method, query, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/api/v1/wechat"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/xml")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	message := `<xml><ToUserName>kudo</ToUserName><FromUserName>parent-openid</FromUserName><MsgType>text</MsgType>` +
+		`<Content>#cmd {"action":"grant","child":"小明","type":"积分","value":5}</Content><MsgId>1</MsgId></xml>`
+
+	if w := do(router, "GET", sign("test-wechat-token", time.Now())+"&echostr=hello", ""); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Expected the URL verification echoed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(router, "POST", sign("test-wechat-token", time.Now()), message); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "已为小明记入积分") {
+		t.Errorf("Expected the signed command executed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Forged, missing and stale signatures are refused before any command runs.
+	for name, query := range map[string]string{
+		"wrong token": sign("wrong-token", time.Now()),
+		"unsigned":    "",
+		"stale":       sign("test-wechat-token", time.Now().Add(-time.Hour)),
+	} {
+		if w := do(router, "POST", query, message); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a %s callback refused, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+	var count int64
+	database.Model(&db.Transaction{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected only the signed command recorded, got %d transactions", count)
+	}
+
+	// Without a WECHAT_TOKEN nothing verifies.
+	unconfigured := SetupRouter(database, &config.Config{APIToken: "test-token"})
+	if w := do(unconfigured, "GET", sign("", time.Now())+"&echostr=hello", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected callbacks refused without a token, got %d", w.Code)
+	}
+}
+
+func TestGrantReward_RejectsInvalidValues(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Test Reward", UnitKind: "money"}
+	database.Create(rewardType)
+
+	for _, value := range []string{"0", "-100", "12.5"} {
+		body := `{"family_id":1,"child_id":1,"reward_type_id":1,"value":` + value + `}`
+		req, _ := http.NewRequest("POST", "/api/v1/rewards/grant", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("value %s: expected status 422, got %d: %s", value, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGrantReward_DecimalAmounts(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+
+	post := func(path, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		data, _ := response["data"].(map[string]interface{})
+		return w.Code, data
+	}
+
+	code, data := post("/api/v1/reward_types", `{"family_id":1,"name":"Allowance","unit_kind":"money","currency":"USD"}`)
+	if code != http.StatusOK || data["scale"] != float64(2) || data["currency"] != "USD" {
+		t.Fatalf("Expected a USD type with the default scale 2, got %d %v", code, data)
+	}
+
+	code, data = post("/api/v1/rewards/grant", `{"family_id":1,"child_id":1,"reward_type_id":1,"amount":"1.25"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if data["new_balance"] != float64(125) || data["display"] != "$1.25" || data["currency"] != "USD" || data["scale"] != float64(2) {
+		t.Errorf("Unexpected grant result %v", data)
+	}
+
+	for _, body := range []string{
+		`{"family_id":1,"child_id":1,"reward_type_id":1,"amount":"1.255"}`,
+		`{"family_id":1,"child_id":1,"reward_type_id":1,"amount":"-1"}`,
+	} {
+		if code, _ := post("/api/v1/rewards/grant", body); code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status 422, got %d", body, code)
+		}
+	}
+	for _, body := range []string{
+		`{"family_id":1,"child_id":1,"reward_type_id":1}`,
+		`{"family_id":1,"child_id":1,"reward_type_id":1,"value":125,"amount":"1.25"}`,
+	} {
+		if code, _ := post("/api/v1/rewards/grant", body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, code)
+		}
+	}
+
+	post("/api/v1/reward_types", `{"family_id":1,"name":"Stars","unit_kind":"points","scale":1}`)
+	code, data = post("/api/v1/rewards/grant", `{"family_id":1,"child_id":1,"reward_type_id":2,"amount":0.5}`)
+	if code != http.StatusOK || data["new_balance"] != float64(5) || data["display"] != "0.5积分" {
+		t.Errorf("Expected half a point, got %d %v", code, data)
+	}
+
+	if code, _ := post("/api/v1/reward_types", `{"family_id":1,"name":"Bad","unit_kind":"money","currency":"EUR"}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an unsupported currency, got %d", code)
+	}
+}
+
+func TestExportImportFamily(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child", WechatOpenID: "openid-child"}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+	services.NewRewardService(database).GrantReward(services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI)), family.ID, child.ID, rewardType.ID, 7, "", "")
+
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/api/v1/families/1/export", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), "family-1.json") {
+		t.Fatalf("Expected the archive as an attachment, got %d %v", w.Code, w.Header())
+	}
+	archive := w.Body.Bytes()
+
+	if w := do("POST", "/api/v1/families/import", archive); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a clashing openid, got %d", w.Code)
+	}
+	w = do("POST", "/api/v1/families/import?clear_openids=true", archive)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data struct {
+			FamilyID     uint64 `json:"family_id"`
+			Transactions int    `json:"transactions"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Data.FamilyID != 2 || response.Data.Transactions != 1 {
+		t.Errorf("Unexpected import result %s", w.Body.String())
+	}
+
+	if w := do("GET", "/api/v1/families/99/export", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing family, got %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/families/import", []byte(`{"format":"other","version":1}`)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for a foreign archive, got %d", w.Code)
+	}
+}
+
+func TestDeleteFamily(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	database.Create(&db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"})
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("DELETE", path, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("/api/v1/families/1")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 without a confirmation token, got %d", w.Code)
+	}
+	var response struct {
+		Details struct {
+			ConfirmationToken string `json:"confirmation_token"`
+		} `json:"details"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Details.ConfirmationToken == "" {
+		t.Fatalf("Expected a confirmation token, got %s", w.Body.String())
+	}
+
+	if w := do("/api/v1/families/1?confirm=wrong"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a wrong token, got %d", w.Code)
+	}
+	if w := do("/api/v1/families/1?confirm=" + response.Details.ConfirmationToken); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var users int64
+	database.Model(&db.User{}).Count(&users)
+	if users != 0 {
+		t.Errorf("Expected the family's users to be deleted, got %d", users)
+	}
+	if w := do("/api/v1/families/1?confirm=" + response.Details.ConfirmationToken); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 once deleted, got %d", w.Code)
+	}
+}
+
+func TestUserLifecycle(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child", IsActive: true}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	listed := func(query string) int {
+		var response struct {
+			Data []db.User `json:"data"`
+		}
+		json.Unmarshal(do("GET", "/api/v1/users?family_id=1"+query, "").Body.Bytes(), &response)
+		return len(response.Data)
+	}
+	grant := `{"family_id":1,"child_id":1,"reward_type_id":1,"value":5}`
+
+	if w := do("PATCH", "/api/v1/users/1", `{"display_name":"Renamed","wechat_openid":"openid-child"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Renamed") {
+		t.Fatalf("Expected the user to be renamed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PATCH", "/api/v1/users/1", `{"display_name":""}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an empty name, got %d", w.Code)
+	}
+
+	if w := do("POST", "/api/v1/users/1/deactivate", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/rewards/grant", grant); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 granting to an inactive child, got %d", w.Code)
+	}
+	if n := listed(""); n != 1 {
+		t.Errorf("Expected a deactivated user to stay listed, got %d users", n)
+	}
+
+	if w := do("DELETE", "/api/v1/users/1", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var count int64
+	database.Model(&db.User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected DELETE to archive rather than delete the user")
+	}
+	if n := listed(""); n != 0 {
+		t.Errorf("Expected an archived user to be hidden, got %d users", n)
+	}
+	if n := listed("&include_archived=true"); n != 1 {
+		t.Errorf("Expected include_archived to list the archived user, got %d users", n)
+	}
+
+	if w := do("POST", "/api/v1/users/1/reactivate", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/rewards/grant", grant); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 granting after reactivation, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestListAuditLogs(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Parent", WechatOpenID: "parent-openid", IsActive: true}
+	database.Create(guardian)
+	database.Create(&db.User{FamilyID: family.ID, Role: "child", DisplayName: "小明", IsActive: true})
+	database.Create(&db.RewardType{FamilyID: family.ID, Name: "积分", UnitKind: "points"})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	processStructuredCommand(context.Background(), database, WeChatMessage{FromUserName: "parent-openid", MsgID: 1}, `{"action":"grant","child":"小明","type":"积分","value":5}`)
+	if w := do("POST", "/api/v1/mcp/tools", `{"tool":"spend_reward","params":{"family_id":1,"child_id":2,"reward_type_id":1,"value":2}}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PATCH", "/api/v1/reward_types/1", `{"max_value":10}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	type page struct {
+		Data struct {
+			AuditLogs []struct {
+				ID      uint64  `json:"id"`
+				UserID  *uint64 `json:"user_id"`
+				Action  string  `json:"action"`
+				Payload struct {
+					Source string          `json:"source"`
+					Before json.RawMessage `json:"before"`
+					After  json.RawMessage `json:"after"`
+				} `json:"payload"`
+			} `json:"audit_logs"`
+			NextCursor *string `json:"next_cursor"`
+		} `json:"data"`
+	}
+	list := func(query string) page {
+		w := do("GET", "/api/v1/audit_logs?family_id=1"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var p page
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return p
+	}
+
+	all := list("").Data.AuditLogs
+	if len(all) != 3 {
+		t.Fatalf("Expected 3 audit logs, got %+v", all)
+	}
+	if all[0].Action != "reward_type.updated" || all[0].Payload.Source != "api" || len(all[0].Payload.Before) == 0 {
+		t.Errorf("Unexpected reward type audit log %+v", all[0])
+	}
+	if all[1].Action != "reward.spent" || all[1].Payload.Source != "mcp" {
+		t.Errorf("Unexpected MCP audit log %+v", all[1])
+	}
+	if all[2].Action != "reward.granted" || all[2].Payload.Source != "wechat" || all[2].UserID == nil || *all[2].UserID != guardian.ID {
+		t.Errorf("Unexpected WeChat audit log %+v", all[2])
+	}
+
+	if byActor := list("&user_id=1").Data.AuditLogs; len(byActor) != 1 || byActor[0].Action != "reward.granted" {
+		t.Errorf("Expected the guardian's grant, got %+v", byActor)
+	}
+	if byAction := list("&action=reward.spent").Data.AuditLogs; len(byAction) != 1 {
+		t.Errorf("Expected one spend, got %+v", byAction)
+	}
+	first := list("&limit=2")
+	if len(first.Data.AuditLogs) != 2 || first.Data.NextCursor == nil {
+		t.Fatalf("Expected a page of 2 with a cursor, got %+v", first.Data)
+	}
+	second := list("&limit=2&cursor=" + *first.Data.NextCursor)
+	if len(second.Data.AuditLogs) != 1 || second.Data.AuditLogs[0].ID != all[2].ID || second.Data.NextCursor != nil {
+		t.Errorf("Expected the last log without a cursor, got %+v", second.Data)
+	}
+
+	if w := do("GET", "/api/v1/audit_logs", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without family_id, got %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/audit_logs?family_id=1&since=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed since, got %d", w.Code)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	router, database := setupTestAPI(t)
+	database.Create(&db.Family{Name: "Test Family"})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/api/v1/webhooks", `{"family_id":1,"url":"not a url"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an invalid URL, got %d: %s", w.Code, w.Body.String())
+	}
+	w := do("POST", "/api/v1/webhooks", `{"family_id":1,"url":"https://ha.example.com/api/webhook/kudo","events":["reward.granted"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Data struct {
+			ID     uint64 `json:"id"`
+			Secret string `json:"secret"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Data.ID == 0 || len(created.Data.Secret) != 64 {
+		t.Fatalf("Expected the webhook and its secret, got %s", w.Body.String())
+	}
+
+	// The secret is shown once.
+	if w := do("GET", "/api/v1/webhooks?family_id=1", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Data.Secret) {
+		t.Errorf("Expected the webhook without its secret, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/webhook_deliveries?family_id=1&status=dead", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deliveries":[]`) {
+		t.Errorf("Expected an empty dead-letter view, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/webhook_deliveries?family_id=1&status=lost", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an unknown status, got %d", w.Code)
+	}
+	if w := do("POST", "/api/v1/webhook_deliveries/1/retry", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 retrying a missing delivery, got %d", w.Code)
+	}
+
+	if w := do("DELETE", "/api/v1/webhooks/"+strconv.FormatUint(created.Data.ID, 10), ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var actions []string
+	database.Model(&db.AuditLog{}).Order("id ASC").Pluck("action", &actions)
+	if strings.Join(actions, " ") != "webhook.created webhook.deleted" {
+		t.Errorf("Expected the webhook changes to be audited, got %v", actions)
+	}
+}
+
+func TestStream(t *testing.T) {
+	router, database := setupTestAPI(t)
+	// The stream and the hub query concurrently; an in-memory database
+	// exists only on its one connection.
+	sqlDB, _ := database.DB()
+	sqlDB.SetMaxOpenConns(1)
+	streamHeartbeat = 50 * time.Millisecond
+	defer func() { streamHeartbeat = 15 * time.Second }()
+
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	service := services.NewRewardService(database)
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	database.Create(&db.Family{Name: "Other Family"})
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid", IsActive: true}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	service.CreateRewardType(ctx, rewardType)
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 5, "", ""); err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	get := func(path string, header http.Header) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return resp
+	}
+
+	req, _ := http.NewRequest("POST", "/api/v1/stream/tokens", strings.NewReader(`{"family_id":1}`))
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var issued struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &issued)
+	if w.Code != http.StatusOK || issued.Data.Token == "" {
+		t.Fatalf("Expected a stream token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/stream?family_id=1": http.StatusUnauthorized,
+		"/api/v1/stream?family_id=1&token=" + stream.IssueToken("test-token", 1, 0, time.Now().Add(time.Hour)):         http.StatusUnauthorized,
+		"/api/v1/stream?family_id=1&token=1.0.9999999999.forged":                                                       http.StatusUnauthorized,
+		"/api/v1/stream?family_id=2&token=" + issued.Data.Token:                                                        http.StatusForbidden,
+		"/api/v1/stream?family_id=3&token=" + stream.IssueToken("test-stream-secret", 3, 0, time.Now().Add(time.Hour)): http.StatusNotFound,
+	} {
+		resp := get(path, nil)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: expected status %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+
+	// Resuming after the reward type's event replays the grant, then the
+	// next spend arrives live.
+	resp := get("/api/v1/stream?family_id=1&token="+issued.Data.Token, http.Header{"Last-Event-ID": {"1"}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	blocks := make(chan string)
+	go func() {
+		defer close(blocks)
+		reader := bufio.NewReader(resp.Body)
+		var block strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\n" {
+				blocks <- block.String()
+				block.Reset()
+				continue
+			}
+			block.WriteString(line)
+		}
+	}()
+	next := func(skip string) string {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case block := <-blocks:
+				if strings.HasPrefix(block, skip) {
+					continue
+				}
+				return block
+			case <-timeout:
+				t.Fatalf("Timed out waiting for an event after %q", skip)
+			}
+		}
+	}
+
+	if block := next(":"); !strings.HasPrefix(block, "retry: ") {
+		t.Errorf("Expected a retry hint first, got %q", block)
+	}
+	if block := next(":"); !strings.HasPrefix(block, "id: 2\nevent: reward.granted\ndata: ") {
+		t.Errorf("Expected the grant to be replayed, got %q", block)
+	}
+	if block := next("id:"); block != ": heartbeat\n" {
+		t.Errorf("Expected a heartbeat on an idle stream, got %q", block)
+	}
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 2, "", ""); err != nil {
+		t.Fatalf("SpendReward: %v", err)
+	}
+	block := next(":")
+	if !strings.HasPrefix(block, "id: 3\nevent: reward.spent\ndata: ") {
+		t.Fatalf("Expected the spend live, got %q", block)
+	}
+	var envelope struct {
+		Data services.LedgerEvent `json:"data"`
+	}
+	json.Unmarshal([]byte(strings.TrimSuffix(block[strings.Index(block, "data: ")+6:], "\n")), &envelope)
+	if envelope.Data.ChildID != child.ID || envelope.Data.RewardTypeID != rewardType.ID || envelope.Data.Balance != 3 {
+		t.Errorf("Unexpected event data %+v", envelope.Data)
+	}
+}
+
+func TestStream_Session(t *testing.T) {
+	router, database := setupTestAPI(t)
+	sqlDB, _ := database.DB()
+	sqlDB.SetMaxOpenConns(1)
+	streamHeartbeat = 50 * time.Millisecond
+	defer func() { streamHeartbeat = 15 * time.Second }()
+	database.Create(&db.Family{Name: "Test Family"})
+	database.Create(&db.User{FamilyID: 1, Role: "guardian", DisplayName: "Mom", IsActive: true})
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	do := func(method, path, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	do("PUT", "/api/v1/users/1/credentials", "test-token", `{"username":"mom","password":"secret-1"}`).Body.Close()
+	var tokens struct {
+		Data struct {
+			AccessToken string `json:"access_token"`
+		} `json:"data"`
+	}
+	decode(do("POST", "/api/v1/auth/login", "", `{"username":"mom","password":"secret-1"}`), &tokens)
+	var issued struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	decode(do("POST", "/api/v1/stream/tokens", tokens.Data.AccessToken, `{"family_id":1}`), &issued)
+	if issued.Data.Token == "" {
+		t.Fatal("Expected a stream token")
+	}
+
+	resp := do("GET", "/api/v1/stream?family_id=1&token="+issued.Data.Token, "", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the stream to open, got %d", resp.StatusCode)
+	}
+
+	// Logging out ends the session, the open stream and the token.
+	if logout := do("POST", "/api/v1/auth/logout", tokens.Data.AccessToken, ""); logout.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to log out, got %d", logout.StatusCode)
+	}
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		ended <- err
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to end with its session")
+	}
+	again := do("GET", "/api/v1/stream?family_id=1&token="+issued.Data.Token, "", "")
+	again.Body.Close()
+	if again.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the token of an ended session refused, got %d", again.StatusCode)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	router, database := setupTestAPI(t)
+	database.Create(&db.Family{Name: "Test Family"})
+	database.Create(&db.User{FamilyID: 1, Role: "child", DisplayName: "Kid", IsActive: true})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/api/v1/users/1/notification_preferences", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"grants":true,"spends":true,"low_balance":true,"approvals":true,"digests":true,"channels":["log"]`) {
+		t.Errorf("Expected the default preference, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PATCH", "/api/v1/users/1/notification_preferences", `{"channels":["email"]}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for email without an address, got %d: %s", w.Code, w.Body.String())
+	}
+	w := do("PATCH", "/api/v1/users/1/notification_preferences", `{"grants":false,"channels":["email","log"],"email":"kid@example.com"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"grants":false,"spends":true,"low_balance":true,"approvals":true,"digests":true,"channels":["email","log"],"email":"kid@example.com"`) {
+		t.Errorf("Expected the updated preference, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/users/9/notification_preferences", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing user, got %d", w.Code)
+	}
+
+	var payload string
+	database.Model(&db.AuditLog{}).Where("action = ?", "notification_preference.updated").Pluck("payload", &payload)
+	if !strings.Contains(payload, `"email_set":true`) || strings.Contains(payload, "kid@example.com") {
+		t.Errorf("Expected the change audited without the address, got %s", payload)
+	}
+}
+
+func TestDigestSetting(t *testing.T) {
+	router, database := setupTestAPI(t)
+	database.Create(&db.Family{Name: "Test Family"})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/api/v1/families/1/digest", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"frequency":"off","time":"20:00","weekday":0,"timezone":"Asia/Shanghai"`) {
+		t.Errorf("Expected the default setting, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{`{"frequency":"daily","time":"25:00"}`, `{"frequency":"daily","timezone":"Nowhere/City"}`, `{"frequency":"weekly","weekday":7}`} {
+		if w := do("PATCH", "/api/v1/families/1/digest", body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422 for %s, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+	w := do("PATCH", "/api/v1/families/1/digest", `{"frequency":"weekly","time":"19:30","weekday":6,"timezone":"Europe/Berlin"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"frequency":"weekly","time":"19:30","weekday":6,"timezone":"Europe/Berlin"`) {
+		t.Errorf("Expected the updated setting, got %d: %s", w.Code, w.Body.String())
+	}
+	// Sunday is kept, not replaced by a default.
+	do("PATCH", "/api/v1/families/1/digest", `{"weekday":0}`)
+	if w := do("GET", "/api/v1/families/1/digest", ""); !strings.Contains(w.Body.String(), `"weekday":0`) {
+		t.Errorf("Expected Sunday, got %s", w.Body.String())
+	}
+	if w := do("GET", "/api/v1/families/9/digest", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing family, got %d", w.Code)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	router, database := setupTestAPI(t)
+	database.Create(&db.Family{Name: "Test Family"})
+	database.Create(&db.User{FamilyID: 1, Role: "guardian", DisplayName: "Mom", IsActive: true})
+	database.Create(&db.User{FamilyID: 1, Role: "child", DisplayName: "Kid", IsActive: true})
+	database.Create(&db.RewardType{FamilyID: 1, Name: "Stars", UnitKind: "points"})
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	var tokens struct {
+		Data struct {
+			AccessToken  string  `json:"access_token"`
+			RefreshToken string  `json:"refresh_token"`
+			User         db.User `json:"user"`
+		} `json:"data"`
+	}
+
+	if w := do("PUT", "/api/v1/users/1/credentials", "test-token", `{"username":"mom","password":"secret-1"}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "password") {
+		t.Fatalf("Expected the credentials set without echoing the password, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/auth/login", "", `{"username":"mom","password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a wrong password, got %d", w.Code)
+	}
+	w := do("POST", "/api/v1/auth/login", "", `{"username":"mom","password":"secret-1"}`)
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || tokens.Data.AccessToken == "" || tokens.Data.User.ID != 1 {
+		t.Fatalf("Expected tokens, got %d: %s", w.Code, w.Body.String())
+	}
+	access, refresh := tokens.Data.AccessToken, tokens.Data.RefreshToken
+
+	if w := do("GET", "/api/v1/auth/me", access, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"display_name":"Mom"`) {
+		t.Errorf("Expected the logged-in user, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/auth/me", "forged", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a forged token, got %d", w.Code)
+	}
+
+	// The logged-in user is the actor of their changes.
+	if w := do("POST", "/api/v1/rewards/grant", access, `{"family_id":1,"child_id":2,"reward_type_id":1,"value":5}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the grant to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var auditLog db.AuditLog
+	database.Where("action = ?", "reward.granted").Take(&auditLog)
+	if auditLog.UserID == nil || *auditLog.UserID != 1 {
+		t.Errorf("Expected the grant audited as user 1, got %v", auditLog.UserID)
+	}
+	if w := do("GET", "/api/v1/transactions?family_id=1&child_id=2", access, ""); !strings.Contains(w.Body.String(), `"created_by":1,`) || !strings.Contains(w.Body.String(), `"creator_name":"Mom"`) {
+		t.Errorf("Expected the grant recorded as created by Mom, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = do("POST", "/api/v1/auth/refresh", "", `{"refresh_token":"`+refresh+`"}`)
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w.Code != http.StatusOK || tokens.Data.RefreshToken == refresh {
+		t.Fatalf("Expected new tokens, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/auth/refresh", "", `{"refresh_token":"`+refresh+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a used refresh token, got %d", w.Code)
+	}
+
+	// Logging out ends the session; revoking ends all of a user's.
+	if w := do("POST", "/api/v1/auth/logout", tokens.Data.AccessToken, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the logout to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/auth/me", tokens.Data.AccessToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 after logout, got %d", w.Code)
+	}
+	w = do("POST", "/api/v1/auth/login", "", `{"username":"mom","password":"secret-1"}`)
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if w := do("DELETE", "/api/v1/users/1/sessions", "test-token", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"revoked":1`) {
+		t.Errorf("Expected one session revoked, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/v1/auth/me", tokens.Data.AccessToken, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 after revocation, got %d", w.Code)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	router, database := setupTestAPI(t)
+	database.Create(&db.Family{Name: "Test Family"})
+	database.Create(&db.Family{Name: "Other Family"})
+	database.Create(&db.User{FamilyID: 1, Role: "guardian", DisplayName: "Mom", IsActive: true})
+	database.Create(&db.User{FamilyID: 1, Role: "child", DisplayName: "小明", WechatOpenID: "child-openid", IsActive: true})
+	database.Create(&db.User{FamilyID: 2, Role: "guardian", DisplayName: "Stranger", IsActive: true})
+	database.Create(&db.RewardType{FamilyID: 1, Name: "积分", UnitKind: "points"})
+	database.Create(&db.RewardType{FamilyID: 2, Name: "Other", UnitKind: "points"})
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	login := func(userID, username string) string {
+		if w := do("PUT", "/api/v1/users/"+userID+"/credentials", "test-token", `{"username":"`+username+`","password":"secret-1"}`); w.Code != http.StatusOK {
+			t.Fatalf("Expected the credentials set, got %d: %s", w.Code, w.Body.String())
+		}
+		var tokens struct {
+			Data struct {
+				AccessToken string `json:"access_token"`
+			} `json:"data"`
+		}
+		w := do("POST", "/api/v1/auth/login", "", `{"username":"`+username+`","password":"secret-1"}`)
+		json.Unmarshal(w.Body.Bytes(), &tokens)
+		return tokens.Data.AccessToken
+	}
+	mom, kid, stranger := login("1", "mom"), login("2", "kid"), login("3", "stranger")
+
+	if w := do("POST", "/api/v1/rewards/grant", mom, `{"family_id":1,"child_id":2,"reward_type_id":1,"value":5}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the guardian's grant to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, c := range []struct {
+		name, token, method, path, body string
+	}{
+		{"child grants", kid, "POST", "/api/v1/rewards/grant", `{"family_id":1,"child_id":2,"reward_type_id":1,"value":5}`},
+		{"child spends", kid, "POST", "/api/v1/rewards/spend", `{"family_id":1,"child_id":2,"reward_type_id":1,"value":1}`},
+		{"child adjusts", kid, "POST", "/api/v1/transactions/1/adjust", `{"new_value":50}`},
+		{"child defines a reward type", kid, "POST", "/api/v1/reward_types", `{"family_id":1,"name":"Candy","unit_kind":"points"}`},
+		{"child updates a reward type", kid, "PATCH", "/api/v1/reward_types/1", `{"children_may_spend":true}`},
+		{"child creates a user", kid, "POST", "/api/v1/users", `{"family_id":1,"role":"guardian","display_name":"Me"}`},
+		{"child renames a guardian", kid, "PATCH", "/api/v1/users/1", `{"display_name":"Me"}`},
+		{"child resets a guardian's password", kid, "PUT", "/api/v1/users/1/credentials", `{"username":"mom","password":"taken-over"}`},
+		{"child reads the audit logs", kid, "GET", "/api/v1/audit_logs?family_id=1", ""},
+		{"child exports the family", kid, "GET", "/api/v1/families/1/export", ""},
+		{"child uses MCP to grant", kid, "POST", "/api/v1/mcp/tools", `{"tool":"grant_reward","params":{"family_id":1,"child_id":2,"reward_type_id":1,"value":5}}`},
+		{"stranger reads a balance", stranger, "GET", "/api/v1/balances?family_id=1&child_id=2&reward_type_id=1", ""},
+		{"stranger lists users", stranger, "GET", "/api/v1/users?family_id=1", ""},
+		{"stranger adds a webhook", stranger, "POST", "/api/v1/webhooks", `{"family_id":1,"url":"https://example.com/hook"}`},
+		{"stranger changes the digest", stranger, "PATCH", "/api/v1/families/1/digest", `{"frequency":"daily"}`},
+		{"stranger deletes the family", stranger, "DELETE", "/api/v1/families/1", ""},
+		{"stranger opens the stream", stranger, "POST", "/api/v1/stream/tokens", `{"family_id":1}`},
+		{"guardian creates a family", mom, "POST", "/api/v1/families", `{"name":"Mine"}`},
+	} {
+		if w := do(c.method, c.path, c.token, c.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status 403, got %d: %s", c.name, w.Code, w.Body.String())
+		}
+	}
+
+	// A child reads their own ledger, and spends once the family allows it.
+	if w := do("GET", "/api/v1/balances?family_id=1&child_id=2&reward_type_id=1", kid, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the child to read their balance, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PATCH", "/api/v1/reward_types/1", mom, `{"children_may_spend":true}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"children_may_spend":true`) {
+		t.Fatalf("Expected the guardian to allow spending, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/v1/rewards/spend", kid, `{"family_id":1,"child_id":2,"reward_type_id":1,"value":1}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the child's spend to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Listings stay within the user's family.
+	var families struct {
+		Data []db.Family `json:"data"`
+	}
+	json.Unmarshal(do("GET", "/api/v1/families", kid, "").Body.Bytes(), &families)
+	if len(families.Data) != 1 || families.Data[0].ID != 1 {
+		t.Errorf("Expected the child to see only their family, got %+v", families.Data)
+	}
+	var rewardTypes struct {
+		Data []db.RewardType `json:"data"`
+	}
+	json.Unmarshal(do("GET", "/api/v1/reward_types", stranger, "").Body.Bytes(), &rewardTypes)
+	if len(rewardTypes.Data) != 1 || rewardTypes.Data[0].FamilyID != 2 {
+		t.Errorf("Expected the stranger to see only their family's reward types, got %+v", rewardTypes.Data)
+	}
+
+	// WeChat commands are held to the sender's role.
+	reply := processStructuredCommand(context.Background(), database, WeChatMessage{FromUserName: "child-openid", MsgID: 1}, `{"action":"grant","child":"小明","type":"积分","value":5}`)
+	if reply != "没有权限执行该操作" {
+		t.Errorf("Expected the child's WeChat grant refused, got %q", reply)
+	}
+}
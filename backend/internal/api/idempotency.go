@@ -0,0 +1,362 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKeyLen  = 128
+	idempotencyPurgeEvery = 10 * time.Minute
+	// idempotencyWithheldKey marks a response carrying a secret in the gin
+	// context.
+	idempotencyWithheldKey = "idempotency.withheld"
+)
+
+// idempotencyLease is how long a request holds its key in flight without
+// renewing it. The request renews the lease while its handler runs, however
+// long that takes, so only a record left by a crashed process expires and
+// frees the key.
+var idempotencyLease = time.Minute
+
+// IdempotencyMiddleware honours the Idempotency-Key header on POST, PATCH and
+// DELETE requests. The first response for a key is persisted and replayed
+// verbatim for retries until it expires; concurrent duplicates are serialized
+// so the handler runs at most once per key. Keys belong to the caller that
+// used them: the same key from another user is another request, and a
+// response is never replayed to anyone but its caller.
+//
+// Only successes and the rejections of a malformed or invalid request, which
+// a retry would get again, are stored. Any other error depends on state that
+// may change, such as a balance or a permission, and frees the key for the
+// retry. A response carrying a secret is never stored: a failed one frees the
+// key, and a retry of a successful one is refused with 409
+// idempotency_response_withheld, as the request was carried out.
+func IdempotencyMiddleware(database *gorm.DB, ttl time.Duration) gin.HandlerFunc {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	store := &idempotencyStore{db: database, ttl: ttl, locks: map[string]*keyLock{}}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" || !isMutatingMethod(c.Request.Method) {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			respondError(c, invalidRequestf("Idempotency-Key is too long"))
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		principal := idempotencyPrincipal(c)
+		hash := requestHash(principal, c.Request, body)
+
+		unlock := store.lock(principal + " " + key)
+		defer unlock()
+		store.purgeExpired()
+
+		existing, err := store.find(principal, key)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if existing != nil {
+			replayIdempotentResponse(c, existing, hash)
+			return
+		}
+
+		record := &db.IdempotencyRecord{
+			Principal:   principal,
+			Key:         key,
+			Method:      c.Request.Method,
+			Path:        c.Request.URL.Path,
+			RequestHash: hash,
+			ExpiresAt:   time.Now().Add(idempotencyLease),
+		}
+		if err := database.Create(record).Error; err != nil {
+			// Another instance claimed the key between our lookup and insert.
+			if existing, _ := store.find(principal, key); existing != nil {
+				replayIdempotentResponse(c, existing, hash)
+				return
+			}
+			respondError(c, err)
+			return
+		}
+
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		stopRenewing := store.renew(record)
+		completed := false
+		defer func() {
+			stopRenewing()
+			if !completed {
+				store.release(record)
+			}
+		}()
+
+		c.Next()
+		stopRenewing()
+
+		success := writer.Status() >= 200 && writer.Status() < 300
+		switch {
+		case c.GetBool(idempotencyWithheldKey) && success:
+			store.withhold(record)
+		case !c.GetBool(idempotencyWithheldKey) && (success || rejectedRequest(writer)):
+			store.complete(record, writer)
+		default:
+			store.release(record)
+		}
+		completed = true
+	}
+}
+
+// withholdIdempotentResponse keeps the response of the request, which
+// carries a secret such as a webhook's signing secret or a confirmation
+// token, out of the idempotency store.
+func withholdIdempotentResponse(c *gin.Context) {
+	c.Set(idempotencyWithheldKey, true)
+}
+
+// rejectedRequest reports whether the response rejects the request itself
+// rather than the state it met: 400 invalid_request or 422
+// validation_failed, not 422 limit_exceeded.
+func rejectedRequest(w *capturingWriter) bool {
+	switch w.Status() {
+	case http.StatusBadRequest:
+		return true
+	case http.StatusUnprocessableEntity:
+		var body struct {
+			Details struct {
+				Reason string `json:"reason"`
+			} `json:"details"`
+		}
+		return json.Unmarshal(w.body.Bytes(), &body) == nil && body.Details.Reason == "validation_failed"
+	}
+	return false
+}
+
+func replayIdempotentResponse(c *gin.Context, record *db.IdempotencyRecord, hash string) {
+	switch {
+	case record.RequestHash != hash:
+		respondError(c, &apiError{status: http.StatusUnprocessableEntity, reason: "idempotency_key_reused", message: "Idempotency-Key was already used for a different request"})
+	case record.StatusCode == 0:
+		respondError(c, &apiError{status: http.StatusConflict, reason: "conflict", message: "A request with this Idempotency-Key is still being processed"})
+	default:
+		if record.ContentType != "" {
+			c.Header("Content-Type", record.ContentType)
+		}
+		c.Header(IdempotencyReplayedHeader, "true")
+		c.Status(record.StatusCode)
+		c.Writer.WriteString(record.ResponseBody)
+	}
+	c.Abort()
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// idempotencyPrincipal names the caller of an authenticated request: a user,
+// or the operator for the shared API token.
+func idempotencyPrincipal(c *gin.Context) string {
+	actor := services.ActorFrom(c.Request.Context())
+	if actor.IsOperator() {
+		return "operator"
+	}
+	return "user:" + strconv.FormatUint(actor.UserID, 10)
+}
+
+func requestHash(principal string, r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, principal+"\n")
+	io.WriteString(h, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type idempotencyStore struct {
+	db  *gorm.DB
+	ttl time.Duration
+
+	mu        sync.Mutex
+	locks     map[string]*keyLock
+	lastPurge time.Time
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock serializes requests sharing an idempotency key within this process.
+func (s *idempotencyStore) lock(key string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &keyLock{}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *idempotencyStore) find(principal, key string) (*db.IdempotencyRecord, error) {
+	var record db.IdempotencyRecord
+	err := s.db.Where("principal = ? AND idempotency_key = ?", principal, key).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !record.ExpiresAt.After(time.Now()) {
+		if record.StatusCode == 0 {
+			// The request holding the key stopped renewing its lease
+			// without finishing; let the retry run.
+			log.Printf("Releasing idempotency key %q abandoned in flight since %s", record.Key, record.CreatedAt.Format(time.RFC3339))
+		}
+		// Free the key for reuse without waiting for the next purge.
+		return nil, s.db.Delete(&record).Error
+	}
+	return &record, nil
+}
+
+func (s *idempotencyStore) purgeExpired() {
+	s.mu.Lock()
+	if time.Since(s.lastPurge) < idempotencyPurgeEvery {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPurge = time.Now()
+	s.mu.Unlock()
+
+	if err := s.db.Where("expires_at <= ?", time.Now()).Delete(&db.IdempotencyRecord{}).Error; err != nil {
+		log.Printf("Failed to purge expired idempotency keys: %v", err)
+	}
+}
+
+// renew extends the lease of the in-flight record until the returned
+// function is called, which may be called more than once.
+func (s *idempotencyStore) renew(record *db.IdempotencyRecord) func() {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(idempotencyLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := s.db.Model(&db.IdempotencyRecord{}).Where("id = ? AND status_code = 0", record.ID).
+					Update("expires_at", time.Now().Add(idempotencyLease)).Error
+				if err != nil {
+					log.Printf("Failed to renew idempotency key %q: %v", record.Key, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+func (s *idempotencyStore) complete(record *db.IdempotencyRecord, w *capturingWriter) {
+	err := s.db.Model(record).Updates(map[string]interface{}{
+		"expires_at":    time.Now().Add(s.ttl),
+		"status_code":   w.Status(),
+		"content_type":  w.Header().Get("Content-Type"),
+		"response_body": w.body.String(),
+	}).Error
+	if err != nil {
+		log.Printf("Failed to store response for idempotency key %q: %v", record.Key, err)
+		s.release(record)
+	}
+}
+
+// withhold records that the request succeeded without storing its response,
+// which carries a secret: a retry gets a conflict instead.
+func (s *idempotencyStore) withhold(record *db.IdempotencyRecord) {
+	status, body := errorBody(&apiError{
+		status:  http.StatusConflict,
+		reason:  "idempotency_response_withheld",
+		message: "The request with this Idempotency-Key succeeded; its response carried a secret and is not kept",
+	})
+	encoded, _ := json.Marshal(body)
+	err := s.db.Model(record).Updates(map[string]interface{}{
+		"expires_at":    time.Now().Add(s.ttl),
+		"status_code":   status,
+		"content_type":  "application/json; charset=utf-8",
+		"response_body": string(encoded),
+	}).Error
+	if err != nil {
+		log.Printf("Failed to store outcome for idempotency key %q: %v", record.Key, err)
+		s.release(record)
+	}
+}
+
+func (s *idempotencyStore) release(record *db.IdempotencyRecord) {
+	if err := s.db.Delete(record).Error; err != nil {
+		log.Printf("Failed to release idempotency key %q: %v", record.Key, err)
+	}
+}
+
+// capturingWriter tees the response body so it can be persisted.
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
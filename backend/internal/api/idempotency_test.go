@@ -0,0 +1,283 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func postWithIdempotencyKey(router *gin.Engine, path, key, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set(IdempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyMiddleware_ReplaysResponse(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	first := postWithIdempotencyKey(router, "/api/v1/families", "family-key-1", `{"name":"Test Family"}`)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", first.Code, first.Body.String())
+	}
+
+	second := postWithIdempotencyKey(router, "/api/v1/families", "family-key-1", `{"name":"Test Family"}`)
+	if second.Code != http.StatusOK {
+		t.Fatalf("Expected replayed status 200, got %d", second.Code)
+	}
+	if second.Header().Get(IdempotencyReplayedHeader) != "true" {
+		t.Error("Expected replayed response to be marked")
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("Expected identical body, got %s vs %s", second.Body.String(), first.Body.String())
+	}
+
+	var count int64
+	database.Model(&db.Family{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 family, got %d", count)
+	}
+
+	// Reusing the key for a different payload is rejected
+	w := postWithIdempotencyKey(router, "/api/v1/families", "family-key-1", `{"name":"Other Family"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422, got %d", w.Code)
+	}
+}
+
+func TestIdempotencyMiddleware_SerializesConcurrentDuplicates(t *testing.T) {
+	router, database := setupTestAPI(t)
+	sqlDB, _ := database.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postWithIdempotencyKey(router, "/api/v1/families", "family-key-2", `{"name":"Test Family"}`)
+		}()
+	}
+	wg.Wait()
+
+	var count int64
+	database.Model(&db.Family{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 family, got %d", count)
+	}
+}
+
+func TestIdempotencyMiddleware_ExpiredKeyIsReusable(t *testing.T) {
+	router, database := setupTestAPI(t)
+
+	postWithIdempotencyKey(router, "/api/v1/families", "family-key-3", `{"name":"Test Family"}`)
+	database.Model(&db.IdempotencyRecord{}).Where("idempotency_key = ?", "family-key-3").
+		Update("expires_at", gorm.Expr("created_at"))
+
+	w := postWithIdempotencyKey(router, "/api/v1/families", "family-key-3", `{"name":"Test Family"}`)
+	if w.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Error("Expected expired key not to be replayed")
+	}
+
+	var count int64
+	database.Model(&db.Family{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 families, got %d", count)
+	}
+}
+
+func TestIdempotencyMiddleware_KeysBelongToTheirCaller(t *testing.T) {
+	router, database := setupTestAPI(t)
+	database.Create(&db.Family{Name: "Test Family"})
+	database.Create(&db.User{FamilyID: 1, Role: "guardian", DisplayName: "Mom", IsActive: true})
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("PUT", "/api/v1/users/1/credentials", "test-token", `{"username":"mom","password":"secret-1"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the credentials set, got %d: %s", w.Code, w.Body.String())
+	}
+	var tokens struct {
+		Data struct {
+			AccessToken string `json:"access_token"`
+		} `json:"data"`
+	}
+	json.Unmarshal(do("POST", "/api/v1/auth/login", "", `{"username":"mom","password":"secret-1"}`).Body.Bytes(), &tokens)
+
+	first := postWithIdempotencyKey(router, "/api/v1/reward_types", "shared-key", `{"family_id":1,"name":"Stars","unit_kind":"points"}`)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", first.Code, first.Body.String())
+	}
+
+	// The guardian's request with the operator's key is their own request:
+	// it runs, and is not refused as a reused key or answered with the
+	// operator's response.
+	req, _ := http.NewRequest("POST", "/api/v1/reward_types", strings.NewReader(`{"family_id":1,"name":"Hearts","unit_kind":"points"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tokens.Data.AccessToken)
+	req.Header.Set(IdempotencyKeyHeader, "shared-key")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(IdempotencyReplayedHeader) != "" || !strings.Contains(w.Body.String(), "Hearts") {
+		t.Errorf("Expected the guardian's request to run, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := postWithIdempotencyKey(router, "/api/v1/reward_types", "shared-key", `{"family_id":1,"name":"Stars","unit_kind":"points"}`); w.Body.String() != first.Body.String() {
+		t.Errorf("Expected the operator's response replayed, got %s", w.Body.String())
+	}
+}
+
+func TestIdempotencyMiddleware_InFlightLease(t *testing.T) {
+	router, database := setupTestAPI(t)
+	body := `{"name":"Test Family"}`
+	req, _ := http.NewRequest("POST", "/api/v1/families", nil)
+	inFlight := func(key string, leasedUntil time.Time) {
+		database.Create(&db.IdempotencyRecord{
+			Principal:   "operator",
+			Key:         key,
+			Method:      "POST",
+			Path:        "/api/v1/families",
+			RequestHash: requestHash("operator", req, []byte(body)),
+			ExpiresAt:   leasedUntil,
+		})
+	}
+
+	inFlight("running", time.Now().Add(idempotencyLease))
+	if w := postWithIdempotencyKey(router, "/api/v1/families", "running", body); w.Code != http.StatusConflict {
+		t.Errorf("Expected a request in flight to hold its key, got %d", w.Code)
+	}
+
+	// A record left in flight by a crash holds the key only until its
+	// lease runs out.
+	inFlight("abandoned", time.Now().Add(-time.Second))
+	if w := postWithIdempotencyKey(router, "/api/v1/families", "abandoned", body); w.Code != http.StatusOK {
+		t.Errorf("Expected an abandoned key to be released, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIdempotencyMiddleware_RenewsLease(t *testing.T) {
+	_, database := setupTestAPI(t)
+	sqlDB, _ := database.DB()
+	sqlDB.SetMaxOpenConns(1)
+	lease := idempotencyLease
+	idempotencyLease = 30 * time.Millisecond
+	defer func() { idempotencyLease = lease }()
+
+	// Two instances share the database; a slow request on one outlives
+	// the lease many times over without the other running it again.
+	runs := 0
+	instance := func(delay time.Duration) *gin.Engine {
+		engine := gin.New()
+		engine.Use(func(c *gin.Context) {
+			c.Request = c.Request.WithContext(services.WithActor(c.Request.Context(), services.OperatorActor(services.SourceAPI)))
+		}, IdempotencyMiddleware(database, time.Hour))
+		engine.POST("/slow", func(c *gin.Context) {
+			runs++
+			time.Sleep(delay)
+			c.JSON(http.StatusOK, gin.H{"runs": runs})
+		})
+		return engine
+	}
+	first, second := instance(5*idempotencyLease), instance(0)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postWithIdempotencyKey(first, "/slow", "slow", "") }()
+	time.Sleep(3 * idempotencyLease)
+	if w := postWithIdempotencyKey(second, "/slow", "slow", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected the slow request to hold its key, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := <-done; w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postWithIdempotencyKey(second, "/slow", "slow", ""); w.Header().Get(IdempotencyReplayedHeader) != "true" || runs != 1 {
+		t.Errorf("Expected the response replayed after %d runs, got %d: %s", runs, w.Code, w.Body.String())
+	}
+}
+
+func TestIdempotencyMiddleware_StoresOnlyRepeatableResponses(t *testing.T) {
+	router, database := setupTestAPI(t)
+	// A malformed request is rejected again on retry.
+	first := postWithIdempotencyKey(router, "/api/v1/reward_types", "malformed", `{`)
+	if w := postWithIdempotencyKey(router, "/api/v1/reward_types", "malformed", `{`); first.Code != http.StatusBadRequest || w.Header().Get(IdempotencyReplayedHeader) != "true" {
+		t.Errorf("Expected a malformed request's rejection replayed, got %d", w.Code)
+	}
+
+	// A missing user may exist by the retry.
+	if w := postWithIdempotencyKey(router, "/api/v1/users/1/deactivate", "missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d: %s", w.Code, w.Body.String())
+	}
+	database.Create(&db.Family{Name: "Test Family"})
+	database.Create(&db.User{FamilyID: 1, Role: "child", DisplayName: "Kid", IsActive: true})
+	if w := postWithIdempotencyKey(router, "/api/v1/users/1/deactivate", "missing", ""); w.Code != http.StatusOK || w.Header().Get(IdempotencyReplayedHeader) != "" {
+		t.Errorf("Expected the retry to run once the user exists, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A webhook's secret is never stored; the retry learns the request
+	// succeeded.
+	hook := `{"family_id":1,"url":"https://93.184.215.14/hook"}`
+	created := postWithIdempotencyKey(router, "/api/v1/webhooks", "webhook", hook)
+	var webhook struct {
+		Data struct {
+			Secret string `json:"secret"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(created.Body.Bytes(), &webhook); created.Code != http.StatusOK || webhook.Data.Secret == "" {
+		t.Fatalf("Expected the webhook created, got %d: %s", created.Code, created.Body.String())
+	}
+	w := postWithIdempotencyKey(router, "/api/v1/webhooks", "webhook", hook)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "idempotency_response_withheld") {
+		t.Errorf("Expected the retry refused as withheld, got %d: %s", w.Code, w.Body.String())
+	}
+	var webhooks int64
+	database.Model(&db.Webhook{}).Count(&webhooks)
+	if webhooks != 1 {
+		t.Errorf("Expected one webhook, got %d", webhooks)
+	}
+
+	// Nor is a purge confirmation token: each retry gets a new one.
+	confirmation := func() string {
+		req, _ := http.NewRequest("DELETE", "/api/v1/families/1", http.NoBody)
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set(IdempotencyKeyHeader, "purge")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var body struct {
+			Details struct {
+				Token string `json:"confirmation_token"`
+			} `json:"details"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusUnprocessableEntity || body.Details.Token == "" {
+			t.Fatalf("Expected a confirmation token, got %d: %s", w.Code, w.Body.String())
+		}
+		return body.Details.Token
+	}
+	if confirmation() == confirmation() {
+		t.Error("Expected a retry to issue a new confirmation token")
+	}
+
+	var records []db.IdempotencyRecord
+	database.Find(&records)
+	for _, record := range records {
+		if strings.Contains(record.ResponseBody, webhook.Data.Secret) || strings.Contains(record.ResponseBody, "confirmation_token") {
+			t.Errorf("Expected no secret stored, got %s", record.ResponseBody)
+		}
+	}
+}
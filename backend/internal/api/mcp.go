@@ -1,9 +1,11 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"reward-system/internal/db"
 	"reward-system/internal/services"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -12,175 +14,309 @@ import (
 func MCPToolsHandler(database *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			Tool    string                 `json:"tool" binding:"required"`
-			Params  map[string]interface{} `json:"params" binding:"required"`
+			Tool   string                 `json:"tool" binding:"required"`
+			Params map[string]interface{} `json:"params" binding:"required"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			respondError(c, invalidRequest(err))
 			return
 		}
 
+		actor := services.ActorFrom(c.Request.Context())
+		actor.Source = services.SourceMCP
+		c.Request = c.Request.WithContext(services.WithActor(c.Request.Context(), actor))
+
 		service := services.NewRewardService(database)
-		
+		params := &mcpParams{values: req.Params}
+
 		switch req.Tool {
 		case "create_reward_type":
-			handleCreateRewardType(c, service, req.Params)
+			handleCreateRewardType(c, service, params)
 		case "grant_reward":
-			handleGrantReward(c, service, req.Params)
+			handleGrantReward(c, service, params)
 		case "spend_reward":
-			handleSpendReward(c, service, req.Params)
+			handleSpendReward(c, service, params)
 		case "query_balance":
-			handleQueryBalance(c, service, req.Params)
+			handleQueryBalance(c, service, params)
 		case "list_transactions":
-			handleListTransactions(c, service, req.Params)
+			handleListTransactions(c, service, params)
 		case "adjust_transaction":
-			handleAdjustTransaction(c, service, req.Params)
+			handleAdjustTransaction(c, service, params)
 		default:
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "Unknown tool"})
+			respondError(c, invalidRequestf("Unknown tool"))
+		}
+	}
+}
+
+// mcpParams reads typed tool parameters. The first missing or mistyped
+// parameter is remembered in err so handlers can check once after reading.
+type mcpParams struct {
+	values map[string]interface{}
+	err    error
+}
+
+func (p *mcpParams) number(key string, required bool) (float64, bool) {
+	raw, present := p.values[key]
+	if !present || raw == nil {
+		if required && p.err == nil {
+			p.err = invalidRequestf("missing parameter " + key)
+		}
+		return 0, false
+	}
+	val, ok := raw.(float64)
+	if !ok && p.err == nil {
+		p.err = invalidRequestf("parameter " + key + " must be a number")
+	}
+	return val, ok
+}
+
+func (p *mcpParams) requireUint(key string) uint64 {
+	val, _ := p.number(key, true)
+	return uint64(val)
+}
+
+func (p *mcpParams) optUint(key string) uint64 {
+	val, _ := p.number(key, false)
+	return uint64(val)
+}
+
+func (p *mcpParams) optInt(key string) *int64 {
+	val, ok := p.number(key, false)
+	if !ok {
+		return nil
+	}
+	v := int64(val)
+	return &v
+}
+
+// optLedgerValue reads a ledger value, rejecting fractions the same way
+// parseLedgerValue does for REST requests.
+func (p *mcpParams) optLedgerValue(key string) *int64 {
+	val, ok := p.number(key, false)
+	if !ok {
+		return nil
+	}
+	v, err := parseLedgerValue(json.Number(strconv.FormatFloat(val, 'f', -1, 64)))
+	if err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		return nil
+	}
+	return &v
+}
+
+// decimal reads a parameter given either as a JSON number or as a string
+// such as "1.25", keeping its exact decimal text.
+func (p *mcpParams) decimal(key string) json.Number {
+	switch raw := p.values[key].(type) {
+	case nil:
+		return ""
+	case float64:
+		return json.Number(strconv.FormatFloat(raw, 'f', -1, 64))
+	case string:
+		return json.Number(raw)
+	}
+	if p.err == nil {
+		p.err = invalidRequestf("parameter " + key + " must be a number or a decimal string")
+	}
+	return ""
+}
+
+func (p *mcpParams) optString(key string) *string {
+	raw, present := p.values[key]
+	if !present || raw == nil {
+		return nil
+	}
+	val, ok := raw.(string)
+	if !ok {
+		if p.err == nil {
+			p.err = invalidRequestf("parameter " + key + " must be a string")
+		}
+		return nil
+	}
+	return &val
+}
+
+func (p *mcpParams) optBool(key string) *bool {
+	raw, present := p.values[key]
+	if !present || raw == nil {
+		return nil
+	}
+	val, ok := raw.(bool)
+	if !ok {
+		if p.err == nil {
+			p.err = invalidRequestf("parameter " + key + " must be a boolean")
+		}
+		return nil
+	}
+	return &val
+}
+
+func (p *mcpParams) requireString(key string) string {
+	val := p.optString(key)
+	if val == nil {
+		if p.err == nil {
+			p.err = invalidRequestf("missing parameter " + key)
 		}
+		return ""
 	}
+	return *val
 }
 
-func handleCreateRewardType(c *gin.Context, service *services.RewardService, params map[string]interface{}) {
-	familyID := uint64(params["family_id"].(float64))
-	name := params["name"].(string)
-	unitKind := params["unit_kind"].(string)
-	unitLabel := ""
-	if val, ok := params["unit_label"].(string); ok {
-		unitLabel = val
+func (p *mcpParams) stringValue(key string) string {
+	if val := p.optString(key); val != nil {
+		return *val
 	}
+	return ""
+}
 
+func handleCreateRewardType(c *gin.Context, service *services.RewardService, params *mcpParams) {
 	rewardType := &db.RewardType{
-		FamilyID:  familyID,
-		Name:      name,
-		UnitKind:  unitKind,
-		UnitLabel: unitLabel,
+		FamilyID:  params.requireUint("family_id"),
+		Name:      params.requireString("name"),
+		UnitKind:  params.requireString("unit_kind"),
+		UnitLabel: params.stringValue("unit_label"),
+		Currency:  params.stringValue("currency"),
+	}
+	rewardType.Scale = services.DefaultScale(rewardType.UnitKind)
+	if scale := params.optInt("scale"); scale != nil {
+		rewardType.Scale = int(*scale)
+	}
+	if maxValue := params.optInt("max_value"); maxValue != nil {
+		rewardType.MaxValue = *maxValue
+	}
+	if threshold := params.optInt("low_balance_threshold"); threshold != nil {
+		rewardType.LowBalanceThreshold = *threshold
+	}
+	if childrenMaySpend := params.optBool("children_may_spend"); childrenMaySpend != nil {
+		rewardType.ChildrenMaySpend = *childrenMaySpend
+	}
+	if params.err != nil {
+		respondError(c, params.err)
+		return
 	}
 
-	if err := service.CreateRewardType(rewardType); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+	if err := service.CreateRewardType(c.Request.Context(), rewardType); err != nil {
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"reward_type_id": rewardType.ID}})
 }
 
-func handleGrantReward(c *gin.Context, service *services.RewardService, params map[string]interface{}) {
-	familyID := uint64(params["family_id"].(float64))
-	childID := uint64(params["child_id"].(float64))
-	rewardTypeID := uint64(params["reward_type_id"].(float64))
-	value := int64(params["value"].(float64))
-	
-	note := ""
-	if val, ok := params["note"].(string); ok {
-		note = val
+func handleGrantReward(c *gin.Context, service *services.RewardService, params *mcpParams) {
+	familyID := params.requireUint("family_id")
+	childID := params.requireUint("child_id")
+	rewardTypeID := params.requireUint("reward_type_id")
+	value := params.decimal("value")
+	amount := params.decimal("amount")
+	note := params.stringValue("note")
+	idempotencyKey := params.stringValue("idempotency_key")
+	if params.err != nil {
+		respondError(c, params.err)
+		return
 	}
-	
-	idempotencyKey := ""
-	if val, ok := params["idempotency_key"].(string); ok {
-		idempotencyKey = val
+
+	scaled, err := ledgerValue(c.Request.Context(), service, familyID, rewardTypeID, value, amount)
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
-	result, err := service.GrantReward(familyID, childID, rewardTypeID, value, note, idempotencyKey)
+	result, err := service.GrantReward(c.Request.Context(), familyID, childID, rewardTypeID, scaled, note, idempotencyKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"code": 0, "data": result})
 }
 
-func handleSpendReward(c *gin.Context, service *services.RewardService, params map[string]interface{}) {
-	familyID := uint64(params["family_id"].(float64))
-	childID := uint64(params["child_id"].(float64))
-	rewardTypeID := uint64(params["reward_type_id"].(float64))
-	value := int64(params["value"].(float64))
-	
-	note := ""
-	if val, ok := params["note"].(string); ok {
-		note = val
+func handleSpendReward(c *gin.Context, service *services.RewardService, params *mcpParams) {
+	familyID := params.requireUint("family_id")
+	childID := params.requireUint("child_id")
+	rewardTypeID := params.requireUint("reward_type_id")
+	value := params.decimal("value")
+	amount := params.decimal("amount")
+	note := params.stringValue("note")
+	idempotencyKey := params.stringValue("idempotency_key")
+	if params.err != nil {
+		respondError(c, params.err)
+		return
 	}
-	
-	idempotencyKey := ""
-	if val, ok := params["idempotency_key"].(string); ok {
-		idempotencyKey = val
+
+	scaled, err := ledgerValue(c.Request.Context(), service, familyID, rewardTypeID, value, amount)
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
-	result, err := service.SpendReward(familyID, childID, rewardTypeID, value, note, idempotencyKey)
+	result, err := service.SpendReward(c.Request.Context(), familyID, childID, rewardTypeID, scaled, note, idempotencyKey)
 	if err != nil {
-		if err.Error() == "insufficient balance" {
-			c.JSON(http.StatusConflict, gin.H{"code": 409, "message": "Insufficient balance"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"code": 0, "data": result})
 }
 
-func handleQueryBalance(c *gin.Context, service *services.RewardService, params map[string]interface{}) {
-	familyID := uint64(params["family_id"].(float64))
-	childID := uint64(params["child_id"].(float64))
-	rewardTypeID := uint64(params["reward_type_id"].(float64))
+func handleQueryBalance(c *gin.Context, service *services.RewardService, params *mcpParams) {
+	familyID := params.requireUint("family_id")
+	childID := params.requireUint("child_id")
+	rewardTypeID := params.requireUint("reward_type_id")
+	if params.err != nil {
+		respondError(c, params.err)
+		return
+	}
 
-	balance, err := service.GetBalance(familyID, childID, rewardTypeID)
+	balance, err := service.GetBalance(c.Request.Context(), familyID, childID, rewardTypeID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"balance": balance}})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": balance})
 }
 
-func handleListTransactions(c *gin.Context, service *services.RewardService, params map[string]interface{}) {
-	familyID := uint64(params["family_id"].(float64))
-	childID := uint64(params["child_id"].(float64))
-	
-	rewardTypeID := uint64(0)
-	if val, ok := params["reward_type_id"].(float64); ok {
-		rewardTypeID = uint64(val)
-	}
-	
+func handleListTransactions(c *gin.Context, service *services.RewardService, params *mcpParams) {
+	familyID := params.requireUint("family_id")
+	childID := params.requireUint("child_id")
+	rewardTypeID := params.optUint("reward_type_id")
+	beforeID := params.optUint("before_id")
 	limit := 20
-	if val, ok := params["limit"].(float64); ok {
-		limit = int(val)
+	if val := params.optInt("limit"); val != nil {
+		limit = int(*val)
 	}
-	
-	beforeID := uint64(0)
-	if val, ok := params["before_id"].(float64); ok {
-		beforeID = uint64(val)
+	if params.err != nil {
+		respondError(c, params.err)
+		return
 	}
 
-	transactions, err := service.ListTransactions(familyID, childID, rewardTypeID, limit, beforeID)
+	transactions, err := service.ListTransactions(c.Request.Context(), familyID, childID, rewardTypeID, limit, beforeID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"code": 0, "data": transactions})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": transactionViews(transactions)})
 }
 
-func handleAdjustTransaction(c *gin.Context, service *services.RewardService, params map[string]interface{}) {
-	transactionID := uint64(params["transaction_id"].(float64))
-	
-	var newValue *int64
-	if val, ok := params["new_value"].(float64); ok {
-		v := int64(val)
-		newValue = &v
-	}
-	
-	var newNote *string
-	if val, ok := params["new_note"].(string); ok {
-		newNote = &val
+func handleAdjustTransaction(c *gin.Context, service *services.RewardService, params *mcpParams) {
+	transactionID := params.requireUint("transaction_id")
+	newValue := params.optLedgerValue("new_value")
+	newNote := params.optString("new_note")
+	if params.err != nil {
+		respondError(c, params.err)
+		return
 	}
 
-	err := service.AdjustTransaction(transactionID, newValue, newNote)
+	transaction, err := service.AdjustTransaction(c.Request.Context(), transactionID, newValue, newNote)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"transaction_id": transactionID}})
-}
\ No newline at end of file
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"transaction_id": transaction.ID}})
+}
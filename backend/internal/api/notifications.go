@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"reward-system/internal/db"
+	"reward-system/internal/digest"
+	"reward-system/internal/notify"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// preferenceView is a notification preference with its channels as a
+// list.
+type preferenceView struct {
+	UserID     uint64   `json:"user_id"`
+	Grants     bool     `json:"grants"`
+	Spends     bool     `json:"spends"`
+	LowBalance bool     `json:"low_balance"`
+	Approvals  bool     `json:"approvals"`
+	Digests    bool     `json:"digests"`
+	Channels   []string `json:"channels"`
+	Email      string   `json:"email,omitempty"`
+}
+
+func viewPreference(preference *db.NotificationPreference) preferenceView {
+	channels := []string{}
+	if preference.Channels != "" {
+		channels = strings.Split(preference.Channels, ",")
+	}
+	return preferenceView{
+		UserID: preference.UserID, Grants: preference.Grants, Spends: preference.Spends, LowBalance: preference.LowBalance,
+		Approvals: preference.Approvals, Digests: preference.Digests, Channels: channels, Email: preference.Email,
+	}
+}
+
+// GetNotificationPreference returns what the user is notified about, the
+// defaults if they never chose.
+func GetNotificationPreference(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		preference, err := notify.GetPreference(c.Request.Context(), database, parseUint(c.Param("id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": viewPreference(preference)})
+	}
+}
+
+// UpdateNotificationPreference changes the given fields of the user's
+// preference; an empty channel list turns notifications off.
+func UpdateNotificationPreference(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Grants     *bool     `json:"grants"`
+			Spends     *bool     `json:"spends"`
+			LowBalance *bool     `json:"low_balance"`
+			Approvals  *bool     `json:"approvals"`
+			Digests    *bool     `json:"digests"`
+			Channels   *[]string `json:"channels"`
+			Email      *string   `json:"email"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		ctx := c.Request.Context()
+		preference, err := notify.GetPreference(ctx, database, parseUint(c.Param("id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		for field, value := range map[*bool]*bool{&preference.Grants: req.Grants, &preference.Spends: req.Spends, &preference.LowBalance: req.LowBalance, &preference.Approvals: req.Approvals, &preference.Digests: req.Digests} {
+			if value != nil {
+				*field = *value
+			}
+		}
+		if req.Channels != nil {
+			preference.Channels = strings.Join(*req.Channels, ",")
+		}
+		if req.Email != nil {
+			preference.Email = *req.Email
+		}
+		if err := notify.SetPreference(ctx, database, preference); err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": viewPreference(preference)})
+	}
+}
+
+// GetDigestSetting returns when the family gets its digest.
+func GetDigestSetting(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setting, err := digest.GetSetting(c.Request.Context(), database, parseUint(c.Param("id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": setting})
+	}
+}
+
+// UpdateDigestSetting changes the given fields of the family's digest
+// setting.
+func UpdateDigestSetting(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Frequency *string `json:"frequency"`
+			Time      *string `json:"time"`
+			Weekday   *int    `json:"weekday"`
+			Timezone  *string `json:"timezone"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		ctx := c.Request.Context()
+		setting, err := digest.GetSetting(ctx, database, parseUint(c.Param("id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if req.Frequency != nil {
+			setting.Frequency = *req.Frequency
+		}
+		if req.Time != nil {
+			setting.Time = *req.Time
+		}
+		if req.Weekday != nil {
+			setting.Weekday = *req.Weekday
+		}
+		if req.Timezone != nil {
+			setting.Timezone = *req.Timezone
+		}
+		if err := digest.SetSetting(ctx, database, setting); err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": setting})
+	}
+}
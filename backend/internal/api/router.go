@@ -1,21 +1,33 @@
 package api
 
 import (
-    "reward-system/internal/config"
+	"reward-system/internal/config"
+	"reward-system/internal/stream"
 
-    "github.com/gin-gonic/gin"
-    "gorm.io/gorm"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func SetupRouter(database *gorm.DB, cfg *config.Config) *gin.Engine {
 	r := gin.Default()
-	
+
 	// Middleware
 	r.Use(CORSMiddleware())
-	r.Use(AuthMiddleware(cfg))
-	
+	r.Use(AuthMiddleware(database, cfg))
+
+	// Sessions; their responses hold tokens, which are not kept for
+	// idempotent replay.
+	sessions := r.Group("/api/v1/auth")
+	{
+		sessions.POST("/login", Login(database, cfg))
+		sessions.POST("/refresh", RefreshSession(database, cfg))
+		sessions.POST("/logout", Logout(database))
+		sessions.GET("/me", CurrentUser())
+	}
+
 	// API v1 group
 	v1 := r.Group("/api/v1")
+	v1.Use(IdempotencyMiddleware(database, cfg.IdempotencyTTL))
 	{
 		// Reward types
 		v1.POST("/reward_types", CreateRewardType(database))
@@ -25,27 +37,55 @@ func SetupRouter(database *gorm.DB, cfg *config.Config) *gin.Engine {
 		// Families and users
 		v1.GET("/families", ListFamilies(database))
 		v1.POST("/families", CreateFamily(database))
+		v1.GET("/families/:id/export", ExportFamily(database))
+		v1.POST("/families/import", ImportFamily(database))
+		v1.DELETE("/families/:id", DeleteFamily(database))
+		v1.GET("/families/:id/digest", GetDigestSetting(database))
+		v1.PATCH("/families/:id/digest", UpdateDigestSetting(database))
 		v1.GET("/users", ListUsers(database))
 		v1.POST("/users", CreateUser(database))
-		v1.DELETE("/users/:id", DeleteUser(database))
-		
+		v1.PATCH("/users/:id", UpdateUser(database))
+		v1.POST("/users/:id/deactivate", DeactivateUser(database))
+		v1.POST("/users/:id/archive", ArchiveUser(database))
+		v1.POST("/users/:id/reactivate", ReactivateUser(database))
+		v1.DELETE("/users/:id", ArchiveUser(database))
+		v1.PUT("/users/:id/credentials", SetCredentials(database))
+		v1.DELETE("/users/:id/sessions", RevokeSessions(database))
+		v1.GET("/users/:id/notification_preferences", GetNotificationPreference(database))
+		v1.PATCH("/users/:id/notification_preferences", UpdateNotificationPreference(database))
+
 		// Rewards
 		v1.POST("/rewards/grant", GrantReward(database))
 		v1.POST("/rewards/spend", SpendReward(database))
-		
+
 		// Balances
 		v1.GET("/balances", GetBalance(database))
-		
+
 		// Transactions
 		v1.GET("/transactions", ListTransactions(database))
 		v1.POST("/transactions/:id/adjust", AdjustTransaction(database))
-		
+
+		// Audit logs
+		v1.GET("/audit_logs", ListAuditLogs(database))
+
+		// Webhooks
+		v1.POST("/webhooks", CreateWebhook(database, cfg))
+		v1.GET("/webhooks", ListWebhooks(database))
+		v1.DELETE("/webhooks/:id", DeleteWebhook(database))
+		v1.GET("/webhook_deliveries", ListWebhookDeliveries(database))
+		v1.POST("/webhook_deliveries/:id/retry", RetryWebhookDelivery(database))
+
+		// Live events
+		v1.POST("/stream/tokens", CreateStreamToken(database, cfg))
+		v1.GET("/stream", Stream(database, stream.NewHub(database), cfg))
+
 		// WeChat webhook
+		v1.GET("/wechat", WeChatWebhook(database, cfg))
 		v1.POST("/wechat", WeChatWebhook(database, cfg))
-		
+
 		// MCP tools
 		v1.POST("/mcp/tools", MCPToolsHandler(database))
 	}
-	
+
 	return r
-}
\ No newline at end of file
+}
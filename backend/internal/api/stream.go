@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"reward-system/internal/auth"
+	"reward-system/internal/config"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/stream"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	streamPath       = "/api/v1/stream"
+	streamTokenTTL   = 24 * time.Hour
+	streamReplaySize = 500
+	// streamRetry is the reconnect delay suggested to EventSource clients.
+	streamRetry = 3 * time.Second
+)
+
+// streamHeartbeat is how often an idle stream sends a comment, so proxies
+// keep the connection open and clients notice a dead one.
+var streamHeartbeat = 15 * time.Second
+
+// CreateStreamToken issues a token that opens one family's stream for a
+// day, for clients such as EventSource that cannot send an access token.
+// The token is bound to the caller's session and stops working when it
+// ends, e.g. on logout.
+func CreateStreamToken(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			FamilyID uint64 `json:"family_id" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		if err := services.AuthorizeGuardian(c.Request.Context(), req.FamilyID); err != nil {
+			respondError(c, err)
+			return
+		}
+		if err := findFamily(database.WithContext(c.Request.Context()), req.FamilyID); err != nil {
+			respondError(c, err)
+			return
+		}
+		withholdIdempotentResponse(c)
+		expires := time.Now().Add(streamTokenTTL)
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{
+			"token":     stream.IssueToken(cfg.StreamSecret, req.FamilyID, currentSessionID(c), expires),
+			"family_id": req.FamilyID, "expires_at": expires,
+		}})
+	}
+}
+
+// Stream sends the family's events as Server-Sent Events while the client
+// stays connected. Each event's id is its outbox id: a client reconnecting
+// with Last-Event-ID (or last_event_id) first gets the events it missed.
+// Either a guardian's access token or a stream token for the family is
+// required. The stream ends once the session behind either is over or its
+// user no longer a guardian of the family.
+func Stream(database *gorm.DB, hub *stream.Hub, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		familyID := parseUint(c.Query("family_id"))
+		if familyID == 0 {
+			respondError(c, invalidRequestf("Missing required parameters"))
+			return
+		}
+		sessionID := currentSessionID(c)
+		if token := c.Query("token"); token != "" {
+			tokenFamilyID, tokenSessionID, err := stream.VerifyToken(cfg.StreamSecret, token)
+			if err != nil {
+				respondError(c, unauthorized("Invalid stream token"))
+				return
+			}
+			if tokenFamilyID != familyID {
+				respondError(c, services.Forbiddenf("stream token is not valid for family %d", familyID))
+				return
+			}
+			sessionID = tokenSessionID
+			if err := checkStreamSession(c, database, sessionID, familyID); err != nil {
+				respondError(c, err)
+				return
+			}
+		} else if err := services.AuthorizeGuardian(ctx, familyID); err != nil {
+			respondError(c, err)
+			return
+		}
+		if err := findFamily(database.WithContext(ctx), familyID); err != nil {
+			respondError(c, err)
+			return
+		}
+		lastEventID := parseUint(c.GetHeader("Last-Event-ID"))
+		if lastEventID == 0 {
+			lastEventID = parseUint(c.Query("last_event_id"))
+		}
+
+		// Subscribe before replaying so nothing committed in between is
+		// lost; replayed events the hub also delivers are skipped.
+		sub, err := hub.Subscribe(ctx, familyID)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		defer sub.Close()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		fmt.Fprintf(c.Writer, "retry: %d\n\n", streamRetry.Milliseconds())
+		c.Writer.Flush()
+
+		replayed := map[uint64]bool{}
+		for lastEventID > 0 {
+			events, err := stream.Replay(ctx, database, familyID, lastEventID, streamReplaySize)
+			if err != nil {
+				return
+			}
+			for i := range events {
+				if err := writeEvent(c, services.NewEventEnvelope(&events[i])); err != nil {
+					return
+				}
+				if events[i].ID > sub.From {
+					replayed[events[i].ID] = true
+				}
+				lastEventID = events[i].ID
+			}
+			if len(events) < streamReplaySize {
+				break
+			}
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case envelope, ok := <-sub.Events:
+				if !ok {
+					// Dropped for falling behind; the client reconnects
+					// and replays from its last event.
+					return
+				}
+				if replayed[envelope.ID] {
+					delete(replayed, envelope.ID)
+					continue
+				}
+				if err := writeEvent(c, envelope); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if err := checkStreamSession(c, database, sessionID, familyID); err != nil {
+					return
+				}
+				if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// checkStreamSession refuses a stream whose session has ended or whose user
+// is no longer a guardian of the family. Session 0, the operator's, is
+// bound to no session.
+func checkStreamSession(c *gin.Context, database *gorm.DB, sessionID, familyID uint64) error {
+	if sessionID == 0 {
+		return nil
+	}
+	user, err := auth.ActiveSession(c.Request.Context(), database, sessionID)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return unauthorized("The session of the stream has ended")
+	}
+	if err != nil {
+		return err
+	}
+	if user.Role != "guardian" || user.FamilyID != familyID {
+		return services.Forbiddenf("user %d is not a guardian of family %d", user.ID, familyID)
+	}
+	return nil
+}
+
+func writeEvent(c *gin.Context, envelope *services.EventEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", envelope.ID, envelope.Type, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+func findFamily(tx *gorm.DB, familyID uint64) error {
+	if err := tx.First(&db.Family{}, familyID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return services.NotFoundf("family %d not found", familyID)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"reward-system/internal/config"
+	"reward-system/internal/db"
+	"reward-system/internal/webhook"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CreateWebhook subscribes a URL to the family's events. The response is
+// the only one that includes the signing secret.
+func CreateWebhook(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			FamilyID uint64   `json:"family_id" binding:"required"`
+			URL      string   `json:"url" binding:"required"`
+			Events   []string `json:"events"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, invalidRequest(err))
+			return
+		}
+		withholdIdempotentResponse(c)
+		created, err := webhook.Create(c.Request.Context(), database, req.FamilyID, req.URL, req.Events, cfg.WebhookAllowedNets)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{
+			"id": created.ID, "family_id": created.FamilyID, "url": created.URL, "events": created.Events,
+			"secret": created.Secret, "created_at": created.CreatedAt,
+		}})
+	}
+}
+
+func ListWebhooks(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		familyID := c.Query("family_id")
+		if familyID == "" {
+			respondError(c, invalidRequestf("Missing required parameters"))
+			return
+		}
+		webhooks, err := webhook.List(c.Request.Context(), database, parseUint(familyID))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": webhooks})
+	}
+}
+
+func DeleteWebhook(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := webhook.Delete(c.Request.Context(), database, parseUint(c.Param("id"))); err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"id": parseUint(c.Param("id"))}})
+	}
+}
+
+// ListWebhookDeliveries pages backwards through the deliveries of a
+// family's webhooks; status=dead is the dead-letter view.
+func ListWebhookDeliveries(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		familyID := c.Query("family_id")
+		if familyID == "" {
+			respondError(c, invalidRequestf("Missing required parameters"))
+			return
+		}
+		filter := webhook.DeliveryFilter{
+			FamilyID:  parseUint(familyID),
+			WebhookID: parseUint(c.Query("webhook_id")),
+			Status:    c.Query("status"),
+			BeforeID:  parseUint(c.Query("cursor")),
+			Limit:     parseInt(c.DefaultQuery("limit", "50")),
+		}
+		page, err := webhook.ListDeliveries(c.Request.Context(), database, filter)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		views := make([]deliveryView, len(page.Deliveries))
+		for i, delivery := range page.Deliveries {
+			views[i] = deliveryView{WebhookDelivery: delivery, URL: delivery.Webhook.URL, EventType: delivery.Event.Type}
+			if delivery.Event.Payload != "" {
+				views[i].Payload = json.RawMessage(delivery.Event.Payload)
+			}
+		}
+		var nextCursor *string
+		if page.NextCursor > 0 {
+			cursor := strconv.FormatUint(page.NextCursor, 10)
+			nextCursor = &cursor
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": gin.H{"deliveries": views, "next_cursor": nextCursor}})
+	}
+}
+
+// RetryWebhookDelivery requeues a dead delivery.
+func RetryWebhookDelivery(database *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		delivery, err := webhook.Retry(c.Request.Context(), database, parseUint(c.Param("id")))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "data": delivery})
+	}
+}
+
+// deliveryView is a delivery with the URL it goes to and the event it
+// carries.
+type deliveryView struct {
+	db.WebhookDelivery
+	URL       string          `json:"url"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
@@ -1,14 +1,24 @@
 package api
 
 import (
-    "net/http"
-    "reward-system/internal/config"
-    "reward-system/internal/services"
-    "sort"
-    "strings"
-
-    "github.com/gin-gonic/gin"
-    "gorm.io/gorm"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reward-system/internal/config"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/units"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type WeChatMessage struct {
@@ -28,20 +38,20 @@ type WeChatResponse struct {
 	Content      string `xml:"Content"`
 }
 
+// wechatPath is the callback URL configured in the WeChat console.
+const wechatPath = "/api/v1/wechat"
+
+// wechatSignatureWindow is how far a callback's timestamp may be from now.
+// The signature does not cover the message, so this bounds how long a
+// captured one can be replayed with another.
+const wechatSignatureWindow = 5 * time.Minute
+
+// WeChatWebhook answers WeChat's callbacks. AuthMiddleware has checked their
+// signature: GET is the console's URL verification, POST a user's message.
 func WeChatWebhook(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Verify signature for GET request (WeChat verification)
-		if c.Request.Method == "GET" {
-			signature := c.Query("signature")
-			timestamp := c.Query("timestamp")
-			nonce := c.Query("nonce")
-			echostr := c.Query("echostr")
-
-			if verifySignature(cfg.WechatToken, signature, timestamp, nonce) {
-				c.String(http.StatusOK, echostr)
-				return
-			}
-			c.String(http.StatusForbidden, "Invalid signature")
+		if c.Request.Method == http.MethodGet {
+			c.String(http.StatusOK, c.Query("echostr"))
 			return
 		}
 
@@ -53,8 +63,8 @@ func WeChatWebhook(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
 		}
 
 		// Process the message
-		response := processWeChatMessage(database, msg)
-		
+		response := processWeChatMessage(c.Request.Context(), database, msg)
+
 		// Send response
 		resp := WeChatResponse{
 			ToUserName:   msg.FromUserName,
@@ -68,33 +78,142 @@ func WeChatWebhook(database *gorm.DB, cfg *config.Config) gin.HandlerFunc {
 	}
 }
 
+// verifyWeChatRequest reports whether a callback carries a valid, recent
+// WeChat signature. Without a WECHAT_TOKEN nothing verifies, so an instance
+// that has not configured one refuses every callback.
+func verifyWeChatRequest(c *gin.Context, token string, now time.Time) bool {
+	timestamp := c.Query("timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(sent, 0)); age > wechatSignatureWindow || age < -wechatSignatureWindow {
+		return false
+	}
+	return verifySignature(token, c.Query("signature"), timestamp, c.Query("nonce"))
+}
+
+// verifySignature checks signature against the hex SHA-1 of token,
+// timestamp and nonce, sorted and concatenated, as WeChat signs them.
 func verifySignature(token, signature, timestamp, nonce string) bool {
-	if token == "" {
-		return true // Skip verification if no token configured
+	if token == "" || signature == "" {
+		return false
 	}
-	
-    params := []string{token, timestamp, nonce}
-    sort.Strings(params)
-    // Simple hash comparison (in production, use proper SHA1)
-    return signature != "" // Simplified for demo
+
+	params := []string{token, timestamp, nonce}
+	sort.Strings(params)
+	sum := sha1.Sum([]byte(strings.Join(params, "")))
+	expected := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(signature))) == 1
 }
 
-func processWeChatMessage(database *gorm.DB, msg WeChatMessage) string {
+func processWeChatMessage(ctx context.Context, database *gorm.DB, msg WeChatMessage) string {
 	content := strings.TrimSpace(msg.Content)
-	
+
 	// Check if it's a structured command
 	if strings.HasPrefix(content, "#cmd ") {
-		return processStructuredCommand(database, msg.FromUserName, content[5:])
+		return processStructuredCommand(ctx, database, msg, content[5:])
 	}
-	
+
 	// Process natural language with MCP
 	return processNaturalLanguage(database, msg.FromUserName, content)
 }
 
-func processStructuredCommand(database *gorm.DB, openID string, cmd string) string {
-	// Parse JSON command and execute
-	// Simplified for now - return a placeholder response
-	return "结构化指令已收到，正在处理..."
+// wechatCommand is the JSON payload of a "#cmd" message, see 需求.md §4.
+type wechatCommand struct {
+	Action string      `json:"action"`
+	Child  string      `json:"child"`
+	Type   string      `json:"type"`
+	Name   string      `json:"name"`
+	Unit   string      `json:"unit"`
+	Value  json.Number `json:"value"`
+	Amount string      `json:"amount"` // display form such as "1小时30分", instead of value
+	Note   string      `json:"note"`
+}
+
+func processStructuredCommand(ctx context.Context, database *gorm.DB, msg WeChatMessage, raw string) string {
+	reply, err := executeStructuredCommand(ctx, services.NewRewardService(database), msg, raw)
+	if err != nil {
+		return errorReply(err)
+	}
+	return reply
+}
+
+func executeStructuredCommand(ctx context.Context, service *services.RewardService, msg WeChatMessage, raw string) (string, error) {
+	var cmd wechatCommand
+	if err := json.Unmarshal([]byte(raw), &cmd); err != nil {
+		return "", invalidRequest(err)
+	}
+
+	sender, err := service.FindUserByOpenID(ctx, msg.FromUserName)
+	if err != nil {
+		return "", err
+	}
+	ctx = services.WithActor(ctx, services.UserActor(sender, services.SourceWeChat))
+
+	if cmd.Action == "define_type" {
+		rewardType := &db.RewardType{
+			FamilyID:  sender.FamilyID,
+			Name:      cmd.Name,
+			UnitKind:  cmd.Type,
+			UnitLabel: cmd.Unit,
+			Scale:     services.DefaultScale(cmd.Type),
+		}
+		if err := service.CreateRewardType(ctx, rewardType); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("已新增奖励类型：%s", rewardType.Name), nil
+	}
+
+	child, err := service.FindChildByName(ctx, sender.FamilyID, cmd.Child)
+	if err != nil {
+		return "", err
+	}
+	rewardType, err := service.FindRewardType(ctx, sender.FamilyID, cmd.Type)
+	if err != nil {
+		return "", err
+	}
+
+	// WeChat redelivers a message when our reply is slow, so the message id
+	// doubles as the idempotency key.
+	idempotencyKey := ""
+	if msg.MsgID != 0 {
+		idempotencyKey = fmt.Sprintf("wechat:%d", msg.MsgID)
+	}
+
+	unit := units.For(rewardType)
+	var value int64
+	if cmd.Action == "grant" || cmd.Action == "spend" {
+		if cmd.Amount != "" {
+			if value, err = unit.Parse(cmd.Amount); err != nil {
+				return "", services.Validationf("cannot read amount %q", cmd.Amount)
+			}
+		} else if value, err = parseLedgerValue(cmd.Value); err != nil {
+			return "", err
+		}
+	}
+
+	switch cmd.Action {
+	case "grant":
+		result, err := service.GrantReward(ctx, sender.FamilyID, child.ID, rewardType.ID, value, cmd.Note, idempotencyKey)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("已为%s记入%s %s，当前余额 %s", child.DisplayName, rewardType.Name, unit.Format(value), result.Display), nil
+	case "spend":
+		result, err := service.SpendReward(ctx, sender.FamilyID, child.ID, rewardType.ID, value, cmd.Note, idempotencyKey)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("已为%s扣除%s %s，当前余额 %s", child.DisplayName, rewardType.Name, unit.Format(value), result.Display), nil
+	case "query":
+		balance, err := service.GetBalance(ctx, sender.FamilyID, child.ID, rewardType.ID)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s的%s余额：%s", child.DisplayName, rewardType.Name, balance.Display), nil
+	}
+	return "", invalidRequestf("unknown action " + cmd.Action)
 }
 
 func processNaturalLanguage(database *gorm.DB, openID string, text string) string {
@@ -102,6 +221,6 @@ func processNaturalLanguage(database *gorm.DB, openID string, text string) strin
 	// Simplified for now - return a placeholder response
 	service := services.NewRewardService(database)
 	_ = service // Use the service to perform operations
-	
+
 	return "自然语言消息已收到: " + text
-}
\ No newline at end of file
+}
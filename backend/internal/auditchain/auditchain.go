@@ -0,0 +1,214 @@
+// Package auditchain computes and verifies the hash chain over each
+// family's audit logs. Every entry stores the SHA-256 of the previous
+// entry's hash and its own content, so editing an entry changes its hash
+// and deleting one breaks the link from the next; the chain head in
+// audit_chains covers entries removed from the end.
+package auditchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"reward-system/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Hash returns the hex SHA-256 of prevHash and the audit log's family,
+// actor, action, time and payload. The payload is hashed in canonical form
+// because MySQL and PostgreSQL rewrite the JSON they store, and the time in
+// whole seconds because MySQL keeps no more; Append truncates it before the
+// log is written.
+func Hash(prevHash string, auditLog *db.AuditLog) (string, error) {
+	payload, err := canonicalJSON(auditLog.Payload)
+	if err != nil {
+		return "", fmt.Errorf("auditchain: payload of audit log %d: %w", auditLog.ID, err)
+	}
+	var familyID, userID uint64
+	if auditLog.FamilyID != nil {
+		familyID = *auditLog.FamilyID
+	}
+	if auditLog.UserID != nil {
+		userID = *auditLog.UserID
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n%s\n%d\n", prevHash, familyID, userID, auditLog.Action, auditLog.CreatedAt.Unix())
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Link sets the hashes of an audit log that follows head in its family's
+// chain and advances head past it.
+func Link(head *db.AuditChain, auditLog *db.AuditLog) error {
+	if auditLog.CreatedAt.IsZero() {
+		auditLog.CreatedAt = time.Now()
+	}
+	auditLog.CreatedAt = auditLog.CreatedAt.Truncate(time.Second)
+	hash, err := Hash(head.Head, auditLog)
+	if err != nil {
+		return err
+	}
+	auditLog.PrevHash, auditLog.Hash = head.Head, hash
+	head.Length++
+	head.Head = hash
+	return nil
+}
+
+// ChainID is the audit_chains key of an audit log's family.
+func ChainID(auditLog *db.AuditLog) uint64 {
+	if auditLog.FamilyID == nil {
+		return 0
+	}
+	return *auditLog.FamilyID
+}
+
+// canonicalJSON re-encodes a JSON document with sorted keys and no
+// insignificant whitespace, keeping numbers as written.
+func canonicalJSON(raw string) ([]byte, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// Report is the outcome of verifying one family's chain. Unchained counts
+// the entries written before the chain existed, which carry no hash.
+type Report struct {
+	FamilyID  uint64   `json:"family_id"`
+	Entries   int64    `json:"entries"`
+	Unchained int64    `json:"unchained"`
+	Head      string   `json:"head"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+// OK reports whether the chain verified.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify checks the chain of every family, or only of familyID when it is
+// not 0, and reports each in family order. Logs without a family, such as
+// the tombstones of deleted families, form chain 0.
+func Verify(ctx context.Context, database *gorm.DB, familyID uint64) ([]*Report, error) {
+	database = database.WithContext(ctx)
+
+	var heads []db.AuditChain
+	query := database.Order("family_id ASC")
+	if familyID != 0 {
+		query = query.Where("family_id = ?", familyID)
+	}
+	if err := query.Find(&heads).Error; err != nil {
+		return nil, err
+	}
+	headOf := make(map[uint64]*db.AuditChain, len(heads))
+	for i := range heads {
+		headOf[heads[i].FamilyID] = &heads[i]
+	}
+
+	// Families with logs but no head have lost it, or never had one.
+	var logged []uint64
+	if err := database.Model(&db.AuditLog{}).Distinct().Pluck("COALESCE(family_id, 0)", &logged).Error; err != nil {
+		return nil, err
+	}
+	ids := make(map[uint64]bool)
+	for id := range headOf {
+		ids[id] = true
+	}
+	for _, id := range logged {
+		if familyID == 0 || id == familyID {
+			ids[id] = true
+		}
+	}
+	sorted := make([]uint64, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	reports := make([]*Report, 0, len(sorted))
+	for _, id := range sorted {
+		report, err := verifyChain(database, id, headOf[id])
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// verifyChain walks one family's logs in id order, which is the order they
+// were appended in.
+func verifyChain(database *gorm.DB, familyID uint64, head *db.AuditChain) (*Report, error) {
+	report := &Report{FamilyID: familyID}
+	query := database.Where("family_id = ?", familyID)
+	if familyID == 0 {
+		query = database.Where("family_id IS NULL")
+	}
+
+	var previous *db.AuditLog
+	var chained int64
+	var batch []db.AuditLog
+	result := query.Order("id ASC").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			auditLog := batch[i]
+			report.Entries++
+			if auditLog.Hash == "" {
+				if previous == nil {
+					report.Unchained++
+				} else {
+					report.Problems = append(report.Problems, fmt.Sprintf("audit log %d has no hash: its hash was removed", auditLog.ID))
+				}
+				continue
+			}
+			chained++
+
+			expectedPrev := ""
+			if previous != nil {
+				expectedPrev = previous.Hash
+			}
+			if auditLog.PrevHash != expectedPrev {
+				if previous == nil {
+					report.Problems = append(report.Problems, fmt.Sprintf("audit log %d does not start the chain: earlier entries were deleted", auditLog.ID))
+				} else {
+					report.Problems = append(report.Problems, fmt.Sprintf("audit log %d does not follow audit log %d: entries between them were deleted", auditLog.ID, previous.ID))
+				}
+			}
+			hash, err := Hash(auditLog.PrevHash, &auditLog)
+			if err != nil {
+				report.Problems = append(report.Problems, err.Error())
+			} else if hash != auditLog.Hash {
+				report.Problems = append(report.Problems, fmt.Sprintf("audit log %d was modified", auditLog.ID))
+			}
+			previous = &auditLog
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	switch {
+	case head == nil && chained > 0:
+		report.Problems = append(report.Problems, "the chain head is missing")
+	case head != nil && previous == nil:
+		report.Problems = append(report.Problems, fmt.Sprintf("the chain head records %d entries but none remain", head.Length))
+	case head != nil:
+		report.Head = head.Head
+		if head.Head != previous.Hash || head.Length != chained {
+			report.Problems = append(report.Problems, fmt.Sprintf("the chain head records %d entries ending in %.12s, but the logs end at audit log %d after %d: entries were deleted from the end", head.Length, head.Head, previous.ID, chained))
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,131 @@
+package auditchain
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+// appendLogs chains n audit logs of the family the way the services do and
+// returns them in order.
+func appendLogs(t *testing.T, database *gorm.DB, familyID uint64, n int) []*db.AuditLog {
+	var head db.AuditChain
+	if err := database.Where("family_id = ?", familyID).FirstOrCreate(&head, db.AuditChain{FamilyID: familyID}).Error; err != nil {
+		t.Fatalf("Failed to read the chain head: %v", err)
+	}
+	var auditLogs []*db.AuditLog
+	for i := 0; i < n; i++ {
+		auditLog := &db.AuditLog{Action: "reward.granted", Payload: `{"source":"api","after":{"balance":` + strings.Repeat("1", i+1) + `}}`}
+		if familyID != 0 {
+			auditLog.FamilyID = &familyID
+		}
+		if err := Link(&head, auditLog); err != nil {
+			t.Fatalf("Link: %v", err)
+		}
+		if err := database.Create(auditLog).Error; err != nil {
+			t.Fatalf("Failed to create audit log: %v", err)
+		}
+		auditLogs = append(auditLogs, auditLog)
+	}
+	if err := database.Model(&db.AuditChain{}).Where("family_id = ?", familyID).
+		Updates(map[string]interface{}{"length": head.Length, "head": head.Head}).Error; err != nil {
+		t.Fatalf("Failed to update the chain head: %v", err)
+	}
+	return auditLogs
+}
+
+func verifyFamily(t *testing.T, database *gorm.DB, familyID uint64) *Report {
+	reports, err := Verify(context.Background(), database, familyID)
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("Verify: %+v, %v", reports, err)
+	}
+	return reports[0]
+}
+
+func TestVerify(t *testing.T) {
+	database := setupTestDB(t)
+	// A log written before the chain existed.
+	familyID := uint64(1)
+	database.Create(&db.AuditLog{FamilyID: &familyID, Action: "grant", Payload: `{}`, CreatedAt: time.Now()})
+	auditLogs := appendLogs(t, database, familyID, 3)
+	appendLogs(t, database, 0, 1)
+	appendLogs(t, database, 2, 2)
+
+	reports, err := Verify(context.Background(), database, 0)
+	if err != nil || len(reports) != 3 {
+		t.Fatalf("Verify: %+v, %v", reports, err)
+	}
+	for _, report := range reports {
+		if !report.OK() {
+			t.Errorf("Expected family %d to verify, got %v", report.FamilyID, report.Problems)
+		}
+	}
+	if report := reports[1]; report.FamilyID != 1 || report.Entries != 4 || report.Unchained != 1 || report.Head != auditLogs[2].Hash {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	// The database may store the payload with its keys in another order.
+	database.Model(auditLogs[0]).Update("payload", `{"after": {"balance": 1}, "source": "api"}`)
+	if report := verifyFamily(t, database, familyID); !report.OK() {
+		t.Errorf("Expected a reformatted payload to verify, got %v", report.Problems)
+	}
+}
+
+func TestVerify_Tampering(t *testing.T) {
+	for name, tamper := range map[string]struct {
+		tamper  func(database *gorm.DB, auditLogs []*db.AuditLog)
+		problem string
+	}{
+		"modified": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Model(auditLogs[1]).Update("payload", `{"source":"api","after":{"balance":99}}`)
+		}, "audit log 2 was modified"},
+		"actor changed": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Model(auditLogs[1]).Update("user_id", 5)
+		}, "audit log 2 was modified"},
+		"deleted in the middle": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Delete(auditLogs[1])
+		}, "audit log 3 does not follow audit log 1"},
+		"deleted at the start": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Delete(auditLogs[0])
+		}, "audit log 2 does not start the chain"},
+		"deleted at the end": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Delete(auditLogs[2])
+		}, "entries were deleted from the end"},
+		"all deleted": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Where("1 = 1").Delete(&db.AuditLog{})
+		}, "none remain"},
+		"hash removed": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Model(auditLogs[1]).Updates(map[string]interface{}{"prev_hash": "", "hash": ""})
+		}, "audit log 2 has no hash"},
+		"head removed": {func(database *gorm.DB, auditLogs []*db.AuditLog) {
+			database.Where("family_id = ?", 1).Delete(&db.AuditChain{})
+		}, "the chain head is missing"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			database := setupTestDB(t)
+			auditLogs := appendLogs(t, database, 1, 3)
+			tamper.tamper(database, auditLogs)
+			report := verifyFamily(t, database, 1)
+			if report.OK() || !strings.Contains(strings.Join(report.Problems, "; "), tamper.problem) {
+				t.Errorf("Expected %q, got %v", tamper.problem, report.Problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+// Package auth logs guardians and children in with their username and
+// password. A login opens a Session and returns a short-lived access token,
+// a JWT naming the user and the session, and a refresh token that trades
+// for new tokens until the session expires or is revoked. Revoking a
+// session, or deactivating its user, ends its access tokens at once.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// AccessTTL is how long an access token is valid.
+	AccessTTL = 15 * time.Minute
+	// RefreshTTL is how long a session lasts from login; refreshing does
+	// not extend it.
+	RefreshTTL = 30 * 24 * time.Hour
+	// MinPasswordLength is the shortest password accepted.
+	MinPasswordLength = 6
+)
+
+// Audit log actions.
+const (
+	ActionCredentialsUpdated = "user.credentials_updated"
+	ActionSessionsRevoked    = "user.sessions_revoked"
+)
+
+// ErrInvalidCredentials is returned by Login for an unknown username, a
+// wrong password or a user who may not log in. It does not say which.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// dummyHash is compared against when the username is unknown, so that a
+// failed login takes as long whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("kudo-dummy-password"), bcrypt.DefaultCost)
+
+// Tokens are what a login or refresh returns.
+type Tokens struct {
+	AccessToken  string   `json:"access_token"`
+	TokenType    string   `json:"token_type"`
+	ExpiresIn    int      `json:"expires_in"` // seconds
+	RefreshToken string   `json:"refresh_token"`
+	User         *db.User `json:"user"`
+}
+
+// SetCredentials gives the user a username and password, replacing any
+// they had, and revokes their sessions so that the old password no longer
+// holds anyone logged in. Users set their own, guardians those of their
+// family's children.
+func SetCredentials(ctx context.Context, database *gorm.DB, userID uint64, username, password string) (*db.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > 64 || strings.IndexFunc(username, unicode.IsSpace) >= 0 {
+		return nil, services.Validationf("username must be 1 to 64 characters without spaces")
+	}
+	if len(password) < MinPasswordLength || len(password) > 72 {
+		return nil, services.Validationf("password must be %d to 72 characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	var user db.User
+	err = database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("user %d not found", userID)
+			}
+			return err
+		}
+		if err := services.AuthorizeAccount(ctx, &user); err != nil {
+			return err
+		}
+		before := map[string]interface{}{"username": string(user.Username)}
+		user.Username = db.OptionalString(username)
+		user.PasswordHash = string(hash)
+		err := tx.Model(&user).Select("username", "password_hash").Updates(&user).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return services.Conflictf("username %q is already taken", username)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := revoke(tx, userID); err != nil {
+			return err
+		}
+		auditLog, err := services.NewAuditLog(ctx, user.FamilyID, ActionCredentialsUpdated, before, map[string]interface{}{"username": username})
+		if err != nil {
+			return err
+		}
+		return services.AppendAuditLog(ctx, storage.NewGorm(tx), auditLog)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Login checks the username and password of an active user and opens a
+// session for them.
+func Login(ctx context.Context, database *gorm.DB, secret, username, password string) (*Tokens, error) {
+	database = database.WithContext(ctx)
+	var user db.User
+	err := database.Where("username = ?", strings.TrimSpace(username)).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || !user.IsActive {
+		return nil, ErrInvalidCredentials
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session := &db.Session{UserID: user.ID, RefreshTokenHash: hashToken(refreshToken), ExpiresAt: time.Now().Add(RefreshTTL)}
+	if err := database.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return issue(secret, &user, session, refreshToken)
+}
+
+// Refresh trades a refresh token for a new access token and a new refresh
+// token; the old refresh token is used up.
+func Refresh(ctx context.Context, database *gorm.DB, secret, refreshToken string) (*Tokens, error) {
+	var tokens *Tokens
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var session db.Session
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("User").
+			Where("refresh_token_hash = ?", hashToken(refreshToken)).Take(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if session.RevokedAt != nil || !time.Now().Before(session.ExpiresAt) || !session.User.IsActive {
+			return ErrInvalidToken
+		}
+		next, err := newRefreshToken()
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&session).Update("refresh_token_hash", hashToken(next)).Error; err != nil {
+			return err
+		}
+		tokens, err = issue(secret, &session.User, &session, next)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Authenticate returns the user an access token was issued to, provided
+// its session is still open and the user still active.
+func Authenticate(ctx context.Context, database *gorm.DB, secret, accessToken string) (*db.User, *Claims, error) {
+	claims, err := Parse(secret, accessToken, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := ActiveSession(ctx, database, claims.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.ID != claims.UserID() {
+		return nil, nil, ErrInvalidToken
+	}
+	return user, claims, nil
+}
+
+// ActiveSession returns the user of a session that is still open, provided
+// the user is still active, or ErrInvalidToken.
+func ActiveSession(ctx context.Context, database *gorm.DB, sessionID uint64) (*db.User, error) {
+	var user db.User
+	err := database.WithContext(ctx).
+		Joins("JOIN sessions ON sessions.user_id = users.id").
+		Where("users.is_active = ?", true).
+		Where("sessions.id = ? AND sessions.revoked_at IS NULL AND sessions.expires_at > ?", sessionID, time.Now()).
+		Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Logout revokes a session.
+func Logout(ctx context.Context, database *gorm.DB, sessionID uint64) error {
+	return database.WithContext(ctx).Model(&db.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).Update("revoked_at", time.Now()).Error
+}
+
+// RevokeSessions logs the user out everywhere, e.g. after a lost phone,
+// and returns how many open sessions were revoked. Users revoke their own,
+// guardians those of their family's children.
+func RevokeSessions(ctx context.Context, database *gorm.DB, userID uint64) (int64, error) {
+	var revoked int64
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user db.User
+		if err := tx.First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("user %d not found", userID)
+			}
+			return err
+		}
+		if err := services.AuthorizeAccount(ctx, &user); err != nil {
+			return err
+		}
+		var err error
+		if revoked, err = revoke(tx, userID); err != nil {
+			return err
+		}
+		auditLog, err := services.NewAuditLog(ctx, user.FamilyID, ActionSessionsRevoked, nil, map[string]interface{}{"user_id": userID, "sessions": revoked})
+		if err != nil {
+			return err
+		}
+		return services.AppendAuditLog(ctx, storage.NewGorm(tx), auditLog)
+	})
+	return revoked, err
+}
+
+// revoke ends the user's open sessions.
+func revoke(tx *gorm.DB, userID uint64) (int64, error) {
+	result := tx.Model(&db.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+func issue(secret string, user *db.User, session *db.Session, refreshToken string) (*Tokens, error) {
+	now := time.Now()
+	accessToken, err := Sign(secret, &Claims{
+		Subject: strconv.FormatUint(user.ID, 10), FamilyID: user.FamilyID, Role: user.Role, SessionID: session.ID,
+		IssuedAt: now.Unix(), ExpiresAt: now.Add(AccessTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{
+		AccessToken: accessToken, TokenType: "Bearer", ExpiresIn: int(AccessTTL / time.Second),
+		RefreshToken: refreshToken, User: user,
+	}, nil
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
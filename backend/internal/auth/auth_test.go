@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Now()
+	token, err := Sign("secret", &Claims{Subject: "7", FamilyID: 2, Role: "child", SessionID: 3, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	claims, err := Parse("secret", token, now)
+	if err != nil || claims.UserID() != 7 || claims.FamilyID != 2 || claims.Role != "child" || claims.SessionID != 3 {
+		t.Fatalf("Parse = %+v, %v", claims, err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","fid":2,"role":"guardian","sid":3,"exp":9999999999}`)) + "." + parts[2]
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."
+	for _, c := range []struct {
+		name, secret, token string
+		at                  time.Time
+	}{
+		{"wrong secret", "other", token, now},
+		{"expired", "secret", token, now.Add(time.Minute)},
+		{"forged", "secret", forged, now},
+		{"alg none", "secret", unsigned, now},
+		{"malformed", "secret", "not.a.jwt", now},
+	} {
+		if _, err := Parse(c.secret, c.token, c.at); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", c.name, err)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Mom", IsActive: true}
+	database.Create(guardian)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid", IsActive: true}
+	database.Create(child)
+
+	if _, err := SetCredentials(ctx, database, guardian.ID, "mom", "short"); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for a short password, got %v", err)
+	}
+	if _, err := SetCredentials(ctx, database, guardian.ID, "m o m", "secret-1"); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for a username with spaces, got %v", err)
+	}
+	if _, err := SetCredentials(ctx, database, guardian.ID, "mom", "secret-1"); err != nil {
+		t.Fatalf("SetCredentials: %v", err)
+	}
+	if _, err := SetCredentials(ctx, database, child.ID, "mom", "secret-2"); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("Expected a conflict for a taken username, got %v", err)
+	}
+	if _, err := SetCredentials(ctx, database, child.ID, "kid", "secret-2"); err != nil {
+		t.Fatalf("SetCredentials: %v", err)
+	}
+
+	for _, login := range [][2]string{{"mom", "secret-2"}, {"dad", "secret-1"}, {"", ""}} {
+		if _, err := Login(ctx, database, "jwt", login[0], login[1]); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Login(%q, %q): expected ErrInvalidCredentials, got %v", login[0], login[1], err)
+		}
+	}
+	tokens, err := Login(ctx, database, "jwt", "mom", "secret-1")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	user, claims, err := Authenticate(ctx, database, "jwt", tokens.AccessToken)
+	if err != nil || user.ID != guardian.ID || claims.Role != "guardian" || claims.FamilyID != family.ID {
+		t.Fatalf("Authenticate = %+v, %+v, %v", user, claims, err)
+	}
+
+	// A refresh token works once.
+	refreshed, err := Refresh(ctx, database, "jwt", tokens.RefreshToken)
+	if err != nil || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("Refresh = %+v, %v", refreshed, err)
+	}
+	if _, err := Refresh(ctx, database, "jwt", tokens.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a used refresh token to be refused, got %v", err)
+	}
+
+	// Logging out ends the session's access and refresh tokens.
+	if err := Logout(ctx, database, claims.SessionID); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if _, _, err := Authenticate(ctx, database, "jwt", refreshed.AccessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a logged out access token to be refused, got %v", err)
+	}
+	if _, err := Refresh(ctx, database, "jwt", refreshed.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a logged out refresh token to be refused, got %v", err)
+	}
+
+	// Revoking logs the child out of every session; deactivating them
+	// refuses their tokens and logins.
+	first, _ := Login(ctx, database, "jwt", "kid", "secret-2")
+	second, _ := Login(ctx, database, "jwt", "kid", "secret-2")
+	if revoked, err := RevokeSessions(ctx, database, child.ID); err != nil || revoked != 2 {
+		t.Errorf("RevokeSessions = %d, %v; want 2", revoked, err)
+	}
+	for _, tokens := range []*Tokens{first, second} {
+		if _, _, err := Authenticate(ctx, database, "jwt", tokens.AccessToken); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Expected a revoked access token to be refused, got %v", err)
+		}
+	}
+	third, _ := Login(ctx, database, "jwt", "kid", "secret-2")
+	database.Model(child).Update("is_active", false)
+	if _, _, err := Authenticate(ctx, database, "jwt", third.AccessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected an inactive user's access token to be refused, got %v", err)
+	}
+	if _, err := Login(ctx, database, "jwt", "kid", "secret-2"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected an inactive user's login to be refused, got %v", err)
+	}
+
+	var actions []string
+	database.Model(&db.AuditLog{}).Order("id ASC").Pluck("action", &actions)
+	if strings.Join(actions, ",") != "user.credentials_updated,user.credentials_updated,user.sessions_revoked" {
+		t.Errorf("Unexpected audit logs %v", actions)
+	}
+}
+
+func TestCredentials_Authorization(t *testing.T) {
+	database := setupTestDB(t)
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	mom := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Mom", IsActive: true}
+	dad := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Dad", IsActive: true}
+	kid := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid", IsActive: true}
+	sibling := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Sibling", IsActive: true}
+	for _, user := range []*db.User{mom, dad, kid, sibling} {
+		database.Create(user)
+	}
+	as := func(user *db.User) context.Context {
+		return services.WithActor(context.Background(), services.UserActor(user, services.SourceAPI))
+	}
+
+	// A guardian manages their own credentials and the children's.
+	if _, err := SetCredentials(as(mom), database, mom.ID, "mom", "secret-1"); err != nil {
+		t.Errorf("Expected a guardian to set their own password, got %v", err)
+	}
+	if _, err := SetCredentials(as(mom), database, kid.ID, "kid", "secret-2"); err != nil {
+		t.Errorf("Expected a guardian to set a child's password, got %v", err)
+	}
+	if _, err := RevokeSessions(as(mom), database, kid.ID); err != nil {
+		t.Errorf("Expected a guardian to revoke a child's sessions, got %v", err)
+	}
+
+	// Another guardian cannot take over their account, nor a child another's.
+	if _, err := SetCredentials(as(dad), database, mom.ID, "mom", "taken-over"); !errors.Is(err, services.ErrForbidden) {
+		t.Errorf("Expected a second guardian refused resetting a guardian's password, got %v", err)
+	}
+	if _, err := RevokeSessions(as(dad), database, mom.ID); !errors.Is(err, services.ErrForbidden) {
+		t.Errorf("Expected a second guardian refused revoking a guardian's sessions, got %v", err)
+	}
+	if _, err := SetCredentials(as(kid), database, sibling.ID, "sibling", "secret-3"); !errors.Is(err, services.ErrForbidden) {
+		t.Errorf("Expected a child refused setting a sibling's password, got %v", err)
+	}
+	if _, err := Login(context.Background(), database, "jwt", "mom", "secret-1"); err != nil {
+		t.Errorf("Expected the guardian's own password to hold, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for an access or refresh token that is
+// malformed, forged, expired or revoked.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Claims are what an access token says about its bearer: the user, their
+// family and role, and the session it was issued for.
+type Claims struct {
+	Subject   string `json:"sub"`
+	FamilyID  uint64 `json:"fid"`
+	Role      string `json:"role"`
+	SessionID uint64 `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// UserID is the user the token was issued to.
+func (c *Claims) UserID() uint64 {
+	id, _ := strconv.ParseUint(c.Subject, 10, 64)
+	return id
+}
+
+// jwtHeader is the only header tokens are signed with; tokens with another,
+// such as alg "none", are rejected.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign returns the claims as a JWT signed with HMAC-SHA256.
+func Sign(secret string, claims *Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signature(secret, unsigned), nil
+}
+
+// Parse verifies a JWT made by Sign and returns its claims unless it has
+// expired by now.
+func Parse(secret, token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signature(secret, parts[0]+"."+parts[1]))) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.UserID() == 0 {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+func signature(secret, unsigned string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
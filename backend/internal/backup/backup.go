@@ -0,0 +1,438 @@
+// Package backup exports a single family as a self-contained JSON archive
+// and imports such an archive into any instance. Ids are not portable
+// between databases, so the archive keeps the exporting instance's ids only
+// to link its records together and Import assigns new ones.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Format identifies kudo family archives; Version is bumped whenever the
+// archive format or the meaning of a field changes. Import still reads
+// archives back to MinVersion.
+//
+// Version 2: created_by is the user who made the transaction and is omitted
+// when the operator made it; version 1 archives carry the child instead.
+const (
+	Format     = "kudo.family"
+	Version    = 2
+	MinVersion = 1
+)
+
+// Archive is one family with everything that belongs to it.
+type Archive struct {
+	Format       string        `json:"format"`
+	Version      int           `json:"version"`
+	ExportedAt   time.Time     `json:"exported_at"`
+	Family       Family        `json:"family"`
+	Users        []User        `json:"users"`
+	RewardTypes  []RewardType  `json:"reward_types"`
+	Accounts     []Account     `json:"accounts"`
+	Transactions []Transaction `json:"transactions"`
+	AuditLogs    []AuditLog    `json:"audit_logs"`
+}
+
+type Family struct {
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type User struct {
+	ID           uint64     `json:"id"`
+	Role         string     `json:"role"`
+	DisplayName  string     `json:"display_name"`
+	WechatOpenID string     `json:"wechat_openid,omitempty"`
+	IsActive     bool       `json:"is_active"`
+	ArchivedAt   *time.Time `json:"archived_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type RewardType struct {
+	ID                  uint64    `json:"id"`
+	Name                string    `json:"name"`
+	UnitKind            string    `json:"unit_kind"`
+	UnitLabel           string    `json:"unit_label,omitempty"`
+	Currency            string    `json:"currency,omitempty"`
+	Scale               int       `json:"scale"`
+	MaxValue            int64     `json:"max_value"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	LowBalanceThreshold int64     `json:"low_balance_threshold,omitempty"`
+	ChildrenMaySpend    bool      `json:"children_may_spend,omitempty"`
+}
+
+type Account struct {
+	ID           uint64    `json:"id"`
+	ChildID      uint64    `json:"child_id"`
+	RewardTypeID uint64    `json:"reward_type_id"`
+	Balance      int64     `json:"balance"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type Transaction struct {
+	ID        uint64    `json:"id"`
+	AccountID uint64    `json:"account_id"`
+	Type      string    `json:"type"`
+	Value     int64     `json:"value"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy uint64    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditLog struct {
+	ID        uint64    `json:"id"`
+	UserID    uint64    `json:"user_id,omitempty"`
+	Action    string    `json:"action"`
+	Payload   string    `json:"payload,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Export reads the family from a single transaction, so the archive is a
+// consistent snapshot even while the family keeps using the ledger. Only
+// guardians export their family.
+func Export(ctx context.Context, database *gorm.DB, familyID uint64) (*Archive, error) {
+	if err := services.AuthorizeGuardian(ctx, familyID); err != nil {
+		return nil, err
+	}
+	archive := &Archive{Format: Format, Version: Version, ExportedAt: time.Now()}
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var family db.Family
+		if err := tx.First(&family, familyID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("family not found").WithDetails(map[string]interface{}{"family_id": familyID})
+			}
+			return err
+		}
+		archive.Family = Family{ID: family.ID, Name: family.Name, CreatedAt: family.CreatedAt, UpdatedAt: family.UpdatedAt}
+
+		var users []db.User
+		if err := tx.Where("family_id = ?", familyID).Order("id ASC").Find(&users).Error; err != nil {
+			return err
+		}
+		for _, u := range users {
+			archive.Users = append(archive.Users, User{
+				ID: u.ID, Role: u.Role, DisplayName: u.DisplayName, WechatOpenID: string(u.WechatOpenID),
+				IsActive: u.IsActive, ArchivedAt: u.ArchivedAt, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt,
+			})
+		}
+
+		var rewardTypes []db.RewardType
+		if err := tx.Where("family_id = ?", familyID).Order("id ASC").Find(&rewardTypes).Error; err != nil {
+			return err
+		}
+		for _, rt := range rewardTypes {
+			archive.RewardTypes = append(archive.RewardTypes, RewardType{
+				ID: rt.ID, Name: rt.Name, UnitKind: rt.UnitKind, UnitLabel: rt.UnitLabel, Currency: rt.Currency,
+				Scale: rt.Scale, MaxValue: rt.MaxValue, CreatedAt: rt.CreatedAt, UpdatedAt: rt.UpdatedAt,
+				LowBalanceThreshold: rt.LowBalanceThreshold, ChildrenMaySpend: rt.ChildrenMaySpend,
+			})
+		}
+
+		var accounts []db.Account
+		if err := tx.Where("family_id = ?", familyID).Order("id ASC").Find(&accounts).Error; err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			archive.Accounts = append(archive.Accounts, Account{
+				ID: a.ID, ChildID: a.ChildID, RewardTypeID: a.RewardTypeID, Balance: a.Balance,
+				CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt,
+			})
+		}
+
+		var transactions []db.Transaction
+		accountIDs := tx.Model(&db.Account{}).Select("id").Where("family_id = ?", familyID)
+		if err := tx.Where("account_id IN (?)", accountIDs).Order("id ASC").Find(&transactions).Error; err != nil {
+			return err
+		}
+		for _, t := range transactions {
+			archive.Transactions = append(archive.Transactions, Transaction{
+				ID: t.ID, AccountID: t.AccountID, Type: t.Type, Value: t.Value, Note: t.Note,
+				CreatedBy: derefID(t.CreatedBy), CreatedAt: t.CreatedAt,
+			})
+		}
+
+		var auditLogs []db.AuditLog
+		if err := tx.Where("family_id = ?", familyID).Order("id ASC").Find(&auditLogs).Error; err != nil {
+			return err
+		}
+		for _, l := range auditLogs {
+			archive.AuditLogs = append(archive.AuditLogs, AuditLog{
+				ID: l.ID, UserID: derefID(l.UserID), Action: l.Action, Payload: l.Payload, CreatedAt: l.CreatedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// ImportOptions adjusts how an archive is restored.
+type ImportOptions struct {
+	// ClearOpenIDs drops the users' WeChat openids, which are unique per
+	// instance, e.g. to restore a copy next to the original family.
+	ClearOpenIDs bool
+}
+
+// ImportResult reports the new family and how many records were restored.
+type ImportResult struct {
+	FamilyID     uint64 `json:"family_id"`
+	Users        int    `json:"users"`
+	RewardTypes  int    `json:"reward_types"`
+	Accounts     int    `json:"accounts"`
+	Transactions int    `json:"transactions"`
+	AuditLogs    int    `json:"audit_logs"`
+}
+
+// Import restores archive as a new family in one transaction. Every record
+// gets a new id and the references between them are remapped. Nothing is
+// written unless every account balance equals the sum of its transactions.
+// Idempotency keys are not restored: they only protect retries against the
+// instance that recorded them. Like creating a family, importing one is
+// left to the operator.
+func Import(ctx context.Context, database *gorm.DB, archive *Archive, opts ImportOptions) (*ImportResult, error) {
+	if err := services.AuthorizeOperator(ctx); err != nil {
+		return nil, err
+	}
+	if archive.Format != Format {
+		return nil, services.Validationf("not a family archive: format %q", archive.Format)
+	}
+	if archive.Version < MinVersion || archive.Version > Version {
+		return nil, services.Validationf("unsupported archive version %d, expected %d to %d", archive.Version, MinVersion, Version)
+	}
+	creators := transactionCreators(archive)
+
+	result := &ImportResult{}
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		family := &db.Family{Name: archive.Family.Name, CreatedAt: archive.Family.CreatedAt, UpdatedAt: archive.Family.UpdatedAt}
+		if err := tx.Create(family).Error; err != nil {
+			return err
+		}
+		result.FamilyID = family.ID
+
+		userIDs := make(map[uint64]uint64, len(archive.Users))
+		for _, u := range archive.Users {
+			user := &db.User{
+				FamilyID: family.ID, Role: u.Role, DisplayName: u.DisplayName, WechatOpenID: db.OptionalString(u.WechatOpenID),
+				IsActive: u.IsActive, ArchivedAt: u.ArchivedAt, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt,
+			}
+			if opts.ClearOpenIDs {
+				user.WechatOpenID = ""
+			}
+			if err := tx.Create(user).Error; err != nil {
+				if errors.Is(err, gorm.ErrDuplicatedKey) {
+					return services.Conflictf("user %q has an openid already used on this instance", u.DisplayName).
+						WithDetails(map[string]interface{}{"user_id": u.ID})
+				}
+				return err
+			}
+			// GORM writes the column default for a false is_active on create.
+			if !u.IsActive {
+				if err := tx.Model(user).UpdateColumn("is_active", false).Error; err != nil {
+					return err
+				}
+			}
+			userIDs[u.ID] = user.ID
+		}
+		result.Users = len(userIDs)
+
+		rewardTypeIDs := make(map[uint64]uint64, len(archive.RewardTypes))
+		for _, rt := range archive.RewardTypes {
+			rewardType := &db.RewardType{
+				FamilyID: family.ID, Name: rt.Name, UnitKind: rt.UnitKind, UnitLabel: rt.UnitLabel, Currency: rt.Currency,
+				Scale: rt.Scale, MaxValue: rt.MaxValue, CreatedAt: rt.CreatedAt, UpdatedAt: rt.UpdatedAt,
+				LowBalanceThreshold: rt.LowBalanceThreshold, ChildrenMaySpend: rt.ChildrenMaySpend,
+			}
+			if err := services.ValidateRewardType(rewardType); err != nil {
+				return err
+			}
+			if err := tx.Create(rewardType).Error; err != nil {
+				return err
+			}
+			rewardTypeIDs[rt.ID] = rewardType.ID
+		}
+		result.RewardTypes = len(rewardTypeIDs)
+
+		accountIDs := make(map[uint64]uint64, len(archive.Accounts))
+		archivedAccounts := make(map[uint64]uint64, len(archive.Accounts))
+		for _, a := range archive.Accounts {
+			childID, ok := userIDs[a.ChildID]
+			if !ok {
+				return invalidReference("account", a.ID, "child", a.ChildID)
+			}
+			rewardTypeID, ok := rewardTypeIDs[a.RewardTypeID]
+			if !ok {
+				return invalidReference("account", a.ID, "reward type", a.RewardTypeID)
+			}
+			account := &db.Account{
+				FamilyID: family.ID, ChildID: childID, RewardTypeID: rewardTypeID, Balance: a.Balance,
+				CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt,
+			}
+			if err := tx.Create(account).Error; err != nil {
+				return err
+			}
+			accountIDs[a.ID] = account.ID
+			archivedAccounts[account.ID] = a.ID
+		}
+		result.Accounts = len(accountIDs)
+
+		// Archives do not keep the balance after each transaction; it is
+		// replayed from the ledger in archive order, which is id order.
+		balances := map[uint64]int64{}
+		for _, t := range archive.Transactions {
+			accountID, ok := accountIDs[t.AccountID]
+			if !ok {
+				return invalidReference("transaction", t.ID, "account", t.AccountID)
+			}
+			if t.Type == "debit" {
+				balances[accountID] -= t.Value
+			} else {
+				balances[accountID] += t.Value
+			}
+			transaction := &db.Transaction{
+				AccountID: accountID, Type: t.Type, Value: t.Value, BalanceAfter: balances[accountID], Note: t.Note, CreatedAt: t.CreatedAt,
+			}
+			if creators != nil {
+				t.CreatedBy = creators[t.ID]
+			}
+			if t.CreatedBy != 0 {
+				createdBy, ok := userIDs[t.CreatedBy]
+				if !ok {
+					return invalidReference("transaction", t.ID, "user", t.CreatedBy)
+				}
+				transaction.CreatedBy = &createdBy
+			}
+			if err := tx.Omit(clause.Associations).Create(transaction).Error; err != nil {
+				return err
+			}
+			result.Transactions++
+		}
+
+		// The restored logs start a new chain: their hashes covered the ids of
+		// the exported family and are recomputed in archive order.
+		repo := storage.NewGorm(tx)
+		for _, l := range archive.AuditLogs {
+			auditLog := &db.AuditLog{FamilyID: &family.ID, Action: l.Action, Payload: l.Payload, CreatedAt: l.CreatedAt}
+			if l.UserID != 0 {
+				userID, ok := userIDs[l.UserID]
+				if !ok {
+					return invalidReference("audit log", l.ID, "user", l.UserID)
+				}
+				auditLog.UserID = &userID
+			}
+			if err := services.AppendAuditLog(ctx, repo, auditLog); err != nil {
+				return err
+			}
+			result.AuditLogs++
+		}
+
+		if err := verifyBalances(tx, family.ID, archivedAccounts); err != nil {
+			return err
+		}
+		auditLog, err := services.NewAuditLog(ctx, family.ID, services.ActionFamilyImported, nil, map[string]interface{}{
+			"exported_at": archive.ExportedAt, "records": result,
+		})
+		if err != nil {
+			return err
+		}
+		return services.AppendAuditLog(ctx, repo, auditLog)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// transactionCreators recovers who made each transaction of a version 1
+// archive, whose created_by is only the child placeholder, from the user of
+// its grant or spend audit log, like migration 013 does for a database.
+// Transactions without one get no creator. It returns nil for current
+// archives, whose created_by is already right.
+func transactionCreators(archive *Archive) map[uint64]uint64 {
+	if archive.Version >= 2 {
+		return nil
+	}
+	creators := make(map[uint64]uint64)
+	for _, l := range archive.AuditLogs {
+		if l.UserID == 0 || (l.Action != services.ActionRewardGranted && l.Action != services.ActionRewardSpent) {
+			continue
+		}
+		var payload struct {
+			After struct {
+				TransactionID uint64 `json:"transaction_id"`
+			} `json:"after"`
+		}
+		if json.Unmarshal([]byte(l.Payload), &payload) == nil && payload.After.TransactionID != 0 {
+			creators[payload.After.TransactionID] = l.UserID
+		}
+	}
+	return creators
+}
+
+func invalidReference(record string, id uint64, target string, targetID uint64) error {
+	return services.Validationf("archive %s %d refers to unknown %s %d", record, id, target, targetID).
+		WithDetails(map[string]interface{}{"record": record, "id": id, "reference": target, "reference_id": targetID})
+}
+
+// verifyBalances checks every account of the family against the sum of its
+// credits minus its debits. Mismatches are reported by their archive ids,
+// which archivedAccounts maps the new ids back to.
+func verifyBalances(tx *gorm.DB, familyID uint64, archivedAccounts map[uint64]uint64) error {
+	var rows []struct {
+		AccountID uint64
+		Balance   int64
+		Ledger    int64
+	}
+	err := tx.Table("accounts").
+		Select("accounts.id AS account_id, accounts.balance AS balance, "+
+			"COALESCE(SUM(CASE WHEN transactions.type = 'credit' THEN transactions.value ELSE -transactions.value END), 0) AS ledger").
+		Joins("LEFT JOIN transactions ON transactions.account_id = accounts.id").
+		Where("accounts.family_id = ?", familyID).
+		Group("accounts.id, accounts.balance").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	var mismatches []map[string]interface{}
+	for _, row := range rows {
+		if row.Balance != row.Ledger {
+			mismatches = append(mismatches, map[string]interface{}{"account_id": archivedAccounts[row.AccountID], "balance": row.Balance, "ledger": row.Ledger})
+		}
+	}
+	if len(mismatches) > 0 {
+		return services.Validationf("%d account balances do not match their transactions", len(mismatches)).
+			WithDetails(map[string]interface{}{"accounts": mismatches})
+	}
+	return nil
+}
+
+// Summary describes an archive in one line, for logs and the CLI.
+func (a *Archive) Summary() string {
+	return fmt.Sprintf("family %q: %d users, %d reward types, %d accounts, %d transactions, %d audit logs",
+		a.Family.Name, len(a.Users), len(a.RewardTypes), len(a.Accounts), len(a.Transactions), len(a.AuditLogs))
+}
+
+func derefID(id *uint64) uint64 {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
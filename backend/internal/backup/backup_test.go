@@ -0,0 +1,254 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"reward-system/internal/auditchain"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+// createFamily builds a family with a guardian, an active and an inactive
+// child, two reward types and a few ledger entries.
+func createFamily(t *testing.T, database *gorm.DB) uint64 {
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	service := services.NewRewardService(database)
+
+	// A family exported from the middle of the id space.
+	database.Create(&db.Family{Name: "Other Family"})
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Dad", WechatOpenID: "openid-dad", IsActive: true}
+	database.Create(guardian)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid", IsActive: true}
+	database.Create(child)
+	former := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Former", IsActive: true}
+	database.Create(former)
+
+	money := &db.RewardType{FamilyID: family.ID, Name: "Pocket Money", UnitKind: "money", Scale: 2, MaxValue: 5000}
+	stars := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "custom", UnitLabel: "stars"}
+	for _, rewardType := range []*db.RewardType{money, stars} {
+		if err := service.CreateRewardType(ctx, rewardType); err != nil {
+			t.Fatalf("Failed to create reward type: %v", err)
+		}
+	}
+	for _, grant := range []struct {
+		child, rewardType uint64
+		value             int64
+	}{{child.ID, money.ID, 1250}, {child.ID, stars.ID, 3}, {former.ID, stars.ID, 1}} {
+		if _, err := service.GrantReward(ctx, family.ID, grant.child, grant.rewardType, grant.value, "good job", ""); err != nil {
+			t.Fatalf("Failed to grant: %v", err)
+		}
+	}
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, money.ID, 250, "snack", "key-1"); err != nil {
+		t.Fatalf("Failed to spend: %v", err)
+	}
+	if _, err := service.ArchiveUser(ctx, former.ID); err != nil {
+		t.Fatalf("Failed to archive: %v", err)
+	}
+	database.Create(&db.AuditLog{FamilyID: &family.ID, UserID: &guardian.ID, Action: "grant", Payload: `{"value":1250}`})
+	return family.ID
+}
+
+func TestExportImport(t *testing.T) {
+	source := setupTestDB(t)
+	familyID := createFamily(t, source)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+
+	archive, err := Export(ctx, source, familyID)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(archive.Users) != 3 || len(archive.RewardTypes) != 2 || len(archive.Accounts) != 3 || len(archive.Transactions) != 4 || len(archive.AuditLogs) != 8 {
+		t.Fatalf("Unexpected archive: %s", archive.Summary())
+	}
+
+	// The archive survives a trip through JSON.
+	encoded, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatalf("Failed to encode archive: %v", err)
+	}
+	var decoded Archive
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Failed to decode archive: %v", err)
+	}
+
+	target := setupTestDB(t)
+	result, err := Import(ctx, target, &decoded, ImportOptions{})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if result.Users != 3 || result.RewardTypes != 2 || result.Accounts != 3 || result.Transactions != 4 || result.AuditLogs != 8 {
+		t.Errorf("Unexpected import result %+v", result)
+	}
+
+	restored, err := Export(ctx, target, result.FamilyID)
+	if err != nil {
+		t.Fatalf("Export of the restored family: %v", err)
+	}
+	if restored.Family.Name != "Test Family" || restored.Users[0].WechatOpenID != "openid-dad" || restored.Users[2].IsActive || restored.Users[2].ArchivedAt == nil {
+		t.Errorf("Users not restored faithfully: %+v", restored.Users)
+	}
+	if restored.RewardTypes[0].Currency != "CNY" || restored.RewardTypes[0].MaxValue != 5000 {
+		t.Errorf("Reward types not restored faithfully: %+v", restored.RewardTypes)
+	}
+	if restored.Accounts[0].Balance != 1000 || restored.Accounts[0].ChildID != restored.Users[1].ID {
+		t.Errorf("Accounts not remapped: %+v", restored.Accounts)
+	}
+	if !restored.Transactions[0].CreatedAt.Equal(archive.Transactions[0].CreatedAt) {
+		t.Errorf("Expected transaction times to be kept, got %s", restored.Transactions[0].CreatedAt)
+	}
+	// The balance after each transaction is replayed from the ledger.
+	var spend db.Transaction
+	target.Where("type = ?", "debit").First(&spend)
+	if spend.BalanceAfter != 1000 {
+		t.Errorf("Expected the spend to have left a balance of 1000, got %d", spend.BalanceAfter)
+	}
+	// The seven changes above, the hand-written log and the import itself.
+	if n := len(restored.AuditLogs); n != 9 || restored.AuditLogs[n-1].Action != services.ActionFamilyImported {
+		t.Fatalf("Expected the restored logs and the import to be audited: %+v", restored.AuditLogs)
+	}
+	if restored.AuditLogs[7].UserID != restored.Users[0].ID || restored.AuditLogs[7].Payload != `{"value":1250}` {
+		t.Errorf("Audit logs not remapped: %+v", restored.AuditLogs)
+	}
+	// The restored logs are chained anew, in their archived order.
+	if reports, err := auditchain.Verify(ctx, target, result.FamilyID); err != nil || len(reports) != 1 || !reports[0].OK() || reports[0].Entries != 9 {
+		t.Errorf("Expected the restored chain to verify, got %+v, %v", reports, err)
+	}
+
+	// The restored ledger keeps working.
+	service := services.NewRewardService(target)
+	if balance, err := service.GetBalance(ctx, result.FamilyID, restored.Users[1].ID, restored.RewardTypes[0].ID); err != nil || balance.Balance != 1000 {
+		t.Errorf("Expected a balance of 1000 after import, got %+v, %v", balance, err)
+	}
+}
+
+func TestImport_Version1(t *testing.T) {
+	database := setupTestDB(t)
+	familyID := createFamily(t, database)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	archive, _ := Export(ctx, database, familyID)
+
+	// A version 1 archive names the child as every transaction's creator;
+	// the first grant's audit log says the guardian made it.
+	legacy := *archive
+	legacy.Version = 1
+	accounts := make(map[uint64]uint64)
+	for _, a := range archive.Accounts {
+		accounts[a.ID] = a.ChildID
+	}
+	legacy.Transactions = append([]Transaction(nil), archive.Transactions...)
+	for i := range legacy.Transactions {
+		legacy.Transactions[i].CreatedBy = accounts[legacy.Transactions[i].AccountID]
+	}
+	legacy.AuditLogs = append([]AuditLog(nil), archive.AuditLogs...)
+	for i, l := range legacy.AuditLogs {
+		if l.Action == services.ActionRewardGranted {
+			legacy.AuditLogs[i].UserID = archive.Users[0].ID
+			break
+		}
+	}
+
+	result, err := Import(ctx, database, &legacy, ImportOptions{ClearOpenIDs: true})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	restored, _ := Export(ctx, database, result.FamilyID)
+	for i, transaction := range restored.Transactions {
+		want := uint64(0)
+		if i == 0 {
+			want = restored.Users[0].ID
+		}
+		if transaction.CreatedBy != want {
+			t.Errorf("Transaction %d: expected created by %d, got %d", i, want, transaction.CreatedBy)
+		}
+	}
+	if restored.Version != Version {
+		t.Errorf("Expected exports at version %d, got %d", Version, restored.Version)
+	}
+}
+
+func TestImport_Conflicts(t *testing.T) {
+	database := setupTestDB(t)
+	familyID := createFamily(t, database)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	archive, _ := Export(ctx, database, familyID)
+
+	var families int64
+	if _, err := Import(ctx, database, archive, ImportOptions{}); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("Expected a conflict on the guardian's openid, got %v", err)
+	}
+	database.Model(&db.Family{}).Count(&families)
+	if families != 2 {
+		t.Errorf("Expected the failed import to be rolled back, got %d families", families)
+	}
+
+	result, err := Import(ctx, database, archive, ImportOptions{ClearOpenIDs: true})
+	if err != nil {
+		t.Fatalf("Expected the copy without openids to import, got %v", err)
+	}
+	var copied db.User
+	database.Where("family_id = ? AND role = ?", result.FamilyID, "guardian").First(&copied)
+	if copied.WechatOpenID != "" {
+		t.Errorf("Expected the openid to be cleared, got %q", copied.WechatOpenID)
+	}
+}
+
+func TestImport_Invalid(t *testing.T) {
+	database := setupTestDB(t)
+	familyID := createFamily(t, database)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	archive, _ := Export(ctx, database, familyID)
+	target := setupTestDB(t)
+
+	tampered := *archive
+	tampered.Accounts = append([]Account(nil), archive.Accounts...)
+	tampered.Accounts[0].Balance += 100
+	_, err := Import(ctx, target, &tampered, ImportOptions{})
+	var svcErr *services.Error
+	if !errors.As(err, &svcErr) || svcErr.Kind != services.KindValidation {
+		t.Fatalf("Expected a validation error for a balance off its ledger, got %v", err)
+	}
+	mismatch := svcErr.Details["accounts"].([]map[string]interface{})[0]
+	if mismatch["account_id"] != archive.Accounts[0].ID || mismatch["ledger"] != int64(1000) {
+		t.Errorf("Expected the mismatch by archive id, got %+v", mismatch)
+	}
+	var families int64
+	target.Model(&db.Family{}).Count(&families)
+	if families != 0 {
+		t.Errorf("Expected nothing to be written, got %d families", families)
+	}
+
+	broken := *archive
+	broken.Transactions = append([]Transaction(nil), archive.Transactions...)
+	broken.Transactions[0].AccountID = 999
+	if _, err := Import(ctx, target, &broken, ImportOptions{}); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for a dangling reference, got %v", err)
+	}
+
+	future := *archive
+	future.Version = Version + 1
+	if _, err := Import(ctx, target, &future, ImportOptions{}); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for an unknown version, got %v", err)
+	}
+	if _, err := Export(ctx, target, 42); !errors.Is(err, services.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing family, got %v", err)
+	}
+}
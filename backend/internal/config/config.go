@@ -1,9 +1,56 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MinSecretLength is the shortest JWT_SECRET or API_TOKEN the server starts
+// with, so that neither can be guessed.
+const MinSecretLength = 32
+
 type Config struct {
-	DBDSN      string
-	WechatToken string
-	APIToken   string
-	MCPURL     string
-	Port       string
-}
\ No newline at end of file
+	DBDSN          string
+	WechatToken    string
+	APIToken       string // optional shared token for development and scripts
+	JWTSecret      string // signs access tokens
+	StreamSecret   string // signs stream tokens; random for each run of the server unless set
+	MCPURL         string
+	Port           string
+	IdempotencyTTL time.Duration
+
+	// WebhookAllowedNets are the non-public addresses webhooks may be
+	// delivered to, such as the LAN of a self-hosted Home Assistant.
+	WebhookAllowedNets []*net.IPNet
+
+	// Notification channels; WeChat and email are off unless configured.
+	WechatAppID     string
+	WechatAppSecret string
+	WechatAPIURL    string
+	SMTPAddr        string
+	SMTPFrom        string
+	SMTPUsername    string
+	SMTPPassword    string
+}
+
+// Validate refuses a configuration the server must not start with: a
+// missing or short JWT_SECRET or STREAM_SECRET, or a short API_TOKEN. The
+// shared token is optional, but one that can be guessed, such as a
+// placeholder copied from an example, would make anyone the operator.
+func (c *Config) Validate() error {
+	if c.JWTSecret == "" {
+		return errors.New("JWT_SECRET is not set")
+	}
+	if len(c.JWTSecret) < MinSecretLength {
+		return fmt.Errorf("JWT_SECRET must be at least %d characters", MinSecretLength)
+	}
+	if len(c.StreamSecret) < MinSecretLength {
+		return fmt.Errorf("STREAM_SECRET must be at least %d characters", MinSecretLength)
+	}
+	if c.APIToken != "" && len(c.APIToken) < MinSecretLength {
+		return fmt.Errorf("API_TOKEN must be at least %d characters, or left empty", MinSecretLength)
+	}
+	return nil
+}
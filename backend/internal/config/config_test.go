@@ -0,0 +1,27 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	secret := strings.Repeat("s", MinSecretLength)
+	for _, tc := range []struct {
+		name      string
+		jwtSecret string
+		apiToken  string
+		valid     bool
+	}{
+		{"secret only", secret, "", true},
+		{"secret and token", secret, strings.Repeat("t", MinSecretLength), true},
+		{"missing secret", "", "", false},
+		{"short secret", "your_jwt_secret", "", false},
+		{"demo token", secret, "demo-token", false},
+	} {
+		cfg := &Config{JWTSecret: tc.jwtSecret, StreamSecret: secret, APIToken: tc.apiToken}
+		if err := cfg.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestDialector(t *testing.T) {
+	cases := map[string]string{
+		"": "mysql",
+		"root:@tcp(localhost:3306)/reward_system":   "mysql",
+		"mysql://root:@tcp(db:3306)/kudo":           "mysql",
+		"postgres://kudo:secret@db:5432/kudo":       "postgres",
+		"postgresql://kudo@db/kudo?sslmode=disable": "postgres",
+		"sqlite://:memory:":                         "sqlite",
+		"sqlite3://:memory:":                        "sqlite",
+	}
+	for dsn, want := range cases {
+		dialector, err := Dialector(dsn)
+		if err != nil {
+			t.Errorf("Dialector(%q) returned error: %v", dsn, err)
+			continue
+		}
+		if got := dialector.Name(); got != want {
+			t.Errorf("Dialector(%q) = %s, want %s", dsn, got, want)
+		}
+	}
+
+	if _, err := Dialector("oracle://scott@tiger"); err == nil {
+		t.Error("Expected an error for an unsupported scheme")
+	}
+}
+
+func TestInitDB_SQLiteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "kudo.db")
+	database, err := InitDB("sqlite://" + path)
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	if err := Migrate(context.Background(), database); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	family := &Family{Name: "Test Family"}
+	if err := database.Create(family).Error; err != nil {
+		t.Fatalf("Failed to create family: %v", err)
+	}
+	// Users without an openid must not collide on the unique index.
+	for _, name := range []string{"小明", "小红"} {
+		if err := database.Create(&User{FamilyID: family.ID, Role: "child", DisplayName: name, IsActive: true}).Error; err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	if err := database.Create(&User{FamilyID: family.ID, Role: "parent", DisplayName: "X"}).Error; err == nil {
+		t.Error("Expected the role check constraint to reject an unknown role")
+	}
+
+	var user User
+	if err := database.Where("display_name = ?", "小明").First(&user).Error; err != nil || user.WechatOpenID != "" {
+		t.Errorf("Expected an unset openid to read back empty, got %q, %v", user.WechatOpenID, err)
+	}
+}
+
+func TestMigrate_SQLite(t *testing.T) {
+	ctx := context.Background()
+	database, err := InitDB("sqlite://" + filepath.Join(t.TempDir(), "kudo.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	if err := Migrate(ctx, database); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	assertSchema(t, database)
+
+	// A second run has nothing to do.
+	if err := Migrate(ctx, database); err != nil {
+		t.Fatalf("Second Migrate: %v", err)
+	}
+}
+
+func TestMigrate_SQLiteCreatedFromModels(t *testing.T) {
+	ctx := context.Background()
+	database, err := InitDB("sqlite://" + filepath.Join(t.TempDir(), "kudo.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	// As the server used to create SQLite databases, minus a later column.
+	if err := database.AutoMigrate(Models()...); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+	if err := database.Migrator().DropColumn(&RewardType{}, "ChildrenMaySpend"); err != nil {
+		t.Fatalf("DropColumn: %v", err)
+	}
+	// Nor did it record the balance after each transaction.
+	if err := database.Migrator().DropColumn(&Transaction{}, "BalanceAfter"); err != nil {
+		t.Fatalf("DropColumn: %v", err)
+	}
+	family := &Family{Name: "Test Family"}
+	database.Create(family)
+	child := &User{FamilyID: family.ID, Role: "child", DisplayName: "Kid"}
+	database.Create(child)
+	rewardType := &RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+	account := &Account{FamilyID: family.ID, ChildID: child.ID, RewardTypeID: rewardType.ID, Balance: 3}
+	database.Create(account)
+	for _, entry := range []struct {
+		kind  string
+		value int64
+	}{{"credit", 5}, {"debit", 2}} {
+		database.Exec("INSERT INTO transactions (account_id, type, value) VALUES (?, ?, ?)", account.ID, entry.kind, entry.value)
+	}
+
+	if err := Migrate(ctx, database); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	assertSchema(t, database)
+	var kept Family
+	if err := database.First(&kept, family.ID).Error; err != nil || kept.Name != "Test Family" {
+		t.Errorf("Expected the existing data to be kept, got %+v, %v", kept, err)
+	}
+	var transactions []Transaction
+	database.Order("id ASC").Find(&transactions)
+	if len(transactions) != 2 || transactions[0].BalanceAfter != 5 || transactions[1].BalanceAfter != 3 {
+		t.Errorf("Expected the balances after the transactions to be filled in, got %+v", transactions)
+	}
+}
+
+// assertSchema checks that the migrated database records its version, has
+// a column for every field of every model and has the views.
+func assertSchema(t *testing.T, database *gorm.DB) {
+	t.Helper()
+	var versions []string
+	database.Table("schema_migrations").Order("version").Pluck("version", &versions)
+	if len(versions) == 0 || versions[0] != "015_baseline" {
+		t.Errorf("Expected schema_migrations to start with the baseline, got %v", versions)
+	}
+	migrator := database.Migrator()
+	for _, model := range Models() {
+		stmt := &gorm.Statement{DB: database}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("Failed to parse %T: %v", model, err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" || field.IgnoreMigration {
+				continue
+			}
+			if !migrator.HasColumn(model, field.DBName) {
+				t.Errorf("Table %s has no column %s", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+	for _, view := range []string{"account_balances", "transaction_history"} {
+		var n int64
+		if err := database.Table(view).Count(&n).Error; err != nil {
+			t.Errorf("Expected the %s view: %v", view, err)
+		}
+	}
+}
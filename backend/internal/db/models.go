@@ -1,6 +1,8 @@
 package db
 
 import (
+	"database/sql/driver"
+	"fmt"
 	"time"
 )
 
@@ -11,63 +13,252 @@ type Family struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// User is a guardian or child. Users are never deleted: a deactivated user
+// has IsActive false, and an archived one additionally has ArchivedAt set
+// and is left out of user listings. The ledger of either is frozen.
+// Username and the bcrypt PasswordHash are the user's login credentials;
+// users without them cannot log in.
 type User struct {
-	ID           uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
-	FamilyID     uint64    `gorm:"not null;index" json:"family_id"`
-	Role         string    `gorm:"type:enum('guardian','child');not null" json:"role"`
-	DisplayName  string    `gorm:"size:64;not null" json:"display_name"`
-	WechatOpenID string    `gorm:"size:128;uniqueIndex" json:"wechat_openid,omitempty"`
-	IsActive     bool      `gorm:"default:true" json:"is_active"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	
+	ID           uint64         `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID     uint64         `gorm:"not null;index" json:"family_id"`
+	Role         string         `gorm:"size:16;not null;check:role IN ('guardian','child')" json:"role"`
+	DisplayName  string         `gorm:"size:64;not null" json:"display_name"`
+	WechatOpenID OptionalString `gorm:"column:wechat_openid;size:128;uniqueIndex" json:"wechat_openid,omitempty"`
+	Username     OptionalString `gorm:"size:64;uniqueIndex" json:"username,omitempty"`
+	PasswordHash string         `gorm:"size:255;not null;default:''" json:"-"`
+	IsActive     bool           `gorm:"default:true" json:"is_active"`
+	ArchivedAt   *time.Time     `gorm:"index" json:"archived_at,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+
 	Family Family `gorm:"foreignKey:FamilyID" json:"family,omitempty"`
 }
 
 type RewardType struct {
-    ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
-    FamilyID  uint64    `gorm:"not null;uniqueIndex:uniq_family_name" json:"family_id"`
-    Name      string    `gorm:"size:64;not null;uniqueIndex:uniq_family_name" json:"name"`
-    UnitKind  string    `gorm:"type:enum('money','time','points','custom');not null" json:"unit_kind"`
-    UnitLabel string    `gorm:"size:32" json:"unit_label,omitempty"`
-    CreatedAt time.Time `json:"created_at"`
-    UpdatedAt time.Time `json:"updated_at"`
-    
-    Family Family `gorm:"foreignKey:FamilyID" json:"family,omitempty"`
+	ID                  uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID            uint64    `gorm:"not null;uniqueIndex:uniq_family_name" json:"family_id"`
+	Name                string    `gorm:"size:64;not null;uniqueIndex:uniq_family_name" json:"name"`
+	UnitKind            string    `gorm:"size:16;not null;check:unit_kind IN ('money','time','points','custom')" json:"unit_kind"`
+	UnitLabel           string    `gorm:"size:32" json:"unit_label,omitempty"`
+	Currency            string    `gorm:"size:3" json:"currency,omitempty"`                 // ISO 4217 code, money only
+	Scale               int       `gorm:"not null;default:0" json:"scale"`                  // decimal places: a value of 125 at scale 2 is 1.25
+	MaxValue            int64     `gorm:"not null;default:0" json:"max_value"`              // per-transaction limit in base units, 0 = unlimited
+	LowBalanceThreshold int64     `gorm:"not null;default:0" json:"low_balance_threshold"`  // a spend leaving less is notified, 0 = never
+	ChildrenMaySpend    bool      `gorm:"not null;default:false" json:"children_may_spend"` // children may spend their own balance
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+
+	Family Family `gorm:"foreignKey:FamilyID" json:"family,omitempty"`
 }
 
 type Account struct {
-    ID           uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
-    FamilyID     uint64    `gorm:"not null;index" json:"family_id"`
-    ChildID      uint64    `gorm:"not null;uniqueIndex:uniq_acc" json:"child_id"`
-    RewardTypeID uint64    `gorm:"not null;uniqueIndex:uniq_acc" json:"reward_type_id"`
-    Balance      int64     `gorm:"default:0;not null" json:"balance"`
-    CreatedAt    time.Time `json:"created_at"`
-    UpdatedAt    time.Time `json:"updated_at"`
-    
-    Child      User       `gorm:"foreignKey:ChildID" json:"child,omitempty"`
-    RewardType RewardType `gorm:"foreignKey:RewardTypeID" json:"reward_type,omitempty"`
+	ID           uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID     uint64    `gorm:"not null;index" json:"family_id"`
+	ChildID      uint64    `gorm:"not null;uniqueIndex:uniq_acc" json:"child_id"`
+	RewardTypeID uint64    `gorm:"not null;uniqueIndex:uniq_acc" json:"reward_type_id"`
+	Balance      int64     `gorm:"default:0;not null" json:"balance"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	Child      User       `gorm:"foreignKey:ChildID" json:"child,omitempty"`
+	RewardType RewardType `gorm:"foreignKey:RewardTypeID" json:"reward_type,omitempty"`
 }
 
 type Transaction struct {
-	ID              uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
-	AccountID       uint64    `gorm:"not null;index" json:"account_id"`
-	Type            string    `gorm:"type:enum('credit','debit');not null" json:"type"`
-	Value           int64     `gorm:"not null" json:"value"`
-	Note            string    `gorm:"size:255" json:"note,omitempty"`
-	CreatedBy       uint64    `gorm:"not null;index" json:"created_by"`
-	IdempotencyKey  string    `gorm:"size:64;index" json:"idempotency_key,omitempty"`
-	CreatedAt       time.Time `json:"created_at"`
-	
-	Account   Account `gorm:"foreignKey:AccountID" json:"account,omitempty"`
-	Creator   User    `gorm:"foreignKey:CreatedBy" json:"creator,omitempty"`
+	ID             uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	AccountID      uint64    `gorm:"not null;index" json:"account_id"`
+	Type           string    `gorm:"size:16;not null;check:type IN ('credit','debit')" json:"type"`
+	Value          int64     `gorm:"not null" json:"value"`
+	BalanceAfter   int64     `gorm:"not null;default:0" json:"balance_after"` // the account's balance right after the transaction was made
+	Note           string    `gorm:"size:255" json:"note,omitempty"`
+	CreatedBy      *uint64   `gorm:"index" json:"created_by"` // the acting user, nil for the API token or the command line
+	IdempotencyKey string    `gorm:"size:64;index" json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	Account Account `gorm:"foreignKey:AccountID" json:"account,omitempty"`
+	Creator *User   `gorm:"foreignKey:CreatedBy" json:"-"`
 }
 
+// AuditLog records an action. FamilyID and UserID are nil for actions that
+// outlive the family or user, such as the tombstone of a deleted family.
+// The logs of each family form a hash chain: Hash covers the entry and
+// PrevHash, the Hash of the family's previous entry, see auditchain.Hash.
 type AuditLog struct {
 	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
-	FamilyID  uint64    `gorm:"index" json:"family_id"`
-	UserID    uint64    `gorm:"index" json:"user_id"`
+	FamilyID  *uint64   `gorm:"index" json:"family_id"`
+	UserID    *uint64   `gorm:"index" json:"user_id"`
 	Action    string    `gorm:"size:32;not null" json:"action"`
 	Payload   string    `gorm:"type:json" json:"payload,omitempty"`
+	PrevHash  string    `gorm:"size:64" json:"prev_hash,omitempty"`
+	Hash      string    `gorm:"size:64" json:"hash,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
-}
\ No newline at end of file
+}
+
+// AuditChain is the head of a family's audit log hash chain: the number of
+// chained entries and the hash of the latest. FamilyID 0 holds the chain of
+// the logs without a family. Appending locks the head, so concurrent changes
+// never fork the chain, and comparing it with the logs reveals entries
+// removed from the end.
+type AuditChain struct {
+	FamilyID  uint64    `gorm:"primaryKey;autoIncrement:false" json:"family_id"`
+	Length    int64     `gorm:"not null;default:0" json:"length"`
+	Head      string    `gorm:"size:64;not null" json:"head"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OutboxEvent is a domain event written in the transaction of the change it
+// describes, so an event exists exactly when its change committed. The
+// webhook dispatcher fans it out to the family's webhooks and then sets
+// DispatchedAt; the notifier tells the family's users and sets NotifiedAt.
+type OutboxEvent struct {
+	ID           uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID     uint64     `gorm:"not null;index" json:"family_id"`
+	Type         string     `gorm:"size:32;not null" json:"type"`
+	Payload      string     `gorm:"type:json" json:"payload,omitempty"`
+	DispatchedAt *time.Time `gorm:"index" json:"dispatched_at,omitempty"`
+	NotifiedAt   *time.Time `gorm:"index" json:"notified_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Webhook is a URL that receives a family's events, signed with Secret.
+// Events is a comma-separated list of event types; empty means all.
+type Webhook struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID  uint64    `gorm:"not null;index" json:"family_id"`
+	URL       string    `gorm:"size:512;not null" json:"url"`
+	Secret    string    `gorm:"size:64;not null" json:"-"`
+	Events    string    `gorm:"size:255" json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one event on its way to one webhook. It is pending
+// until the webhook answers with a 2xx status, and dead once it has failed
+// too often to retry.
+type WebhookDelivery struct {
+	ID            uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	WebhookID     uint64     `gorm:"not null;uniqueIndex:uniq_webhook_event" json:"webhook_id"`
+	EventID       uint64     `gorm:"not null;uniqueIndex:uniq_webhook_event;index" json:"event_id"`
+	Status        string     `gorm:"size:16;not null;index:idx_status_next_attempt;check:status IN ('pending','delivered','dead')" json:"status"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"not null;index:idx_status_next_attempt" json:"next_attempt_at"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `gorm:"size:512" json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	Webhook Webhook     `gorm:"foreignKey:WebhookID" json:"-"`
+	Event   OutboxEvent `gorm:"foreignKey:EventID" json:"-"`
+}
+
+// NotificationPreference is what a user is told about and how. Channels is
+// a comma-separated list of notify channels; Email is the address of the
+// email channel. Users without one get notify.DefaultPreference.
+type NotificationPreference struct {
+	UserID     uint64    `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+	Grants     bool      `gorm:"not null" json:"grants"`
+	Spends     bool      `gorm:"not null" json:"spends"`
+	LowBalance bool      `gorm:"not null" json:"low_balance"`
+	Approvals  bool      `gorm:"not null" json:"approvals"`
+	Digests    bool      `gorm:"not null" json:"digests"`
+	Channels   string    `gorm:"size:64;not null" json:"channels"`
+	Email      string    `gorm:"size:254" json:"email,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// DigestSetting is when a family gets its digest: Frequency is off, daily or
+// weekly, Time the local "15:04" it is sent at in Timezone, and Weekday the
+// day of weekly digests, 0 for Sunday.
+type DigestSetting struct {
+	FamilyID  uint64    `gorm:"primaryKey;autoIncrement:false" json:"family_id"`
+	Frequency string    `gorm:"size:8;not null;check:frequency IN ('off','daily','weekly')" json:"frequency"`
+	Time      string    `gorm:"size:5;not null" json:"time"`
+	Weekday   int       `gorm:"not null" json:"weekday"`
+	Timezone  string    `gorm:"size:64;not null" json:"timezone"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DigestRun records a digest that was sent, so that each period's digest
+// goes out once. Period names the digest, e.g. "daily/2024-06-10T20:00".
+type DigestRun struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID  uint64    `gorm:"not null;uniqueIndex:uniq_family_period" json:"family_id"`
+	Period    string    `gorm:"size:32;not null;uniqueIndex:uniq_family_period" json:"period"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Session is a login of a user. The access tokens issued for it name the
+// session, so revoking it logs them out at once. Its refresh token is
+// stored only as a SHA-256 hash and replaced on every refresh.
+type Session struct {
+	ID               uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID           uint64     `gorm:"not null;index" json:"user_id"`
+	RefreshTokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt        time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// PurgeConfirmation is a confirmation of deleting a family, issued to the
+// guardian or operator (UserID nil) who asked for it. Its token is stored
+// only as a SHA-256 hash and expires; ConfirmedAt is set once the token was
+// sent back, after which it counts as that guardian's consent until
+// ExpiresAt.
+type PurgeConfirmation struct {
+	ID          uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	FamilyID    uint64     `gorm:"not null;index" json:"family_id"`
+	UserID      *uint64    `gorm:"index" json:"user_id"`
+	TokenHash   string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// IdempotencyRecord stores the response of a mutating request made with an
+// Idempotency-Key header so that retries replay it instead of re-executing.
+// A StatusCode of 0 marks a request that is still in flight. Keys are
+// unique per Principal, the caller that made the request.
+type IdempotencyRecord struct {
+	ID           uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Principal    string    `gorm:"size:64;not null;uniqueIndex:uniq_idempotency_key" json:"principal"`
+	Key          string    `gorm:"column:idempotency_key;size:128;not null;uniqueIndex:uniq_idempotency_key" json:"key"`
+	Method       string    `gorm:"size:8;not null" json:"method"`
+	Path         string    `gorm:"size:255;not null" json:"path"`
+	RequestHash  string    `gorm:"size:64;not null" json:"request_hash"`
+	StatusCode   int       `gorm:"not null;default:0" json:"status_code"`
+	ContentType  string    `gorm:"size:128" json:"content_type,omitempty"`
+	ResponseBody string    `gorm:"type:text" json:"response_body,omitempty"`
+	ExpiresAt    time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OptionalString is a string column that stores the empty string as NULL, so
+// that a unique index only applies to values that are actually set.
+type OptionalString string
+
+func (s OptionalString) Value() (driver.Value, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return string(s), nil
+}
+
+func (s *OptionalString) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = ""
+	case string:
+		*s = OptionalString(v)
+	case []byte:
+		*s = OptionalString(v)
+	default:
+		return fmt.Errorf("db: cannot scan %T into OptionalString", src)
+	}
+	return nil
+}
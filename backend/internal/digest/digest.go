@@ -0,0 +1,252 @@
+// Package digest sends each family a daily or weekly summary of what every
+// child earned, spent and now holds per reward type, at the time and in
+// the timezone the family chose. The digest goes to the guardians over
+// their notification channels, and each period's digest is sent once even
+// across restarts.
+//
+// The ledger has no expiring credits and no savings goals yet, so the
+// digest reports neither; it gains them when the domain does.
+package digest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones must resolve on hosts without a zoneinfo database
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+	"reward-system/internal/units"
+
+	"gorm.io/gorm"
+)
+
+// Frequencies.
+const (
+	Off    = "off"
+	Daily  = "daily"
+	Weekly = "weekly"
+)
+
+// ActionSettingUpdated is the audit log action of digest setting changes.
+const ActionSettingUpdated = "digest_setting.updated"
+
+// DefaultTimezone is the timezone of families that did not choose one.
+const DefaultTimezone = "Asia/Shanghai"
+
+// DefaultSetting is the setting of a family that never chose one: no
+// digest, or if turned on, at 20:00 in DefaultTimezone, weekly on Sunday.
+func DefaultSetting(familyID uint64) *db.DigestSetting {
+	return &db.DigestSetting{FamilyID: familyID, Frequency: Off, Time: "20:00", Weekday: int(time.Sunday), Timezone: DefaultTimezone}
+}
+
+// GetSetting returns the family's digest setting, or the default. Only
+// guardians manage the setting.
+func GetSetting(ctx context.Context, database *gorm.DB, familyID uint64) (*db.DigestSetting, error) {
+	if err := services.AuthorizeGuardian(ctx, familyID); err != nil {
+		return nil, err
+	}
+	if err := database.WithContext(ctx).First(&db.Family{}, familyID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, services.NotFoundf("family %d not found", familyID)
+		}
+		return nil, err
+	}
+	return settingOf(ctx, database, familyID)
+}
+
+func settingOf(ctx context.Context, database *gorm.DB, familyID uint64) (*db.DigestSetting, error) {
+	var setting db.DigestSetting
+	err := database.WithContext(ctx).Where("family_id = ?", familyID).Take(&setting).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return DefaultSetting(familyID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+// SetSetting validates and saves the family's digest setting.
+func SetSetting(ctx context.Context, database *gorm.DB, setting *db.DigestSetting) error {
+	if err := Validate(setting); err != nil {
+		return err
+	}
+	return database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		before, err := GetSetting(ctx, tx, setting.FamilyID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Save(setting).Error; err != nil {
+			return err
+		}
+		auditLog, err := services.NewAuditLog(ctx, setting.FamilyID, ActionSettingUpdated, before, setting)
+		if err != nil {
+			return err
+		}
+		return services.AppendAuditLog(ctx, storage.NewGorm(tx), auditLog)
+	})
+}
+
+// Validate checks the frequency, time, weekday and timezone of a setting.
+func Validate(setting *db.DigestSetting) error {
+	switch setting.Frequency {
+	case Off, Daily, Weekly:
+	default:
+		return services.Validationf("frequency must be one of %s, %s or %s", Off, Daily, Weekly)
+	}
+	if _, err := time.Parse("15:04", setting.Time); err != nil || len(setting.Time) != 5 {
+		return services.Validationf("time must be a local time such as 20:00").WithDetails(map[string]interface{}{"time": setting.Time})
+	}
+	if setting.Weekday < 0 || setting.Weekday > 6 {
+		return services.Validationf("weekday must be between 0 (Sunday) and 6 (Saturday)").WithDetails(map[string]interface{}{"weekday": setting.Weekday})
+	}
+	if _, err := time.LoadLocation(setting.Timezone); err != nil || setting.Timezone == "" || setting.Timezone == "Local" {
+		return services.Validationf("unknown timezone %q", setting.Timezone)
+	}
+	return nil
+}
+
+// Latest returns the period of the most recent digest due at or before
+// now: it ends at the setting's time on the last matching day and covers
+// the day or week before. ok is false when digests are off.
+func Latest(setting *db.DigestSetting, now time.Time) (from, to time.Time, ok bool) {
+	if setting.Frequency != Daily && setting.Frequency != Weekly {
+		return time.Time{}, time.Time{}, false
+	}
+	location, err := time.LoadLocation(setting.Timezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	at, err := time.Parse("15:04", setting.Time)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	local := now.In(location)
+	to = time.Date(local.Year(), local.Month(), local.Day(), at.Hour(), at.Minute(), 0, 0, location)
+	if to.After(local) {
+		to = to.AddDate(0, 0, -1)
+	}
+	if setting.Frequency == Daily {
+		return to.AddDate(0, 0, -1), to, true
+	}
+	for int(to.Weekday()) != setting.Weekday {
+		to = to.AddDate(0, 0, -1)
+	}
+	return to.AddDate(0, 0, -7), to, true
+}
+
+// Period names the digest of a setting ending at to, e.g.
+// "daily/2024-06-10T20:00" in the family's local time.
+func Period(setting *db.DigestSetting, to time.Time) string {
+	return setting.Frequency + "/" + to.Format("2006-01-02T15:04")
+}
+
+// Digest is what happened in a family in [From, To).
+type Digest struct {
+	FamilyName string
+	Frequency  string
+	From, To   time.Time
+	Children   []ChildSummary
+}
+
+// ChildSummary is one child's activity per reward type they hold.
+type ChildSummary struct {
+	Name     string
+	Holdings []Holding
+}
+
+// Holding is what a child earned and spent of a reward type in the period
+// and the balance now.
+type Holding struct {
+	RewardType db.RewardType
+	Earned     int64
+	Spent      int64
+	Balance    int64
+}
+
+// Compose gathers the family's digest for [from, to). Archived children
+// are left out. The bounds are compared in the server's timezone, which the
+// ledger's timestamps are written in.
+func Compose(ctx context.Context, database *gorm.DB, familyID uint64, frequency string, from, to time.Time) (*Digest, error) {
+	database = database.WithContext(ctx)
+	var family db.Family
+	if err := database.First(&family, familyID).Error; err != nil {
+		return nil, err
+	}
+	var children []db.User
+	if err := database.Where("family_id = ? AND role = ? AND archived_at IS NULL", familyID, "child").Order("id ASC").Find(&children).Error; err != nil {
+		return nil, err
+	}
+	var accounts []db.Account
+	if err := database.Preload("RewardType").Where("family_id = ?", familyID).Order("reward_type_id ASC").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	var totals []struct {
+		AccountID uint64
+		Type      string
+		Total     int64
+	}
+	err := database.Model(&db.Transaction{}).Select("account_id, type, SUM(value) AS total").
+		Where("account_id IN (?)", database.Model(&db.Account{}).Select("id").Where("family_id = ?", familyID)).
+		Where("created_at >= ? AND created_at < ?", from.Local(), to.Local()).
+		Group("account_id, type").Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+	earned, spent := map[uint64]int64{}, map[uint64]int64{}
+	for _, total := range totals {
+		if total.Type == "credit" {
+			earned[total.AccountID] = total.Total
+		} else {
+			spent[total.AccountID] = total.Total
+		}
+	}
+
+	digest := &Digest{FamilyName: family.Name, Frequency: frequency, From: from, To: to}
+	for _, child := range children {
+		summary := ChildSummary{Name: child.DisplayName}
+		for _, account := range accounts {
+			if account.ChildID == child.ID {
+				summary.Holdings = append(summary.Holdings, Holding{
+					RewardType: account.RewardType, Earned: earned[account.ID], Spent: spent[account.ID], Balance: account.Balance,
+				})
+			}
+		}
+		digest.Children = append(digest.Children, summary)
+	}
+	return digest, nil
+}
+
+// Subject is the title of the digest.
+func (d *Digest) Subject() string {
+	name := "每日摘要"
+	if d.Frequency == Weekly {
+		name = "每周摘要"
+	}
+	return d.FamilyName + name
+}
+
+// Text renders the digest, one line per child and reward type.
+func (d *Digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s（%s – %s）\n", d.Subject(), d.From.Format("1月2日 15:04"), d.To.Format("1月2日 15:04"))
+	if len(d.Children) == 0 {
+		b.WriteString("还没有孩子。\n")
+	}
+	for _, child := range d.Children {
+		b.WriteString("\n" + child.Name + "\n")
+		if len(child.Holdings) == 0 {
+			b.WriteString("  还没有任何奖励\n")
+		}
+		for _, holding := range child.Holdings {
+			unit := units.For(&holding.RewardType)
+			fmt.Fprintf(&b, "  %s：获得 %s，使用 %s，余额 %s\n",
+				holding.RewardType.Name, unit.Format(holding.Earned), unit.Format(holding.Spent), unit.Format(holding.Balance))
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,127 @@
+package digest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/notify"
+	"reward-system/internal/services"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+// inbox is a notification channel that keeps what it is given.
+type inbox struct {
+	messages []notify.Message
+}
+
+func (i *inbox) Notify(ctx context.Context, recipient notify.Recipient, message notify.Message) error {
+	i.messages = append(i.messages, message)
+	return nil
+}
+
+func TestLatest(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	// Wednesday 2024-06-12 19:00 in Shanghai.
+	now := time.Date(2024, 6, 12, 19, 0, 0, 0, shanghai)
+	cases := []struct {
+		setting  db.DigestSetting
+		from, to string
+	}{
+		{db.DigestSetting{Frequency: Daily, Time: "20:00", Timezone: "Asia/Shanghai"}, "2024-06-10T20:00", "2024-06-11T20:00"},
+		{db.DigestSetting{Frequency: Daily, Time: "08:30", Timezone: "Asia/Shanghai"}, "2024-06-11T08:30", "2024-06-12T08:30"},
+		// 19:00 in Shanghai is 12:00 in Berlin.
+		{db.DigestSetting{Frequency: Daily, Time: "11:00", Timezone: "Europe/Berlin"}, "2024-06-11T11:00", "2024-06-12T11:00"},
+		{db.DigestSetting{Frequency: Weekly, Time: "20:00", Weekday: 0, Timezone: "Asia/Shanghai"}, "2024-06-02T20:00", "2024-06-09T20:00"},
+		{db.DigestSetting{Frequency: Weekly, Time: "18:00", Weekday: 3, Timezone: "Asia/Shanghai"}, "2024-06-05T18:00", "2024-06-12T18:00"},
+	}
+	for _, c := range cases {
+		from, to, ok := Latest(&c.setting, now)
+		if !ok || from.Format("2006-01-02T15:04") != c.from || to.Format("2006-01-02T15:04") != c.to {
+			t.Errorf("Latest(%+v) = %s, %s, %v; want %s, %s", c.setting, from, to, ok, c.from, c.to)
+		}
+	}
+	if _, _, ok := Latest(DefaultSetting(1), now); ok {
+		t.Errorf("Expected no digest when digests are off")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	service := services.NewRewardService(database)
+
+	family := &db.Family{Name: "张家"}
+	database.Create(family)
+	database.Create(&db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Mom", IsActive: true})
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "小明", IsActive: true}
+	database.Create(child)
+	money := &db.RewardType{FamilyID: family.ID, Name: "零花钱", UnitKind: "money", Scale: 2}
+	service.CreateRewardType(ctx, money)
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, money.ID, 1000, "", ""); err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, money.ID, 200, "", ""); err != nil {
+		t.Fatalf("SpendReward: %v", err)
+	}
+
+	for _, invalid := range []db.DigestSetting{
+		{FamilyID: family.ID, Frequency: "hourly", Time: "20:00", Timezone: "Asia/Shanghai"},
+		{FamilyID: family.ID, Frequency: Daily, Time: "8pm", Timezone: "Asia/Shanghai"},
+		{FamilyID: family.ID, Frequency: Weekly, Time: "20:00", Weekday: 7, Timezone: "Asia/Shanghai"},
+		{FamilyID: family.ID, Frequency: Daily, Time: "20:00", Timezone: "Mars/Olympus"},
+	} {
+		if err := SetSetting(ctx, database, &invalid); !errors.Is(err, services.ErrValidation) {
+			t.Errorf("Expected a validation error for %+v, got %v", invalid, err)
+		}
+	}
+	// The digest is due half an hour from now; the clock is an hour ahead.
+	now := time.Now().Add(time.Hour)
+	due := now.Add(-30 * time.Minute).In(time.UTC).Format("15:04")
+	if err := SetSetting(ctx, database, &db.DigestSetting{FamilyID: family.ID, Frequency: Daily, Time: due, Timezone: "UTC"}); err != nil {
+		t.Fatalf("SetSetting: %v", err)
+	}
+
+	channel := &inbox{}
+	scheduler := NewScheduler(database, map[string]notify.Notifier{notify.ChannelLog: channel})
+	scheduler.Now = func() time.Time { return now }
+	if err := scheduler.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	// Neither running again nor a restarted scheduler sends it twice.
+	scheduler.RunOnce(ctx)
+	restarted := NewScheduler(database, map[string]notify.Notifier{notify.ChannelLog: channel})
+	restarted.Now = scheduler.Now
+	restarted.RunOnce(ctx)
+
+	if len(channel.messages) != 1 {
+		t.Fatalf("Expected one digest, got %d", len(channel.messages))
+	}
+	message := channel.messages[0]
+	if message.Kind != notify.KindDigest || message.Subject != "张家每日摘要" || !strings.Contains(message.Text, "小明\n  零花钱：获得 ¥10.00，使用 ¥2.00，余额 ¥8.00") {
+		t.Errorf("Unexpected digest %+v", message)
+	}
+
+	// A digest too late to catch up on is skipped.
+	scheduler.Now = func() time.Time { return now.Add(24*time.Hour - 30*time.Minute + scheduler.CatchUp + time.Minute) }
+	scheduler.RunOnce(ctx)
+	if len(channel.messages) != 1 {
+		t.Errorf("Expected a missed digest to be skipped, got %d digests", len(channel.messages))
+	}
+}
@@ -0,0 +1,81 @@
+package digest
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/notify"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Scheduler sends the digests that are due. A digest is claimed by
+// recording its period in digest_runs before it is sent, so it goes out at
+// most once however often the scheduler restarts, and several schedulers
+// may share a database.
+type Scheduler struct {
+	DB        *gorm.DB
+	Notifiers map[string]notify.Notifier
+	// Interval is how often Run looks for due digests.
+	Interval time.Duration
+	// CatchUp is how late a digest may still be sent, e.g. after the
+	// server was down at its time; later ones are skipped.
+	CatchUp time.Duration
+	// Now is the clock, for tests.
+	Now func() time.Time
+}
+
+func NewScheduler(database *gorm.DB, notifiers map[string]notify.Notifier) *Scheduler {
+	return &Scheduler{DB: database, Notifiers: notifiers, Interval: time.Minute, CatchUp: 6 * time.Hour, Now: time.Now}
+}
+
+// Run sends digests until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Digest failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce sends each family's latest digest if it is due and not yet sent.
+func (s *Scheduler) RunOnce(ctx context.Context) error {
+	var settings []db.DigestSetting
+	if err := s.DB.WithContext(ctx).Where("frequency <> ?", Off).Order("family_id ASC").Find(&settings).Error; err != nil {
+		return err
+	}
+	now := s.Now()
+	for i := range settings {
+		from, to, ok := Latest(&settings[i], now)
+		if !ok || now.Sub(to) > s.CatchUp {
+			continue
+		}
+		if err := s.send(ctx, &settings[i], from, to); err != nil {
+			log.Printf("digest: family %d: %v", settings[i].FamilyID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) send(ctx context.Context, setting *db.DigestSetting, from, to time.Time) error {
+	run := &db.DigestRun{FamilyID: setting.FamilyID, Period: Period(setting, to)}
+	result := s.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(run)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	digest, err := Compose(ctx, s.DB, setting.FamilyID, setting.Frequency, from, to)
+	if err != nil {
+		return err
+	}
+	return notify.SendToGuardians(ctx, s.DB, s.Notifiers, setting.FamilyID, notify.Message{Kind: notify.KindDigest, Subject: digest.Subject(), Text: digest.Text()})
+}
@@ -0,0 +1,563 @@
+// Package migrate applies the SQL migrations embedded in the migrations
+// package and records each applied version, with the checksum of its file,
+// in schema_migrations.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"reward-system/migrations"
+)
+
+// Migration is one versioned schema change. Version is the file name without
+// its extension, e.g. "001_initial_schema"; Down comes from the paired
+// 001_initial_schema.down.sql file.
+type Migration struct {
+	Version  string
+	Up       string
+	Down     string
+	Checksum string // SHA-256 of Up
+}
+
+// States reported by Status.
+const (
+	StatePending  = "pending"
+	StateApplied  = "applied"
+	StateModified = "modified" // applied, but the file has changed since
+	StateUnknown  = "unknown"  // applied, but not part of this binary
+	StateRetired  = "retired"  // applied, then removed from the schema path
+)
+
+// Status describes one migration as recorded in the database.
+type Status struct {
+	Version   string
+	State     string
+	AppliedAt string
+}
+
+// ErrModified is returned when an applied migration no longer matches the
+// checksum recorded when it ran. Applied migrations must not be edited; add
+// a new migration instead.
+var ErrModified = errors.New("migrate: applied migration has been modified")
+
+var (
+	upFile   = regexp.MustCompile(`^([0-9]+_[a-z0-9_]+)\.sql$`)
+	downFile = regexp.MustCompile(`^([0-9]+_[a-z0-9_]+)\.down\.sql$`)
+)
+
+// retired lists versions that were removed from the schema path. Databases
+// may still record them as applied; they are never run or rolled back.
+var retired = map[string]bool{
+	"002_test_data": true, // demo data, generated by cmd/seed instead
+}
+
+// dialects maps a GORM dialect name onto the directory of its migrations.
+var dialects = map[string]string{
+	"mysql":    ".",
+	"postgres": "postgres",
+	"sqlite":   "sqlite",
+}
+
+const (
+	lockName    = "kudo_schema_migrations"
+	lockKey     = 7365786 // PostgreSQL advisory lock id
+	lockTimeout = 5 * time.Minute
+)
+
+// Load returns the embedded migrations for dialect in version order.
+func Load(dialect string) ([]Migration, error) {
+	dir, ok := dialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("migrate: no SQL migrations for %s", dialect)
+	}
+	entries, err := fs.ReadDir(migrations.FS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	byVersion := make(map[string]*Migration)
+	downs := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		up := upFile.FindStringSubmatch(entry.Name())
+		down := downFile.FindStringSubmatch(entry.Name())
+		if up == nil && down == nil {
+			continue
+		}
+		content, err := fs.ReadFile(migrations.FS, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %w", err)
+		}
+		if up != nil {
+			byVersion[up[1]] = &Migration{Version: up[1], Up: string(content), Checksum: checksum(string(content))}
+		} else {
+			downs[down[1]] = string(content)
+		}
+	}
+
+	loaded := make([]Migration, 0, len(byVersion))
+	for version, down := range downs {
+		migration, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("migrate: %s.down.sql has no up migration", version)
+		}
+		migration.Down = down
+	}
+	for _, migration := range byVersion {
+		loaded = append(loaded, *migration)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Version < loaded[j].Version })
+	return loaded, nil
+}
+
+func checksum(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+// Migrator applies migrations to one database. Only one migrator changes a
+// database at a time: Up, Down and Redo hold a database-wide lock (MySQL
+// GET_LOCK, PostgreSQL advisory lock) while they run. SQLite has no such
+// lock; there each migration's transaction holds the write lock, and a
+// migrator that lost the race fails on recording its version again.
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+
+	// DryRun writes the statements that would run to Out instead of
+	// executing them, and leaves schema_migrations untouched.
+	DryRun bool
+	Out    io.Writer
+}
+
+// New returns a migrator for db using the embedded migrations of dialect,
+// which is a GORM dialect name: "mysql", "postgres" or "sqlite".
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	loaded, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: loaded, Out: io.Discard}, nil
+}
+
+// appliedVersion is a row of schema_migrations. Checksum is empty for rows
+// recorded before checksums were kept.
+type appliedVersion struct {
+	checksum  string
+	appliedAt string
+}
+
+// Up applies every migration not yet recorded in schema_migrations, oldest
+// first, and returns the versions it applied.
+func (m *Migrator) Up(ctx context.Context) ([]string, error) {
+	var versions []string
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[string]appliedVersion) error {
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.up(ctx, conn, migration); err != nil {
+				return err
+			}
+			versions = append(versions, migration.Version)
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// Down rolls back the n most recently applied migrations, newest first, and
+// returns the versions it rolled back. Nothing runs unless every one of them
+// has a down migration.
+func (m *Migrator) Down(ctx context.Context, n int) ([]string, error) {
+	var versions []string
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[string]appliedVersion) error {
+		targets, err := m.latest(applied, n)
+		if err != nil {
+			return err
+		}
+		for _, migration := range targets {
+			if err := m.down(ctx, conn, migration); err != nil {
+				return err
+			}
+			versions = append(versions, migration.Version)
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// Redo rolls back the most recently applied migration and applies it again,
+// returning its version.
+func (m *Migrator) Redo(ctx context.Context) (string, error) {
+	var version string
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[string]appliedVersion) error {
+		targets, err := m.latest(applied, 1)
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			return errors.New("migrate: no applied migration to redo")
+		}
+		if err := m.down(ctx, conn, targets[0]); err != nil {
+			return err
+		}
+		version = targets[0].Version
+		return m.up(ctx, conn, targets[0])
+	})
+	return version, err
+}
+
+// Status lists every migration of the binary, and any applied version the
+// binary does not know, in version order.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := m.appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	known := make(map[string]bool)
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		status := Status{Version: migration.Version, State: StatePending}
+		if row, ok := applied[migration.Version]; ok {
+			status.State, status.AppliedAt = StateApplied, row.appliedAt
+			if row.checksum != "" && row.checksum != migration.Checksum {
+				status.State = StateModified
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	for version, row := range applied {
+		if known[version] {
+			continue
+		}
+		state := StateUnknown
+		if retired[version] {
+			state = StateRetired
+		}
+		statuses = append(statuses, Status{Version: version, State: state, AppliedAt: row.appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// latest returns the n most recently applied migrations, newest first.
+func (m *Migrator) latest(applied map[string]appliedVersion, n int) ([]Migration, error) {
+	versions := make([]string, 0, len(applied))
+	for version := range applied {
+		if !retired[version] {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	if n < len(versions) {
+		versions = versions[:n]
+	}
+
+	targets := make([]Migration, 0, len(versions))
+	for _, version := range versions {
+		migration, ok := m.find(version)
+		if !ok {
+			return nil, fmt.Errorf("migrate: cannot roll back %s, it is not part of this binary", version)
+		}
+		if strings.TrimSpace(migration.Down) == "" {
+			return nil, fmt.Errorf("migrate: %s has no down migration", version)
+		}
+		targets = append(targets, migration)
+	}
+	return targets, nil
+}
+
+func (m *Migrator) find(version string) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// locked runs fn on a dedicated connection holding the migration lock, after
+// verifying the checksums of the applied migrations. A dry run takes no lock
+// and creates nothing.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, applied map[string]appliedVersion) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !m.DryRun {
+		unlock, err := m.lock(ctx, conn)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := m.createVersionTable(ctx, conn); err != nil {
+			return fmt.Errorf("migrate: failed to create schema_migrations: %w", err)
+		}
+	}
+
+	applied, err := m.appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if err := m.verify(ctx, conn, applied); err != nil {
+		return err
+	}
+	return fn(conn, applied)
+}
+
+// verify fails with ErrModified when an applied migration has changed, and
+// records the checksum of versions applied before checksums were kept.
+func (m *Migrator) verify(ctx context.Context, conn *sql.Conn, applied map[string]appliedVersion) error {
+	var modified []string
+	for _, migration := range m.migrations {
+		row, ok := applied[migration.Version]
+		switch {
+		case !ok:
+		case row.checksum == "":
+			if m.DryRun {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, m.bind("UPDATE schema_migrations SET checksum = ? WHERE version = ?"), migration.Checksum, migration.Version); err != nil {
+				return fmt.Errorf("migrate: failed to record checksum of %s: %w", migration.Version, err)
+			}
+		case row.checksum != migration.Checksum:
+			modified = append(modified, migration.Version)
+		}
+	}
+	if len(modified) > 0 {
+		return fmt.Errorf("%w: %s", ErrModified, strings.Join(modified, ", "))
+	}
+	return nil
+}
+
+func (m *Migrator) up(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	err := m.run(ctx, conn, "up "+migration.Version, Split(migration.Up),
+		"INSERT INTO schema_migrations (version, checksum) VALUES (?, ?)", migration.Version, migration.Checksum)
+	if err != nil {
+		return fmt.Errorf("migrate: failed to apply %s: %w", migration.Version, err)
+	}
+	return nil
+}
+
+func (m *Migrator) down(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	err := m.run(ctx, conn, "down "+migration.Version, Split(migration.Down),
+		"DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+	if err != nil {
+		return fmt.Errorf("migrate: failed to roll back %s: %w", migration.Version, err)
+	}
+	return nil
+}
+
+// execer is satisfied by both *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// run executes statements followed by the schema_migrations update record,
+// inside one transaction where the dialect allows.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, label string, statements []string, record string, args ...interface{}) error {
+	if m.DryRun {
+		fmt.Fprintf(m.Out, "-- %s\n", label)
+		for _, statement := range statements {
+			fmt.Fprintf(m.Out, "%s;\n\n", statement)
+		}
+		return nil
+	}
+
+	exec := func(conn execer) error {
+		for _, statement := range statements {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		_, err := conn.ExecContext(ctx, m.bind(record), args...)
+		return err
+	}
+
+	if !m.transactional() {
+		return exec(conn)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := exec(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// transactional reports whether DDL can be rolled back. MySQL commits
+// implicitly before and after each DDL statement, so a failed migration
+// there can leave its earlier statements applied.
+func (m *Migrator) transactional() bool {
+	return m.dialect != "mysql"
+}
+
+// bind rewrites ? placeholders into the dialect's bind parameter syntax.
+func (m *Migrator) bind(query string) string {
+	if m.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// lock takes the database-wide migration lock on conn, waiting up to
+// lockTimeout for another migrator to finish. SQLite takes no lock, see
+// Migrator.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn) (unlock func(), err error) {
+	busy := fmt.Errorf("migrate: another migration has held the lock for over %s", lockTimeout)
+	switch m.dialect {
+	case "mysql":
+		var acquired sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(lockTimeout.Seconds())).Scan(&acquired); err != nil {
+			return nil, fmt.Errorf("migrate: failed to take the migration lock: %w", err)
+		}
+		if acquired.Int64 != 1 {
+			return nil, busy
+		}
+		return func() {
+			var released sql.NullInt64
+			conn.QueryRowContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName).Scan(&released)
+		}, nil
+	case "postgres":
+		deadline := time.Now().Add(lockTimeout)
+		for {
+			var acquired bool
+			if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey).Scan(&acquired); err != nil {
+				return nil, fmt.Errorf("migrate: failed to take the migration lock: %w", err)
+			}
+			if acquired {
+				break
+			}
+			if time.Now().After(deadline) {
+				return nil, busy
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+		return func() {
+			var released bool
+			conn.QueryRowContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey).Scan(&released)
+		}, nil
+	}
+	return func() {}, nil
+}
+
+func (m *Migrator) createVersionTable(ctx context.Context, conn *sql.Conn) error {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version VARCHAR(255) PRIMARY KEY,
+		checksum VARCHAR(64),
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	if m.dialect == "mysql" {
+		query += " ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci"
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	// Tables created before checksums were kept lack the column.
+	if !m.hasChecksumColumn(ctx, conn) {
+		_, err := conn.ExecContext(ctx, "ALTER TABLE schema_migrations ADD COLUMN checksum VARCHAR(64)")
+		return err
+	}
+	return nil
+}
+
+func (m *Migrator) hasChecksumColumn(ctx context.Context, conn *sql.Conn) bool {
+	rows, err := conn.QueryContext(ctx, "SELECT checksum FROM schema_migrations WHERE 1 = 0")
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// versionTableExists reports whether schema_migrations has been created, so
+// that Status and dry runs work on an empty database without creating it.
+func (m *Migrator) versionTableExists(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var query string
+	switch m.dialect {
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_migrations'"
+	case "postgres":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	default:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	}
+	var count int
+	if err := conn.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (m *Migrator) appliedVersions(ctx context.Context, conn *sql.Conn) (map[string]appliedVersion, error) {
+	applied := make(map[string]appliedVersion)
+	exists, err := m.versionTableExists(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: failed to read schema_migrations: %w", err)
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	columns := "version, checksum, applied_at"
+	if !m.hasChecksumColumn(ctx, conn) {
+		columns = "version, NULL, applied_at"
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT "+columns+" FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("migrate: failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version string
+		var sum, appliedAt sql.NullString
+		if err := rows.Scan(&version, &sum, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedVersion{checksum: sum.String, appliedAt: appliedAt.String}
+	}
+	return applied, rows.Err()
+}
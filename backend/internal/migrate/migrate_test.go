@@ -0,0 +1,245 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestLoad(t *testing.T) {
+	mysql, err := Load("mysql")
+	if err != nil {
+		t.Fatalf("Load(mysql): %v", err)
+	}
+	postgres, err := Load("postgres")
+	if err != nil {
+		t.Fatalf("Load(postgres): %v", err)
+	}
+	if len(mysql) == 0 || mysql[0].Version != "001_initial_schema" {
+		t.Fatalf("Expected the initial schema first, got %+v", mysql)
+	}
+	if len(mysql) != len(postgres) {
+		t.Fatalf("Expected every MySQL migration to have a PostgreSQL equivalent, got %d and %d", len(mysql), len(postgres))
+	}
+	for i := range mysql {
+		if mysql[i].Version != postgres[i].Version {
+			t.Errorf("Migration %d is %s for MySQL but %s for PostgreSQL", i, mysql[i].Version, postgres[i].Version)
+		}
+	}
+
+	// SQLite starts from a baseline and then has every later migration.
+	sqlite, err := Load("sqlite")
+	if err != nil || len(sqlite) == 0 {
+		t.Fatalf("Load(sqlite) = %d migrations, %v", len(sqlite), err)
+	}
+	baseline, _, _ := strings.Cut(sqlite[0].Version, "_")
+	var later []string
+	for _, migration := range mysql {
+		if number, _, _ := strings.Cut(migration.Version, "_"); number > baseline {
+			later = append(later, migration.Version)
+		}
+	}
+	if len(sqlite) != 1+len(later) {
+		t.Fatalf("Expected SQLite to have the %d MySQL migrations after %s, got %d", len(later), sqlite[0].Version, len(sqlite)-1)
+	}
+	for i, version := range later {
+		if sqlite[i+1].Version != version {
+			t.Errorf("Migration %s is %s for SQLite", version, sqlite[i+1].Version)
+		}
+	}
+	if _, err := Load("oracle"); err == nil {
+		t.Error("Expected an error for a dialect without SQL migrations")
+	}
+}
+
+func TestLoad_DownMigrations(t *testing.T) {
+	for _, dialect := range []string{"mysql", "postgres", "sqlite"} {
+		loaded, _ := Load(dialect)
+		for _, migration := range loaded {
+			if migration.Down == "" {
+				t.Errorf("%s migration %s has no down migration", dialect, migration.Version)
+			}
+			if migration.Checksum != checksum(migration.Up) {
+				t.Errorf("%s migration %s has checksum %s", dialect, migration.Version, migration.Checksum)
+			}
+		}
+	}
+}
+
+func testMigrator(t *testing.T) (*Migrator, *sql.DB) {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	sqlDB, _ := database.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	migrations := []Migration{
+		{Version: "001_create", Up: "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);", Down: "DROP TABLE items;"},
+		{Version: "002_insert", Up: "INSERT INTO items (name) VALUES ('a');\nINSERT INTO items (name) VALUES ('b');", Down: "DELETE FROM items;"},
+	}
+	for i := range migrations {
+		migrations[i].Checksum = checksum(migrations[i].Up)
+	}
+	return &Migrator{db: sqlDB, dialect: "sqlite", migrations: migrations, Out: io.Discard}, sqlDB
+}
+
+func count(t *testing.T, sqlDB *sql.DB, table string) int {
+	var n int
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		return -1
+	}
+	return n
+}
+
+func TestMigrator_Up(t *testing.T) {
+	migrator, sqlDB := testMigrator(t)
+	ctx := context.Background()
+
+	applied, err := migrator.Up(ctx)
+	if err != nil || !reflect.DeepEqual(applied, []string{"001_create", "002_insert"}) {
+		t.Fatalf("Up applied %v, %v", applied, err)
+	}
+	if applied, err := migrator.Up(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("Expected a second Up to apply nothing, got %v, %v", applied, err)
+	}
+
+	// A failing migration rolls back its earlier statements and stays pending.
+	migrator.migrations = append(migrator.migrations, Migration{
+		Version: "003_broken",
+		Up:      "INSERT INTO items (name) VALUES ('c');\nINSERT INTO missing VALUES (1);",
+	})
+	if _, err := migrator.Up(ctx); err == nil {
+		t.Fatal("Expected the broken migration to fail")
+	}
+	if items, versions := count(t, sqlDB, "items"), count(t, sqlDB, "schema_migrations"); items != 2 || versions != 2 {
+		t.Errorf("Expected the broken migration to be rolled back, got %d items and %d versions", items, versions)
+	}
+}
+
+func TestMigrator_DownAndRedo(t *testing.T) {
+	migrator, sqlDB := testMigrator(t)
+	ctx := context.Background()
+	migrator.Up(ctx)
+
+	if version, err := migrator.Redo(ctx); err != nil || version != "002_insert" {
+		t.Fatalf("Redo: %s, %v", version, err)
+	}
+	if items := count(t, sqlDB, "items"); items != 2 {
+		t.Errorf("Expected the redone migration to insert 2 items once, got %d", items)
+	}
+
+	rolledBack, err := migrator.Down(ctx, 5)
+	if err != nil || !reflect.DeepEqual(rolledBack, []string{"002_insert", "001_create"}) {
+		t.Fatalf("Down rolled back %v, %v", rolledBack, err)
+	}
+	if items, versions := count(t, sqlDB, "items"), count(t, sqlDB, "schema_migrations"); items != -1 || versions != 0 {
+		t.Errorf("Expected an empty schema, got %d items and %d versions", items, versions)
+	}
+	if _, err := migrator.Redo(ctx); err == nil {
+		t.Error("Expected Redo to fail without applied migrations")
+	}
+
+	// Nothing is rolled back when one of the targets has no down migration.
+	migrator.Up(ctx)
+	migrator.migrations[0].Down = ""
+	if _, err := migrator.Down(ctx, 2); err == nil {
+		t.Fatal("Expected Down to refuse a migration without a down file")
+	}
+	if versions := count(t, sqlDB, "schema_migrations"); versions != 2 {
+		t.Errorf("Expected both migrations to stay applied, got %d", versions)
+	}
+}
+
+func TestMigrator_Checksums(t *testing.T) {
+	migrator, sqlDB := testMigrator(t)
+	ctx := context.Background()
+	migrator.Up(ctx)
+
+	// Versions recorded before checksums were kept are trusted once.
+	sqlDB.Exec("UPDATE schema_migrations SET checksum = NULL WHERE version = '001_create'")
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	migrator.migrations[0].Up += "\n-- edited"
+	migrator.migrations[0].Checksum = checksum(migrator.migrations[0].Up)
+	if _, err := migrator.Up(ctx); !errors.Is(err, ErrModified) {
+		t.Errorf("Expected ErrModified, got %v", err)
+	}
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if statuses[0].State != StateModified || statuses[1].State != StateApplied || statuses[1].AppliedAt == "" {
+		t.Errorf("Unexpected statuses %+v", statuses)
+	}
+}
+
+func TestMigrator_Status(t *testing.T) {
+	migrator, sqlDB := testMigrator(t)
+	ctx := context.Background()
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil || len(statuses) != 2 || statuses[0].State != StatePending {
+		t.Fatalf("Expected two pending migrations on an empty database, got %+v, %v", statuses, err)
+	}
+	if tables := count(t, sqlDB, "schema_migrations"); tables != -1 {
+		t.Error("Expected Status not to create schema_migrations")
+	}
+
+	migrator.Up(ctx)
+	sqlDB.Exec("INSERT INTO schema_migrations (version) VALUES ('002_test_data')")
+	if rolledBack, err := migrator.Down(ctx, 1); err != nil || rolledBack[0] != "002_insert" {
+		t.Errorf("Expected Down to skip the retired version, got %v, %v", rolledBack, err)
+	}
+	migrator.Up(ctx)
+	sqlDB.Exec("INSERT INTO schema_migrations (version) VALUES ('003_newer')")
+	statuses, _ = migrator.Status(ctx)
+	want := []string{StateApplied, StateApplied, StateRetired, StateUnknown}
+	for i, status := range statuses {
+		if status.State != want[i] {
+			t.Errorf("%s is %s, want %s", status.Version, status.State, want[i])
+		}
+	}
+	if _, err := migrator.Down(ctx, 1); err == nil {
+		t.Error("Expected Down to refuse a version that is not part of the binary")
+	}
+}
+
+func TestMigrator_DryRun(t *testing.T) {
+	migrator, sqlDB := testMigrator(t)
+	ctx := context.Background()
+	var out bytes.Buffer
+	migrator.DryRun, migrator.Out = true, &out
+
+	applied, err := migrator.Up(ctx)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("Up: %v, %v", applied, err)
+	}
+	if !strings.Contains(out.String(), "-- up 001_create\nCREATE TABLE items") {
+		t.Errorf("Expected the statements to be printed, got %q", out.String())
+	}
+	if tables := count(t, sqlDB, "schema_migrations"); tables != -1 {
+		t.Error("Expected a dry run not to touch the database")
+	}
+
+	migrator.DryRun = false
+	migrator.Up(ctx)
+	migrator.DryRun = true
+	out.Reset()
+	if rolledBack, err := migrator.Down(ctx, 1); err != nil || rolledBack[0] != "002_insert" {
+		t.Fatalf("Down: %v, %v", rolledBack, err)
+	}
+	if items := count(t, sqlDB, "items"); items != 2 || !strings.Contains(out.String(), "DELETE FROM items") {
+		t.Errorf("Expected the rollback to be printed only, got %d items and %q", items, out.String())
+	}
+}
@@ -0,0 +1,81 @@
+package migrate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Split breaks a migration script into statements on the semicolons that
+// are not inside a quoted string, identifier, comment or PostgreSQL
+// dollar-quoted body. Comments are dropped. Quotes inside strings must be
+// escaped by doubling them, as standard SQL does.
+func Split(script string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			i += end
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += 2 + end + 2
+			}
+		case c == '\'' || c == '"' || c == '`':
+			end := quotedEnd(script, i)
+			current.WriteString(script[i:end])
+			i = end
+		case c == '$' && dollarTag.MatchString(script[i:]):
+			tag := dollarTag.FindString(script[i:])
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				end = len(script)
+			} else {
+				end = i + len(tag) + end + len(tag)
+			}
+			current.WriteString(script[i:end])
+			i = end
+		case c == ';':
+			flush()
+			i++
+		default:
+			current.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return statements
+}
+
+var dollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z_0-9]*)?\$`)
+
+// quotedEnd returns the index just past the quoted run starting at start,
+// treating a doubled quote character as an escaped one.
+func quotedEnd(script string, start int) int {
+	quote := script[start]
+	for i := start + 1; i < len(script); i++ {
+		if script[i] != quote {
+			continue
+		}
+		if i+1 < len(script) && script[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(script)
+}
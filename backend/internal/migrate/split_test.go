@@ -0,0 +1,27 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	script := `-- header; not a statement
+CREATE TABLE a (note VARCHAR(8) DEFAULT 'x;y');
+/* block; comment */
+INSERT INTO a VALUES ('it''s; fine');
+COMMENT ON TABLE a IS '注释；说明';
+CREATE FUNCTION f() RETURNS trigger AS $body$ BEGIN NEW.x := 1; RETURN NEW; END $body$ LANGUAGE plpgsql;
+SELECT "semi;colon", ` + "`back;tick`" + ` FROM a
+`
+	want := []string{
+		"CREATE TABLE a (note VARCHAR(8) DEFAULT 'x;y')",
+		"INSERT INTO a VALUES ('it''s; fine')",
+		"COMMENT ON TABLE a IS '注释；说明'",
+		"CREATE FUNCTION f() RETURNS trigger AS $body$ BEGIN NEW.x := 1; RETURN NEW; END $body$ LANGUAGE plpgsql",
+		"SELECT \"semi;colon\", `back;tick` FROM a",
+	}
+	if got := Split(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("Split returned\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,257 @@
+// Package notify tells guardians and children what happens to their
+// rewards: grants, spends, balances running low and approvals waiting for
+// them. Each user chooses what they hear about and over which channels,
+// such as WeChat customer-service messages or email; the Worker turns the
+// family's outbox events into notifications.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of notification; a user can turn each off.
+const (
+	KindGrant      = "grant"
+	KindSpend      = "spend"
+	KindLowBalance = "low_balance"
+	KindApproval   = "approval"
+	KindDigest     = "digest"
+)
+
+// Channels a notification can go out on.
+const (
+	ChannelWeChat = "wechat"
+	ChannelEmail  = "email"
+	ChannelLog    = "log"
+)
+
+// Channels lists every channel.
+var Channels = []string{ChannelWeChat, ChannelEmail, ChannelLog}
+
+// ActionPreferenceUpdated is the audit log action of preference changes.
+const ActionPreferenceUpdated = "notification_preference.updated"
+
+// Message is one notification. Subject is used where the channel has one,
+// such as email.
+type Message struct {
+	Kind    string
+	Subject string
+	Text    string
+}
+
+// Recipient is a user as the channels address them.
+type Recipient struct {
+	UserID uint64
+	Name   string
+	OpenID string
+	Email  string
+}
+
+// ErrNoAddress is returned by a channel for a recipient it cannot reach,
+// such as a user without a bound WeChat account.
+var ErrNoAddress = errors.New("recipient has no address on this channel")
+
+// Notifier sends messages over one channel.
+type Notifier interface {
+	Notify(ctx context.Context, recipient Recipient, message Message) error
+}
+
+// DefaultPreference is the preference of a user who has not set one:
+// everything, over WeChat if they have bound an account and to the log
+// otherwise.
+func DefaultPreference(user *db.User) *db.NotificationPreference {
+	channel := ChannelLog
+	if user.WechatOpenID != "" {
+		channel = ChannelWeChat
+	}
+	return &db.NotificationPreference{UserID: user.ID, Grants: true, Spends: true, LowBalance: true, Approvals: true, Digests: true, Channels: channel}
+}
+
+// Wants reports whether the preference asks for notifications of kind.
+func Wants(preference *db.NotificationPreference, kind string) bool {
+	switch kind {
+	case KindGrant:
+		return preference.Grants
+	case KindSpend:
+		return preference.Spends
+	case KindLowBalance:
+		return preference.LowBalance
+	case KindApproval:
+		return preference.Approvals
+	case KindDigest:
+		return preference.Digests
+	}
+	return false
+}
+
+// GetPreference returns the user's preference, or the default when they
+// have not set one. Users and their family's guardians may read it.
+func GetPreference(ctx context.Context, database *gorm.DB, userID uint64) (*db.NotificationPreference, error) {
+	var user db.User
+	if err := database.WithContext(ctx).First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, services.NotFoundf("user %d not found", userID)
+		}
+		return nil, err
+	}
+	if err := services.AuthorizeSelf(ctx, user.FamilyID, user.ID); err != nil {
+		return nil, err
+	}
+	return preferenceOf(ctx, database, &user)
+}
+
+func preferenceOf(ctx context.Context, database *gorm.DB, user *db.User) (*db.NotificationPreference, error) {
+	var preference db.NotificationPreference
+	err := database.WithContext(ctx).Where("user_id = ?", user.ID).Take(&preference).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return DefaultPreference(user), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+// SetPreference replaces the user's preference. Every channel must be
+// known, and the email channel needs an address.
+func SetPreference(ctx context.Context, database *gorm.DB, preference *db.NotificationPreference) error {
+	channels := strings.Split(preference.Channels, ",")
+	if preference.Channels == "" {
+		channels = nil
+	}
+	for _, channel := range channels {
+		if !knownChannel(channel) {
+			return services.Validationf("unknown notification channel %q", channel).WithDetails(map[string]interface{}{"channels": Channels})
+		}
+		if channel == ChannelEmail && preference.Email == "" {
+			return services.Validationf("the email channel needs an email address")
+		}
+	}
+	if preference.Email != "" {
+		if address, err := mail.ParseAddress(preference.Email); err != nil || address.Address != preference.Email {
+			return services.Validationf("invalid email address %q", preference.Email)
+		}
+	}
+
+	return database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user db.User
+		if err := tx.First(&user, preference.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("user %d not found", preference.UserID)
+			}
+			return err
+		}
+		if err := services.AuthorizeSelf(ctx, user.FamilyID, user.ID); err != nil {
+			return err
+		}
+		before, err := preferenceOf(ctx, tx, &user)
+		if err != nil {
+			return err
+		}
+		if err := tx.Save(preference).Error; err != nil {
+			return err
+		}
+		auditLog, err := services.NewAuditLog(ctx, user.FamilyID, ActionPreferenceUpdated, snapshot(before), snapshot(preference))
+		if err != nil {
+			return err
+		}
+		return services.AppendAuditLog(ctx, storage.NewGorm(tx), auditLog)
+	})
+}
+
+// Send gives the message to the user over each channel of their preference
+// if they want messages of its kind. Channels that are not configured, and
+// failures, are logged: notifications are best effort.
+func Send(ctx context.Context, notifiers map[string]Notifier, user *db.User, preference *db.NotificationPreference, message Message) {
+	if !user.IsActive || !Wants(preference, message.Kind) || preference.Channels == "" {
+		return
+	}
+	recipient := Recipient{UserID: user.ID, Name: user.DisplayName, OpenID: string(user.WechatOpenID), Email: preference.Email}
+	for _, channel := range strings.Split(preference.Channels, ",") {
+		notifier, ok := notifiers[channel]
+		if !ok {
+			log.Printf("notify: channel %s is not configured, dropping %s notification for user %d", channel, message.Kind, user.ID)
+			continue
+		}
+		if err := notifier.Notify(ctx, recipient, message); err != nil {
+			log.Printf("notify: %s notification for user %d over %s failed: %v", message.Kind, user.ID, channel, err)
+		}
+	}
+}
+
+// SendToGuardians sends the message to each of the family's guardians, see
+// Send.
+func SendToGuardians(ctx context.Context, database *gorm.DB, notifiers map[string]Notifier, familyID uint64, message Message) error {
+	var guardians []db.User
+	if err := database.WithContext(ctx).Where("family_id = ? AND role = ?", familyID, "guardian").Order("id ASC").Find(&guardians).Error; err != nil {
+		return err
+	}
+	return sendAll(ctx, database, notifiers, guardians, message)
+}
+
+func sendAll(ctx context.Context, database *gorm.DB, notifiers map[string]Notifier, users []db.User, message Message) error {
+	for i := range users {
+		preference, err := preferenceOf(ctx, database, &users[i])
+		if err != nil {
+			return err
+		}
+		Send(ctx, notifiers, &users[i], preference, message)
+	}
+	return nil
+}
+
+// preferenceSnapshot is what audit logs keep of a preference; whether an
+// email address is set, not the address.
+type preferenceSnapshot struct {
+	UserID     uint64 `json:"user_id"`
+	Grants     bool   `json:"grants"`
+	Spends     bool   `json:"spends"`
+	LowBalance bool   `json:"low_balance"`
+	Approvals  bool   `json:"approvals"`
+	Digests    bool   `json:"digests"`
+	Channels   string `json:"channels"`
+	EmailSet   bool   `json:"email_set"`
+}
+
+func snapshot(preference *db.NotificationPreference) *preferenceSnapshot {
+	return &preferenceSnapshot{
+		UserID: preference.UserID, Grants: preference.Grants, Spends: preference.Spends, LowBalance: preference.LowBalance,
+		Approvals: preference.Approvals, Digests: preference.Digests, Channels: preference.Channels, EmailSet: preference.Email != "",
+	}
+}
+
+func knownChannel(channel string) bool {
+	for _, known := range Channels {
+		if channel == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Log is the channel that writes notifications to the server log, for
+// development and for users who have no other channel.
+type Log struct {
+	Logger *log.Logger
+}
+
+func (l *Log) Notify(ctx context.Context, recipient Recipient, message Message) error {
+	line := fmt.Sprintf("notify: [%s] to %s (user %d): %s", message.Kind, recipient.Name, recipient.UserID, message.Text)
+	if l.Logger == nil {
+		log.Print(line)
+		return nil
+	}
+	l.Logger.Print(line)
+	return nil
+}
@@ -0,0 +1,269 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+// wechatServer is a stand-in for the WeChat API that expires the first
+// access token it hands out after one use.
+type wechatServer struct {
+	mu       sync.Mutex
+	tokens   int
+	messages map[string][]string
+}
+
+func (s *wechatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/cgi-bin/token":
+		if r.URL.Query().Get("appid") != "app" || r.URL.Query().Get("secret") != "secret" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 40013, "errmsg": "invalid appid"})
+			return
+		}
+		s.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token-" + string(rune('0'+s.tokens)), "expires_in": 7200})
+	case "/cgi-bin/message/custom/send":
+		token := r.URL.Query().Get("access_token")
+		if token == "token-1" && len(s.messages) > 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 42001, "errmsg": "access_token expired"})
+			return
+		}
+		var body struct {
+			ToUser string `json:"touser"`
+			Text   struct {
+				Content string `json:"content"`
+			} `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.messages[body.ToUser] = append(s.messages[body.ToUser], body.Text.Content)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "errmsg": "ok"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// smtpServer is a stand-in mail server that accepts every message and
+// keeps the decoded bodies by recipient.
+type smtpServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	mail     map[string][]string
+}
+
+func startSMTP(t *testing.T) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := &smtpServer{listener: listener, mail: map[string][]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var to string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			to = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			parts := strings.SplitN(data.String(), "\r\n\r\n", 2)
+			body, _ := base64.StdEncoding.DecodeString(strings.ReplaceAll(parts[1], "\r\n", ""))
+			s.mu.Lock()
+			s.mail[to] = append(s.mail[to], string(body))
+			s.mu.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestWorker(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	service := services.NewRewardService(database)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Mom", WechatOpenID: "openid-mom", IsActive: true}
+	database.Create(guardian)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "小明", IsActive: true}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "零花钱", UnitKind: "money", Scale: 2, LowBalanceThreshold: 500}
+	if err := service.CreateRewardType(ctx, rewardType); err != nil {
+		t.Fatalf("CreateRewardType: %v", err)
+	}
+
+	// Mom keeps the default, WeChat; the child reads email and does not
+	// care about grants.
+	if err := SetPreference(ctx, database, &db.NotificationPreference{UserID: child.ID, Spends: true, LowBalance: true, Channels: "email,sms", Email: "kid@example.com"}); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for an unknown channel, got %v", err)
+	}
+	if err := SetPreference(ctx, database, &db.NotificationPreference{UserID: child.ID, Spends: true, LowBalance: true, Channels: "email"}); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for email without an address, got %v", err)
+	}
+	if err := SetPreference(ctx, database, &db.NotificationPreference{UserID: child.ID, Spends: true, LowBalance: true, Channels: "email", Email: "kid@example.com"}); err != nil {
+		t.Fatalf("SetPreference: %v", err)
+	}
+	if preference, _ := GetPreference(ctx, database, guardian.ID); preference.Channels != ChannelWeChat || !preference.Grants {
+		t.Errorf("Expected the default preference, got %+v", preference)
+	}
+
+	wechatAPI := &wechatServer{messages: map[string][]string{}}
+	server := httptest.NewServer(wechatAPI)
+	defer server.Close()
+	wechat := NewWeChat("app", "secret")
+	wechat.BaseURL = server.URL
+	mailServer := startSMTP(t)
+	defer mailServer.listener.Close()
+	worker := NewWorker(database, map[string]Notifier{
+		ChannelWeChat: wechat,
+		ChannelEmail:  &SMTP{Addr: mailServer.listener.Addr().String(), From: "kudo@example.com"},
+		ChannelLog:    &Log{},
+	})
+
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "洗碗", ""); err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 200, "", ""); err != nil {
+		t.Fatalf("SpendReward: %v", err)
+	}
+	// This spend takes the balance below ¥5.00.
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 400, "", ""); err != nil {
+		t.Fatalf("SpendReward: %v", err)
+	}
+	if err := worker.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	// Events are notified once.
+	if err := worker.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+
+	want := []string{
+		"小明获得了 ¥10.00 零花钱（洗碗），现在有 ¥10.00。",
+		"小明使用了 ¥2.00 零花钱，还剩 ¥8.00。",
+		"小明使用了 ¥4.00 零花钱，还剩 ¥4.00。",
+		"小明的零花钱只剩 ¥4.00 了，低于提醒线 ¥5.00。",
+	}
+	if got := wechatAPI.messages["openid-mom"]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected WeChat messages:\n%s", strings.Join(got, "\n"))
+	}
+	if wechatAPI.tokens != 2 {
+		t.Errorf("Expected the expired access token to be replaced once, got %d tokens", wechatAPI.tokens)
+	}
+	mailServer.mu.Lock()
+	defer mailServer.mu.Unlock()
+	if got := mailServer.mail["kid@example.com"]; strings.Join(got, "\n") != strings.Join(want[1:], "\n") {
+		t.Errorf("Unexpected email:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Stale events are not notified.
+	worker.MaxAge = time.Nanosecond
+	service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 100, "", "")
+	worker.RunOnce(ctx)
+	if len(wechatAPI.messages["openid-mom"]) != len(want) {
+		t.Errorf("Expected no notification of a stale event")
+	}
+}
+
+// inbox is a notification channel that keeps what it is given, by user.
+type inbox map[uint64][]Message
+
+func (i inbox) Notify(ctx context.Context, recipient Recipient, message Message) error {
+	i[recipient.UserID] = append(i[recipient.UserID], message)
+	return nil
+}
+
+func TestWorker_DeletionRequested(t *testing.T) {
+	database := setupTestDB(t)
+	family := &db.Family{Name: "王家"}
+	database.Create(family)
+	mum := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "妈妈", IsActive: true}
+	database.Create(mum)
+	dad := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "爸爸", IsActive: true}
+	database.Create(dad)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "小明", IsActive: true}
+	database.Create(child)
+
+	// Mum's consent awaits dad's.
+	expires := time.Date(2024, 6, 12, 19, 0, 0, 0, time.Local)
+	payload, _ := json.Marshal(&services.DeletionRequestedEvent{RequestedBy: mum.ID, ConfirmedBy: []uint64{mum.ID}, Awaiting: []uint64{dad.ID}, ExpiresAt: expires})
+	database.Create(&db.OutboxEvent{FamilyID: family.ID, Type: services.EventFamilyDeletionRequested, Payload: string(payload), CreatedAt: time.Now()})
+
+	received := inbox{}
+	if err := NewWorker(database, map[string]Notifier{ChannelWeChat: received, ChannelLog: received}).RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if len(received[mum.ID]) != 0 || len(received[child.ID]) != 0 {
+		t.Errorf("Expected only the awaited guardian to be asked, got %v", received)
+	}
+	want := "妈妈申请删除家庭王家及其全部数据。如同意，请在 2024-06-12 19:00 前确认删除；不同意则无需处理，申请到期后失效。"
+	if got := received[dad.ID]; len(got) != 1 || got[0].Kind != KindApproval || got[0].Text != want {
+		t.Errorf("Unexpected approval request %+v", got)
+	}
+}
@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTP is the channel that sends notifications as plain-text email. The
+// server must offer STARTTLS for authentication unless it runs on
+// localhost.
+type SMTP struct {
+	// Addr is host:port of the mail server.
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Notify(ctx context.Context, recipient Recipient, message Message) error {
+	if recipient.Email == "" {
+		return ErrNoAddress
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{recipient.Email}, s.compose(recipient, message))
+}
+
+// compose writes the email with a UTF-8 subject and a base64 body, which
+// suits Chinese text.
+func (s *SMTP) compose(recipient Recipient, message Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", (&mail.Address{Name: recipient.Name, Address: recipient.Email}).String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", message.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(message.Text))
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultWeChatURL is the base URL of the WeChat Official Account API.
+const DefaultWeChatURL = "https://api.weixin.qq.com"
+
+// WeChat is the channel that sends customer-service text messages to the
+// user's bound WeChat account. WeChat only delivers them to users who have
+// messaged the account recently, which the bot's users do.
+type WeChat struct {
+	// BaseURL is DefaultWeChatURL; tests point it at a stand-in.
+	BaseURL   string
+	AppID     string
+	AppSecret string
+	Client    *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func NewWeChat(appID, appSecret string) *WeChat {
+	return &WeChat{BaseURL: DefaultWeChatURL, AppID: appID, AppSecret: appSecret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// wechatResult is the error part of every WeChat API response.
+type wechatResult struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (r *wechatResult) err() error {
+	if r.ErrCode == 0 {
+		return nil
+	}
+	return fmt.Errorf("wechat error %d: %s", r.ErrCode, r.ErrMsg)
+}
+
+// Access token error codes: invalid, not the latest, expired.
+func staleToken(code int) bool {
+	return code == 40001 || code == 40014 || code == 42001
+}
+
+func (w *WeChat) Notify(ctx context.Context, recipient Recipient, message Message) error {
+	if recipient.OpenID == "" {
+		return ErrNoAddress
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"touser":  recipient.OpenID,
+		"msgtype": "text",
+		"text":    map[string]string{"content": message.Text},
+	})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := w.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		var result wechatResult
+		if err := w.call(ctx, http.MethodPost, "/cgi-bin/message/custom/send?access_token="+url.QueryEscape(token), body, &result); err != nil {
+			return err
+		}
+		if staleToken(result.ErrCode) && attempt == 0 {
+			w.forget(token)
+			continue
+		}
+		return result.err()
+	}
+}
+
+// accessToken returns the cached access token, fetching a new one shortly
+// before it expires.
+func (w *WeChat) accessToken(ctx context.Context) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.token != "" && time.Now().Before(w.expires) {
+		return w.token, nil
+	}
+	var result struct {
+		wechatResult
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	query := url.Values{"grant_type": {"client_credential"}, "appid": {w.AppID}, "secret": {w.AppSecret}}
+	if err := w.call(ctx, http.MethodGet, "/cgi-bin/token?"+query.Encode(), nil, &result); err != nil {
+		return "", err
+	}
+	if err := result.err(); err != nil {
+		return "", err
+	}
+	w.token = result.AccessToken
+	w.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return w.token, nil
+}
+
+func (w *WeChat) forget(token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.token == token {
+		w.token = ""
+	}
+}
+
+func (w *WeChat) call(ctx context.Context, method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, w.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wechat API: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
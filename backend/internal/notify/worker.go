@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/units"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Worker notifies the family's users of the outbox events: the child and
+// the guardians hear about grants, spends and spends that leave a balance
+// below its reward type's LowBalanceThreshold, and guardians whose approval
+// a request to delete the family awaits are asked for it. Each event is
+// claimed once,
+// so it is notified at most once even across restarts or with several
+// workers.
+type Worker struct {
+	DB        *gorm.DB
+	Notifiers map[string]Notifier
+	// Interval is how often Run polls the outbox.
+	Interval  time.Duration
+	BatchSize int
+	// MaxAge is how old an event may be and still be notified; older
+	// ones, e.g. from before a long outage, are skipped as stale.
+	MaxAge time.Duration
+}
+
+func NewWorker(database *gorm.DB, notifiers map[string]Notifier) *Worker {
+	return &Worker{DB: database, Notifiers: notifiers, Interval: 2 * time.Second, BatchSize: 100, MaxAge: time.Hour}
+}
+
+// Run notifies until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Notification failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce claims the events not yet notified and notifies them.
+func (w *Worker) RunOnce(ctx context.Context) error {
+	var events []db.OutboxEvent
+	err := w.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("notified_at IS NULL").Order("id ASC").Limit(w.BatchSize).Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		ids := make([]uint64, len(events))
+		for i := range events {
+			ids[i] = events[i].ID
+		}
+		return tx.Model(&db.OutboxEvent{}).Where("id IN ?", ids).Update("notified_at", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		if err := w.notifyEvent(ctx, &events[i]); err != nil {
+			log.Printf("notify: event %d: %v", events[i].ID, err)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) notifyEvent(ctx context.Context, event *db.OutboxEvent) error {
+	if time.Since(event.CreatedAt) > w.MaxAge {
+		return nil
+	}
+	switch event.Type {
+	case services.EventRewardGranted, services.EventRewardSpent:
+		return w.notifyLedger(ctx, event)
+	case services.EventFamilyDeletionRequested:
+		return w.notifyDeletionRequested(ctx, event)
+	}
+	return nil
+}
+
+func (w *Worker) notifyLedger(ctx context.Context, event *db.OutboxEvent) error {
+	var ledger services.LedgerEvent
+	if err := json.Unmarshal([]byte(event.Payload), &ledger); err != nil {
+		return err
+	}
+	database := w.DB.WithContext(ctx)
+	var child db.User
+	if err := database.First(&child, ledger.ChildID).Error; err != nil {
+		return err
+	}
+	var rewardType db.RewardType
+	if err := database.First(&rewardType, ledger.RewardTypeID).Error; err != nil {
+		return err
+	}
+	var users []db.User
+	if err := database.Where("family_id = ? AND role = ?", event.FamilyID, "guardian").Order("id ASC").Find(&users).Error; err != nil {
+		return err
+	}
+	users = append([]db.User{child}, users...)
+
+	for _, message := range ledgerMessages(&ledger, &child, &rewardType) {
+		if err := sendAll(ctx, w.DB, w.Notifiers, users, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyDeletionRequested asks the guardians still awaited to approve
+// deleting the family.
+func (w *Worker) notifyDeletionRequested(ctx context.Context, event *db.OutboxEvent) error {
+	var request services.DeletionRequestedEvent
+	if err := json.Unmarshal([]byte(event.Payload), &request); err != nil {
+		return err
+	}
+	database := w.DB.WithContext(ctx)
+	var family db.Family
+	if err := database.First(&family, event.FamilyID).Error; err != nil {
+		return err
+	}
+	var requester db.User
+	if err := database.First(&requester, request.RequestedBy).Error; err != nil {
+		return err
+	}
+	var awaiting []db.User
+	if err := database.Where("id IN ? AND family_id = ? AND role = ?", request.Awaiting, event.FamilyID, "guardian").
+		Order("id ASC").Find(&awaiting).Error; err != nil {
+		return err
+	}
+	return sendAll(ctx, w.DB, w.Notifiers, awaiting, Message{
+		Kind:    KindApproval,
+		Subject: fmt.Sprintf("%s申请删除家庭%s", requester.DisplayName, family.Name),
+		Text: fmt.Sprintf("%s申请删除家庭%s及其全部数据。如同意，请在 %s 前确认删除；不同意则无需处理，申请到期后失效。",
+			requester.DisplayName, family.Name, request.ExpiresAt.Local().Format("2006-01-02 15:04")),
+	})
+}
+
+// ledgerMessages words a grant or spend, and a balance it took below the
+// threshold.
+func ledgerMessages(ledger *services.LedgerEvent, child *db.User, rewardType *db.RewardType) []Message {
+	unit := units.For(rewardType)
+	note := ""
+	if ledger.Note != "" {
+		note = "（" + ledger.Note + "）"
+	}
+	if ledger.Type == "credit" {
+		return []Message{{
+			Kind:    KindGrant,
+			Subject: fmt.Sprintf("%s获得了%s", child.DisplayName, rewardType.Name),
+			Text: fmt.Sprintf("%s获得了 %s %s%s，现在有 %s。",
+				child.DisplayName, unit.Format(ledger.Value), rewardType.Name, note, unit.Format(ledger.Balance)),
+		}}
+	}
+
+	messages := []Message{{
+		Kind:    KindSpend,
+		Subject: fmt.Sprintf("%s使用了%s", child.DisplayName, rewardType.Name),
+		Text: fmt.Sprintf("%s使用了 %s %s%s，还剩 %s。",
+			child.DisplayName, unit.Format(ledger.Value), rewardType.Name, note, unit.Format(ledger.Balance)),
+	}}
+	threshold := rewardType.LowBalanceThreshold
+	if threshold > 0 && ledger.Balance < threshold && ledger.Balance+ledger.Value >= threshold {
+		messages = append(messages, Message{
+			Kind:    KindLowBalance,
+			Subject: fmt.Sprintf("%s的%s快用完了", child.DisplayName, rewardType.Name),
+			Text: fmt.Sprintf("%s的%s只剩 %s 了，低于提醒线 %s。",
+				child.DisplayName, rewardType.Name, unit.Format(ledger.Balance), unit.Format(threshold)),
+		})
+	}
+	return messages
+}
@@ -0,0 +1,277 @@
+// Package purge deletes a family together with everything that belongs to
+// it: users and their sessions, notification preferences and idempotency
+// records, reward types, accounts, transactions, audit logs, webhooks,
+// digest settings and pending events. Only a tombstone audit log recording
+// when the family was deleted and how many records went with it is kept, in
+// line with the minimal data retention promised by 需求.md §8.
+package purge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ActionFamilyDeleted is the action of the tombstone audit log.
+const ActionFamilyDeleted = "family.deleted"
+
+// ConfirmationTTL is how long a confirmation token may be sent back, and
+// ConsentTTL how long a guardian's confirmation then waits for the others.
+const (
+	ConfirmationTTL = 10 * time.Minute
+	ConsentTTL      = 24 * time.Hour
+)
+
+// Result counts the records deleted with a family. ConfirmedBy lists the
+// guardians who agreed to it and is empty when the operator deleted it.
+type Result struct {
+	FamilyID     uint64   `json:"family_id"`
+	Users        int64    `json:"users"`
+	RewardTypes  int64    `json:"reward_types"`
+	Accounts     int64    `json:"accounts"`
+	Transactions int64    `json:"transactions"`
+	AuditLogs    int64    `json:"audit_logs"`
+	Webhooks     int64    `json:"webhooks"`
+	ConfirmedBy  []uint64 `json:"confirmed_by,omitempty"`
+}
+
+// Family deletes the family in a single transaction once it is confirmed.
+// A call without a token deletes nothing: it issues a new confirmation token
+// to the caller, valid for ConfirmationTTL, and the returned error carries
+// it with the counts of what would be deleted. Sending the token back
+// confirms. The operator's confirmation deletes the family at once; a
+// guardian's counts as their consent, and the family is deleted when every
+// guardian who is not archived, deactivated ones included, has consented
+// within ConsentTTL. Until then the returned conflict lists the guardians
+// still awaited, and a family.deletion_requested event asks them for their
+// approval. Children cannot delete their family.
+func Family(ctx context.Context, database *gorm.DB, familyID uint64, token string) (*Result, error) {
+	if err := services.AuthorizeGuardian(ctx, familyID); err != nil {
+		return nil, err
+	}
+	actor := services.ActorFrom(ctx)
+	now := time.Now()
+	result := &Result{FamilyID: familyID}
+	// Issued tokens and consents are committed, so the errors reporting
+	// them are only returned after the transaction.
+	var pending error
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Locking the family serialises guardians confirming at once, so
+		// the last of them sees every other consent.
+		var family db.Family
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&family, familyID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("family %d not found", familyID)
+			}
+			return err
+		}
+
+		accountIDs := tx.Model(&db.Account{}).Select("id").Where("family_id = ?", familyID)
+		// Plucked now, as the users are gone by the time idempotency records
+		// are matched to them.
+		var users []uint64
+		if err := tx.Model(&db.User{}).Where("family_id = ?", familyID).Pluck("id", &users).Error; err != nil {
+			return err
+		}
+		webhookIDs := tx.Model(&db.Webhook{}).Select("id").Where("family_id = ?", familyID)
+		userIDs := tx.Model(&db.User{}).Select("id").Where("family_id = ?", familyID)
+		counts := []struct {
+			model interface{}
+			query *gorm.DB
+			n     *int64
+		}{
+			{&db.User{}, tx.Where("family_id = ?", familyID), &result.Users},
+			{&db.RewardType{}, tx.Where("family_id = ?", familyID), &result.RewardTypes},
+			{&db.Account{}, tx.Where("family_id = ?", familyID), &result.Accounts},
+			{&db.Transaction{}, tx.Where("account_id IN (?)", accountIDs), &result.Transactions},
+			{&db.AuditLog{}, tx.Where("family_id = ?", familyID), &result.AuditLogs},
+			{&db.Webhook{}, tx.Where("family_id = ?", familyID), &result.Webhooks},
+		}
+		for _, c := range counts {
+			if err := c.query.Model(c.model).Count(c.n).Error; err != nil {
+				return err
+			}
+		}
+
+		if token == "" {
+			issued, expiresAt, err := issueConfirmation(tx, familyID, actor, now)
+			if err != nil {
+				return err
+			}
+			pending = services.Validationf("deleting family %d must be confirmed with a confirmation token", familyID).
+				WithDetails(map[string]interface{}{"confirmation_token": issued, "expires_at": expiresAt, "deletes": result})
+			return nil
+		}
+		if err := confirm(tx, familyID, actor, token, now); err != nil {
+			return err
+		}
+		if !actor.IsOperator() {
+			confirmedBy, awaiting, err := consents(tx, familyID, now)
+			if err != nil {
+				return err
+			}
+			if len(awaiting) > 0 {
+				// The awaited guardians are asked for their approval.
+				event := &services.DeletionRequestedEvent{RequestedBy: actor.UserID, ConfirmedBy: confirmedBy, Awaiting: awaiting, ExpiresAt: now.Add(ConsentTTL)}
+				if err := services.EmitEvent(ctx, storage.NewGorm(tx), familyID, services.EventFamilyDeletionRequested, event); err != nil {
+					return err
+				}
+				pending = services.Conflictf("deleting family %d still awaits the confirmation of %d guardians", familyID, len(awaiting)).
+					WithDetails(map[string]interface{}{"awaiting": awaiting, "confirmed_by": confirmedBy})
+				return nil
+			}
+			result.ConfirmedBy = confirmedBy
+		}
+
+		// Children before parents, so the foreign keys hold at every step.
+		deletes := []struct {
+			model interface{}
+			query *gorm.DB
+		}{
+			{&db.Transaction{}, tx.Where("account_id IN (?)", accountIDs)},
+			{&db.WebhookDelivery{}, tx.Where("webhook_id IN (?)", webhookIDs)},
+			{&db.NotificationPreference{}, tx.Where("user_id IN (?)", userIDs)},
+			{&db.Session{}, tx.Where("user_id IN (?)", userIDs)},
+			{&db.IdempotencyRecord{}, idempotencyRecords(tx, familyID, users)},
+			{&db.PurgeConfirmation{}, tx.Where("family_id = ?", familyID)},
+			{&db.Webhook{}, tx.Where("family_id = ?", familyID)},
+			{&db.DigestSetting{}, tx.Where("family_id = ?", familyID)},
+			{&db.DigestRun{}, tx.Where("family_id = ?", familyID)},
+			{&db.OutboxEvent{}, tx.Where("family_id = ?", familyID)},
+			{&db.Account{}, tx.Where("family_id = ?", familyID)},
+			{&db.AuditLog{}, tx.Where("family_id = ?", familyID)},
+			{&db.AuditChain{}, tx.Where("family_id = ?", familyID)},
+			{&db.RewardType{}, tx.Where("family_id = ?", familyID)},
+			{&db.User{}, tx.Where("family_id = ?", familyID)},
+			{&db.Family{}, tx.Where("id = ?", familyID)},
+		}
+		for _, d := range deletes {
+			if err := d.query.Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+
+		// The tombstone outlives the family and its users, which audit_logs
+		// can no longer reference: it names the family in its payload and
+		// joins the chain of logs without a family. The payload records the
+		// channel and who confirmed, by their former ids.
+		tombstone, err := services.NewAuditLog(ctx, familyID, ActionFamilyDeleted, nil, result)
+		if err != nil {
+			return err
+		}
+		tombstone.FamilyID, tombstone.UserID = nil, nil
+		return services.AppendAuditLog(ctx, storage.NewGorm(tx), tombstone)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, pending
+	}
+	return result, nil
+}
+
+// issueConfirmation stores a new confirmation token for the actor and
+// returns it with its expiry.
+func issueConfirmation(tx *gorm.DB, familyID uint64, actor services.Actor, now time.Time) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	confirmation := &db.PurgeConfirmation{FamilyID: familyID, TokenHash: hashToken(token), ExpiresAt: now.Add(ConfirmationTTL)}
+	if !actor.IsOperator() {
+		userID := actor.UserID
+		confirmation.UserID = &userID
+	}
+	if err := tx.Create(confirmation).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	return token, confirmation.ExpiresAt, nil
+}
+
+// confirm records the actor's consent with a token issued to them for the
+// family. A token confirms once, and not after it expired.
+func confirm(tx *gorm.DB, familyID uint64, actor services.Actor, token string, now time.Time) error {
+	query := tx.Where("family_id = ? AND token_hash = ? AND confirmed_at IS NULL AND expires_at > ?", familyID, hashToken(token), now)
+	if actor.IsOperator() {
+		query = query.Where("user_id IS NULL")
+	} else {
+		query = query.Where("user_id = ?", actor.UserID)
+	}
+	var confirmation db.PurgeConfirmation
+	if err := query.First(&confirmation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return services.Conflictf("confirmation token for family %d is unknown, used or expired; request a new one", familyID)
+		}
+		return err
+	}
+	return tx.Model(&confirmation).Updates(map[string]interface{}{"confirmed_at": now, "expires_at": now.Add(ConsentTTL)}).Error
+}
+
+// consents splits the family's guardians into those whose consent is still
+// valid and those still awaited. Deactivated guardians are awaited too: one
+// guardian could otherwise deactivate the others and delete the family
+// alone. Only archived guardians, who left the family for good, are not.
+func consents(tx *gorm.DB, familyID uint64, now time.Time) (confirmedBy, awaiting []uint64, err error) {
+	var guardians []uint64
+	if err := tx.Model(&db.User{}).Where("family_id = ? AND role = ? AND archived_at IS NULL", familyID, "guardian").
+		Order("id ASC").Pluck("id", &guardians).Error; err != nil {
+		return nil, nil, err
+	}
+	var confirmed []uint64
+	if err := tx.Model(&db.PurgeConfirmation{}).
+		Where("family_id = ? AND user_id IS NOT NULL AND confirmed_at IS NOT NULL AND expires_at > ?", familyID, now).
+		Pluck("user_id", &confirmed).Error; err != nil {
+		return nil, nil, err
+	}
+	consented := make(map[uint64]bool, len(confirmed))
+	for _, id := range confirmed {
+		consented[id] = true
+	}
+	for _, id := range guardians {
+		if consented[id] {
+			confirmedBy = append(confirmedBy, id)
+		} else {
+			awaiting = append(awaiting, id)
+		}
+	}
+	return confirmedBy, awaiting, nil
+}
+
+// idempotencyRecords selects the idempotency records of the family: those
+// of its users, whose cached responses hold the family's data and purge
+// confirmation tokens, and the operator's for requests addressing the
+// family or one of its users by path. Other operator requests do not name
+// the family in the record; they expire with the idempotency TTL.
+func idempotencyRecords(tx *gorm.DB, familyID uint64, users []uint64) *gorm.DB {
+	principals := make([]string, len(users))
+	paths := []string{fmt.Sprintf("/api/v1/families/%d", familyID)}
+	for i, id := range users {
+		principals[i] = fmt.Sprintf("user:%d", id)
+		paths = append(paths, fmt.Sprintf("/api/v1/users/%d", id))
+	}
+	query, args := "principal IN ?", []interface{}{principals}
+	for _, path := range paths {
+		query += " OR (principal = 'operator' AND (path = ? OR path LIKE ?))"
+		args = append(args, path, path+"/%")
+	}
+	return tx.Where(query, args...)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
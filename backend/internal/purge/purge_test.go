@@ -0,0 +1,278 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"reward-system/internal/auditchain"
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+// createFamily builds a family with a guardian, a child, a reward type, a
+// grant, an audit log and a webhook with a delivery of the grant.
+func createFamily(t *testing.T, database *gorm.DB, name string) (*db.Family, *db.User, *db.RewardType) {
+	family := &db.Family{Name: name}
+	database.Create(family)
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Mum", WechatOpenID: db.OptionalString("openid-" + name), IsActive: true}
+	database.Create(guardian)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid", IsActive: true}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	if _, err := services.NewRewardService(database).GrantReward(ctx, family.ID, child.ID, rewardType.ID, 5, "", ""); err != nil {
+		t.Fatalf("Failed to grant: %v", err)
+	}
+	auditLog := &db.AuditLog{FamilyID: &family.ID, UserID: &guardian.ID, Action: "grant", Payload: `{"value":5}`}
+	if err := services.AppendAuditLog(ctx, storage.NewGorm(database), auditLog); err != nil {
+		t.Fatalf("Failed to audit: %v", err)
+	}
+	webhook := &db.Webhook{FamilyID: family.ID, URL: "https://example.com/" + name, Secret: "secret"}
+	database.Create(webhook)
+	var event db.OutboxEvent
+	database.Where("family_id = ?", family.ID).First(&event)
+	database.Create(&db.WebhookDelivery{WebhookID: webhook.ID, EventID: event.ID, Status: "pending", NextAttemptAt: time.Now()})
+	return family, child, rewardType
+}
+
+func confirmationOf(t *testing.T, err error) string {
+	var svcErr *services.Error
+	if !errors.As(err, &svcErr) {
+		t.Fatalf("Expected a service error, got %v", err)
+	}
+	token, _ := svcErr.Details["confirmation_token"].(string)
+	if token == "" {
+		t.Fatalf("Expected a confirmation token in %v", svcErr.Details)
+	}
+	return token
+}
+
+func TestFamily(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	family, child, rewardType := createFamily(t, database, "Deleted")
+	other, otherChild, _ := createFamily(t, database, "Kept")
+
+	_, err := Family(ctx, database, family.ID, "")
+	if !errors.Is(err, services.ErrValidation) {
+		t.Fatalf("Expected a validation error without a token, got %v", err)
+	}
+	token := confirmationOf(t, err)
+
+	// Each request issues its own token, which expires.
+	_, err = Family(ctx, database, family.ID, "")
+	if second := confirmationOf(t, err); second == token {
+		t.Errorf("Expected every request to issue a new token")
+	}
+	database.Model(&db.PurgeConfirmation{}).Where("token_hash = ?", hashToken(token)).Update("expires_at", time.Now().Add(-time.Second))
+	if _, err := Family(ctx, database, family.ID, token); !errors.Is(err, services.ErrConflict) {
+		t.Fatalf("Expected a conflict for an expired token, got %v", err)
+	}
+	if _, err := Family(ctx, database, family.ID, "wrong"); !errors.Is(err, services.ErrConflict) {
+		t.Fatalf("Expected a conflict for a wrong token, got %v", err)
+	}
+	_, err = Family(ctx, database, family.ID, "")
+	token = confirmationOf(t, err)
+
+	// A token confirms deleting only the family it was issued for.
+	if _, err := Family(ctx, database, other.ID, token); !errors.Is(err, services.ErrConflict) {
+		t.Fatalf("Expected a conflict for another family's token, got %v", err)
+	}
+
+	services.NewRewardService(database).GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1, "", "")
+	// Cached responses of the family's users and of operator requests naming
+	// it go with the family; the rest stay.
+	for i, record := range []struct{ principal, path string }{
+		{fmt.Sprintf("user:%d", child.ID), "/api/v1/rewards/spend"},
+		{"operator", fmt.Sprintf("/api/v1/families/%d", family.ID)},
+		{"operator", fmt.Sprintf("/api/v1/users/%d/deactivate", child.ID)},
+		{fmt.Sprintf("user:%d", otherChild.ID), "/api/v1/rewards/spend"},
+		{"operator", fmt.Sprintf("/api/v1/families/%d", other.ID)},
+		{"operator", "/api/v1/rewards/grant"},
+	} {
+		database.Create(&db.IdempotencyRecord{Principal: record.principal, Key: fmt.Sprintf("key-%d", i), Method: "POST", Path: record.path,
+			RequestHash: "hash", StatusCode: 200, ResponseBody: "{}", ExpiresAt: time.Now().Add(time.Hour)})
+	}
+	result, err := Family(ctx, database, family.ID, token)
+	if err != nil {
+		t.Fatalf("Family: %v", err)
+	}
+	if result.Users != 2 || result.RewardTypes != 1 || result.Accounts != 1 || result.Transactions != 2 || result.AuditLogs != 3 || result.Webhooks != 1 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	// Only the other family's records remain.
+	for name, model := range map[string]interface{}{
+		"families": &db.Family{}, "users": &db.User{}, "reward types": &db.RewardType{},
+		"accounts": &db.Account{}, "transactions": &db.Transaction{},
+		"webhooks": &db.Webhook{}, "webhook deliveries": &db.WebhookDelivery{},
+		"purge confirmations": &db.PurgeConfirmation{},
+	} {
+		var n int64
+		database.Model(model).Count(&n)
+		want := int64(1)
+		switch name {
+		case "users":
+			want = 2
+		case "purge confirmations":
+			want = 0
+		}
+		if n != want {
+			t.Errorf("Expected %d %s to remain, got %d", want, name, n)
+		}
+	}
+	var records []db.IdempotencyRecord
+	database.Order("id ASC").Find(&records)
+	if len(records) != 3 || records[0].Principal != fmt.Sprintf("user:%d", otherChild.ID) {
+		t.Errorf("Expected only the other family's idempotency records to remain, got %+v", records)
+	}
+	var events int64
+	database.Model(&db.OutboxEvent{}).Where("family_id = ?", family.ID).Count(&events)
+	if events != 0 {
+		t.Errorf("Expected the family's outbox events to be deleted, got %d", events)
+	}
+	var users []db.User
+	database.Find(&users)
+	for _, user := range users {
+		if user.FamilyID != other.ID {
+			t.Errorf("User %d of the deleted family survived", user.ID)
+		}
+	}
+
+	var tombstone db.AuditLog
+	if err := database.Where("action = ?", ActionFamilyDeleted).First(&tombstone).Error; err != nil {
+		t.Fatalf("Expected a tombstone audit log: %v", err)
+	}
+	if tombstone.FamilyID != nil || tombstone.UserID != nil {
+		t.Errorf("Expected the tombstone to keep no reference, got %+v", tombstone)
+	}
+	if !strings.Contains(tombstone.Payload, fmt.Sprintf(`"family_id":%d`, family.ID)) || !strings.Contains(tombstone.Payload, `"source":"cli"`) {
+		t.Errorf("Expected the tombstone to name the family and the channel, got %s", tombstone.Payload)
+	}
+	var remaining int64
+	database.Model(&db.AuditLog{}).Where("family_id = ?", other.ID).Count(&remaining)
+	if remaining != 2 {
+		t.Errorf("Expected the other family's audit logs to remain, got %d", remaining)
+	}
+	// The deleted family's chain goes with it; the tombstone starts chain 0.
+	reports, err := auditchain.Verify(ctx, database, 0)
+	if err != nil || len(reports) != 2 || reports[0].FamilyID != 0 || reports[0].Entries != 1 || !reports[0].OK() || !reports[1].OK() {
+		t.Errorf("Expected the remaining chains to verify, got %+v, %v", reports, err)
+	}
+
+	if _, err := Family(ctx, database, family.ID, token); !errors.Is(err, services.ErrNotFound) {
+		t.Errorf("Expected not found for a deleted family, got %v", err)
+	}
+}
+
+func TestFamily_Guardians(t *testing.T) {
+	database := setupTestDB(t)
+	family, kid, _ := createFamily(t, database, "Deleted")
+	var mum db.User
+	database.Where("family_id = ? AND role = ?", family.ID, "guardian").First(&mum)
+	dad := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Dad", IsActive: true}
+	database.Create(dad)
+	former := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Former", IsActive: true}
+	database.Create(former)
+	database.Model(former).Updates(map[string]interface{}{"is_active": false, "archived_at": time.Now()})
+	as := func(user *db.User) context.Context {
+		return services.WithActor(context.Background(), services.UserActor(user, services.SourceAPI))
+	}
+
+	if _, err := Family(as(kid), database, family.ID, ""); !errors.Is(err, services.ErrForbidden) {
+		t.Fatalf("Expected a child to be refused, got %v", err)
+	}
+
+	// One guardian's confirmation awaits the other active guardian.
+	_, err := Family(as(&mum), database, family.ID, "")
+	mumToken := confirmationOf(t, err)
+	_, err = Family(as(dad), database, family.ID, "")
+	dadToken := confirmationOf(t, err)
+	if _, err := Family(as(&mum), database, family.ID, dadToken); !errors.Is(err, services.ErrConflict) {
+		t.Fatalf("Expected a guardian refused confirming with another's token, got %v", err)
+	}
+	_, err = Family(as(&mum), database, family.ID, mumToken)
+	var svcErr *services.Error
+	if !errors.As(err, &svcErr) || svcErr.Kind != services.KindConflict {
+		t.Fatalf("Expected a conflict awaiting the second guardian, got %v", err)
+	}
+	if awaiting, _ := svcErr.Details["awaiting"].([]uint64); len(awaiting) != 1 || awaiting[0] != dad.ID {
+		t.Errorf("Expected to await only the second guardian, not the archived one, got %v", svcErr.Details)
+	}
+	var request db.OutboxEvent
+	if err := database.Where("type = ?", services.EventFamilyDeletionRequested).First(&request).Error; err != nil ||
+		!strings.Contains(request.Payload, fmt.Sprintf(`"awaiting":[%d]`, dad.ID)) {
+		t.Errorf("Expected a deletion request awaiting the second guardian, got %+v, %v", request, err)
+	}
+	if _, err := Family(as(&mum), database, family.ID, mumToken); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("Expected a used token to be refused, got %v", err)
+	}
+	var families int64
+	database.Model(&db.Family{}).Count(&families)
+	if families != 1 {
+		t.Fatalf("Expected the family to survive one guardian's confirmation, got %d families", families)
+	}
+
+	// The last confirmation deletes it.
+	result, err := Family(as(dad), database, family.ID, dadToken)
+	if err != nil {
+		t.Fatalf("Family: %v", err)
+	}
+	if len(result.ConfirmedBy) != 2 || result.ConfirmedBy[0] != mum.ID || result.ConfirmedBy[1] != dad.ID {
+		t.Errorf("Expected both guardians to have confirmed, got %v", result.ConfirmedBy)
+	}
+	database.Model(&db.Family{}).Count(&families)
+	if families != 0 {
+		t.Errorf("Expected the family to be deleted, got %d families", families)
+	}
+}
+
+func TestFamily_DeactivatedGuardian(t *testing.T) {
+	database := setupTestDB(t)
+	family, _, _ := createFamily(t, database, "Deleted")
+	var mum db.User
+	database.Where("family_id = ? AND role = ?", family.ID, "guardian").First(&mum)
+	dad := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Dad", IsActive: true}
+	database.Create(dad)
+	ctx := services.WithActor(context.Background(), services.UserActor(&mum, services.SourceAPI))
+
+	// Deactivating the other guardian does not let one delete the family
+	// alone.
+	if _, err := services.NewRewardService(database).DeactivateUser(ctx, dad.ID); err != nil {
+		t.Fatalf("DeactivateUser: %v", err)
+	}
+	_, err := Family(ctx, database, family.ID, "")
+	_, err = Family(ctx, database, family.ID, confirmationOf(t, err))
+	var svcErr *services.Error
+	if !errors.As(err, &svcErr) || svcErr.Kind != services.KindConflict {
+		t.Fatalf("Expected a conflict awaiting the deactivated guardian, got %v", err)
+	}
+	if awaiting, _ := svcErr.Details["awaiting"].([]uint64); len(awaiting) != 1 || awaiting[0] != dad.ID {
+		t.Errorf("Expected to await the deactivated guardian, got %v", svcErr.Details)
+	}
+	var families int64
+	database.Model(&db.Family{}).Count(&families)
+	if families != 1 {
+		t.Errorf("Expected the family to survive, got %d families", families)
+	}
+}
@@ -0,0 +1,264 @@
+// Package seed fills a database with realistic demo data: families with
+// guardians and children, the usual reward types, and a history of grants
+// and spends recorded through RewardService so that balances always match
+// the ledger.
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/gorm"
+)
+
+// Options controls how much data Run generates. The same Seed and Now
+// produce the same data.
+type Options struct {
+	Families int   // number of families
+	Children int   // children per family
+	Months   int   // months of ledger history per child
+	Seed     int64 // random seed
+	Now      time.Time
+	// Force adds demo data to a database that already has families.
+	Force bool
+}
+
+// DefaultOptions returns a small data set: three families of two children
+// with three months of history.
+func DefaultOptions() Options {
+	return Options{Families: 3, Children: 2, Months: 3, Seed: 1, Now: time.Now()}
+}
+
+// Summary counts the rows Run created.
+type Summary struct {
+	Families     int
+	Users        int
+	RewardTypes  int
+	Transactions int
+}
+
+// ErrNotEmpty is returned when the database already has families and
+// Options.Force is not set, so that demo data never lands in a real
+// database by mistake.
+var ErrNotEmpty = errors.New("seed: database already has families")
+
+var (
+	surnames   = []string{"张", "李", "王", "陈", "刘", "杨", "黄", "赵", "周", "吴"}
+	childNames = []string{"小明", "小红", "小刚", "小美", "小强", "小雨", "小宇", "小乐"}
+)
+
+// rewardTemplate is a reward type every demo family defines, with the range
+// of a typical grant and spend in base units.
+type rewardTemplate struct {
+	rewardType         db.RewardType
+	grantMin, grantMax int64
+	spendMin, spendMax int64
+	grantNotes         []string
+	spendNotes         []string
+}
+
+var rewardTemplates = []rewardTemplate{
+	{
+		rewardType: db.RewardType{Name: "零花钱", UnitKind: "money", Currency: "CNY", Scale: 2, MaxValue: 10000},
+		grantMin:   100,
+		grantMax:   2000,
+		spendMin:   300,
+		spendMax:   3000,
+		grantNotes: []string{"完成作业", "帮忙洗碗", "整理房间", "考试进步"},
+		spendNotes: []string{"买零食", "买文具", "买绘本"},
+	},
+	{
+		rewardType: db.RewardType{Name: "看电视时间", UnitKind: "time", UnitLabel: "分钟", MaxValue: 120},
+		grantMin:   10,
+		grantMax:   60,
+		spendMin:   20,
+		spendMax:   90,
+		grantNotes: []string{"按时睡觉", "练琴30分钟", "阅读半小时"},
+		spendNotes: []string{"看动画片", "看纪录片"},
+	},
+	{
+		rewardType: db.RewardType{Name: "积分", UnitKind: "points", UnitLabel: "积分"},
+		grantMin:   1,
+		grantMax:   20,
+		spendMin:   10,
+		spendMax:   50,
+		grantNotes: []string{"主动帮忙", "整理书包", "照顾宠物"},
+		spendNotes: []string{"兑换小玩具", "兑换游乐园门票"},
+	},
+	{
+		rewardType: db.RewardType{Name: "星星奖励", UnitKind: "custom", UnitLabel: "星星"},
+		grantMin:   1,
+		grantMax:   3,
+		spendMin:   5,
+		spendMax:   10,
+		grantNotes: []string{"表现很棒", "学会新技能"},
+		spendNotes: []string{"兑换周末活动"},
+	},
+}
+
+// Run creates the demo data described by opts in database.
+func Run(ctx context.Context, database *gorm.DB, opts Options) (*Summary, error) {
+	if opts.Families < 1 || opts.Children < 1 || opts.Months < 0 {
+		return nil, fmt.Errorf("seed: need at least one family and one child, and a non-negative number of months")
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	var existing int64
+	if err := database.WithContext(ctx).Model(&db.Family{}).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 && !opts.Force {
+		return nil, ErrNotEmpty
+	}
+
+	g := &generator{
+		database: database.WithContext(ctx),
+		service:  services.NewRewardService(database),
+		rand:     rand.New(rand.NewSource(opts.Seed)),
+		opts:     opts,
+		summary:  &Summary{},
+	}
+	for i := 0; i < opts.Families; i++ {
+		if err := g.family(ctx, i); err != nil {
+			return g.summary, err
+		}
+	}
+	return g.summary, nil
+}
+
+type generator struct {
+	database *gorm.DB
+	service  *services.RewardService
+	rand     *rand.Rand
+	opts     Options
+	summary  *Summary
+	clock    time.Time
+}
+
+func (g *generator) family(ctx context.Context, index int) error {
+	surname := surnames[index%len(surnames)]
+	name := surname + "家"
+	if index >= len(surnames) {
+		name = fmt.Sprintf("%s家%d", surname, index/len(surnames)+1)
+	}
+	family := &db.Family{Name: name}
+	if err := g.service.CreateFamily(ctx, family); err != nil {
+		return err
+	}
+	g.summary.Families++
+
+	var guardians []*db.User
+	for _, name := range []string{"爸爸", "妈妈"} {
+		guardian, err := g.user(ctx, family.ID, "guardian", surname+name)
+		if err != nil {
+			return err
+		}
+		guardians = append(guardians, guardian)
+	}
+
+	rewardTypes := make([]*db.RewardType, len(rewardTemplates))
+	for i, template := range rewardTemplates {
+		rewardType := template.rewardType
+		rewardType.FamilyID = family.ID
+		if err := g.service.CreateRewardType(ctx, &rewardType); err != nil {
+			return err
+		}
+		rewardTypes[i] = &rewardType
+		g.summary.RewardTypes++
+	}
+
+	for i := 0; i < g.opts.Children; i++ {
+		name := surname + childNames[i%len(childNames)]
+		if i >= len(childNames) {
+			name = fmt.Sprintf("%s%d", name, i/len(childNames)+1)
+		}
+		child, err := g.user(ctx, family.ID, "child", name)
+		if err != nil {
+			return err
+		}
+		if err := g.history(ctx, family.ID, child.ID, guardians, rewardTypes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *generator) user(ctx context.Context, familyID uint64, role, name string) (*db.User, error) {
+	user := &db.User{FamilyID: familyID, Role: role, DisplayName: name}
+	if err := g.service.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	g.summary.Users++
+	return user, nil
+}
+
+// history records a day-by-day ledger for the child: most days bring a
+// grant of some reward type, and a spend follows whenever the balance
+// covers it. The guardians take turns by day recording them. Each
+// transaction is then backdated into its day, in the order it was recorded.
+func (g *generator) history(ctx context.Context, familyID, childID uint64, guardians []*db.User, rewardTypes []*db.RewardType) error {
+	start := g.opts.Now.AddDate(0, -g.opts.Months, 0)
+	balances := make([]int64, len(rewardTypes))
+
+	for day := start; day.Before(g.opts.Now); day = day.AddDate(0, 0, 1) {
+		g.clock = time.Date(day.Year(), day.Month(), day.Day(), 7, 0, 0, 0, day.Location())
+		ctx := services.WithActor(ctx, services.UserActor(guardians[day.YearDay()%len(guardians)], services.SourceCLI))
+		for i, rewardType := range rewardTypes {
+			template := rewardTemplates[i]
+			if g.rand.Float64() < 0.35 {
+				value := g.between(template.grantMin, template.grantMax)
+				result, err := g.service.GrantReward(ctx, familyID, childID, rewardType.ID, value, g.pick(template.grantNotes), "")
+				if err != nil {
+					return err
+				}
+				balances[i] = result.NewBalance
+				if err := g.backdate(result.TransactionID); err != nil {
+					return err
+				}
+			}
+			if g.rand.Float64() < 0.15 {
+				value := g.between(template.spendMin, template.spendMax)
+				if value > balances[i] {
+					continue
+				}
+				result, err := g.service.SpendReward(ctx, familyID, childID, rewardType.ID, value, g.pick(template.spendNotes), "")
+				if err != nil {
+					return err
+				}
+				balances[i] = result.NewBalance
+				if err := g.backdate(result.TransactionID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// backdate moves a transaction to the generator's clock, which advances by
+// up to a couple of hours per transaction through the day.
+func (g *generator) backdate(transactionID uint64) error {
+	g.clock = g.clock.Add(time.Duration(10+g.rand.Intn(120)) * time.Minute)
+	createdAt := g.clock
+	if createdAt.After(g.opts.Now) {
+		createdAt = g.opts.Now
+	}
+	g.summary.Transactions++
+	return g.database.Model(&db.Transaction{}).Where("id = ?", transactionID).Update("created_at", createdAt).Error
+}
+
+func (g *generator) between(min, max int64) int64 {
+	return min + g.rand.Int63n(max-min+1)
+}
+
+func (g *generator) pick(options []string) string {
+	return options[g.rand.Intn(len(options))]
+}
@@ -0,0 +1,86 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+func TestRun(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	now := time.Date(2026, 6, 30, 20, 0, 0, 0, time.UTC)
+	opts := Options{Families: 2, Children: 3, Months: 2, Seed: 42, Now: now}
+
+	summary, err := Run(ctx, database, opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if summary.Families != 2 || summary.Users != 2*(2+3) || summary.RewardTypes != 2*len(rewardTemplates) || summary.Transactions == 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	// Every balance matches its ledger and never went negative.
+	var accounts []db.Account
+	database.Find(&accounts)
+	for _, account := range accounts {
+		var transactions []db.Transaction
+		database.Where("account_id = ?", account.ID).Order("id ASC").Find(&transactions)
+		var balance int64
+		for _, transaction := range transactions {
+			if transaction.Type == "credit" {
+				balance += transaction.Value
+			} else {
+				balance -= transaction.Value
+			}
+			if balance < 0 {
+				t.Fatalf("Account %d went negative", account.ID)
+			}
+			if transaction.CreatedAt.Before(now.AddDate(0, -2, -1)) || transaction.CreatedAt.After(now) {
+				t.Errorf("Transaction %d dated %s is outside the history", transaction.ID, transaction.CreatedAt)
+			}
+		}
+		if balance != account.Balance {
+			t.Errorf("Account %d has balance %d but its ledger sums to %d", account.ID, account.Balance, balance)
+		}
+	}
+
+	if _, err := Run(ctx, database, opts); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("Expected ErrNotEmpty on a second run, got %v", err)
+	}
+	opts.Force = true
+	if _, err := Run(ctx, database, opts); err != nil {
+		t.Errorf("Expected Force to add a second data set, got %v", err)
+	}
+}
+
+func TestRun_Deterministic(t *testing.T) {
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	opts := Options{Families: 1, Children: 1, Months: 1, Seed: 7, Now: time.Date(2026, 1, 31, 20, 0, 0, 0, time.UTC)}
+	first, err := Run(ctx, setupTestDB(t), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	second, _ := Run(ctx, setupTestDB(t), opts)
+	if *first != *second {
+		t.Errorf("Expected the same seed to generate the same data, got %+v and %+v", first, second)
+	}
+}
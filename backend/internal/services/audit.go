@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"reward-system/internal/auditchain"
+	"reward-system/internal/db"
+	"reward-system/internal/storage"
+)
+
+// Audit log actions, see AuditPayload for what each records.
+const (
+	ActionFamilyCreated       = "family.created"
+	ActionFamilyImported      = "family.imported"
+	ActionUserCreated         = "user.created"
+	ActionUserUpdated         = "user.updated"
+	ActionUserDeactivated     = "user.deactivated"
+	ActionUserArchived        = "user.archived"
+	ActionUserReactivated     = "user.reactivated"
+	ActionRewardTypeCreated   = "reward_type.created"
+	ActionRewardTypeUpdated   = "reward_type.updated"
+	ActionRewardGranted       = "reward.granted"
+	ActionRewardSpent         = "reward.spent"
+	ActionTransactionAdjusted = "transaction.adjusted"
+)
+
+// Sources name the channel a change came through.
+const (
+	SourceAPI    = "api"
+	SourceMCP    = "mcp"
+	SourceWeChat = "wechat"
+	SourceCLI    = "cli"
+)
+
+// Actor is who makes a change and through which channel. UserID is 0 when
+// the caller is not a known user, such as a client of the shared API token,
+// which Operator then marks; FamilyID and Role are the user's, for the
+// checks in policy.go.
+type Actor struct {
+	UserID   uint64
+	FamilyID uint64
+	Role     string
+	Source   string
+	Operator bool
+}
+
+// userID returns the actor's user id, or nil when the actor is not a user.
+func (a Actor) userID() *uint64 {
+	if a.UserID == 0 {
+		return nil
+	}
+	id := a.UserID
+	return &id
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes the services attribute to actor.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set with WithActor, or the zero Actor.
+func ActorFrom(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// AuditPayload is the JSON payload of an audit log: the channel and the
+// state of the changed record before and after the change. Before is
+// omitted for creations.
+type AuditPayload struct {
+	Source string      `json:"source,omitempty"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// NewAuditLog builds the audit log of a change to the family by the actor of
+// ctx. Callers writing through GORM rather than a Repository create it in
+// the transaction of the change themselves.
+func NewAuditLog(ctx context.Context, familyID uint64, action string, before, after interface{}) (*db.AuditLog, error) {
+	actor := ActorFrom(ctx)
+	payload, err := json.Marshal(AuditPayload{Source: actor.Source, Before: before, After: after})
+	if err != nil {
+		return nil, err
+	}
+	return &db.AuditLog{FamilyID: &familyID, UserID: actor.userID(), Action: action, Payload: string(payload), CreatedAt: time.Now()}, nil
+}
+
+// audit records a change in the transaction of repo, so the audit log is
+// committed or rolled back together with the change.
+func audit(ctx context.Context, repo storage.Repository, familyID uint64, action string, before, after interface{}) error {
+	auditLog, err := NewAuditLog(ctx, familyID, action, before, after)
+	if err != nil {
+		return err
+	}
+	return AppendAuditLog(ctx, repo, auditLog)
+}
+
+// AppendAuditLog links the audit log into its family's hash chain and writes
+// it. The chain head stays locked until the transaction of repo ends, so
+// concurrent changes to a family append one after the other.
+func AppendAuditLog(ctx context.Context, repo storage.Repository, auditLog *db.AuditLog) error {
+	head, err := lockAuditChain(ctx, repo, auditchain.ChainID(auditLog))
+	if err != nil {
+		return err
+	}
+	if err := auditchain.Link(head, auditLog); err != nil {
+		return err
+	}
+	if err := repo.CreateAuditLog(ctx, auditLog); err != nil {
+		return err
+	}
+	return repo.UpdateAuditChain(ctx, head)
+}
+
+// lockAuditChain locks the head of a chain, starting the chain on the
+// family's first audit log.
+func lockAuditChain(ctx context.Context, repo storage.Repository, familyID uint64) (*db.AuditChain, error) {
+	head, err := repo.LockAuditChain(ctx, familyID)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return head, err
+	}
+	// As in getOrCreateAccount, the insert runs in a savepoint in case a
+	// concurrent change started the chain since the lookup above.
+	err = repo.Transaction(ctx, func(repo storage.Repository) error {
+		return repo.CreateAuditChain(ctx, &db.AuditChain{FamilyID: familyID})
+	})
+	if err != nil && !errors.Is(err, storage.ErrDuplicate) {
+		return nil, err
+	}
+	return repo.LockAuditChain(ctx, familyID)
+}
+
+// The snapshots below are what audit logs keep of a record: the fields a
+// reviewer needs, and nothing personal beyond the display name (需求.md §8).
+
+type userSnapshot struct {
+	ID          uint64     `json:"id"`
+	Role        string     `json:"role"`
+	DisplayName string     `json:"display_name"`
+	WechatBound bool       `json:"wechat_bound"`
+	IsActive    bool       `json:"is_active"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+}
+
+func userAudit(user *db.User) userSnapshot {
+	return userSnapshot{
+		ID: user.ID, Role: user.Role, DisplayName: user.DisplayName, WechatBound: user.WechatOpenID != "",
+		IsActive: user.IsActive, ArchivedAt: user.ArchivedAt,
+	}
+}
+
+type rewardTypeSnapshot struct {
+	ID                  uint64 `json:"id"`
+	Name                string `json:"name"`
+	UnitKind            string `json:"unit_kind"`
+	UnitLabel           string `json:"unit_label,omitempty"`
+	Currency            string `json:"currency,omitempty"`
+	Scale               int    `json:"scale"`
+	MaxValue            int64  `json:"max_value"`
+	LowBalanceThreshold int64  `json:"low_balance_threshold,omitempty"`
+	ChildrenMaySpend    bool   `json:"children_may_spend,omitempty"`
+}
+
+func rewardTypeAudit(rewardType *db.RewardType) rewardTypeSnapshot {
+	return rewardTypeSnapshot{
+		ID: rewardType.ID, Name: rewardType.Name, UnitKind: rewardType.UnitKind, UnitLabel: rewardType.UnitLabel,
+		Currency: rewardType.Currency, Scale: rewardType.Scale, MaxValue: rewardType.MaxValue,
+		LowBalanceThreshold: rewardType.LowBalanceThreshold, ChildrenMaySpend: rewardType.ChildrenMaySpend,
+	}
+}
+
+// ledgerSnapshot is a transaction together with the balance of its account.
+type ledgerSnapshot struct {
+	TransactionID uint64 `json:"transaction_id,omitempty"`
+	AccountID     uint64 `json:"account_id"`
+	ChildID       uint64 `json:"child_id"`
+	RewardTypeID  uint64 `json:"reward_type_id"`
+	Type          string `json:"type,omitempty"`
+	Value         int64  `json:"value,omitempty"`
+	Note          string `json:"note,omitempty"`
+	Balance       int64  `json:"balance"`
+}
+
+func ledgerAudit(transaction *db.Transaction, account *db.Account) ledgerSnapshot {
+	snapshot := ledgerSnapshot{AccountID: account.ID, ChildID: account.ChildID, RewardTypeID: account.RewardTypeID, Balance: account.Balance}
+	if transaction != nil {
+		snapshot.TransactionID = transaction.ID
+		snapshot.Type = transaction.Type
+		snapshot.Value = transaction.Value
+		snapshot.Note = transaction.Note
+	}
+	return snapshot
+}
+
+// AuditLogPage is a page of audit logs, newest first. NextCursor is the
+// BeforeID of the next page, or 0 on the last page.
+type AuditLogPage struct {
+	AuditLogs  []db.AuditLog
+	NextCursor uint64
+}
+
+// ListAuditLogs returns a page of the family's audit logs. The limit
+// defaults to 50 and is capped at 200. Only guardians read them.
+func (s *RewardService) ListAuditLogs(ctx context.Context, query storage.AuditLogFilter) (*AuditLogPage, error) {
+	if err := AuthorizeGuardian(ctx, query.FamilyID); err != nil {
+		return nil, err
+	}
+	if query.Limit <= 0 {
+		query.Limit = 50
+	}
+	if query.Limit > 200 {
+		query.Limit = 200
+	}
+	auditLogs, err := s.repo.ListAuditLogs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	page := &AuditLogPage{AuditLogs: auditLogs}
+	if len(auditLogs) == query.Limit {
+		page.NextCursor = auditLogs[len(auditLogs)-1].ID
+	}
+	return page, nil
+}
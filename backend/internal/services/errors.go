@@ -0,0 +1,88 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"reward-system/internal/storage"
+
+	"gorm.io/gorm"
+)
+
+// ErrorKind classifies service errors so that every transport (REST, MCP,
+// WeChat) can map them onto the same error codes.
+type ErrorKind string
+
+const (
+	KindNotFound            ErrorKind = "not_found"
+	KindForbidden           ErrorKind = "forbidden"
+	KindValidation          ErrorKind = "validation_failed"
+	KindInsufficientBalance ErrorKind = "insufficient_balance"
+	KindLimitExceeded       ErrorKind = "limit_exceeded"
+	KindConflict            ErrorKind = "conflict"
+)
+
+// Error is a typed domain error returned by the services.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is makes errors.Is match any *Error of the same kind, so callers can test
+// against the sentinels below regardless of message and details.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+// WithDetails returns a copy of e carrying the given details.
+func (e *Error) WithDetails(details map[string]interface{}) *Error {
+	return &Error{Kind: e.Kind, Message: e.Message, Details: details}
+}
+
+var (
+	ErrNotFound            = &Error{Kind: KindNotFound, Message: "not found"}
+	ErrForbidden           = &Error{Kind: KindForbidden, Message: "forbidden"}
+	ErrValidation          = &Error{Kind: KindValidation, Message: "validation failed"}
+	ErrInsufficientBalance = &Error{Kind: KindInsufficientBalance, Message: "insufficient balance"}
+	ErrLimitExceeded       = &Error{Kind: KindLimitExceeded, Message: "limit exceeded"}
+	ErrConflict            = &Error{Kind: KindConflict, Message: "conflict"}
+)
+
+func NotFoundf(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func Forbiddenf(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+func Validationf(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+func LimitExceededf(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindLimitExceeded, Message: fmt.Sprintf(format, args...)}
+}
+
+func Conflictf(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+// translateDBError turns the storage and GORM errors callers care about into
+// typed errors; what names the missing or clashing resource.
+func translateDBError(err error, what string) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		return NotFoundf("%s not found", what)
+	case errors.Is(err, storage.ErrDuplicate), errors.Is(err, gorm.ErrDuplicatedKey):
+		return Conflictf("%s already exists", what)
+	}
+	return err
+}
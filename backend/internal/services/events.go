@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/storage"
+	"reward-system/internal/units"
+)
+
+// Domain events written to the outbox. They share their names with the
+// audit log actions of the same changes.
+const (
+	EventRewardGranted       = ActionRewardGranted
+	EventRewardSpent         = ActionRewardSpent
+	EventTransactionAdjusted = ActionTransactionAdjusted
+	EventRewardTypeCreated   = ActionRewardTypeCreated
+)
+
+// EventFamilyDeletionRequested is written when a guardian consents to
+// deleting their family and the other guardians' consent is still awaited.
+// It has no audit log of its own; the deletion is audited when it happens.
+const EventFamilyDeletionRequested = "family.deletion_requested"
+
+// EventTypes lists every domain event type.
+var EventTypes = []string{EventRewardGranted, EventRewardSpent, EventTransactionAdjusted, EventRewardTypeCreated, EventFamilyDeletionRequested}
+
+// LedgerEvent is the payload of the grant, spend and adjustment events: the
+// transaction as it now stands and the balance of its account after the
+// change. PreviousValue is set on adjustments that changed the value.
+type LedgerEvent struct {
+	TransactionID  uint64    `json:"transaction_id"`
+	AccountID      uint64    `json:"account_id"`
+	ChildID        uint64    `json:"child_id"`
+	RewardTypeID   uint64    `json:"reward_type_id"`
+	Type           string    `json:"type"`
+	Value          int64     `json:"value"`
+	PreviousValue  *int64    `json:"previous_value,omitempty"`
+	Note           string    `json:"note,omitempty"`
+	Balance        int64     `json:"balance"`
+	Scale          int       `json:"scale"`
+	Currency       string    `json:"currency,omitempty"`
+	BalanceDisplay string    `json:"balance_display"`
+	CreatedBy      *uint64   `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func ledgerEvent(transaction *db.Transaction, account *db.Account, rewardType *db.RewardType) *LedgerEvent {
+	return &LedgerEvent{
+		TransactionID: transaction.ID, AccountID: account.ID, ChildID: account.ChildID, RewardTypeID: account.RewardTypeID,
+		Type: transaction.Type, Value: transaction.Value, Note: transaction.Note,
+		Balance: account.Balance, Scale: rewardType.Scale, Currency: rewardType.Currency,
+		BalanceDisplay: units.For(rewardType).Format(account.Balance),
+		CreatedBy:      transaction.CreatedBy, CreatedAt: transaction.CreatedAt,
+	}
+}
+
+// DeletionRequestedEvent is the payload of the deletion request event:
+// RequestedBy consented to deleting the family until ExpiresAt, and the
+// guardians in Awaiting have yet to.
+type DeletionRequestedEvent struct {
+	RequestedBy uint64    `json:"requested_by"`
+	ConfirmedBy []uint64  `json:"confirmed_by"`
+	Awaiting    []uint64  `json:"awaiting"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// EventEnvelope is how an outbox event is published, to webhooks and
+// streams alike. ID is the outbox id: it is the same on every delivery of
+// the event and increases with each event.
+type EventEnvelope struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	FamilyID  uint64          `json:"family_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func NewEventEnvelope(event *db.OutboxEvent) *EventEnvelope {
+	envelope := &EventEnvelope{ID: event.ID, Type: event.Type, FamilyID: event.FamilyID, CreatedAt: event.CreatedAt}
+	if event.Payload != "" {
+		envelope.Data = json.RawMessage(event.Payload)
+	}
+	return envelope
+}
+
+// EmitEvent writes an event to the outbox for changes made outside the
+// services, such as a family's deletion, see emit.
+func EmitEvent(ctx context.Context, repo storage.Repository, familyID uint64, eventType string, payload interface{}) error {
+	return emit(ctx, repo, familyID, eventType, payload)
+}
+
+// emit writes an event to the outbox in the transaction of repo, so it is
+// published exactly when the change commits.
+func emit(ctx context.Context, repo storage.Repository, familyID uint64, eventType string, payload interface{}) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return repo.CreateOutboxEvent(ctx, &db.OutboxEvent{FamilyID: familyID, Type: eventType, Payload: string(encoded), CreatedAt: time.Now()})
+}
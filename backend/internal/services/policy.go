@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+
+	"reward-system/internal/db"
+)
+
+// Authorization follows section 8 of 需求.md: guardians manage their
+// family's reward types, users and ledger; children read their own balances
+// and transactions and spend only from the reward types the family opened
+// to them. No user reaches another family. The operator of the instance, a
+// client of the shared API token, the command line or a background job, is
+// not restricted; only those set the marker of OperatorActor, so a context
+// without an actor is nobody and is refused everything.
+//
+// The services check their own methods, so REST, MCP and WeChat share one
+// policy; the API checks the endpoints that bypass the services with the
+// same functions. Every refusal is a KindForbidden error.
+
+// UserActor returns the actor for a user acting through source.
+func UserActor(user *db.User, source string) Actor {
+	return Actor{UserID: user.ID, FamilyID: user.FamilyID, Role: user.Role, Source: source}
+}
+
+// OperatorActor returns the actor for the operator of the instance acting
+// through source.
+func OperatorActor(source string) Actor {
+	return Actor{Operator: true, Source: source}
+}
+
+// IsOperator reports whether the actor is the operator of the instance.
+func (a Actor) IsOperator() bool {
+	return a.Operator && a.UserID == 0
+}
+
+// isMemberOf reports whether the actor is a user of the family.
+func (a Actor) isMemberOf(familyID uint64) bool {
+	return a.UserID != 0 && a.FamilyID == familyID
+}
+
+// isGuardianOf reports whether the actor is a guardian of the family.
+func (a Actor) isGuardianOf(familyID uint64) bool {
+	return a.isMemberOf(familyID) && a.Role == "guardian"
+}
+
+// AuthorizeOperator allows only actors that are not users, for what spans
+// families such as creating or importing one.
+func AuthorizeOperator(ctx context.Context) error {
+	if ActorFrom(ctx).IsOperator() {
+		return nil
+	}
+	return Forbiddenf("only the operator of the instance may do this")
+}
+
+// AuthorizeGuardian allows the guardians of the family.
+func AuthorizeGuardian(ctx context.Context, familyID uint64) error {
+	actor := ActorFrom(ctx)
+	if actor.IsOperator() || actor.isGuardianOf(familyID) {
+		return nil
+	}
+	return Forbiddenf("only a guardian of family %d may do this", familyID).WithDetails(map[string]interface{}{"family_id": familyID})
+}
+
+// AuthorizeMember allows every user of the family.
+func AuthorizeMember(ctx context.Context, familyID uint64) error {
+	actor := ActorFrom(ctx)
+	if actor.IsOperator() || actor.isMemberOf(familyID) {
+		return nil
+	}
+	return Forbiddenf("not a member of family %d", familyID).WithDetails(map[string]interface{}{"family_id": familyID})
+}
+
+// AuthorizeSelf allows the user themselves and the guardians of their
+// family, for a child's ledger or a user's own settings.
+func AuthorizeSelf(ctx context.Context, familyID, userID uint64) error {
+	actor := ActorFrom(ctx)
+	if actor.IsOperator() || actor.isGuardianOf(familyID) || (actor.isMemberOf(familyID) && actor.UserID == userID) {
+		return nil
+	}
+	return Forbiddenf("only user %d or a guardian of their family may do this", userID).WithDetails(map[string]interface{}{"family_id": familyID, "user_id": userID})
+}
+
+// AuthorizeAccount allows the user themselves and, for a child, the
+// guardians of their family: what lets someone sign in, such as a password
+// or sessions, is not managed by another adult.
+func AuthorizeAccount(ctx context.Context, user *db.User) error {
+	actor := ActorFrom(ctx)
+	if actor.IsOperator() || (actor.isMemberOf(user.FamilyID) && actor.UserID == user.ID) {
+		return nil
+	}
+	if user.Role == "child" && actor.isGuardianOf(user.FamilyID) {
+		return nil
+	}
+	return Forbiddenf("only user %d or, for a child, a guardian of their family may do this", user.ID).WithDetails(map[string]interface{}{"family_id": user.FamilyID, "user_id": user.ID})
+}
+
+// ScopeFamily resolves the family a listing is limited to: a user may only
+// list their own, which is also the default, while the operator lists every
+// family when familyID is 0.
+func ScopeFamily(ctx context.Context, familyID uint64) (uint64, error) {
+	actor := ActorFrom(ctx)
+	if actor.IsOperator() {
+		return familyID, nil
+	}
+	if familyID == 0 {
+		familyID = actor.FamilyID
+	}
+	if err := AuthorizeMember(ctx, familyID); err != nil {
+		return 0, err
+	}
+	return familyID, nil
+}
+
+// authorizeSpend allows the family's guardians to spend from any child's
+// balance, and a child to spend from their own where the reward type
+// allows children to spend.
+func authorizeSpend(ctx context.Context, rewardType *db.RewardType, childID uint64) error {
+	actor := ActorFrom(ctx)
+	if actor.IsOperator() || actor.isGuardianOf(rewardType.FamilyID) {
+		return nil
+	}
+	if actor.isMemberOf(rewardType.FamilyID) && actor.UserID == childID && rewardType.ChildrenMaySpend {
+		return nil
+	}
+	return Forbiddenf("only a guardian may spend %s here", rewardType.Name).WithDetails(map[string]interface{}{"reward_type_id": rewardType.ID, "child_id": childID})
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"reward-system/internal/db"
+	"reward-system/internal/units"
+)
+
+// LedgerResult is the outcome of a grant or spend. NewBalance is in scaled
+// units; Scale and Currency tell clients how to read it. Account (with its
+// RewardType) and Transaction are for callers and are not serialized.
+type LedgerResult struct {
+	TransactionID uint64 `json:"transaction_id"`
+	NewBalance    int64  `json:"new_balance"`
+	Scale         int    `json:"scale"`
+	Currency      string `json:"currency,omitempty"`
+	Display       string `json:"display"`
+	// Replayed is set when an idempotency key matched an earlier request
+	// and nothing new was written.
+	Replayed bool `json:"-"`
+
+	Account     *db.Account     `json:"-"`
+	Transaction *db.Transaction `json:"-"`
+}
+
+// newLedgerResult reports the balance recorded with the transaction, which
+// for a replay may since have changed.
+func newLedgerResult(transaction *db.Transaction, account *db.Account, rewardType *db.RewardType) *LedgerResult {
+	account.RewardType = *rewardType
+	return &LedgerResult{
+		TransactionID: transaction.ID,
+		NewBalance:    transaction.BalanceAfter,
+		Scale:         rewardType.Scale,
+		Currency:      rewardType.Currency,
+		Display:       units.For(rewardType).Format(transaction.BalanceAfter),
+		Account:       account,
+		Transaction:   transaction,
+	}
+}
+
+// BalanceResult is a child's balance of one reward type. A child without an
+// account yet has a zero balance.
+type BalanceResult struct {
+	Balance  int64  `json:"balance"`
+	Scale    int    `json:"scale"`
+	Currency string `json:"currency,omitempty"`
+	Display  string `json:"display"`
+
+	RewardType *db.RewardType `json:"-"`
+}
+
+func newBalanceResult(balance int64, rewardType *db.RewardType) *BalanceResult {
+	return &BalanceResult{
+		Balance:    balance,
+		Scale:      rewardType.Scale,
+		Currency:   rewardType.Currency,
+		Display:    units.For(rewardType).Format(balance),
+		RewardType: rewardType,
+	}
+}
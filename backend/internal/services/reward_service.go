@@ -1,220 +1,421 @@
 package services
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"reward-system/internal/db"
+	"reward-system/internal/storage"
 
 	"gorm.io/gorm"
 )
 
+// RewardService implements the ledger and the family's reward
+// configuration. Every method takes the request's context, which bounds the
+// storage operations it runs.
 type RewardService struct {
-	db *gorm.DB
+	repo storage.Repository
 }
 
+// NewRewardService returns a service storing its data in a GORM database.
 func NewRewardService(db *gorm.DB) *RewardService {
-	return &RewardService{db: db}
+	return NewRewardServiceWithRepository(storage.NewGorm(db))
 }
 
-func (s *RewardService) GrantReward(familyID, childID, rewardTypeID uint64, value int64, note, idempotencyKey string) (map[string]interface{}, error) {
-	tx := s.db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+// NewRewardServiceWithRepository returns a service on any repository, such as
+// storage.NewMemory() for running the ledger without a database.
+func NewRewardServiceWithRepository(repo storage.Repository) *RewardService {
+	return &RewardService{repo: repo}
+}
+
+// GrantReward credits value to the child's account of the reward type,
+// opening the account on first use. Only guardians grant.
+func (s *RewardService) GrantReward(ctx context.Context, familyID, childID, rewardTypeID uint64, value int64, note, idempotencyKey string) (*LedgerResult, error) {
+	if err := AuthorizeGuardian(ctx, familyID); err != nil {
+		return nil, err
+	}
+	var result *LedgerResult
+	err := s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		_, rewardType, err := checkLedgerTargets(ctx, repo, familyID, childID, rewardTypeID)
+		if err != nil {
+			return err
+		}
+		if err := ValidateValue(rewardType, value); err != nil {
+			return err
 		}
-	}()
 
-	// Check idempotency
-	if idempotencyKey != "" {
-		var existingTx db.Transaction
-		if err := tx.Where("idempotency_key = ?", idempotencyKey).First(&existingTx).Error; err == nil {
-			tx.Rollback()
-			return map[string]interface{}{
-				"transaction_id": existingTx.ID,
-				"new_balance":      s.getAccountBalance(tx, childID, rewardTypeID),
-			}, nil
+		// Check idempotency
+		if result, err = replayIdempotent(ctx, repo, idempotencyKey, childID, rewardType, "credit", value); result != nil || err != nil {
+			return err
+		}
+
+		// Get or create account, then lock it for update
+		account, err := getOrCreateAccount(ctx, repo, familyID, childID, rewardTypeID)
+		if err != nil {
+			return err
+		}
+		if account, err = repo.LockAccount(ctx, account.ID); err != nil {
+			return err
 		}
-	}
 
-	// Get or create account
-	account, err := s.getOrCreateAccount(tx, familyID, childID, rewardTypeID)
+		transaction := &db.Transaction{
+			AccountID:      account.ID,
+			Type:           "credit",
+			Value:          value,
+			BalanceAfter:   account.Balance + value,
+			Note:           note,
+			CreatedBy:      ActorFrom(ctx).userID(),
+			IdempotencyKey: idempotencyKey,
+		}
+		if err := repo.CreateTransaction(ctx, transaction); err != nil {
+			return err
+		}
+
+		before := ledgerAudit(nil, account)
+		account.Balance += value
+		if err := repo.UpdateAccountBalance(ctx, account.ID, account.Balance); err != nil {
+			return err
+		}
+		if err := audit(ctx, repo, familyID, ActionRewardGranted, before, ledgerAudit(transaction, account)); err != nil {
+			return err
+		}
+		if err := emit(ctx, repo, familyID, EventRewardGranted, ledgerEvent(transaction, account, rewardType)); err != nil {
+			return err
+		}
+
+		result = newLedgerResult(transaction, account, rewardType)
+		return nil
+	})
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
+	return result, nil
+}
 
-	// Lock account for update
-	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&account, account.ID).Error; err != nil {
-		tx.Rollback()
+// SpendReward debits value from the child's account of the reward type; the
+// balance may not go negative. Guardians spend, and so does the child
+// themselves where the reward type has ChildrenMaySpend.
+func (s *RewardService) SpendReward(ctx context.Context, familyID, childID, rewardTypeID uint64, value int64, note, idempotencyKey string) (*LedgerResult, error) {
+	if err := AuthorizeSelf(ctx, familyID, childID); err != nil {
 		return nil, err
 	}
+	var result *LedgerResult
+	err := s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		_, rewardType, err := checkLedgerTargets(ctx, repo, familyID, childID, rewardTypeID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeSpend(ctx, rewardType, childID); err != nil {
+			return err
+		}
+		if err := ValidateValue(rewardType, value); err != nil {
+			return err
+		}
+
+		// Check idempotency
+		if result, err = replayIdempotent(ctx, repo, idempotencyKey, childID, rewardType, "debit", value); result != nil || err != nil {
+			return err
+		}
+
+		// Get account, then lock it for update
+		account, err := repo.FindAccount(ctx, childID, rewardTypeID)
+		if err != nil {
+			return translateDBError(err, "account")
+		}
+		if account, err = repo.LockAccount(ctx, account.ID); err != nil {
+			return err
+		}
+
+		if account.Balance < value {
+			return ErrInsufficientBalance.WithDetails(map[string]interface{}{
+				"balance":   account.Balance,
+				"requested": value,
+			})
+		}
 
-	// Create transaction
-	transaction := &db.Transaction{
-		AccountID:      account.ID,
-		Type:           "credit",
-		Value:          value,
-		Note:           note,
-		CreatedBy:      childID, // In real implementation, this should be the guardian ID
-		IdempotencyKey: idempotencyKey,
+		transaction := &db.Transaction{
+			AccountID:      account.ID,
+			Type:           "debit",
+			Value:          value,
+			BalanceAfter:   account.Balance - value,
+			Note:           note,
+			CreatedBy:      ActorFrom(ctx).userID(),
+			IdempotencyKey: idempotencyKey,
+		}
+		if err := repo.CreateTransaction(ctx, transaction); err != nil {
+			return err
+		}
+
+		before := ledgerAudit(nil, account)
+		account.Balance -= value
+		if err := repo.UpdateAccountBalance(ctx, account.ID, account.Balance); err != nil {
+			return err
+		}
+		if err := audit(ctx, repo, familyID, ActionRewardSpent, before, ledgerAudit(transaction, account)); err != nil {
+			return err
+		}
+		if err := emit(ctx, repo, familyID, EventRewardSpent, ledgerEvent(transaction, account, rewardType)); err != nil {
+			return err
+		}
+
+		result = newLedgerResult(transaction, account, rewardType)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return result, nil
+}
 
-	if err := tx.Create(transaction).Error; err != nil {
-		tx.Rollback()
+// GetBalance reads a balance, for the child or a guardian. Balances of
+// inactive children stay readable: their ledger is frozen, not gone.
+func (s *RewardService) GetBalance(ctx context.Context, familyID, childID, rewardTypeID uint64) (*BalanceResult, error) {
+	if err := AuthorizeSelf(ctx, familyID, childID); err != nil {
+		return nil, err
+	}
+	if _, err := familyChild(ctx, s.repo, familyID, childID); err != nil {
+		return nil, err
+	}
+	rewardType, err := familyRewardType(ctx, s.repo, familyID, rewardTypeID)
+	if err != nil {
 		return nil, err
 	}
 
-	// Update account balance
-	account.Balance += value
-	if err := tx.Save(&account).Error; err != nil {
-		tx.Rollback()
+	account, err := s.repo.FindAccount(ctx, childID, rewardTypeID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return newBalanceResult(0, rewardType), nil
+	}
+	if err != nil {
 		return nil, err
 	}
+	return newBalanceResult(account.Balance, rewardType), nil
+}
 
-	if err := tx.Commit().Error; err != nil {
+// ListTransactions pages backwards through a child's transactions, for the
+// child or a guardian. The limit defaults to 20 and is capped at 200.
+func (s *RewardService) ListTransactions(ctx context.Context, familyID, childID, rewardTypeID uint64, limit int, beforeID uint64) ([]db.Transaction, error) {
+	if err := AuthorizeSelf(ctx, familyID, childID); err != nil {
 		return nil, err
 	}
+	if limit <= 0 {
+		limit = 20
+	}
+	if limit > 200 {
+		limit = 200
+	}
+	if _, err := familyChild(ctx, s.repo, familyID, childID); err != nil {
+		return nil, err
+	}
+	if rewardTypeID > 0 {
+		if _, err := familyRewardType(ctx, s.repo, familyID, rewardTypeID); err != nil {
+			return nil, err
+		}
+	}
 
-	return map[string]interface{}{
-		"transaction_id": transaction.ID,
-		"new_balance":      account.Balance,
-	}, nil
+	return s.repo.ListTransactions(ctx, storage.TransactionFilter{
+		FamilyID:     familyID,
+		ChildID:      childID,
+		RewardTypeID: rewardTypeID,
+		BeforeID:     beforeID,
+		Limit:        limit,
+	})
 }
 
-func (s *RewardService) SpendReward(familyID, childID, rewardTypeID uint64, value int64, note, idempotencyKey string) (map[string]interface{}, error) {
-	tx := s.db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+// AdjustTransaction corrects the value or note of a recorded transaction
+// and returns it as updated. A new value moves the account balance by the
+// difference, which may not take the balance below zero. Only guardians
+// adjust.
+func (s *RewardService) AdjustTransaction(ctx context.Context, transactionID uint64, newValue *int64, newNote *string) (*db.Transaction, error) {
+	var transaction *db.Transaction
+	err := s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		var err error
+		if transaction, err = repo.GetTransaction(ctx, transactionID); err != nil {
+			return translateDBError(err, "transaction")
 		}
-	}()
-
-	// Check idempotency
-	if idempotencyKey != "" {
-		var existingTx db.Transaction
-		if err := tx.Where("idempotency_key = ?", idempotencyKey).First(&existingTx).Error; err == nil {
-			tx.Rollback()
-			return map[string]interface{}{
-				"transaction_id": existingTx.ID,
-				"new_balance":      s.getAccountBalance(tx, childID, rewardTypeID),
-			}, nil
+		account, err := repo.LockAccount(ctx, transaction.AccountID)
+		if err != nil {
+			return translateDBError(err, "account")
+		}
+		if err := AuthorizeGuardian(ctx, account.FamilyID); err != nil {
+			return err
+		}
+		if err := checkActiveChild(ctx, repo, account.ChildID); err != nil {
+			return err
+		}
+		if newValue == nil && newNote == nil {
+			return nil
+		}
+		before := ledgerAudit(transaction, account)
+		rewardType, err := repo.GetRewardType(ctx, account.RewardTypeID)
+		if err != nil {
+			return translateDBError(err, "reward type")
 		}
-	}
-
-	// Get account
-	var account db.Account
-	if err := tx.Where("child_id = ? AND reward_type_id = ?", childID, rewardTypeID).First(&account).Error; err != nil {
-		tx.Rollback()
-		return nil, fmt.Errorf("account not found")
-	}
 
-	// Lock account for update
-	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&account, account.ID).Error; err != nil {
-		tx.Rollback()
+		var previousValue *int64
+		if newValue != nil {
+			if err := ValidateValue(rewardType, *newValue); err != nil {
+				return err
+			}
+			delta := *newValue - transaction.Value
+			if transaction.Type == "debit" {
+				delta = -delta
+			}
+			if account.Balance+delta < 0 {
+				return ErrInsufficientBalance.WithDetails(map[string]interface{}{
+					"balance":   account.Balance,
+					"requested": -delta,
+				})
+			}
+			if delta != 0 {
+				account.Balance += delta
+				if err := repo.UpdateAccountBalance(ctx, account.ID, account.Balance); err != nil {
+					return err
+				}
+			}
+			if *newValue != transaction.Value {
+				previous := transaction.Value
+				previousValue = &previous
+			}
+			transaction.Value = *newValue
+		}
+		if newNote != nil {
+			transaction.Note = *newNote
+		}
+		if err := repo.UpdateTransaction(ctx, transaction); err != nil {
+			return err
+		}
+		if err := audit(ctx, repo, account.FamilyID, ActionTransactionAdjusted, before, ledgerAudit(transaction, account)); err != nil {
+			return err
+		}
+		event := ledgerEvent(transaction, account, rewardType)
+		event.PreviousValue = previousValue
+		return emit(ctx, repo, account.FamilyID, EventTransactionAdjusted, event)
+	})
+	if err != nil {
 		return nil, err
 	}
+	return transaction, nil
+}
 
-	// Check sufficient balance
-	if account.Balance < value {
-		tx.Rollback()
-		return nil, fmt.Errorf("insufficient balance")
+func getOrCreateAccount(ctx context.Context, repo storage.Repository, familyID, childID, rewardTypeID uint64) (*db.Account, error) {
+	account, err := repo.FindAccount(ctx, childID, rewardTypeID)
+	if errors.Is(err, storage.ErrNotFound) {
+		account = &db.Account{
+			FamilyID:     familyID,
+			ChildID:      childID,
+			RewardTypeID: rewardTypeID,
+			Balance:      0,
+		}
+		// The insert runs in a savepoint: PostgreSQL rejects every further
+		// statement of a transaction once one has failed, and a concurrent
+		// request may have opened the account since the lookup above.
+		err = repo.Transaction(ctx, func(repo storage.Repository) error {
+			return repo.CreateAccount(ctx, account)
+		})
+		if errors.Is(err, storage.ErrDuplicate) {
+			if existing, findErr := repo.FindAccount(ctx, childID, rewardTypeID); findErr == nil {
+				return existing, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return account, nil
 	}
+	return account, err
+}
 
-	// Create transaction
-	transaction := &db.Transaction{
-		AccountID:      account.ID,
-		Type:           "debit",
-		Value:          value,
-		Note:           note,
-		CreatedBy:      childID, // In real implementation, this should be the guardian ID
-		IdempotencyKey: idempotencyKey,
+// checkLedgerTargets verifies that childID is an active child of familyID and
+// that rewardTypeID is defined by the same family, so a mistyped id can never
+// touch another family's ledger or credit a guardian.
+func checkLedgerTargets(ctx context.Context, repo storage.Repository, familyID, childID, rewardTypeID uint64) (*db.User, *db.RewardType, error) {
+	child, err := familyChild(ctx, repo, familyID, childID)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	if err := tx.Create(transaction).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+	if !child.IsActive {
+		return nil, nil, inactiveChild(child)
 	}
-
-	// Update account balance
-	account.Balance -= value
-	if err := tx.Save(&account).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+	rewardType, err := familyRewardType(ctx, repo, familyID, rewardTypeID)
+	if err != nil {
+		return nil, nil, err
 	}
+	return child, rewardType, nil
+}
 
-	if err := tx.Commit().Error; err != nil {
-		return nil, err
+// checkActiveChild rejects changes to the ledger of a deactivated or
+// archived child, whose transactions are frozen.
+func checkActiveChild(ctx context.Context, repo storage.Repository, childID uint64) error {
+	child, err := repo.GetUser(ctx, childID)
+	if err != nil {
+		return translateDBError(err, "child")
 	}
-
-	return map[string]interface{}{
-		"transaction_id": transaction.ID,
-		"new_balance":      account.Balance,
-	}, nil
+	if !child.IsActive {
+		return inactiveChild(child)
+	}
+	return nil
 }
 
-func (s *RewardService) GetBalance(familyID, childID, rewardTypeID uint64) (int64, error) {
-	var account db.Account
-	if err := s.db.Where("child_id = ? AND reward_type_id = ?", childID, rewardTypeID).First(&account).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return 0, nil
-		}
-		return 0, err
+func inactiveChild(child *db.User) error {
+	details := map[string]interface{}{"child_id": child.ID}
+	if child.ArchivedAt != nil {
+		return Validationf("child %d is archived", child.ID).WithDetails(details)
 	}
-	return account.Balance, nil
+	return Validationf("child %d is inactive", child.ID).WithDetails(details)
 }
 
-func (s *RewardService) ListTransactions(familyID, childID, rewardTypeID uint64, limit int, beforeID uint64) ([]db.Transaction, error) {
-	query := s.db.Where("account_id IN (SELECT id FROM accounts WHERE child_id = ?)", childID)
-	
-	if rewardTypeID > 0 {
-		query = query.Where("reward_type_id = ?", rewardTypeID)
+func familyChild(ctx context.Context, repo storage.Repository, familyID, childID uint64) (*db.User, error) {
+	child, err := repo.GetUser(ctx, childID)
+	if err != nil {
+		return nil, translateDBError(err, "child")
 	}
-	
-	if beforeID > 0 {
-		query = query.Where("id < ?", beforeID)
+	if child.FamilyID != familyID {
+		return nil, NotFoundf("child not found in family").WithDetails(map[string]interface{}{"family_id": familyID, "child_id": childID})
 	}
-	
-	var transactions []db.Transaction
-	if err := query.Order("id DESC").Limit(limit).Find(&transactions).Error; err != nil {
-		return nil, err
+	if child.Role != "child" {
+		return nil, Validationf("user %d is not a child", childID).WithDetails(map[string]interface{}{"child_id": childID, "role": child.Role})
 	}
-	
-	return transactions, nil
+	return child, nil
 }
 
-func (s *RewardService) AdjustTransaction(transactionID uint64, newValue *int64, newNote *string) error {
-	return s.db.Model(&db.Transaction{}).Where("id = ?", transactionID).Updates(map[string]interface{}{
-		"value": newValue,
-		"note":  newNote,
-	}).Error
+func familyRewardType(ctx context.Context, repo storage.Repository, familyID, rewardTypeID uint64) (*db.RewardType, error) {
+	rewardType, err := repo.GetRewardType(ctx, rewardTypeID)
+	if err != nil {
+		return nil, translateDBError(err, "reward type")
+	}
+	if rewardType.FamilyID != familyID {
+		return nil, NotFoundf("reward type not found in family").WithDetails(map[string]interface{}{"family_id": familyID, "reward_type_id": rewardTypeID})
+	}
+	return rewardType, nil
 }
 
-func (s *RewardService) getOrCreateAccount(tx *gorm.DB, familyID, childID, rewardTypeID uint64) (*db.Account, error) {
-	var account db.Account
-	
-	if err := tx.Where("child_id = ? AND reward_type_id = ?", childID, rewardTypeID).First(&account).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Create new account
-			account = db.Account{
-				FamilyID:     familyID,
-				ChildID:      childID,
-				RewardTypeID: rewardTypeID,
-				Balance:      0,
-			}
-			if err := tx.Create(&account).Error; err != nil {
-				return nil, err
-			}
-			return &account, nil
-		}
+// replayIdempotent returns the result of the transaction already recorded
+// under idempotencyKey, or nil when the key is unused. The result carries
+// the balance recorded with that transaction, not the current one. A key
+// that was used for another account, type or value is a conflict rather than
+// a replay.
+func replayIdempotent(ctx context.Context, repo storage.Repository, idempotencyKey string, childID uint64, rewardType *db.RewardType, txType string, value int64) (*LedgerResult, error) {
+	if idempotencyKey == "" {
+		return nil, nil
+	}
+	existingTx, err := repo.FindTransactionByIdempotencyKey(ctx, idempotencyKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
-	
-	return &account, nil
-}
-
-func (s *RewardService) getAccountBalance(tx *gorm.DB, childID, rewardTypeID uint64) int64 {
-	var account db.Account
-	if err := tx.Where("child_id = ? AND reward_type_id = ?", childID, rewardTypeID).First(&account).Error; err != nil {
-		return 0
+	account, err := repo.GetAccount(ctx, existingTx.AccountID)
+	if err != nil {
+		return nil, err
 	}
-	return account.Balance
-}
\ No newline at end of file
+	if account.ChildID != childID || account.RewardTypeID != rewardType.ID {
+		return nil, Conflictf("idempotency key already used for another account")
+	}
+	if existingTx.Type != txType || existingTx.Value != value {
+		return nil, Conflictf("idempotency key already used for a %s of %d", existingTx.Type, existingTx.Value).
+			WithDetails(map[string]interface{}{"transaction_id": existingTx.ID, "type": existingTx.Type, "value": existingTx.Value})
+	}
+	result := newLedgerResult(existingTx, account, rewardType)
+	result.Replayed = true
+	return result, nil
+}
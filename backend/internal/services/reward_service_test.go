@@ -1,14 +1,20 @@
 package services
 
 import (
-	"testing"
-	"reward-system/internal/db"
+	"context"
+	"encoding/json"
+	"errors"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"reward-system/internal/auditchain"
+	"reward-system/internal/db"
+	"reward-system/internal/storage"
+	"strings"
+	"testing"
 )
 
 func setupTestDB(t *testing.T) *gorm.DB {
-	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
 	if err != nil {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
@@ -21,6 +27,10 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		&db.Account{},
 		&db.Transaction{},
 		&db.AuditLog{},
+		&db.AuditChain{},
+		&db.OutboxEvent{},
+		&db.Webhook{},
+		&db.WebhookDelivery{},
 	); err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
@@ -29,12 +39,13 @@ func setupTestDB(t *testing.T) *gorm.DB {
 }
 
 func TestRewardService_GrantReward(t *testing.T) {
-	db := setupTestDB(t)
-	service := NewRewardService(db)
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
 
 	// Create test data
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -43,7 +54,7 @@ func TestRewardService_GrantReward(t *testing.T) {
 		Role:        "child",
 		DisplayName: "Test Child",
 	}
-	if err := db.Create(child).Error; err != nil {
+	if err := database.Create(child).Error; err != nil {
 		t.Fatalf("Failed to create test child: %v", err)
 	}
 
@@ -52,42 +63,65 @@ func TestRewardService_GrantReward(t *testing.T) {
 		Name:     "Test Reward",
 		UnitKind: "money",
 	}
-	if err := db.Create(rewardType).Error; err != nil {
+	if err := database.Create(rewardType).Error; err != nil {
 		t.Fatalf("Failed to create test reward type: %v", err)
 	}
 
 	// Test grant reward
-	result, err := service.GrantReward(family.ID, child.ID, rewardType.ID, 1000, "Test grant", "test-key-1")
+	result, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "Test grant", "test-key-1")
 	if err != nil {
 		t.Fatalf("Failed to grant reward: %v", err)
 	}
 
-	if result["transaction_id"] == nil {
+	if result.TransactionID == 0 {
 		t.Error("Expected transaction_id to be set")
 	}
 
-	if result["new_balance"] != int64(1000) {
-		t.Errorf("Expected balance to be 1000, got %v", result["new_balance"])
+	if result.NewBalance != int64(1000) {
+		t.Errorf("Expected balance to be 1000, got %v", result.NewBalance)
 	}
 
 	// Test idempotency
-	result2, err := service.GrantReward(family.ID, child.ID, rewardType.ID, 1000, "Test grant", "test-key-1")
+	result2, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "Test grant", "test-key-1")
 	if err != nil {
 		t.Fatalf("Failed to grant reward with same idempotency key: %v", err)
 	}
 
-	if result["transaction_id"] != result2["transaction_id"] {
+	if result.TransactionID != result2.TransactionID {
 		t.Error("Expected same transaction_id for idempotent request")
 	}
+	if result.Replayed || !result2.Replayed {
+		t.Error("Expected only the retried grant to be marked as replayed")
+	}
+	if result2.NewBalance != 1000 || result2.Account.RewardType.ID != rewardType.ID {
+		t.Errorf("Expected the replay to report the account, got %+v", result2)
+	}
+
+	// A replay reports the balance the grant left, not the current one, and
+	// the key cannot be reused for another type or value.
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 500, "", "test-key-2"); err != nil {
+		t.Fatalf("Failed to grant reward: %v", err)
+	}
+	result3, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "Test grant", "test-key-1")
+	if err != nil || result3.NewBalance != 1000 || result3.Display != result.Display {
+		t.Errorf("Expected the replay to report the recorded balance 1000, got %+v, %v", result3, err)
+	}
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 2000, "Test grant", "test-key-1"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a key reused with another value, got %v", err)
+	}
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "Test grant", "test-key-1"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a key reused for a spend, got %v", err)
+	}
 }
 
 func TestRewardService_SpendReward(t *testing.T) {
-	db := setupTestDB(t)
-	service := NewRewardService(db)
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
 
 	// Create test data
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -96,7 +130,7 @@ func TestRewardService_SpendReward(t *testing.T) {
 		Role:        "child",
 		DisplayName: "Test Child",
 	}
-	if err := db.Create(child).Error; err != nil {
+	if err := database.Create(child).Error; err != nil {
 		t.Fatalf("Failed to create test child: %v", err)
 	}
 
@@ -105,28 +139,28 @@ func TestRewardService_SpendReward(t *testing.T) {
 		Name:     "Test Reward",
 		UnitKind: "money",
 	}
-	if err := db.Create(rewardType).Error; err != nil {
+	if err := database.Create(rewardType).Error; err != nil {
 		t.Fatalf("Failed to create test reward type: %v", err)
 	}
 
 	// First grant some reward
-	_, err := service.GrantReward(family.ID, child.ID, rewardType.ID, 1000, "Initial grant", "test-grant")
+	_, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "Initial grant", "test-grant")
 	if err != nil {
 		t.Fatalf("Failed to grant initial reward: %v", err)
 	}
 
 	// Test spend reward
-	result, err := service.SpendReward(family.ID, child.ID, rewardType.ID, 500, "Test spend", "test-spend-1")
+	result, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 500, "Test spend", "test-spend-1")
 	if err != nil {
 		t.Fatalf("Failed to spend reward: %v", err)
 	}
 
-	if result["new_balance"] != int64(500) {
-		t.Errorf("Expected balance to be 500, got %v", result["new_balance"])
+	if result.NewBalance != int64(500) {
+		t.Errorf("Expected balance to be 500, got %v", result.NewBalance)
 	}
 
 	// Test insufficient balance
-	_, err = service.SpendReward(family.ID, child.ID, rewardType.ID, 1000, "Test overspend", "test-overspend")
+	_, err = service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 1000, "Test overspend", "test-overspend")
 	if err == nil {
 		t.Error("Expected error for insufficient balance")
 	}
@@ -134,15 +168,30 @@ func TestRewardService_SpendReward(t *testing.T) {
 	if err.Error() != "insufficient balance" {
 		t.Errorf("Expected 'insufficient balance' error, got: %v", err)
 	}
+
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Expected ErrInsufficientBalance, got: %v", err)
+	}
+
+	// Spending from a reward type the child has no account for
+	otherType := &db.RewardType{FamilyID: family.ID, Name: "Other Reward", UnitKind: "points"}
+	if err := database.Create(otherType).Error; err != nil {
+		t.Fatalf("Failed to create test reward type: %v", err)
+	}
+	_, err = service.SpendReward(ctx, family.ID, child.ID, otherType.ID, 1, "No account", "test-no-account")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for missing account, got: %v", err)
+	}
 }
 
 func TestRewardService_GetBalance(t *testing.T) {
-	db := setupTestDB(t)
-	service := NewRewardService(db)
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
 
 	// Create test data
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -151,7 +200,7 @@ func TestRewardService_GetBalance(t *testing.T) {
 		Role:        "child",
 		DisplayName: "Test Child",
 	}
-	if err := db.Create(child).Error; err != nil {
+	if err := database.Create(child).Error; err != nil {
 		t.Fatalf("Failed to create test child: %v", err)
 	}
 
@@ -160,43 +209,44 @@ func TestRewardService_GetBalance(t *testing.T) {
 		Name:     "Test Reward",
 		UnitKind: "money",
 	}
-	if err := db.Create(rewardType).Error; err != nil {
+	if err := database.Create(rewardType).Error; err != nil {
 		t.Fatalf("Failed to create test reward type: %v", err)
 	}
 
 	// Test balance for non-existent account
-	balance, err := service.GetBalance(family.ID, child.ID, rewardType.ID)
+	balance, err := service.GetBalance(ctx, family.ID, child.ID, rewardType.ID)
 	if err != nil {
 		t.Fatalf("Failed to get balance: %v", err)
 	}
 
-	if balance != int64(0) {
-		t.Errorf("Expected balance to be 0 for non-existent account, got %v", balance)
+	if balance.Balance != 0 {
+		t.Errorf("Expected balance to be 0 for non-existent account, got %v", balance.Balance)
 	}
 
 	// Grant some reward and check balance
-	_, err = service.GrantReward(family.ID, child.ID, rewardType.ID, 1500, "Test grant", "test-balance")
+	_, err = service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1500, "Test grant", "test-balance")
 	if err != nil {
 		t.Fatalf("Failed to grant reward: %v", err)
 	}
 
-	balance, err = service.GetBalance(family.ID, child.ID, rewardType.ID)
+	balance, err = service.GetBalance(ctx, family.ID, child.ID, rewardType.ID)
 	if err != nil {
 		t.Fatalf("Failed to get balance after grant: %v", err)
 	}
 
-	if balance != int64(1500) {
-		t.Errorf("Expected balance to be 1500, got %v", balance)
+	if balance.Balance != 1500 {
+		t.Errorf("Expected balance to be 1500, got %v", balance.Balance)
 	}
 }
 
 func TestRewardService_ListTransactions(t *testing.T) {
-	db := setupTestDB(t)
-	service := NewRewardService(db)
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
 
 	// Create test data
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -205,7 +255,7 @@ func TestRewardService_ListTransactions(t *testing.T) {
 		Role:        "child",
 		DisplayName: "Test Child",
 	}
-	if err := db.Create(child).Error; err != nil {
+	if err := database.Create(child).Error; err != nil {
 		t.Fatalf("Failed to create test child: %v", err)
 	}
 
@@ -214,14 +264,14 @@ func TestRewardService_ListTransactions(t *testing.T) {
 		Name:     "Test Reward",
 		UnitKind: "money",
 	}
-	if err := db.Create(rewardType).Error; err != nil {
+	if err := database.Create(rewardType).Error; err != nil {
 		t.Fatalf("Failed to create test reward type: %v", err)
 	}
 
 	// Create multiple transactions
 	transactions := []struct {
 		value int64
-		type  string
+		kind  string
 		note  string
 		key   string
 	}{
@@ -232,13 +282,13 @@ func TestRewardService_ListTransactions(t *testing.T) {
 	}
 
 	for _, tx := range transactions {
-		if tx.type == "credit" {
-			_, err := service.GrantReward(family.ID, child.ID, rewardType.ID, tx.value, tx.note, tx.key)
+		if tx.kind == "credit" {
+			_, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, tx.value, tx.note, tx.key)
 			if err != nil {
 				t.Fatalf("Failed to create grant transaction: %v", err)
 			}
 		} else {
-			_, err := service.SpendReward(family.ID, child.ID, rewardType.ID, tx.value, tx.note, tx.key)
+			_, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, tx.value, tx.note, tx.key)
 			if err != nil {
 				t.Fatalf("Failed to create spend transaction: %v", err)
 			}
@@ -246,7 +296,7 @@ func TestRewardService_ListTransactions(t *testing.T) {
 	}
 
 	// Test listing transactions
-	result, err := service.ListTransactions(family.ID, child.ID, rewardType.ID, 10, 0)
+	result, err := service.ListTransactions(ctx, family.ID, child.ID, rewardType.ID, 10, 0)
 	if err != nil {
 		t.Fatalf("Failed to list transactions: %v", err)
 	}
@@ -259,15 +309,30 @@ func TestRewardService_ListTransactions(t *testing.T) {
 	if result[0].Type != "debit" || result[0].Value != 300 {
 		t.Error("Expected newest transaction to be debit of 300")
 	}
+
+	// The limit defaults to 20 and is capped at 200.
+	var account db.Account
+	database.Where("child_id = ?", child.ID).First(&account)
+	more := make([]db.Transaction, 250)
+	for i := range more {
+		more[i] = db.Transaction{AccountID: account.ID, Type: "credit", Value: 1}
+	}
+	database.CreateInBatches(more, 100)
+	for limit, want := range map[int]int{0: 20, -1: 20, 50: 50, 1000: 200} {
+		if result, err := service.ListTransactions(ctx, family.ID, child.ID, 0, limit, 0); err != nil || len(result) != want {
+			t.Errorf("ListTransactions with limit %d = %d transactions, %v; want %d", limit, len(result), err, want)
+		}
+	}
 }
 
 func TestRewardService_CreateRewardType(t *testing.T) {
-	db := setupTestDB(t)
-	service := NewRewardService(db)
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
 
 	// Create test family
 	family := &db.Family{Name: "Test Family"}
-	if err := db.Create(family).Error; err != nil {
+	if err := database.Create(family).Error; err != nil {
 		t.Fatalf("Failed to create test family: %v", err)
 	}
 
@@ -279,7 +344,7 @@ func TestRewardService_CreateRewardType(t *testing.T) {
 		UnitLabel: "元",
 	}
 
-	err := service.CreateRewardType(rewardType)
+	err := service.CreateRewardType(ctx, rewardType)
 	if err != nil {
 		t.Fatalf("Failed to create reward type: %v", err)
 	}
@@ -290,11 +355,593 @@ func TestRewardService_CreateRewardType(t *testing.T) {
 
 	// Verify the reward type was created
 	var found db.RewardType
-	if err := db.First(&found, rewardType.ID).Error; err != nil {
+	if err := database.First(&found, rewardType.ID).Error; err != nil {
 		t.Fatalf("Failed to find created reward type: %v", err)
 	}
 
 	if found.Name != "Test Reward Type" {
 		t.Errorf("Expected reward type name to be 'Test Reward Type', got %s", found.Name)
 	}
-}
\ No newline at end of file
+}
+
+func TestRewardService_FamilyIntegrity(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	otherFamily := &db.Family{Name: "Other Family"}
+	database.Create(family)
+	database.Create(otherFamily)
+
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Test Guardian", WechatOpenID: "guardian-openid"}
+	otherChild := &db.User{FamilyID: otherFamily.ID, Role: "child", DisplayName: "Other Child", WechatOpenID: "other-openid"}
+	inactiveChild := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Inactive Child", WechatOpenID: "inactive-openid"}
+	for _, u := range []*db.User{child, guardian, otherChild, inactiveChild} {
+		if err := database.Create(u).Error; err != nil {
+			t.Fatalf("Failed to create test user: %v", err)
+		}
+	}
+	database.Model(inactiveChild).Update("is_active", false)
+
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Test Reward", UnitKind: "money"}
+	otherType := &db.RewardType{FamilyID: otherFamily.ID, Name: "Other Reward", UnitKind: "money"}
+	database.Create(rewardType)
+	database.Create(otherType)
+
+	cases := []struct {
+		name         string
+		childID      uint64
+		rewardTypeID uint64
+		want         error
+	}{
+		{"child of another family", otherChild.ID, rewardType.ID, ErrNotFound},
+		{"unknown child", 9999, rewardType.ID, ErrNotFound},
+		{"guardian as child", guardian.ID, rewardType.ID, ErrValidation},
+		{"inactive child", inactiveChild.ID, rewardType.ID, ErrValidation},
+		{"reward type of another family", child.ID, otherType.ID, ErrNotFound},
+	}
+	for _, tc := range cases {
+		if _, err := service.GrantReward(ctx, family.ID, tc.childID, tc.rewardTypeID, 100, "", ""); !errors.Is(err, tc.want) {
+			t.Errorf("GrantReward with %s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		if _, err := service.SpendReward(ctx, family.ID, tc.childID, tc.rewardTypeID, 100, "", ""); !errors.Is(err, tc.want) {
+			t.Errorf("SpendReward with %s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		if _, err := service.GetBalance(ctx, family.ID, tc.childID, tc.rewardTypeID); tc.want == ErrNotFound && !errors.Is(err, tc.want) {
+			t.Errorf("GetBalance with %s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	var count int64
+	database.Model(&db.Transaction{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no transactions to be written, got %d", count)
+	}
+
+	// An idempotency key cannot be replayed against another child's account
+	secondChild := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Second Child", WechatOpenID: "second-openid"}
+	database.Create(secondChild)
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 100, "", "shared-key"); err != nil {
+		t.Fatalf("Failed to grant reward: %v", err)
+	}
+	if _, err := service.GrantReward(ctx, family.ID, secondChild.ID, rewardType.ID, 100, "", "shared-key"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for reused idempotency key, got %v", err)
+	}
+}
+
+func TestRewardService_ValueValidation(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "TV Time", UnitKind: "time", MaxValue: 120}
+	if err := service.CreateRewardType(ctx, rewardType); err != nil {
+		t.Fatalf("Failed to create reward type: %v", err)
+	}
+
+	for _, value := range []int64{0, -30} {
+		if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, value, "", ""); !errors.Is(err, ErrValidation) {
+			t.Errorf("GrantReward(%d): expected ErrValidation, got %v", value, err)
+		}
+		if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, value, "", ""); !errors.Is(err, ErrValidation) {
+			t.Errorf("SpendReward(%d): expected ErrValidation, got %v", value, err)
+		}
+	}
+
+	_, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 121, "", "")
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+	if details := err.(*Error).Details; details["max_value"] != int64(120) {
+		t.Errorf("Expected max_value in details, got %v", details)
+	}
+
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 120, "", ""); err != nil {
+		t.Errorf("Expected grant at the maximum to succeed, got %v", err)
+	}
+
+	if err := service.CreateRewardType(ctx, &db.RewardType{FamilyID: family.ID, Name: "Bad", UnitKind: "money", MaxValue: -1}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected ErrValidation for negative max_value, got %v", err)
+	}
+}
+
+func TestRewardService_CurrencyAndScale(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Pocket Money", UnitKind: "money", Scale: 2}
+	if err := service.CreateRewardType(ctx, rewardType); err != nil {
+		t.Fatalf("Failed to create reward type: %v", err)
+	}
+	if rewardType.Currency != "CNY" {
+		t.Errorf("Expected money to default to CNY, got %q", rewardType.Currency)
+	}
+
+	invalid := []*db.RewardType{
+		{FamilyID: family.ID, Name: "Half Minutes", UnitKind: "time", Scale: 1},
+		{FamilyID: family.ID, Name: "Tiny", UnitKind: "points", Scale: 9},
+		{FamilyID: family.ID, Name: "Euros", UnitKind: "money", Currency: "EUR", Scale: 2},
+		{FamilyID: family.ID, Name: "Dollar Points", UnitKind: "points", Currency: "USD"},
+	}
+	for _, rt := range invalid {
+		if err := service.CreateRewardType(ctx, rt); !errors.Is(err, ErrValidation) {
+			t.Errorf("CreateRewardType(%s): expected ErrValidation, got %v", rt.Name, err)
+		}
+	}
+
+	result, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 150, "", "")
+	if err != nil {
+		t.Fatalf("Failed to grant reward: %v", err)
+	}
+	if result.Scale != 2 || result.Currency != "CNY" || result.Display != "¥1.50" {
+		t.Errorf("Unexpected grant result %v", result)
+	}
+
+	// Rescaling would turn the stored 150 cents into ¥15.0.
+	scale := 1
+	if _, err := service.UpdateRewardType(ctx, rewardType.ID, RewardTypeUpdate{Scale: &scale}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict when rescaling a type with balances, got %v", err)
+	}
+	name := "Allowance"
+	if _, err := service.UpdateRewardType(ctx, rewardType.ID, RewardTypeUpdate{Name: &name}); err != nil {
+		t.Errorf("Expected renaming to succeed, got %v", err)
+	}
+}
+
+func TestRewardService_UserLifecycle(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child", IsActive: true}
+	database.Create(child)
+	database.Create(&db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Test Guardian", WechatOpenID: "guardian-openid", IsActive: true})
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+	granted, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 10, "", "")
+	if err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+
+	name, openID := "Renamed Child", "child-openid"
+	if user, err := service.UpdateUser(ctx, child.ID, UserUpdate{DisplayName: &name, WechatOpenID: &openID}); err != nil || user.DisplayName != name {
+		t.Fatalf("UpdateUser: %+v, %v", user, err)
+	}
+	taken, empty := "guardian-openid", " "
+	if _, err := service.UpdateUser(ctx, child.ID, UserUpdate{WechatOpenID: &taken}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected a conflict for another user's openid, got %v", err)
+	}
+	if _, err := service.UpdateUser(ctx, child.ID, UserUpdate{DisplayName: &empty}); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected a validation error for an empty name, got %v", err)
+	}
+
+	note := "fixed"
+	for _, step := range []struct {
+		name   string
+		change func(context.Context, uint64) (*db.User, error)
+	}{{"deactivated", service.DeactivateUser}, {"archived", service.ArchiveUser}} {
+		user, err := step.change(ctx, child.ID)
+		if err != nil || user.IsActive {
+			t.Fatalf("%s: %+v, %v", step.name, user, err)
+		}
+		if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1, "", ""); !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected grants to a %s child to fail, got %v", step.name, err)
+		}
+		if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 1, "", ""); !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected spends by a %s child to fail, got %v", step.name, err)
+		}
+		if _, err := service.AdjustTransaction(ctx, granted.TransactionID, nil, &note); !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected adjustments for a %s child to fail, got %v", step.name, err)
+		}
+		if _, err := service.FindUserByOpenID(ctx, openID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected a %s user's openid to be ignored, got %v", step.name, err)
+		}
+		if balance, err := service.GetBalance(ctx, family.ID, child.ID, rewardType.ID); err != nil || balance.Balance != 10 {
+			t.Errorf("Expected the balance of a %s child to stay readable: %+v, %v", step.name, balance, err)
+		}
+	}
+
+	user, err := service.ReactivateUser(ctx, child.ID)
+	if err != nil || !user.IsActive || user.ArchivedAt != nil {
+		t.Fatalf("ReactivateUser: %+v, %v", user, err)
+	}
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 1, "", ""); err != nil {
+		t.Errorf("Expected grants after reactivation to succeed, got %v", err)
+	}
+	if _, err := service.ArchiveUser(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found for a missing user, got %v", err)
+	}
+}
+
+func TestRewardService_AuditLogs(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	operator := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	if err := service.CreateFamily(operator, family); err != nil {
+		t.Fatalf("CreateFamily: %v", err)
+	}
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Test Guardian"}
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	for _, user := range []*db.User{guardian, child} {
+		if err := service.CreateUser(operator, user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	ctx := WithActor(context.Background(), UserActor(guardian, SourceWeChat))
+
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	if err := service.CreateRewardType(ctx, rewardType); err != nil {
+		t.Fatalf("CreateRewardType: %v", err)
+	}
+	granted, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 10, "good job", "key-1")
+	if err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+	// A replay changes nothing and is not audited again.
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 10, "good job", "key-1"); err != nil {
+		t.Fatalf("GrantReward replay: %v", err)
+	}
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 4, "", ""); err != nil {
+		t.Fatalf("SpendReward: %v", err)
+	}
+	// A failed change leaves no audit log behind.
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 100, "", ""); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("Expected insufficient balance, got %v", err)
+	}
+
+	// Lowering the grant from 10 to 7 takes 3 off the balance of 6.
+	newValue := int64(7)
+	if _, err := service.AdjustTransaction(ctx, granted.TransactionID, &newValue, nil); err != nil {
+		t.Fatalf("AdjustTransaction: %v", err)
+	}
+	if balance, _ := service.GetBalance(ctx, family.ID, child.ID, rewardType.ID); balance.Balance != 3 {
+		t.Errorf("Expected the adjustment to move the balance to 3, got %d", balance.Balance)
+	}
+	// Lowering it to 1 would leave the balance at -3.
+	newValue = 1
+	if _, err := service.AdjustTransaction(ctx, granted.TransactionID, &newValue, nil); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Expected an adjustment below a zero balance to fail, got %v", err)
+	}
+
+	page, err := service.ListAuditLogs(ctx, storage.AuditLogFilter{FamilyID: family.ID})
+	if err != nil {
+		t.Fatalf("ListAuditLogs: %v", err)
+	}
+	var actions []string
+	for _, auditLog := range page.AuditLogs {
+		actions = append(actions, auditLog.Action)
+	}
+	want := []string{ActionTransactionAdjusted, ActionRewardSpent, ActionRewardGranted, ActionRewardTypeCreated, ActionUserCreated, ActionUserCreated, ActionFamilyCreated}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Fatalf("Expected actions %v, got %v", want, actions)
+	}
+
+	adjusted := page.AuditLogs[0]
+	if adjusted.UserID == nil || *adjusted.UserID != guardian.ID {
+		t.Errorf("Expected the guardian as the actor, got %v", adjusted.UserID)
+	}
+	var payload struct {
+		Source string
+		Before struct{ Value, Balance int64 }
+		After  struct{ Value, Balance int64 }
+	}
+	if err := json.Unmarshal([]byte(adjusted.Payload), &payload); err != nil {
+		t.Fatalf("Invalid payload %q: %v", adjusted.Payload, err)
+	}
+	if payload.Source != SourceWeChat || payload.Before.Value != 10 || payload.Before.Balance != 6 || payload.After.Value != 7 || payload.After.Balance != 3 {
+		t.Errorf("Unexpected payload %s", adjusted.Payload)
+	}
+	if family := page.AuditLogs[6]; family.UserID != nil {
+		t.Errorf("Expected no actor without WithActor, got %v", *family.UserID)
+	}
+	// Events go to the outbox with the same changes, and only with them.
+	var events []string
+	database.Model(&db.OutboxEvent{}).Order("id ASC").Pluck("type", &events)
+	if strings.Join(events, " ") != strings.Join([]string{EventRewardTypeCreated, EventRewardGranted, EventRewardSpent, EventTransactionAdjusted}, " ") {
+		t.Errorf("Unexpected outbox events %v", events)
+	}
+	// The failed changes rolled back their links along with their logs.
+	if reports, err := auditchain.Verify(ctx, database, family.ID); err != nil || len(reports) != 1 || !reports[0].OK() || reports[0].Entries != 7 || reports[0].Head != adjusted.Hash {
+		t.Errorf("Expected the family's chain to verify, got %+v, %v", reports, err)
+	}
+
+	if page, _ := service.ListAuditLogs(ctx, storage.AuditLogFilter{FamilyID: family.ID, Limit: 2}); len(page.AuditLogs) != 2 || page.NextCursor != page.AuditLogs[1].ID {
+		t.Errorf("Expected a full page with a cursor, got %+v", page)
+	}
+}
+
+func TestRewardService_Authorization(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	other := &db.Family{Name: "Other Family"}
+	for _, f := range []*db.Family{family, other} {
+		if err := service.CreateFamily(ctx, f); err != nil {
+			t.Fatalf("CreateFamily: %v", err)
+		}
+	}
+	guardian := &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Parent"}
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid"}
+	sibling := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Sibling"}
+	stranger := &db.User{FamilyID: other.ID, Role: "guardian", DisplayName: "Stranger"}
+	for _, user := range []*db.User{guardian, child, sibling, stranger} {
+		if err := service.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	asGuardian := WithActor(ctx, UserActor(guardian, SourceAPI))
+	asChild := WithActor(ctx, UserActor(child, SourceAPI))
+	asStranger := WithActor(ctx, UserActor(stranger, SourceAPI))
+
+	stars := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	if err := service.CreateRewardType(asChild, stars); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused defining a reward type, got %v", err)
+	}
+	if err := service.CreateRewardType(asStranger, stars); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a guardian of another family to be refused, got %v", err)
+	}
+	if err := service.CreateRewardType(asGuardian, stars); err != nil {
+		t.Fatalf("CreateRewardType: %v", err)
+	}
+	if _, err := service.UpdateRewardType(asChild, stars.ID, RewardTypeUpdate{MaxValue: new(int64)}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused updating a reward type, got %v", err)
+	}
+
+	granted, err := service.GrantReward(asGuardian, family.ID, child.ID, stars.ID, 10, "", "")
+	if err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+	if _, err := service.GrantReward(asChild, family.ID, child.ID, stars.ID, 10, "", ""); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused granting, got %v", err)
+	}
+	if _, err := service.GrantReward(asStranger, family.ID, child.ID, stars.ID, 10, "", ""); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a guardian of another family to be refused granting, got %v", err)
+	}
+	note := "fixed"
+	if _, err := service.AdjustTransaction(asChild, granted.TransactionID, nil, &note); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused adjusting, got %v", err)
+	}
+
+	// A child reads their own ledger only.
+	if _, err := service.GetBalance(asChild, family.ID, child.ID, stars.ID); err != nil {
+		t.Errorf("Expected a child to read their balance, got %v", err)
+	}
+	if _, err := service.ListTransactions(asChild, family.ID, child.ID, 0, 20, 0); err != nil {
+		t.Errorf("Expected a child to read their transactions, got %v", err)
+	}
+	if _, err := service.GetBalance(asChild, family.ID, sibling.ID, stars.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused a sibling's balance, got %v", err)
+	}
+	if _, err := service.ListTransactions(asStranger, family.ID, child.ID, 0, 20, 0); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a guardian of another family to be refused transactions, got %v", err)
+	}
+
+	// A child spends only where the family allows it.
+	if _, err := service.SpendReward(asChild, family.ID, child.ID, stars.ID, 1, "", ""); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused spending, got %v", err)
+	}
+	allow := true
+	if _, err := service.UpdateRewardType(asGuardian, stars.ID, RewardTypeUpdate{ChildrenMaySpend: &allow}); err != nil {
+		t.Fatalf("UpdateRewardType: %v", err)
+	}
+	if _, err := service.SpendReward(asChild, family.ID, child.ID, stars.ID, 1, "", ""); err != nil {
+		t.Errorf("Expected a child to spend once allowed, got %v", err)
+	}
+	if _, err := service.SpendReward(asChild, family.ID, sibling.ID, stars.ID, 1, "", ""); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused spending a sibling's balance, got %v", err)
+	}
+
+	// Each transaction records who made it; the operator is no user.
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, stars.ID, 1, "", ""); err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+	transactions, err := service.ListTransactions(asGuardian, family.ID, child.ID, 0, 20, 0)
+	if err != nil || len(transactions) != 3 {
+		t.Fatalf("ListTransactions = %d transactions, %v; want 3", len(transactions), err)
+	}
+	for i, want := range []uint64{0, child.ID, guardian.ID} {
+		var got uint64
+		if transactions[i].CreatedBy != nil {
+			got = *transactions[i].CreatedBy
+		}
+		if got != want {
+			t.Errorf("Transaction %d: expected created by %d, got %d", transactions[i].ID, want, got)
+		}
+	}
+	if creator := transactions[1].Creator; creator == nil || creator.DisplayName != "Kid" {
+		t.Errorf("Expected the creator to be loaded, got %+v", creator)
+	}
+
+	// Only guardians manage users and read audit logs; only the operator
+	// creates families.
+	if err := service.CreateUser(asChild, &db.User{FamilyID: family.ID, Role: "guardian", DisplayName: "Me Too"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused creating a user, got %v", err)
+	}
+	if _, err := service.DeactivateUser(asChild, sibling.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused deactivating a user, got %v", err)
+	}
+	if _, err := service.ArchiveUser(asStranger, child.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a guardian of another family to be refused archiving, got %v", err)
+	}
+	if _, err := service.ListAuditLogs(asChild, storage.AuditLogFilter{FamilyID: family.ID}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a child to be refused the audit logs, got %v", err)
+	}
+	if err := service.CreateFamily(asGuardian, &db.Family{Name: "Another"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a guardian to be refused creating a family, got %v", err)
+	}
+
+	// Listings default to the user's family and stop at its border.
+	if familyID, err := ScopeFamily(asChild, 0); err != nil || familyID != family.ID {
+		t.Errorf("ScopeFamily = %d, %v; want %d", familyID, err, family.ID)
+	}
+	if _, err := ScopeFamily(asStranger, family.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected another family's listing refused, got %v", err)
+	}
+	if familyID, err := ScopeFamily(ctx, 0); err != nil || familyID != 0 {
+		t.Errorf("ScopeFamily = %d, %v; want every family for the operator", familyID, err)
+	}
+
+	// A context without an actor is nobody, not the operator.
+	nobody := context.Background()
+	if _, err := service.GrantReward(nobody, family.ID, child.ID, stars.ID, 1, "", ""); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a grant without an actor refused, got %v", err)
+	}
+	if _, err := ScopeFamily(nobody, 0); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected a listing without an actor refused, got %v", err)
+	}
+	if err := service.CreateFamily(WithActor(nobody, Actor{Source: SourceAPI}), &db.Family{Name: "Another"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected an actor without the operator marker refused, got %v", err)
+	}
+}
+
+func TestRewardService_ContextCancelled(t *testing.T) {
+	database := setupTestDB(t)
+	service := NewRewardService(database)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+
+	ctx, cancel := context.WithCancel(WithActor(context.Background(), OperatorActor(SourceCLI)))
+	cancel()
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 10, "", ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	var count int64
+	database.Model(&db.Transaction{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no transactions to be written, got %d", count)
+	}
+}
+
+func TestRewardService_MemoryRepository(t *testing.T) {
+	repo := storage.NewMemory()
+	service := NewRewardServiceWithRepository(repo)
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	child := &db.User{FamilyID: 1, Role: "child", DisplayName: "Test Child", IsActive: true}
+	if err := repo.CreateUser(ctx, child); err != nil {
+		t.Fatalf("Failed to create child: %v", err)
+	}
+	rewardType := &db.RewardType{FamilyID: 1, Name: "Pocket Money", UnitKind: "money", Scale: 2}
+	if err := service.CreateRewardType(ctx, rewardType); err != nil {
+		t.Fatalf("Failed to create reward type: %v", err)
+	}
+
+	if _, err := service.GrantReward(ctx, 1, child.ID, rewardType.ID, 1000, "", "key-1"); err != nil {
+		t.Fatalf("Failed to grant reward: %v", err)
+	}
+	replay, err := service.GrantReward(ctx, 1, child.ID, rewardType.ID, 1000, "", "key-1")
+	if err != nil || !replay.Replayed || replay.NewBalance != 1000 {
+		t.Fatalf("Expected a replay at balance 1000, got %+v, %v", replay, err)
+	}
+	if _, err := service.SpendReward(ctx, 1, child.ID, rewardType.ID, 5000, "", ""); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Expected ErrInsufficientBalance, got %v", err)
+	}
+	result, err := service.SpendReward(ctx, 1, child.ID, rewardType.ID, 250, "", "")
+	if err != nil || result.NewBalance != 750 || result.Display != "¥7.50" {
+		t.Fatalf("Expected balance ¥7.50, got %+v, %v", result, err)
+	}
+	if _, err := service.GetBalance(ctx, 2, child.ID, rewardType.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for another family, got %v", err)
+	}
+
+	transactions, err := service.ListTransactions(ctx, 1, child.ID, 0, 10, 0)
+	if err != nil || len(transactions) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d, %v", len(transactions), err)
+	}
+	if transactions[0].Type != "debit" || transactions[0].Account.RewardType.ID != rewardType.ID {
+		t.Errorf("Unexpected newest transaction %+v", transactions[0])
+	}
+}
+
+// racyAccounts hides existing accounts from the first lookups, as if another
+// request opened the account between the lookup and the insert.
+type racyAccounts struct {
+	storage.Repository
+	misses *int
+}
+
+func (r racyAccounts) Transaction(ctx context.Context, fn func(repo storage.Repository) error) error {
+	return r.Repository.Transaction(ctx, func(tx storage.Repository) error {
+		return fn(racyAccounts{Repository: tx, misses: r.misses})
+	})
+}
+
+func (r racyAccounts) FindAccount(ctx context.Context, childID, rewardTypeID uint64) (*db.Account, error) {
+	if *r.misses > 0 {
+		*r.misses--
+		return nil, storage.ErrNotFound
+	}
+	return r.Repository.FindAccount(ctx, childID, rewardTypeID)
+}
+
+func TestRewardService_AccountOpenedConcurrently(t *testing.T) {
+	database := setupTestDB(t)
+	misses := 1
+	service := NewRewardServiceWithRepository(racyAccounts{Repository: storage.NewGorm(database), misses: &misses})
+	ctx := WithActor(context.Background(), OperatorActor(SourceCLI))
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Test Child"}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	database.Create(rewardType)
+	database.Create(&db.Account{FamilyID: family.ID, ChildID: child.ID, RewardTypeID: rewardType.ID, Balance: 100})
+
+	result, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 50, "", "")
+	if err != nil {
+		t.Fatalf("Expected the grant to use the account opened concurrently, got %v", err)
+	}
+	if result.NewBalance != 150 {
+		t.Errorf("Expected balance 150, got %d", result.NewBalance)
+	}
+	var count int64
+	database.Model(&db.Account{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected a single account, got %d", count)
+	}
+}
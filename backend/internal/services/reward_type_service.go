@@ -1,9 +1,139 @@
 package services
 
 import (
-    "reward-system/internal/db"
+	"context"
+	"errors"
+	"reward-system/internal/db"
+	"reward-system/internal/storage"
+	"reward-system/internal/units"
 )
 
-func (s *RewardService) CreateRewardType(rewardType *db.RewardType) error {
-	return s.db.Create(rewardType).Error
-}
\ No newline at end of file
+// CreateRewardType saves a new reward type. Money types without a currency
+// are in yuan; callers pick the scale, see DefaultScale. Only guardians
+// define reward types.
+func (s *RewardService) CreateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	if err := AuthorizeGuardian(ctx, rewardType.FamilyID); err != nil {
+		return err
+	}
+	if rewardType.UnitKind == "money" && rewardType.Currency == "" {
+		rewardType.Currency = units.DefaultCurrency
+	}
+	if err := ValidateRewardType(rewardType); err != nil {
+		return err
+	}
+	return s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		if err := repo.CreateRewardType(ctx, rewardType); err != nil {
+			return translateDBError(err, "reward type")
+		}
+		if err := audit(ctx, repo, rewardType.FamilyID, ActionRewardTypeCreated, nil, rewardTypeAudit(rewardType)); err != nil {
+			return err
+		}
+		return emit(ctx, repo, rewardType.FamilyID, EventRewardTypeCreated, rewardTypeAudit(rewardType))
+	})
+}
+
+// GetRewardType returns a reward type of the family.
+func (s *RewardService) GetRewardType(ctx context.Context, familyID, rewardTypeID uint64) (*db.RewardType, error) {
+	if err := AuthorizeMember(ctx, familyID); err != nil {
+		return nil, err
+	}
+	return familyRewardType(ctx, s.repo, familyID, rewardTypeID)
+}
+
+// RewardTypeUpdate holds the fields of a reward type to change; nil fields
+// are left as they are.
+type RewardTypeUpdate struct {
+	Name                *string
+	UnitKind            *string
+	UnitLabel           *string
+	Currency            *string
+	Scale               *int
+	MaxValue            *int64
+	LowBalanceThreshold *int64
+	ChildrenMaySpend    *bool
+}
+
+// UpdateRewardType changes a reward type; only guardians may.
+func (s *RewardService) UpdateRewardType(ctx context.Context, rewardTypeID uint64, update RewardTypeUpdate) (*db.RewardType, error) {
+	var rewardType *db.RewardType
+	err := s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		var err error
+		if rewardType, err = repo.GetRewardType(ctx, rewardTypeID); err != nil {
+			return translateDBError(err, "reward type")
+		}
+		if err := AuthorizeGuardian(ctx, rewardType.FamilyID); err != nil {
+			return err
+		}
+		original := *rewardType
+
+		if update.Name != nil {
+			rewardType.Name = *update.Name
+		}
+		if update.UnitKind != nil {
+			rewardType.UnitKind = *update.UnitKind
+		}
+		if update.UnitLabel != nil {
+			rewardType.UnitLabel = *update.UnitLabel
+		}
+		if update.Currency != nil {
+			rewardType.Currency = *update.Currency
+		}
+		if update.Scale != nil {
+			rewardType.Scale = *update.Scale
+		}
+		if update.MaxValue != nil {
+			rewardType.MaxValue = *update.MaxValue
+		}
+		if update.LowBalanceThreshold != nil {
+			rewardType.LowBalanceThreshold = *update.LowBalanceThreshold
+		}
+		if update.ChildrenMaySpend != nil {
+			rewardType.ChildrenMaySpend = *update.ChildrenMaySpend
+		}
+		if rewardType.UnitKind == "money" && rewardType.Currency == "" {
+			rewardType.Currency = units.DefaultCurrency
+		}
+		if err := ValidateRewardType(rewardType); err != nil {
+			return err
+		}
+		if rewardType.UnitKind != original.UnitKind || rewardType.Currency != original.Currency || rewardType.Scale != original.Scale {
+			// Stored values would silently change meaning, e.g. 125 cents
+			// becoming 125 dollars.
+			accounts, err := repo.CountAccounts(ctx, rewardType.ID)
+			if err != nil {
+				return err
+			}
+			if accounts > 0 {
+				return Conflictf("unit kind, currency and scale cannot change once the reward type has balances").WithDetails(map[string]interface{}{"reward_type_id": rewardType.ID})
+			}
+		}
+		if *rewardType == original {
+			return nil
+		}
+		if err := repo.UpdateRewardType(ctx, rewardType); err != nil {
+			return translateDBError(err, "reward type")
+		}
+		return audit(ctx, repo, rewardType.FamilyID, ActionRewardTypeUpdated, rewardTypeAudit(&original), rewardTypeAudit(rewardType))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rewardType, nil
+}
+
+// FindRewardType resolves a reward type of the family by name, falling back
+// to the first type of that unit kind so that "money" or "time" also work.
+func (s *RewardService) FindRewardType(ctx context.Context, familyID uint64, nameOrKind string) (*db.RewardType, error) {
+	rewardType, err := s.repo.FindRewardTypeByName(ctx, familyID, nameOrKind)
+	if err == nil {
+		return rewardType, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	rewardType, err = s.repo.FindRewardTypeByKind(ctx, familyID, nameOrKind)
+	if err != nil {
+		return nil, translateDBError(err, "reward type")
+	}
+	return rewardType, nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/storage"
+)
+
+// FindUserByOpenID returns the active user bound to a WeChat openid.
+func (s *RewardService) FindUserByOpenID(ctx context.Context, openID string) (*db.User, error) {
+	user, err := s.repo.FindUserByOpenID(ctx, openID)
+	if err != nil {
+		return nil, translateDBError(err, "user")
+	}
+	return user, nil
+}
+
+// FindChildByName looks up a child of the family by display name.
+func (s *RewardService) FindChildByName(ctx context.Context, familyID uint64, name string) (*db.User, error) {
+	user, err := s.repo.FindChildByName(ctx, familyID, name)
+	if err != nil {
+		return nil, translateDBError(err, "child")
+	}
+	return user, nil
+}
+
+// CreateFamily saves a new family. Users belong to a family already, so
+// only the operator creates families.
+func (s *RewardService) CreateFamily(ctx context.Context, family *db.Family) error {
+	if err := AuthorizeOperator(ctx); err != nil {
+		return err
+	}
+	return s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		if err := repo.CreateFamily(ctx, family); err != nil {
+			return err
+		}
+		return audit(ctx, repo, family.ID, ActionFamilyCreated, nil, map[string]interface{}{"id": family.ID, "name": family.Name})
+	})
+}
+
+// CreateUser adds an active guardian or child to their family. Only
+// guardians manage users.
+func (s *RewardService) CreateUser(ctx context.Context, user *db.User) error {
+	if err := AuthorizeGuardian(ctx, user.FamilyID); err != nil {
+		return err
+	}
+	user.DisplayName = strings.TrimSpace(user.DisplayName)
+	if user.DisplayName == "" {
+		return Validationf("display name must not be empty")
+	}
+	if user.Role != "guardian" && user.Role != "child" {
+		return Validationf("role must be guardian or child").WithDetails(map[string]interface{}{"role": user.Role})
+	}
+	user.IsActive = true
+	return s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		if err := repo.CreateUser(ctx, user); err != nil {
+			return translateDBError(err, "wechat openid")
+		}
+		return audit(ctx, repo, user.FamilyID, ActionUserCreated, nil, userAudit(user))
+	})
+}
+
+// UserUpdate holds the user fields to change; nil fields are kept. An empty
+// WechatOpenID unbinds the user from WeChat.
+type UserUpdate struct {
+	DisplayName  *string
+	WechatOpenID *string
+}
+
+// UpdateUser renames a user or changes the WeChat openid bound to them.
+func (s *RewardService) UpdateUser(ctx context.Context, userID uint64, update UserUpdate) (*db.User, error) {
+	return s.changeUser(ctx, userID, ActionUserUpdated, func(user *db.User) error {
+		if update.DisplayName != nil {
+			name := strings.TrimSpace(*update.DisplayName)
+			if name == "" {
+				return Validationf("display name must not be empty")
+			}
+			user.DisplayName = name
+		}
+		if update.WechatOpenID != nil {
+			user.WechatOpenID = db.OptionalString(strings.TrimSpace(*update.WechatOpenID))
+		}
+		return nil
+	})
+}
+
+// DeactivateUser suspends a user: an inactive child's ledger is frozen and
+// an inactive user can no longer use WeChat commands. Their data is kept
+// and ReactivateUser undoes it.
+func (s *RewardService) DeactivateUser(ctx context.Context, userID uint64) (*db.User, error) {
+	return s.changeUser(ctx, userID, ActionUserDeactivated, func(user *db.User) error {
+		user.IsActive = false
+		return nil
+	})
+}
+
+// ArchiveUser deactivates a user who has left the family for good, such as
+// a grown-up child, and leaves them out of user listings. Their balances and
+// transactions stay readable but frozen.
+func (s *RewardService) ArchiveUser(ctx context.Context, userID uint64) (*db.User, error) {
+	return s.changeUser(ctx, userID, ActionUserArchived, func(user *db.User) error {
+		user.IsActive = false
+		if user.ArchivedAt == nil {
+			now := time.Now()
+			user.ArchivedAt = &now
+		}
+		return nil
+	})
+}
+
+// ReactivateUser returns a deactivated or archived user to active.
+func (s *RewardService) ReactivateUser(ctx context.Context, userID uint64) (*db.User, error) {
+	return s.changeUser(ctx, userID, ActionUserReactivated, func(user *db.User) error {
+		user.IsActive = true
+		user.ArchivedAt = nil
+		return nil
+	})
+}
+
+// changeUser applies change to the user and saves the result, recording it
+// as action unless nothing changed. Only the family's guardians change
+// users.
+func (s *RewardService) changeUser(ctx context.Context, userID uint64, action string, change func(user *db.User) error) (*db.User, error) {
+	var user *db.User
+	err := s.repo.Transaction(ctx, func(repo storage.Repository) error {
+		var err error
+		if user, err = repo.GetUser(ctx, userID); err != nil {
+			return translateDBError(err, "user")
+		}
+		if err := AuthorizeGuardian(ctx, user.FamilyID); err != nil {
+			return err
+		}
+		before := userAudit(user)
+		original := *user
+		if err := change(user); err != nil {
+			return err
+		}
+		if user.DisplayName == original.DisplayName && user.WechatOpenID == original.WechatOpenID &&
+			user.IsActive == original.IsActive && user.ArchivedAt == original.ArchivedAt {
+			return nil
+		}
+		if err := repo.UpdateUser(ctx, user); err != nil {
+			return translateDBError(err, "wechat openid")
+		}
+		return audit(ctx, repo, user.FamilyID, action, before, userAudit(user))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
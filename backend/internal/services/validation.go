@@ -0,0 +1,99 @@
+package services
+
+import (
+	"reward-system/internal/db"
+	"reward-system/internal/units"
+)
+
+// UnitKinds lists the supported RewardType.UnitKind values.
+var UnitKinds = []string{"money", "time", "points", "custom"}
+
+// DefaultScale is the scale a new reward type gets when none is given:
+// money in cents, everything else in whole units.
+func DefaultScale(unitKind string) int {
+	if unitKind == "money" {
+		return 2
+	}
+	return 0
+}
+
+// baseUnit names the smallest step a reward type's values are counted in,
+// e.g. "0.01 CNY", "minutes", "points" or "0.1 points".
+func baseUnit(rewardType *db.RewardType) string {
+	name := "units"
+	switch rewardType.UnitKind {
+	case "money":
+		name = rewardType.Currency
+	case "time":
+		return "minutes"
+	case "points":
+		name = "points"
+	default:
+		if rewardType.UnitLabel != "" {
+			name = rewardType.UnitLabel
+		}
+	}
+	if rewardType.Scale > 0 {
+		return units.FormatDecimal(1, rewardType.Scale) + " " + name
+	}
+	return name
+}
+
+// ValidateValue checks a single ledger value against its reward type. Values
+// must be positive, since the transaction type already carries the sign, and
+// may not exceed the type's per-transaction maximum when one is set.
+func ValidateValue(rewardType *db.RewardType, value int64) error {
+	if value <= 0 {
+		return Validationf("value must be a positive whole number of %s", baseUnit(rewardType)).WithDetails(map[string]interface{}{
+			"value":     value,
+			"unit_kind": rewardType.UnitKind,
+			"scale":     rewardType.Scale,
+			"base_unit": baseUnit(rewardType),
+		})
+	}
+	if rewardType.MaxValue > 0 && value > rewardType.MaxValue {
+		return LimitExceededf("value exceeds the maximum of %d %s per transaction", rewardType.MaxValue, baseUnit(rewardType)).WithDetails(map[string]interface{}{
+			"value":     value,
+			"max_value": rewardType.MaxValue,
+			"unit_kind": rewardType.UnitKind,
+			"base_unit": baseUnit(rewardType),
+		})
+	}
+	return nil
+}
+
+// ValidateRewardType checks a reward type definition before it is saved.
+func ValidateRewardType(rewardType *db.RewardType) error {
+	if rewardType.Name == "" {
+		return Validationf("reward type name is required")
+	}
+	known := false
+	for _, kind := range UnitKinds {
+		if rewardType.UnitKind == kind {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return Validationf("unknown unit kind %q", rewardType.UnitKind).WithDetails(map[string]interface{}{"unit_kinds": UnitKinds})
+	}
+	if rewardType.Scale < 0 || rewardType.Scale > units.MaxScale {
+		return Validationf("scale must be between 0 and %d", units.MaxScale).WithDetails(map[string]interface{}{"scale": rewardType.Scale})
+	}
+	if rewardType.UnitKind == "time" && rewardType.Scale != 0 {
+		return Validationf("time is counted in whole minutes, scale must be 0").WithDetails(map[string]interface{}{"scale": rewardType.Scale})
+	}
+	if rewardType.UnitKind == "money" && !units.IsCurrency(rewardType.Currency) {
+		return Validationf("unsupported currency %q", rewardType.Currency).WithDetails(map[string]interface{}{"currencies": units.Currencies()})
+	}
+	if rewardType.UnitKind != "money" && rewardType.Currency != "" {
+		return Validationf("currency only applies to money reward types").WithDetails(map[string]interface{}{"currency": rewardType.Currency})
+	}
+	if rewardType.MaxValue < 0 {
+		return Validationf("max_value must not be negative").WithDetails(map[string]interface{}{"max_value": rewardType.MaxValue})
+	}
+	if rewardType.LowBalanceThreshold < 0 {
+		return Validationf("low_balance_threshold must not be negative").WithDetails(map[string]interface{}{"low_balance_threshold": rewardType.LowBalanceThreshold})
+	}
+	return nil
+}
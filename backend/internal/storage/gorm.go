@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"reward-system/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type gormRepository struct {
+	db *gorm.DB
+}
+
+// NewGorm returns a Repository backed by a GORM database. The database
+// should be opened with TranslateError so that unique key violations are
+// reported as ErrDuplicate.
+func NewGorm(database *gorm.DB) Repository {
+	return &gormRepository{db: database}
+}
+
+func (r *gormRepository) Transaction(ctx context.Context, fn func(repo Repository) error) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&gormRepository{db: tx})
+	})
+}
+
+// translate maps GORM errors onto the storage errors.
+func translate(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return ErrNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *gormRepository) CreateFamily(ctx context.Context, family *db.Family) error {
+	return translate(r.db.WithContext(ctx).Create(family).Error)
+}
+
+func (r *gormRepository) GetUser(ctx context.Context, id uint64) (*db.User, error) {
+	var user db.User
+	if err := r.db.WithContext(ctx).First(&user, id).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &user, nil
+}
+
+func (r *gormRepository) FindUserByOpenID(ctx context.Context, openID string) (*db.User, error) {
+	var user db.User
+	if err := r.db.WithContext(ctx).Where("wechat_openid = ? AND is_active = ?", openID, true).First(&user).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &user, nil
+}
+
+func (r *gormRepository) FindChildByName(ctx context.Context, familyID uint64, name string) (*db.User, error) {
+	var user db.User
+	err := r.db.WithContext(ctx).Where("family_id = ? AND role = ? AND display_name = ?", familyID, "child", name).Order("id ASC").First(&user).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+	return &user, nil
+}
+
+func (r *gormRepository) CreateUser(ctx context.Context, user *db.User) error {
+	return translate(r.db.WithContext(ctx).Create(user).Error)
+}
+
+func (r *gormRepository) UpdateUser(ctx context.Context, user *db.User) error {
+	err := r.db.WithContext(ctx).Model(user).Select("display_name", "wechat_openid", "is_active", "archived_at").Updates(user).Error
+	return translate(err)
+}
+
+func (r *gormRepository) GetRewardType(ctx context.Context, id uint64) (*db.RewardType, error) {
+	var rewardType db.RewardType
+	if err := r.db.WithContext(ctx).First(&rewardType, id).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &rewardType, nil
+}
+
+func (r *gormRepository) FindRewardTypeByName(ctx context.Context, familyID uint64, name string) (*db.RewardType, error) {
+	var rewardType db.RewardType
+	if err := r.db.WithContext(ctx).Where("family_id = ? AND name = ?", familyID, name).First(&rewardType).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &rewardType, nil
+}
+
+func (r *gormRepository) FindRewardTypeByKind(ctx context.Context, familyID uint64, unitKind string) (*db.RewardType, error) {
+	var rewardType db.RewardType
+	err := r.db.WithContext(ctx).Where("family_id = ? AND unit_kind = ?", familyID, unitKind).Order("id ASC").First(&rewardType).Error
+	if err != nil {
+		return nil, translate(err)
+	}
+	return &rewardType, nil
+}
+
+func (r *gormRepository) CreateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	return translate(r.db.WithContext(ctx).Create(rewardType).Error)
+}
+
+func (r *gormRepository) UpdateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	err := r.db.WithContext(ctx).Model(rewardType).Select("name", "unit_kind", "unit_label", "currency", "scale", "max_value", "low_balance_threshold", "children_may_spend").Updates(rewardType).Error
+	return translate(err)
+}
+
+func (r *gormRepository) GetAccount(ctx context.Context, id uint64) (*db.Account, error) {
+	var account db.Account
+	if err := r.db.WithContext(ctx).First(&account, id).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &account, nil
+}
+
+func (r *gormRepository) FindAccount(ctx context.Context, childID, rewardTypeID uint64) (*db.Account, error) {
+	var account db.Account
+	if err := r.db.WithContext(ctx).Where("child_id = ? AND reward_type_id = ?", childID, rewardTypeID).First(&account).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &account, nil
+}
+
+func (r *gormRepository) LockAccount(ctx context.Context, id uint64) (*db.Account, error) {
+	var account db.Account
+	if err := r.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, id).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &account, nil
+}
+
+func (r *gormRepository) CountAccounts(ctx context.Context, rewardTypeID uint64) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&db.Account{}).Where("reward_type_id = ?", rewardTypeID).Count(&count).Error
+	return count, err
+}
+
+func (r *gormRepository) CreateAccount(ctx context.Context, account *db.Account) error {
+	return translate(r.db.WithContext(ctx).Create(account).Error)
+}
+
+func (r *gormRepository) UpdateAccountBalance(ctx context.Context, id uint64, balance int64) error {
+	result := r.db.WithContext(ctx).Model(&db.Account{}).Where("id = ?", id).Update("balance", balance)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormRepository) GetTransaction(ctx context.Context, id uint64) (*db.Transaction, error) {
+	var transaction db.Transaction
+	if err := r.db.WithContext(ctx).First(&transaction, id).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &transaction, nil
+}
+
+func (r *gormRepository) FindTransactionByIdempotencyKey(ctx context.Context, key string) (*db.Transaction, error) {
+	var transaction db.Transaction
+	if err := r.db.WithContext(ctx).Where("idempotency_key = ?", key).First(&transaction).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &transaction, nil
+}
+
+func (r *gormRepository) ListTransactions(ctx context.Context, filter TransactionFilter) ([]db.Transaction, error) {
+	accounts := r.db.Model(&db.Account{}).Select("id").Where("family_id = ? AND child_id = ?", filter.FamilyID, filter.ChildID)
+	if filter.RewardTypeID > 0 {
+		accounts = accounts.Where("reward_type_id = ?", filter.RewardTypeID)
+	}
+
+	query := r.db.WithContext(ctx).Where("account_id IN (?)", accounts)
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var transactions []db.Transaction
+	if err := query.Preload("Account.RewardType").Preload("Creator").Order("id DESC").Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (r *gormRepository) CreateTransaction(ctx context.Context, transaction *db.Transaction) error {
+	return translate(r.db.WithContext(ctx).Omit(clause.Associations).Create(transaction).Error)
+}
+
+func (r *gormRepository) UpdateTransaction(ctx context.Context, transaction *db.Transaction) error {
+	err := r.db.WithContext(ctx).Model(transaction).Select("value", "note").Updates(transaction).Error
+	return translate(err)
+}
+
+func (r *gormRepository) CreateAuditLog(ctx context.Context, auditLog *db.AuditLog) error {
+	return translate(r.db.WithContext(ctx).Create(auditLog).Error)
+}
+
+func (r *gormRepository) CreateOutboxEvent(ctx context.Context, event *db.OutboxEvent) error {
+	return translate(r.db.WithContext(ctx).Create(event).Error)
+}
+
+func (r *gormRepository) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]db.AuditLog, error) {
+	query := r.db.WithContext(ctx).Where("family_id = ?", filter.FamilyID)
+	if filter.UserID > 0 {
+		query = query.Where("user_id = ?", filter.UserID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var auditLogs []db.AuditLog
+	if err := query.Order("id DESC").Find(&auditLogs).Error; err != nil {
+		return nil, err
+	}
+	return auditLogs, nil
+}
+
+func (r *gormRepository) LockAuditChain(ctx context.Context, familyID uint64) (*db.AuditChain, error) {
+	var chain db.AuditChain
+	if err := r.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Where("family_id = ?", familyID).First(&chain).Error; err != nil {
+		return nil, translate(err)
+	}
+	return &chain, nil
+}
+
+func (r *gormRepository) CreateAuditChain(ctx context.Context, chain *db.AuditChain) error {
+	return translate(r.db.WithContext(ctx).Create(chain).Error)
+}
+
+func (r *gormRepository) UpdateAuditChain(ctx context.Context, chain *db.AuditChain) error {
+	// Chain 0 has a zero primary key, so the key is matched explicitly.
+	err := r.db.WithContext(ctx).Model(&db.AuditChain{}).Where("family_id = ?", chain.FamilyID).
+		Updates(map[string]interface{}{"length": chain.Length, "head": chain.Head, "updated_at": time.Now()}).Error
+	return translate(err)
+}
@@ -0,0 +1,631 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"reward-system/internal/db"
+)
+
+// memoryTables holds the records of a Memory repository. Records are stored
+// by value without their associations and copied on the way in and out, so
+// callers never share memory with the store.
+type memoryTables struct {
+	families     map[uint64]db.Family
+	users        map[uint64]db.User
+	rewardTypes  map[uint64]db.RewardType
+	accounts     map[uint64]db.Account
+	transactions map[uint64]db.Transaction
+	auditLogs    map[uint64]db.AuditLog
+	auditChains  map[uint64]db.AuditChain
+	outboxEvents map[uint64]db.OutboxEvent
+	nextID       map[string]uint64
+}
+
+func newMemoryTables() *memoryTables {
+	return &memoryTables{
+		families:     map[uint64]db.Family{},
+		users:        map[uint64]db.User{},
+		rewardTypes:  map[uint64]db.RewardType{},
+		accounts:     map[uint64]db.Account{},
+		transactions: map[uint64]db.Transaction{},
+		auditLogs:    map[uint64]db.AuditLog{},
+		auditChains:  map[uint64]db.AuditChain{},
+		outboxEvents: map[uint64]db.OutboxEvent{},
+		nextID:       map[string]uint64{},
+	}
+}
+
+// Memory is an in-process Repository. Transactions are serializable: one
+// transaction runs at a time, holding the lock on the data for writing. It
+// changes the data in place and logs how to undo each change, which it
+// replays when it fails, so a transaction costs what it changes rather than
+// the size of the data. Reads outside of a transaction hold the lock for
+// reading and so only see committed data.
+type Memory struct {
+	mu   sync.RWMutex
+	data *memoryTables
+}
+
+// NewMemory returns an empty in-memory Repository.
+func NewMemory() *Memory {
+	return &Memory{data: newMemoryTables()}
+}
+
+func (m *Memory) Transaction(ctx context.Context, fn func(repo Repository) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryTx{tables: m.data}
+	committed := false
+	defer func() {
+		// Also when fn panics.
+		if !committed {
+			tx.rollbackTo(0)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// committed returns a read-only view of the committed data. The caller
+// holds m.mu for reading.
+func (m *Memory) committed() *memoryTx {
+	return &memoryTx{tables: m.data}
+}
+
+// write runs a single statement outside of a transaction as its own
+// transaction, the way autocommit does in SQL.
+func (m *Memory) write(ctx context.Context, fn func(tx *memoryTx) error) error {
+	return m.Transaction(ctx, func(repo Repository) error {
+		return fn(repo.(*memoryTx))
+	})
+}
+
+func (m *Memory) CreateFamily(ctx context.Context, family *db.Family) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateFamily(ctx, family) })
+}
+
+func (m *Memory) GetUser(ctx context.Context, id uint64) (*db.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().GetUser(ctx, id)
+}
+
+func (m *Memory) FindUserByOpenID(ctx context.Context, openID string) (*db.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().FindUserByOpenID(ctx, openID)
+}
+
+func (m *Memory) FindChildByName(ctx context.Context, familyID uint64, name string) (*db.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().FindChildByName(ctx, familyID, name)
+}
+
+func (m *Memory) CreateUser(ctx context.Context, user *db.User) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateUser(ctx, user) })
+}
+
+func (m *Memory) UpdateUser(ctx context.Context, user *db.User) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.UpdateUser(ctx, user) })
+}
+
+func (m *Memory) GetRewardType(ctx context.Context, id uint64) (*db.RewardType, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().GetRewardType(ctx, id)
+}
+
+func (m *Memory) FindRewardTypeByName(ctx context.Context, familyID uint64, name string) (*db.RewardType, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().FindRewardTypeByName(ctx, familyID, name)
+}
+
+func (m *Memory) FindRewardTypeByKind(ctx context.Context, familyID uint64, unitKind string) (*db.RewardType, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().FindRewardTypeByKind(ctx, familyID, unitKind)
+}
+
+func (m *Memory) CreateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateRewardType(ctx, rewardType) })
+}
+
+func (m *Memory) UpdateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.UpdateRewardType(ctx, rewardType) })
+}
+
+func (m *Memory) GetAccount(ctx context.Context, id uint64) (*db.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().GetAccount(ctx, id)
+}
+
+func (m *Memory) FindAccount(ctx context.Context, childID, rewardTypeID uint64) (*db.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().FindAccount(ctx, childID, rewardTypeID)
+}
+
+// LockAccount outside of a transaction only reads the account, as a locking
+// read does in autocommit mode.
+func (m *Memory) LockAccount(ctx context.Context, id uint64) (*db.Account, error) {
+	return m.GetAccount(ctx, id)
+}
+
+func (m *Memory) CountAccounts(ctx context.Context, rewardTypeID uint64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().CountAccounts(ctx, rewardTypeID)
+}
+
+func (m *Memory) CreateAccount(ctx context.Context, account *db.Account) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateAccount(ctx, account) })
+}
+
+func (m *Memory) UpdateAccountBalance(ctx context.Context, id uint64, balance int64) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.UpdateAccountBalance(ctx, id, balance) })
+}
+
+func (m *Memory) GetTransaction(ctx context.Context, id uint64) (*db.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().GetTransaction(ctx, id)
+}
+
+func (m *Memory) FindTransactionByIdempotencyKey(ctx context.Context, key string) (*db.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().FindTransactionByIdempotencyKey(ctx, key)
+}
+
+func (m *Memory) ListTransactions(ctx context.Context, filter TransactionFilter) ([]db.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().ListTransactions(ctx, filter)
+}
+
+func (m *Memory) CreateTransaction(ctx context.Context, transaction *db.Transaction) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateTransaction(ctx, transaction) })
+}
+
+func (m *Memory) UpdateTransaction(ctx context.Context, transaction *db.Transaction) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.UpdateTransaction(ctx, transaction) })
+}
+
+func (m *Memory) CreateAuditLog(ctx context.Context, auditLog *db.AuditLog) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateAuditLog(ctx, auditLog) })
+}
+
+func (m *Memory) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]db.AuditLog, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().ListAuditLogs(ctx, filter)
+}
+
+func (m *Memory) CreateOutboxEvent(ctx context.Context, event *db.OutboxEvent) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateOutboxEvent(ctx, event) })
+}
+
+// LockAuditChain outside of a transaction only reads the chain head.
+func (m *Memory) LockAuditChain(ctx context.Context, familyID uint64) (*db.AuditChain, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.committed().LockAuditChain(ctx, familyID)
+}
+
+func (m *Memory) CreateAuditChain(ctx context.Context, chain *db.AuditChain) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.CreateAuditChain(ctx, chain) })
+}
+
+func (m *Memory) UpdateAuditChain(ctx context.Context, chain *db.AuditChain) error {
+	return m.write(ctx, func(tx *memoryTx) error { return tx.UpdateAuditChain(ctx, chain) })
+}
+
+// memoryTx is the Repository handed to a Memory transaction. Holding the
+// transaction lock already serializes it, so LockAccount needs no extra
+// locking. undo holds, in order, how to revert each change it made.
+type memoryTx struct {
+	tables *memoryTables
+	undo   []func()
+}
+
+// Transaction nests by remembering how far the undo log reached, the way a
+// savepoint would, and undoing the nested changes alone when fn fails.
+func (tx *memoryTx) Transaction(ctx context.Context, fn func(repo Repository) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	savepoint := len(tx.undo)
+	if err := fn(tx); err != nil {
+		tx.rollbackTo(savepoint)
+		return err
+	}
+	return nil
+}
+
+// rollbackTo undoes the changes logged after savepoint, newest first.
+func (tx *memoryTx) rollbackTo(savepoint int) {
+	for i := len(tx.undo) - 1; i >= savepoint; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = tx.undo[:savepoint]
+}
+
+// newID allocates the next id of table.
+func (tx *memoryTx) newID(table string) uint64 {
+	previous := tx.tables.nextID[table]
+	tx.undo = append(tx.undo, func() { tx.tables.nextID[table] = previous })
+	tx.tables.nextID[table] = previous + 1
+	return previous + 1
+}
+
+// put stores record under id in table and logs how to undo it.
+func put[T any](tx *memoryTx, table map[uint64]T, id uint64, record T) {
+	if previous, ok := table[id]; ok {
+		tx.undo = append(tx.undo, func() { table[id] = previous })
+	} else {
+		tx.undo = append(tx.undo, func() { delete(table, id) })
+	}
+	table[id] = record
+}
+
+func (tx *memoryTx) CreateFamily(ctx context.Context, family *db.Family) error {
+	record := *family
+	record.ID = tx.newID("families")
+	record.CreatedAt, record.UpdatedAt = time.Now(), time.Now()
+	put(tx, tx.tables.families, record.ID, record)
+	family.ID, family.CreatedAt, family.UpdatedAt = record.ID, record.CreatedAt, record.UpdatedAt
+	return nil
+}
+
+func (tx *memoryTx) GetUser(ctx context.Context, id uint64) (*db.User, error) {
+	user, ok := tx.tables.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (tx *memoryTx) FindUserByOpenID(ctx context.Context, openID string) (*db.User, error) {
+	for _, id := range sortedIDs(tx.tables.users) {
+		if user := tx.tables.users[id]; string(user.WechatOpenID) == openID && user.IsActive {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (tx *memoryTx) FindChildByName(ctx context.Context, familyID uint64, name string) (*db.User, error) {
+	for _, id := range sortedIDs(tx.tables.users) {
+		if user := tx.tables.users[id]; user.FamilyID == familyID && user.Role == "child" && user.DisplayName == name {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (tx *memoryTx) CreateUser(ctx context.Context, user *db.User) error {
+	if user.WechatOpenID != "" {
+		for _, existing := range tx.tables.users {
+			if existing.WechatOpenID == user.WechatOpenID {
+				return ErrDuplicate
+			}
+		}
+	}
+	record := *user
+	record.Family = db.Family{}
+	record.ID = tx.newID("users")
+	record.CreatedAt, record.UpdatedAt = time.Now(), time.Now()
+	put(tx, tx.tables.users, record.ID, record)
+	user.ID, user.CreatedAt, user.UpdatedAt = record.ID, record.CreatedAt, record.UpdatedAt
+	return nil
+}
+
+func (tx *memoryTx) UpdateUser(ctx context.Context, user *db.User) error {
+	record, ok := tx.tables.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if user.WechatOpenID != "" {
+		for id, existing := range tx.tables.users {
+			if id != user.ID && existing.WechatOpenID == user.WechatOpenID {
+				return ErrDuplicate
+			}
+		}
+	}
+	record.DisplayName = user.DisplayName
+	record.WechatOpenID = user.WechatOpenID
+	record.IsActive = user.IsActive
+	record.ArchivedAt = user.ArchivedAt
+	record.UpdatedAt = time.Now()
+	put(tx, tx.tables.users, record.ID, record)
+	user.UpdatedAt = record.UpdatedAt
+	return nil
+}
+
+func (tx *memoryTx) GetRewardType(ctx context.Context, id uint64) (*db.RewardType, error) {
+	rewardType, ok := tx.tables.rewardTypes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &rewardType, nil
+}
+
+func (tx *memoryTx) FindRewardTypeByName(ctx context.Context, familyID uint64, name string) (*db.RewardType, error) {
+	for _, id := range sortedIDs(tx.tables.rewardTypes) {
+		if rewardType := tx.tables.rewardTypes[id]; rewardType.FamilyID == familyID && rewardType.Name == name {
+			return &rewardType, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (tx *memoryTx) FindRewardTypeByKind(ctx context.Context, familyID uint64, unitKind string) (*db.RewardType, error) {
+	for _, id := range sortedIDs(tx.tables.rewardTypes) {
+		if rewardType := tx.tables.rewardTypes[id]; rewardType.FamilyID == familyID && rewardType.UnitKind == unitKind {
+			return &rewardType, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (tx *memoryTx) CreateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	if tx.rewardTypeNameTaken(rewardType) {
+		return ErrDuplicate
+	}
+	record := *rewardType
+	record.Family = db.Family{}
+	record.ID = tx.newID("reward_types")
+	record.CreatedAt, record.UpdatedAt = time.Now(), time.Now()
+	put(tx, tx.tables.rewardTypes, record.ID, record)
+	rewardType.ID, rewardType.CreatedAt, rewardType.UpdatedAt = record.ID, record.CreatedAt, record.UpdatedAt
+	return nil
+}
+
+func (tx *memoryTx) UpdateRewardType(ctx context.Context, rewardType *db.RewardType) error {
+	record, ok := tx.tables.rewardTypes[rewardType.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if tx.rewardTypeNameTaken(rewardType) {
+		return ErrDuplicate
+	}
+	record.Name = rewardType.Name
+	record.UnitKind = rewardType.UnitKind
+	record.UnitLabel = rewardType.UnitLabel
+	record.Currency = rewardType.Currency
+	record.Scale = rewardType.Scale
+	record.MaxValue = rewardType.MaxValue
+	record.LowBalanceThreshold = rewardType.LowBalanceThreshold
+	record.ChildrenMaySpend = rewardType.ChildrenMaySpend
+	record.UpdatedAt = time.Now()
+	put(tx, tx.tables.rewardTypes, record.ID, record)
+	rewardType.UpdatedAt = record.UpdatedAt
+	return nil
+}
+
+func (tx *memoryTx) rewardTypeNameTaken(rewardType *db.RewardType) bool {
+	for id, existing := range tx.tables.rewardTypes {
+		if id != rewardType.ID && existing.FamilyID == rewardType.FamilyID && existing.Name == rewardType.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *memoryTx) GetAccount(ctx context.Context, id uint64) (*db.Account, error) {
+	account, ok := tx.tables.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &account, nil
+}
+
+func (tx *memoryTx) FindAccount(ctx context.Context, childID, rewardTypeID uint64) (*db.Account, error) {
+	for _, account := range tx.tables.accounts {
+		if account.ChildID == childID && account.RewardTypeID == rewardTypeID {
+			return &account, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (tx *memoryTx) LockAccount(ctx context.Context, id uint64) (*db.Account, error) {
+	return tx.GetAccount(ctx, id)
+}
+
+func (tx *memoryTx) CountAccounts(ctx context.Context, rewardTypeID uint64) (int64, error) {
+	var count int64
+	for _, account := range tx.tables.accounts {
+		if account.RewardTypeID == rewardTypeID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (tx *memoryTx) CreateAccount(ctx context.Context, account *db.Account) error {
+	if _, err := tx.FindAccount(ctx, account.ChildID, account.RewardTypeID); err == nil {
+		return ErrDuplicate
+	}
+	record := *account
+	record.Child, record.RewardType = db.User{}, db.RewardType{}
+	record.ID = tx.newID("accounts")
+	record.CreatedAt, record.UpdatedAt = time.Now(), time.Now()
+	put(tx, tx.tables.accounts, record.ID, record)
+	account.ID, account.CreatedAt, account.UpdatedAt = record.ID, record.CreatedAt, record.UpdatedAt
+	return nil
+}
+
+func (tx *memoryTx) UpdateAccountBalance(ctx context.Context, id uint64, balance int64) error {
+	account, ok := tx.tables.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	account.Balance = balance
+	account.UpdatedAt = time.Now()
+	put(tx, tx.tables.accounts, id, account)
+	return nil
+}
+
+func (tx *memoryTx) GetTransaction(ctx context.Context, id uint64) (*db.Transaction, error) {
+	transaction, ok := tx.tables.transactions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &transaction, nil
+}
+
+func (tx *memoryTx) FindTransactionByIdempotencyKey(ctx context.Context, key string) (*db.Transaction, error) {
+	for _, id := range sortedIDs(tx.tables.transactions) {
+		if transaction := tx.tables.transactions[id]; transaction.IdempotencyKey == key {
+			return &transaction, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (tx *memoryTx) ListTransactions(ctx context.Context, filter TransactionFilter) ([]db.Transaction, error) {
+	ids := sortedIDs(tx.tables.transactions)
+	transactions := []db.Transaction{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(transactions) == filter.Limit {
+			break
+		}
+		transaction := tx.tables.transactions[ids[i]]
+		if filter.BeforeID > 0 && transaction.ID >= filter.BeforeID {
+			continue
+		}
+		account := tx.tables.accounts[transaction.AccountID]
+		if account.FamilyID != filter.FamilyID || account.ChildID != filter.ChildID {
+			continue
+		}
+		if filter.RewardTypeID > 0 && account.RewardTypeID != filter.RewardTypeID {
+			continue
+		}
+		account.RewardType = tx.tables.rewardTypes[account.RewardTypeID]
+		transaction.Account = account
+		if transaction.CreatedBy != nil {
+			if creator, ok := tx.tables.users[*transaction.CreatedBy]; ok {
+				transaction.Creator = &creator
+			}
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, nil
+}
+
+func (tx *memoryTx) CreateTransaction(ctx context.Context, transaction *db.Transaction) error {
+	record := *transaction
+	record.Account, record.Creator = db.Account{}, nil
+	record.ID = tx.newID("transactions")
+	record.CreatedAt = time.Now()
+	put(tx, tx.tables.transactions, record.ID, record)
+	transaction.ID, transaction.CreatedAt = record.ID, record.CreatedAt
+	return nil
+}
+
+func (tx *memoryTx) UpdateTransaction(ctx context.Context, transaction *db.Transaction) error {
+	record, ok := tx.tables.transactions[transaction.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	record.Value = transaction.Value
+	record.Note = transaction.Note
+	put(tx, tx.tables.transactions, record.ID, record)
+	return nil
+}
+
+func (tx *memoryTx) CreateAuditLog(ctx context.Context, auditLog *db.AuditLog) error {
+	record := *auditLog
+	record.ID = tx.newID("audit_logs")
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = time.Now()
+	}
+	put(tx, tx.tables.auditLogs, record.ID, record)
+	auditLog.ID, auditLog.CreatedAt = record.ID, record.CreatedAt
+	return nil
+}
+
+func (tx *memoryTx) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]db.AuditLog, error) {
+	ids := sortedIDs(tx.tables.auditLogs)
+	auditLogs := []db.AuditLog{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(auditLogs) == filter.Limit {
+			break
+		}
+		auditLog := tx.tables.auditLogs[ids[i]]
+		switch {
+		case auditLog.FamilyID == nil || *auditLog.FamilyID != filter.FamilyID,
+			filter.UserID > 0 && (auditLog.UserID == nil || *auditLog.UserID != filter.UserID),
+			filter.Action != "" && auditLog.Action != filter.Action,
+			!filter.Since.IsZero() && auditLog.CreatedAt.Before(filter.Since),
+			!filter.Until.IsZero() && !auditLog.CreatedAt.Before(filter.Until),
+			filter.BeforeID > 0 && auditLog.ID >= filter.BeforeID:
+			continue
+		}
+		auditLogs = append(auditLogs, auditLog)
+	}
+	return auditLogs, nil
+}
+
+func (tx *memoryTx) CreateOutboxEvent(ctx context.Context, event *db.OutboxEvent) error {
+	record := *event
+	record.ID = tx.newID("outbox_events")
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = time.Now()
+	}
+	put(tx, tx.tables.outboxEvents, record.ID, record)
+	event.ID, event.CreatedAt = record.ID, record.CreatedAt
+	return nil
+}
+
+func (tx *memoryTx) LockAuditChain(ctx context.Context, familyID uint64) (*db.AuditChain, error) {
+	chain, ok := tx.tables.auditChains[familyID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &chain, nil
+}
+
+func (tx *memoryTx) CreateAuditChain(ctx context.Context, chain *db.AuditChain) error {
+	if _, ok := tx.tables.auditChains[chain.FamilyID]; ok {
+		return ErrDuplicate
+	}
+	chain.UpdatedAt = time.Now()
+	put(tx, tx.tables.auditChains, chain.FamilyID, *chain)
+	return nil
+}
+
+func (tx *memoryTx) UpdateAuditChain(ctx context.Context, chain *db.AuditChain) error {
+	if _, ok := tx.tables.auditChains[chain.FamilyID]; !ok {
+		return ErrNotFound
+	}
+	chain.UpdatedAt = time.Now()
+	put(tx, tx.tables.auditChains, chain.FamilyID, *chain)
+	return nil
+}
+
+func sortedIDs[T any](records map[uint64]T) []uint64 {
+	ids := make([]uint64, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,105 @@
+// Package storage puts the data access of the reward services behind the
+// Repository interface. NewGorm stores data in a SQL database, NewMemory
+// keeps it in process for tools and tests that run the ledger without a SQL
+// driver. Both give the same transactional guarantees.
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"reward-system/internal/db"
+)
+
+var (
+	// ErrNotFound is returned when a looked-up record does not exist.
+	ErrNotFound = errors.New("storage: record not found")
+	// ErrDuplicate is returned when a write would break a unique key.
+	ErrDuplicate = errors.New("storage: duplicate key")
+)
+
+// Repository reads and writes families, users, reward types, accounts,
+// transactions and audit logs. Lookups return ErrNotFound for missing
+// records and writes return ErrDuplicate for unique key violations: one
+// openid per user, one reward type name per family and one account per
+// child and reward type.
+type Repository interface {
+	// Transaction runs fn against a Repository bound to a new transaction.
+	// The writes fn makes through it are committed together when fn returns
+	// nil and discarded when it returns an error or panics. Accounts read
+	// with LockAccount stay locked until the transaction ends.
+	Transaction(ctx context.Context, fn func(repo Repository) error) error
+
+	CreateFamily(ctx context.Context, family *db.Family) error
+
+	GetUser(ctx context.Context, id uint64) (*db.User, error)
+	// FindUserByOpenID returns the active user bound to a WeChat openid.
+	FindUserByOpenID(ctx context.Context, openID string) (*db.User, error)
+	FindChildByName(ctx context.Context, familyID uint64, name string) (*db.User, error)
+	CreateUser(ctx context.Context, user *db.User) error
+	// UpdateUser saves the name, openid and lifecycle state of an existing
+	// user.
+	UpdateUser(ctx context.Context, user *db.User) error
+
+	GetRewardType(ctx context.Context, id uint64) (*db.RewardType, error)
+	FindRewardTypeByName(ctx context.Context, familyID uint64, name string) (*db.RewardType, error)
+	// FindRewardTypeByKind returns the family's oldest reward type of a kind.
+	FindRewardTypeByKind(ctx context.Context, familyID uint64, unitKind string) (*db.RewardType, error)
+	CreateRewardType(ctx context.Context, rewardType *db.RewardType) error
+	// UpdateRewardType saves every field of an existing reward type.
+	UpdateRewardType(ctx context.Context, rewardType *db.RewardType) error
+
+	GetAccount(ctx context.Context, id uint64) (*db.Account, error)
+	FindAccount(ctx context.Context, childID, rewardTypeID uint64) (*db.Account, error)
+	// LockAccount reads an account and locks it against concurrent ledger
+	// writes until the surrounding transaction ends.
+	LockAccount(ctx context.Context, id uint64) (*db.Account, error)
+	CountAccounts(ctx context.Context, rewardTypeID uint64) (int64, error)
+	CreateAccount(ctx context.Context, account *db.Account) error
+	UpdateAccountBalance(ctx context.Context, id uint64, balance int64) error
+
+	GetTransaction(ctx context.Context, id uint64) (*db.Transaction, error)
+	FindTransactionByIdempotencyKey(ctx context.Context, key string) (*db.Transaction, error)
+	// ListTransactions returns matching transactions newest first, each with
+	// its Account and the account's RewardType filled in.
+	ListTransactions(ctx context.Context, filter TransactionFilter) ([]db.Transaction, error)
+	CreateTransaction(ctx context.Context, transaction *db.Transaction) error
+	// UpdateTransaction saves the value and note of an existing transaction.
+	UpdateTransaction(ctx context.Context, transaction *db.Transaction) error
+
+	// CreateAuditLog appends an entry to the audit trail.
+	CreateAuditLog(ctx context.Context, auditLog *db.AuditLog) error
+	// ListAuditLogs returns matching audit logs newest first.
+	ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]db.AuditLog, error)
+	// CreateOutboxEvent records a domain event for the webhook dispatcher.
+	CreateOutboxEvent(ctx context.Context, event *db.OutboxEvent) error
+	// LockAuditChain reads the head of a family's audit log chain and locks
+	// it against concurrent appends until the surrounding transaction ends.
+	LockAuditChain(ctx context.Context, familyID uint64) (*db.AuditChain, error)
+	CreateAuditChain(ctx context.Context, chain *db.AuditChain) error
+	UpdateAuditChain(ctx context.Context, chain *db.AuditChain) error
+}
+
+// TransactionFilter selects the transactions of a child. RewardTypeID and
+// BeforeID are optional; BeforeID pages backwards from a transaction id.
+type TransactionFilter struct {
+	FamilyID     uint64
+	ChildID      uint64
+	RewardTypeID uint64
+	BeforeID     uint64
+	Limit        int
+}
+
+// AuditLogFilter selects the audit logs of a family. UserID (the actor),
+// Action, Since, Until and BeforeID are optional; BeforeID pages backwards
+// from an audit log id.
+type AuditLogFilter struct {
+	FamilyID uint64
+	UserID   uint64
+	Action   string
+	Since    time.Time
+	Until    time.Time
+	BeforeID uint64
+	Limit    int
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// repositories returns a fresh instance of every implementation, so that
+// each test checks they behave the same.
+func repositories(t *testing.T) map[string]Repository {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(&db.Family{}, &db.User{}, &db.RewardType{}, &db.Account{}, &db.Transaction{}, &db.AuditLog{}, &db.AuditChain{}, &db.OutboxEvent{}); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return map[string]Repository{"gorm": NewGorm(database), "memory": NewMemory()}
+}
+
+func TestRepository_CRUD(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			child := &db.User{FamilyID: 1, Role: "child", DisplayName: "小明", WechatOpenID: "openid-1", IsActive: true}
+			if err := repo.CreateUser(ctx, child); err != nil || child.ID == 0 {
+				t.Fatalf("CreateUser: id %d, %v", child.ID, err)
+			}
+			if err := repo.CreateUser(ctx, &db.User{FamilyID: 1, Role: "child", DisplayName: "小红", WechatOpenID: "openid-1", IsActive: true}); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Expected ErrDuplicate for a second user with the same openid, got %v", err)
+			}
+			if user, err := repo.FindUserByOpenID(ctx, "openid-1"); err != nil || user.ID != child.ID {
+				t.Errorf("FindUserByOpenID: %+v, %v", user, err)
+			}
+			if user, err := repo.FindChildByName(ctx, 1, "小明"); err != nil || user.ID != child.ID {
+				t.Errorf("FindChildByName: %+v, %v", user, err)
+			}
+			if _, err := repo.GetUser(ctx, 999); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for a missing user, got %v", err)
+			}
+
+			other := &db.User{FamilyID: 1, Role: "child", DisplayName: "小红", WechatOpenID: "openid-2", IsActive: true}
+			if err := repo.CreateUser(ctx, other); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			other.WechatOpenID = "openid-1"
+			if err := repo.UpdateUser(ctx, other); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Expected ErrDuplicate for taking another user's openid, got %v", err)
+			}
+			archivedAt := time.Now()
+			other.DisplayName, other.WechatOpenID, other.IsActive, other.ArchivedAt = "小红红", "", false, &archivedAt
+			if err := repo.UpdateUser(ctx, other); err != nil {
+				t.Fatalf("UpdateUser: %v", err)
+			}
+			if user, err := repo.GetUser(ctx, other.ID); err != nil || user.DisplayName != "小红红" || user.WechatOpenID != "" || user.IsActive || user.ArchivedAt == nil {
+				t.Errorf("GetUser after UpdateUser: %+v, %v", user, err)
+			}
+
+			money := &db.RewardType{FamilyID: 1, Name: "零花钱", UnitKind: "money", Currency: "CNY", Scale: 2}
+			if err := repo.CreateRewardType(ctx, money); err != nil {
+				t.Fatalf("CreateRewardType: %v", err)
+			}
+			if err := repo.CreateRewardType(ctx, &db.RewardType{FamilyID: 1, Name: "零花钱", UnitKind: "points"}); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Expected ErrDuplicate for a second type with the same name, got %v", err)
+			}
+			money.MaxValue = 5000
+			if err := repo.UpdateRewardType(ctx, money); err != nil {
+				t.Fatalf("UpdateRewardType: %v", err)
+			}
+			if found, err := repo.FindRewardTypeByKind(ctx, 1, "money"); err != nil || found.MaxValue != 5000 {
+				t.Errorf("FindRewardTypeByKind: %+v, %v", found, err)
+			}
+
+			account := &db.Account{FamilyID: 1, ChildID: child.ID, RewardTypeID: money.ID}
+			if err := repo.CreateAccount(ctx, account); err != nil {
+				t.Fatalf("CreateAccount: %v", err)
+			}
+			if err := repo.CreateAccount(ctx, &db.Account{FamilyID: 1, ChildID: child.ID, RewardTypeID: money.ID}); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Expected ErrDuplicate for a second account, got %v", err)
+			}
+			if err := repo.UpdateAccountBalance(ctx, account.ID, 300); err != nil {
+				t.Fatalf("UpdateAccountBalance: %v", err)
+			}
+			if count, err := repo.CountAccounts(ctx, money.ID); err != nil || count != 1 {
+				t.Errorf("CountAccounts: %d, %v", count, err)
+			}
+
+			for i, value := range []int64{100, 200, 300} {
+				key := ""
+				if i == 1 {
+					key = "key-1"
+				}
+				if err := repo.CreateTransaction(ctx, &db.Transaction{AccountID: account.ID, Type: "credit", Value: value, CreatedBy: &child.ID, IdempotencyKey: key}); err != nil {
+					t.Fatalf("CreateTransaction: %v", err)
+				}
+			}
+			if found, err := repo.FindTransactionByIdempotencyKey(ctx, "key-1"); err != nil || found.Value != 200 {
+				t.Errorf("FindTransactionByIdempotencyKey: %+v, %v", found, err)
+			}
+
+			transactions, err := repo.ListTransactions(ctx, TransactionFilter{FamilyID: 1, ChildID: child.ID, Limit: 2})
+			if err != nil {
+				t.Fatalf("ListTransactions: %v", err)
+			}
+			if len(transactions) != 2 || transactions[0].Value != 300 || transactions[1].Value != 200 {
+				t.Fatalf("Expected the two newest transactions, got %+v", transactions)
+			}
+			if transactions[0].Account.RewardType.Name != "零花钱" {
+				t.Errorf("Expected the account and reward type to be filled in, got %+v", transactions[0].Account)
+			}
+			if transactions[0].Creator == nil || transactions[0].Creator.ID != child.ID {
+				t.Errorf("Expected the creator to be filled in, got %+v", transactions[0].Creator)
+			}
+			older, _ := repo.ListTransactions(ctx, TransactionFilter{FamilyID: 1, ChildID: child.ID, BeforeID: transactions[1].ID})
+			if len(older) != 1 || older[0].Value != 100 {
+				t.Errorf("Expected one older transaction, got %+v", older)
+			}
+			if other, _ := repo.ListTransactions(ctx, TransactionFilter{FamilyID: 2, ChildID: child.ID}); len(other) != 0 {
+				t.Errorf("Expected no transactions for another family, got %+v", other)
+			}
+
+			first := transactions[1]
+			first.Note = "corrected"
+			if err := repo.UpdateTransaction(ctx, &first); err != nil {
+				t.Fatalf("UpdateTransaction: %v", err)
+			}
+			if found, _ := repo.GetTransaction(ctx, first.ID); found.Note != "corrected" {
+				t.Errorf("Expected the note to be saved, got %+v", found)
+			}
+		})
+	}
+}
+
+func TestRepository_Transaction(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			rewardType := &db.RewardType{FamilyID: 1, Name: "Stars", UnitKind: "points"}
+			repo.CreateRewardType(ctx, rewardType)
+			account := &db.Account{FamilyID: 1, ChildID: 1, RewardTypeID: rewardType.ID}
+			repo.CreateAccount(ctx, account)
+
+			failure := errors.New("abort")
+			err := repo.Transaction(ctx, func(tx Repository) error {
+				locked, err := tx.LockAccount(ctx, account.ID)
+				if err != nil {
+					return err
+				}
+				if err := tx.UpdateAccountBalance(ctx, locked.ID, 50); err != nil {
+					return err
+				}
+				if err := tx.CreateTransaction(ctx, &db.Transaction{AccountID: locked.ID, Type: "credit", Value: 50}); err != nil {
+					return err
+				}
+				if inside, _ := tx.GetAccount(ctx, account.ID); inside.Balance != 50 {
+					t.Errorf("Expected the transaction to see its own write, got %d", inside.Balance)
+				}
+				return failure
+			})
+			if !errors.Is(err, failure) {
+				t.Fatalf("Expected the callback error, got %v", err)
+			}
+			if after, _ := repo.GetAccount(ctx, account.ID); after.Balance != 0 {
+				t.Errorf("Expected the balance update to be rolled back, got %d", after.Balance)
+			}
+			if listed, _ := repo.ListTransactions(ctx, TransactionFilter{FamilyID: 1, ChildID: 1}); len(listed) != 0 {
+				t.Errorf("Expected the transaction insert to be rolled back, got %+v", listed)
+			}
+
+			err = repo.Transaction(ctx, func(tx Repository) error {
+				return tx.UpdateAccountBalance(ctx, account.ID, 70)
+			})
+			if err != nil {
+				t.Fatalf("Transaction: %v", err)
+			}
+			if after, _ := repo.GetAccount(ctx, account.ID); after.Balance != 70 {
+				t.Errorf("Expected the balance update to be committed, got %d", after.Balance)
+			}
+
+			// A failed nested transaction undoes its own changes alone.
+			err = repo.Transaction(ctx, func(tx Repository) error {
+				if err := tx.UpdateAccountBalance(ctx, account.ID, 80); err != nil {
+					return err
+				}
+				nestedErr := tx.Transaction(ctx, func(nested Repository) error {
+					if err := nested.UpdateAccountBalance(ctx, account.ID, 90); err != nil {
+						return err
+					}
+					if err := nested.CreateTransaction(ctx, &db.Transaction{AccountID: account.ID, Type: "credit", Value: 10}); err != nil {
+						return err
+					}
+					return failure
+				})
+				if !errors.Is(nestedErr, failure) {
+					t.Errorf("Expected the nested callback error, got %v", nestedErr)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Transaction: %v", err)
+			}
+			if after, _ := repo.GetAccount(ctx, account.ID); after.Balance != 80 {
+				t.Errorf("Expected the outer update kept and the nested one undone, got %d", after.Balance)
+			}
+			if listed, _ := repo.ListTransactions(ctx, TransactionFilter{FamilyID: 1, ChildID: 1}); len(listed) != 0 {
+				t.Errorf("Expected the nested insert to be rolled back, got %+v", listed)
+			}
+
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			if err := repo.Transaction(cancelled, func(tx Repository) error { return nil }); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRepository_AuditLogs(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			family := &db.Family{Name: "Test Family"}
+			if err := repo.CreateFamily(ctx, family); err != nil || family.ID == 0 {
+				t.Fatalf("CreateFamily: id %d, %v", family.ID, err)
+			}
+			otherFamily, actor := uint64(99), uint64(7)
+			for _, auditLog := range []*db.AuditLog{
+				{FamilyID: &family.ID, UserID: &actor, Action: "reward.granted", Payload: `{}`},
+				{FamilyID: &family.ID, Action: "reward_type.created", Payload: `{}`},
+				{FamilyID: &otherFamily, UserID: &actor, Action: "reward.granted", Payload: `{}`},
+				{FamilyID: &family.ID, UserID: &actor, Action: "reward.spent", Payload: `{}`},
+			} {
+				if err := repo.CreateAuditLog(ctx, auditLog); err != nil || auditLog.ID == 0 {
+					t.Fatalf("CreateAuditLog: id %d, %v", auditLog.ID, err)
+				}
+			}
+
+			auditLogs, err := repo.ListAuditLogs(ctx, AuditLogFilter{FamilyID: family.ID})
+			if err != nil || len(auditLogs) != 3 || auditLogs[0].Action != "reward.spent" {
+				t.Fatalf("ListAuditLogs: %+v, %v", auditLogs, err)
+			}
+			if page, _ := repo.ListAuditLogs(ctx, AuditLogFilter{FamilyID: family.ID, BeforeID: auditLogs[0].ID, Limit: 1}); len(page) != 1 || page[0].ID != auditLogs[1].ID {
+				t.Errorf("Expected the page before the newest log, got %+v", page)
+			}
+			if byActor, _ := repo.ListAuditLogs(ctx, AuditLogFilter{FamilyID: family.ID, UserID: actor}); len(byActor) != 2 {
+				t.Errorf("Expected 2 logs by the actor, got %+v", byActor)
+			}
+			if byAction, _ := repo.ListAuditLogs(ctx, AuditLogFilter{FamilyID: family.ID, Action: "reward.granted"}); len(byAction) != 1 {
+				t.Errorf("Expected 1 grant in the family, got %+v", byAction)
+			}
+			if future, _ := repo.ListAuditLogs(ctx, AuditLogFilter{FamilyID: family.ID, Since: time.Now().Add(time.Hour)}); len(future) != 0 {
+				t.Errorf("Expected no logs in the future, got %+v", future)
+			}
+		})
+	}
+}
+
+func TestRepository_AuditChains(t *testing.T) {
+	for name, repo := range repositories(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := repo.LockAuditChain(ctx, 0); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Expected ErrNotFound before the chain starts, got %v", err)
+			}
+			if err := repo.CreateAuditChain(ctx, &db.AuditChain{FamilyID: 0}); err != nil {
+				t.Fatalf("CreateAuditChain: %v", err)
+			}
+			if err := repo.CreateAuditChain(ctx, &db.AuditChain{FamilyID: 0}); !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Expected ErrDuplicate for a second head, got %v", err)
+			}
+
+			err := repo.Transaction(ctx, func(repo Repository) error {
+				head, err := repo.LockAuditChain(ctx, 0)
+				if err != nil {
+					return err
+				}
+				head.Length, head.Head = 1, "abc"
+				return repo.UpdateAuditChain(ctx, head)
+			})
+			if err != nil {
+				t.Fatalf("UpdateAuditChain: %v", err)
+			}
+			if head, err := repo.LockAuditChain(ctx, 0); err != nil || head.Length != 1 || head.Head != "abc" {
+				t.Errorf("Expected the updated head, got %+v, %v", head, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Package stream pushes a family's domain events to live subscribers, such
+// as the dashboard's Server-Sent Events connection. The Hub tails the
+// outbox the services write each event to in the transaction of its
+// change, so a subscriber sees exactly the changes that committed, in
+// order, with the outbox id to resume from after a reconnect.
+package stream
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/gorm"
+)
+
+// Hub polls the outbox for all subscribers at once and fans the new events
+// out by family. It polls only while somebody is subscribed.
+type Hub struct {
+	DB *gorm.DB
+	// Interval is how often the outbox is polled.
+	Interval time.Duration
+	// GapTimeout is how long an outbox id skipped over is waited for: ids
+	// are allocated before their transaction commits, so a lower id can
+	// appear after a higher one.
+	GapTimeout time.Duration
+	// Buffer is how many events a subscriber may fall behind before it is
+	// dropped; it then reconnects and replays from the outbox.
+	Buffer int
+	// BatchSize is the most events read per poll.
+	BatchSize int
+
+	mu          sync.Mutex
+	subscribers map[uint64]map[*Subscription]struct{}
+	running     bool
+	last        uint64
+}
+
+// maxGaps bounds the ids waited for, so a jump in the id sequence does not
+// turn into a huge query.
+const maxGaps = 1000
+
+func NewHub(database *gorm.DB) *Hub {
+	return &Hub{
+		DB:          database,
+		Interval:    500 * time.Millisecond,
+		GapTimeout:  10 * time.Second,
+		Buffer:      64,
+		BatchSize:   500,
+		subscribers: map[uint64]map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription receives the events of one family committed after it was
+// made. Events is closed when the subscriber is dropped for falling
+// behind.
+type Subscription struct {
+	Events <-chan *services.EventEnvelope
+	// From is the last outbox id the hub had seen when the subscription
+	// was made; events up to it are only in the outbox.
+	From uint64
+
+	events   chan *services.EventEnvelope
+	hub      *Hub
+	familyID uint64
+}
+
+// Subscribe starts receiving the family's events. The subscription must be
+// closed.
+func (h *Hub) Subscribe(ctx context.Context, familyID uint64) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.running {
+		var last uint64
+		if err := h.DB.WithContext(ctx).Model(&db.OutboxEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&last).Error; err != nil {
+			return nil, err
+		}
+		h.last, h.running = last, true
+		go h.run()
+	}
+
+	events := make(chan *services.EventEnvelope, h.Buffer)
+	sub := &Subscription{Events: events, From: h.last, events: events, hub: h, familyID: familyID}
+	if h.subscribers[familyID] == nil {
+		h.subscribers[familyID] = map[*Subscription]struct{}{}
+	}
+	h.subscribers[familyID][sub] = struct{}{}
+	return sub, nil
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	family := h.subscribers[sub.familyID]
+	delete(family, sub)
+	if len(family) == 0 {
+		delete(h.subscribers, sub.familyID)
+	}
+}
+
+// Replay returns up to limit of the family's events after afterID, oldest
+// first.
+func Replay(ctx context.Context, database *gorm.DB, familyID, afterID uint64, limit int) ([]db.OutboxEvent, error) {
+	events := []db.OutboxEvent{}
+	err := database.WithContext(ctx).Where("family_id = ? AND id > ?", familyID, afterID).
+		Order("id ASC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// run polls until the last subscriber is gone.
+func (h *Hub) run() {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	gaps := map[uint64]time.Time{}
+	for range ticker.C {
+		h.mu.Lock()
+		if len(h.subscribers) == 0 {
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+		last := h.last
+		h.mu.Unlock()
+
+		events, err := h.poll(last, gaps)
+		if err != nil {
+			log.Printf("stream: polling the outbox: %v", err)
+			continue
+		}
+		h.publish(events)
+	}
+}
+
+// poll reads the events after last and those of the gaps still waited for,
+// and updates the gaps.
+func (h *Hub) poll(last uint64, gaps map[uint64]time.Time) ([]db.OutboxEvent, error) {
+	now := time.Now()
+	waiting := make([]uint64, 0, len(gaps))
+	for id, since := range gaps {
+		if now.Sub(since) > h.GapTimeout {
+			delete(gaps, id)
+			continue
+		}
+		waiting = append(waiting, id)
+	}
+
+	query := h.DB.Where("id > ?", last)
+	if len(waiting) > 0 {
+		query = h.DB.Where("id > ? OR id IN ?", last, waiting)
+	}
+	events := []db.OutboxEvent{}
+	if err := query.Order("id ASC").Limit(h.BatchSize).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if event.ID <= last {
+			delete(gaps, event.ID)
+			continue
+		}
+		for id := last + 1; id < event.ID && len(gaps) < maxGaps; id++ {
+			gaps[id] = now
+		}
+		last = event.ID
+	}
+	return events, nil
+}
+
+// publish hands the events to the subscribers of their families, dropping
+// any subscriber whose buffer is full.
+func (h *Hub) publish(events []db.OutboxEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range events {
+		event := &events[i]
+		if event.ID > h.last {
+			h.last = event.ID
+		}
+		envelope := services.NewEventEnvelope(event)
+		for sub := range h.subscribers[event.FamilyID] {
+			select {
+			case sub.events <- envelope:
+			default:
+				h.remove(sub)
+				close(sub.events)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+func TestHub(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := context.Background()
+	hub := NewHub(database)
+	// The test polls by hand.
+	hub.Interval, hub.Buffer = time.Hour, 2
+
+	database.Create(&db.OutboxEvent{ID: 1, FamilyID: 1, Type: "reward.granted", CreatedAt: time.Now()})
+	sub, err := hub.Subscribe(ctx, 1)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Close()
+	other, _ := hub.Subscribe(ctx, 2)
+	if sub.From != 1 {
+		t.Errorf("Expected the subscription to start after event 1, got %d", sub.From)
+	}
+
+	gaps := map[uint64]time.Time{}
+	poll := func() {
+		events, err := hub.poll(hub.last, gaps)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+		hub.publish(events)
+	}
+	received := func() []uint64 {
+		var ids []uint64
+		for {
+			select {
+			case envelope := <-sub.Events:
+				ids = append(ids, envelope.ID)
+			default:
+				return ids
+			}
+		}
+	}
+
+	// Event 2 commits after event 3: it is still delivered, once.
+	database.Create(&db.OutboxEvent{ID: 3, FamilyID: 1, Type: "reward.spent", CreatedAt: time.Now()})
+	database.Create(&db.OutboxEvent{ID: 4, FamilyID: 2, Type: "reward.spent", CreatedAt: time.Now()})
+	poll()
+	if ids := received(); len(ids) != 1 || ids[0] != 3 {
+		t.Fatalf("Expected event 3, got %v", ids)
+	}
+	database.Create(&db.OutboxEvent{ID: 2, FamilyID: 1, Type: "reward.granted", CreatedAt: time.Now()})
+	poll()
+	poll()
+	if ids := received(); len(ids) != 1 || ids[0] != 2 || len(gaps) != 0 {
+		t.Fatalf("Expected the late event 2, got %v with gaps %v", ids, gaps)
+	}
+
+	// A subscriber that falls behind is dropped.
+	for id := uint64(5); id <= 6; id++ {
+		database.Create(&db.OutboxEvent{ID: id, FamilyID: 2, Type: "reward.granted", CreatedAt: time.Now()})
+	}
+	poll()
+	for range other.Events {
+	}
+	if _, ok := hub.subscribers[2]; ok {
+		t.Errorf("Expected the full subscriber to be dropped")
+	}
+	other.Close()
+
+	events, _ := Replay(ctx, database, 1, 1, 10)
+	if len(events) != 2 || events[0].ID != 2 || events[1].ID != 3 {
+		t.Errorf("Expected events 2 and 3 to be replayed, got %+v", events)
+	}
+}
+
+func TestToken(t *testing.T) {
+	token := IssueToken("secret", 7, 3, time.Now().Add(time.Minute))
+	if familyID, sessionID, err := VerifyToken("secret", token); err != nil || familyID != 7 || sessionID != 3 {
+		t.Errorf("VerifyToken = %d, %d, %v", familyID, sessionID, err)
+	}
+	if _, _, err := VerifyToken("other", token); err != ErrInvalidToken {
+		t.Errorf("Expected a token signed with another secret to be invalid, got %v", err)
+	}
+	if _, _, err := VerifyToken("secret", "8"+token[1:]); err != ErrInvalidToken {
+		t.Errorf("Expected a token for another family to be invalid, got %v", err)
+	}
+	if _, _, err := VerifyToken("secret", "7.4"+token[3:]); err != ErrInvalidToken {
+		t.Errorf("Expected a token for another session to be invalid, got %v", err)
+	}
+	if _, _, err := VerifyToken("secret", IssueToken("secret", 7, 3, time.Now().Add(-time.Second))); err != ErrInvalidToken {
+		t.Errorf("Expected an expired token to be invalid, got %v", err)
+	}
+}
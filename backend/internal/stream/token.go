@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for a stream token that is malformed, forged
+// or expired.
+var ErrInvalidToken = errors.New("invalid or expired stream token")
+
+// IssueToken returns a token that opens the family's stream until it
+// expires, and only while the session it was issued from stays open: the
+// stream checks the session when it opens and at every heartbeat. Tokens
+// issued to the operator carry session 0 and are bound to none. Browsers
+// cannot set headers on an EventSource, so the stream takes this token in
+// its URL instead of the API token.
+func IssueToken(secret string, familyID, sessionID uint64, expires time.Time) string {
+	claims := fmt.Sprintf("%d.%d.%d", familyID, sessionID, expires.Unix())
+	return claims + "." + tokenMAC(secret, claims)
+}
+
+// VerifyToken returns the family and the session a token was issued for.
+func VerifyToken(secret, token string) (familyID, sessionID uint64, err error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return 0, 0, ErrInvalidToken
+	}
+	claims, mac := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(tokenMAC(secret, claims))) {
+		return 0, 0, ErrInvalidToken
+	}
+	parts := strings.Split(claims, ".")
+	if len(parts) != 3 {
+		return 0, 0, ErrInvalidToken
+	}
+	if familyID, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, ErrInvalidToken
+	}
+	if sessionID, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return 0, 0, ErrInvalidToken
+	}
+	return familyID, sessionID, nil
+}
+
+func tokenMAC(secret, claims string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("stream." + claims))
+	return hex.EncodeToString(mac.Sum(nil))
+}
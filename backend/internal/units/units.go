@@ -0,0 +1,219 @@
+// Package units formats ledger values for people and parses them back.
+//
+// Values are stored as integers scaled by the reward type's decimal scale:
+// with scale 2 a money value of 125 is $1.25, with scale 1 a points value of
+// 5 is 0.5 points. Time is always counted in whole minutes.
+package units
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"reward-system/internal/db"
+)
+
+const (
+	DefaultCurrency = "CNY"
+	// MaxScale bounds the decimal places a reward type may declare.
+	MaxScale = 4
+
+	defaultPoints = "积分"
+)
+
+// currencySymbols maps the supported currency codes to the prefixes Format
+// writes and Parse accepts; the first symbol is the canonical one.
+var currencySymbols = map[string][]string{
+	"CNY": {"¥", "￥"},
+	"USD": {"$", "US$"},
+	"HKD": {"HK$"},
+}
+
+// Currencies returns the supported currency codes in a stable order.
+func Currencies() []string {
+	return []string{"CNY", "USD", "HKD"}
+}
+
+// IsCurrency reports whether code is a supported currency.
+func IsCurrency(code string) bool {
+	_, ok := currencySymbols[code]
+	return ok
+}
+
+// Unit describes how the values of one reward type are written.
+type Unit struct {
+	Kind     string
+	Label    string
+	Currency string // money only; empty means CNY
+	Scale    int    // decimal places held by a value
+}
+
+// For returns the unit of a reward type.
+func For(rewardType *db.RewardType) Unit {
+	return Unit{Kind: rewardType.UnitKind, Label: rewardType.UnitLabel, Currency: rewardType.Currency, Scale: rewardType.Scale}
+}
+
+// Format renders value, e.g. 10000 CNY at scale 2 as "¥100.00", 125 USD as
+// "$1.25", 90 time as "1小时30分" and 5 points at scale 1 as "0.5积分".
+func (u Unit) Format(value int64) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+
+	switch u.Kind {
+	case "money":
+		return sign + u.symbols()[0] + FormatDecimal(value, u.Scale)
+	case "time":
+		hours, minutes := value/60, value%60
+		switch {
+		case hours == 0:
+			return fmt.Sprintf("%s%d分钟", sign, minutes)
+		case minutes == 0:
+			return fmt.Sprintf("%s%d小时", sign, hours)
+		}
+		return fmt.Sprintf("%s%d小时%d分", sign, hours, minutes)
+	}
+	return sign + FormatDecimal(value, u.Scale) + u.label()
+}
+
+func (u Unit) label() string {
+	if u.Label == "" && u.Kind == "points" {
+		return defaultPoints
+	}
+	return u.Label
+}
+
+func (u Unit) currency() string {
+	if u.Currency == "" {
+		return DefaultCurrency
+	}
+	return u.Currency
+}
+
+func (u Unit) symbols() []string {
+	if symbols, ok := currencySymbols[u.currency()]; ok {
+		return symbols
+	}
+	return []string{u.currency() + " "}
+}
+
+var (
+	timePattern    = regexp.MustCompile(`^([+-]?)(?:(\d+)(?:小时|时))?(?:(\d+)(?:分钟|分)?)?$`)
+	decimalPattern = regexp.MustCompile(`^(\d+)(?:\.(\d+))?$`)
+)
+
+// Parse reads a string written by Format back into scaled units. It also
+// accepts the common variants people type: "100元", "USD 1.25",
+// "1小时30分钟", "90分钟", or a bare number.
+func (u Unit) Parse(s string) (int64, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	s = strings.ReplaceAll(s, " ", "")
+	if s == "" {
+		return 0, u.parseError(s)
+	}
+
+	switch u.Kind {
+	case "money":
+		sign, number := splitSign(s)
+		number = u.trimCurrency(number)
+		value, err := ParseDecimal(number, u.Scale)
+		if err != nil {
+			return 0, u.parseError(s)
+		}
+		return applySign(sign, value), nil
+	case "time":
+		m := timePattern.FindStringSubmatch(s)
+		if m == nil || (m[2] == "" && m[3] == "") {
+			return 0, u.parseError(s)
+		}
+		var hours, minutes int64
+		if m[2] != "" {
+			hours, _ = strconv.ParseInt(m[2], 10, 64)
+		}
+		if m[3] != "" {
+			minutes, _ = strconv.ParseInt(m[3], 10, 64)
+		}
+		return applySign(m[1], hours*60+minutes), nil
+	}
+
+	sign, number := splitSign(strings.TrimSuffix(s, u.label()))
+	value, err := ParseDecimal(number, u.Scale)
+	if err != nil {
+		return 0, u.parseError(s)
+	}
+	return applySign(sign, value), nil
+}
+
+// trimCurrency strips a currency symbol or code written before or after the
+// number, and the 元 suffix for yuan.
+func (u Unit) trimCurrency(s string) string {
+	code := u.currency()
+	s = strings.TrimSuffix(strings.TrimPrefix(s, code), code)
+	if code == DefaultCurrency {
+		s = strings.TrimSuffix(s, "元")
+	}
+	for _, symbol := range u.symbols() {
+		if strings.HasPrefix(s, symbol) {
+			return strings.TrimPrefix(s, symbol)
+		}
+	}
+	return s
+}
+
+func (u Unit) parseError(s string) error {
+	return fmt.Errorf("units: cannot parse %q as %s", s, u.Kind)
+}
+
+// FormatDecimal writes a scaled integer as a decimal, e.g. 125 at scale 2 as
+// "1.25". Every fractional digit is written so that amounts line up.
+func FormatDecimal(value int64, scale int) string {
+	digits := strconv.FormatInt(value, 10)
+	sign := ""
+	if value < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if scale <= 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	cut := len(digits) - scale
+	return sign + digits[:cut] + "." + digits[cut:]
+}
+
+// ParseDecimal reads an unsigned decimal such as "1.25" into an integer at
+// the given scale. More fractional digits than the scale holds are rejected
+// unless they are trailing zeros, so a value is never rounded.
+func ParseDecimal(s string, scale int) (int64, error) {
+	m := decimalPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("units: %q is not a decimal number", s)
+	}
+	fraction := strings.TrimRight(m[2], "0")
+	if len(fraction) > scale {
+		return 0, fmt.Errorf("units: %q has more than %d decimal places", s, scale)
+	}
+	value, err := strconv.ParseInt(m[1]+fraction+strings.Repeat("0", scale-len(fraction)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("units: %q is out of range", s)
+	}
+	return value, nil
+}
+
+func splitSign(s string) (string, string) {
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		return s[:1], s[1:]
+	}
+	return "", s
+}
+
+func applySign(sign string, value int64) int64 {
+	if sign == "-" {
+		return -value
+	}
+	return value
+}
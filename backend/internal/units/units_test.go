@@ -0,0 +1,127 @@
+package units
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		unit  Unit
+		value int64
+		want  string
+	}{
+		{Unit{Kind: "money", Scale: 2}, 10000, "¥100.00"},
+		{Unit{Kind: "money", Label: "元", Scale: 2}, 5, "¥0.05"},
+		{Unit{Kind: "money", Scale: 2}, -150, "-¥1.50"},
+		{Unit{Kind: "money", Currency: "USD", Scale: 2}, 125, "$1.25"},
+		{Unit{Kind: "money", Currency: "HKD", Scale: 2}, 5000, "HK$50.00"},
+		{Unit{Kind: "money", Currency: "USD"}, 3, "$3"},
+		{Unit{Kind: "points", Scale: 1}, 5, "0.5积分"},
+		{Unit{Kind: "points", Scale: 1}, -15, "-1.5积分"},
+		{Unit{Kind: "time"}, 90, "1小时30分"},
+		{Unit{Kind: "time"}, 120, "2小时"},
+		{Unit{Kind: "time"}, 45, "45分钟"},
+		{Unit{Kind: "points"}, 120, "120积分"},
+		{Unit{Kind: "points", Label: "分"}, 120, "120分"},
+		{Unit{Kind: "custom", Label: "星星"}, 3, "3星星"},
+		{Unit{Kind: "custom"}, 3, "3"},
+	}
+	for _, tc := range cases {
+		if got := tc.unit.Format(tc.value); got != tc.want {
+			t.Errorf("%+v.Format(%d) = %q, want %q", tc.unit, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		unit  Unit
+		input string
+		want  int64
+	}{
+		{Unit{Kind: "money", Scale: 2}, "¥100.00", 10000},
+		{Unit{Kind: "money", Scale: 2}, "100元", 10000},
+		{Unit{Kind: "money", Scale: 2}, "￥1,234.5", 123450},
+		{Unit{Kind: "money", Scale: 2}, "-¥1.50", -150},
+		{Unit{Kind: "money", Currency: "USD", Scale: 2}, "$1.25", 125},
+		{Unit{Kind: "money", Currency: "USD", Scale: 2}, "USD 1.25", 125},
+		{Unit{Kind: "money", Currency: "HKD", Scale: 2}, "HK$50", 5000},
+		{Unit{Kind: "points", Scale: 1}, "0.5积分", 5},
+		{Unit{Kind: "time"}, "1小时30分", 90},
+		{Unit{Kind: "time"}, "1小时30分钟", 90},
+		{Unit{Kind: "time"}, "2小时", 120},
+		{Unit{Kind: "time"}, "45分钟", 45},
+		{Unit{Kind: "time"}, "45", 45},
+		{Unit{Kind: "points"}, "120积分", 120},
+		{Unit{Kind: "custom", Label: "星星"}, "3星星", 3},
+	}
+	for _, tc := range cases {
+		got, err := tc.unit.Parse(tc.input)
+		if err != nil {
+			t.Errorf("%+v.Parse(%q) returned error: %v", tc.unit, tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%+v.Parse(%q) = %d, want %d", tc.unit, tc.input, got, tc.want)
+		}
+	}
+
+	for _, input := range []string{"", "abc", "1.234元", "3小时半"} {
+		unit := Unit{Kind: "money", Scale: 2}
+		if input == "3小时半" {
+			unit.Kind = "time"
+		}
+		if _, err := unit.Parse(input); err == nil {
+			t.Errorf("%+v.Parse(%q) expected an error", unit, input)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, unit := range []Unit{{Kind: "money", Scale: 2}, {Kind: "money", Currency: "USD", Scale: 2}, {Kind: "money", Currency: "HKD"}, {Kind: "time"}, {Kind: "points"}, {Kind: "points", Scale: 1}, {Kind: "custom", Label: "星星"}} {
+		for _, value := range []int64{0, 1, 59, 60, 61, 12345} {
+			got, err := unit.Parse(unit.Format(value))
+			if err != nil || got != value {
+				t.Errorf("%+v round trip of %d gave %d, %v", unit, value, got, err)
+			}
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	cases := []struct {
+		input string
+		scale int
+		want  int64
+	}{
+		{"1.25", 2, 125},
+		{"1.5", 2, 150},
+		{"1.50", 1, 15},
+		{"3", 0, 3},
+		{"0.5", 1, 5},
+		{"0.0001", 4, 1},
+	}
+	for _, tc := range cases {
+		got, err := ParseDecimal(tc.input, tc.scale)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseDecimal(%q, %d) = %d, %v, want %d", tc.input, tc.scale, got, err, tc.want)
+		}
+		if back, _ := ParseDecimal(FormatDecimal(got, tc.scale), tc.scale); back != got {
+			t.Errorf("FormatDecimal(%d, %d) does not round trip", got, tc.scale)
+		}
+	}
+
+	invalid := []struct {
+		input string
+		scale int
+	}{
+		{"1.255", 2},
+		{"0.5", 0},
+		{"-1", 2},
+		{"1e3", 2},
+		{"99999999999999999999", 2},
+	}
+	for _, tc := range invalid {
+		if _, err := ParseDecimal(tc.input, tc.scale); err == nil {
+			t.Errorf("ParseDecimal(%q, %d) expected an error", tc.input, tc.scale)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"reward-system/internal/services"
+)
+
+// reservedNets are the IPv4 and IPv6 ranges beyond those the net package
+// classifies that no webhook may be delivered to: this network, shared
+// carrier-grade NAT space, IETF protocol assignments, benchmarking, the
+// reserved class E, and NAT64, which reaches IPv4 addresses through IPv6.
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+// NewClient returns the client deliveries are made with. It connects only
+// to public addresses and those in allowed, checked on the address it
+// dials, so a name that resolves to a loopback, private, link-local or
+// cloud metadata address (169.254.169.254), whether when the webhook was
+// added or later, is refused unless the operator allowed it; and it does
+// not follow redirects, which could lead to one. Any proxy from the
+// environment is ignored for the same reason.
+func NewClient(timeout time.Duration, allowed []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: func(network, address string, _ syscall.RawConn) error {
+		return checkDialAddress(address, allowed)
+	}}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ParseAllowedNets parses WEBHOOK_ALLOWED_NETS: a comma-separated list of
+// CIDR ranges or single addresses that webhooks may be delivered to although
+// they are not public, such as a Home Assistant on the LAN.
+func ParseAllowedNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkDialAddress refuses to connect to an address that is neither public
+// nor allowed.
+func checkDialAddress(address string, allowed []*net.IPNet) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !permitted(ip, allowed) {
+		return fmt.Errorf("webhook address %s is not public and not in WEBHOOK_ALLOWED_NETS", host)
+	}
+	return nil
+}
+
+// checkDestination rejects a webhook host that is, or resolves to, an
+// address deliveries may not reach. A name that does not resolve yet is
+// accepted; every delivery checks the address it connects to again.
+func checkDestination(ctx context.Context, host string, allowed []*net.IPNet) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !permitted(ip, allowed) {
+			return services.Validationf("webhook host %s resolves to %s, which is not public; add it to WEBHOOK_ALLOWED_NETS to allow it", host, ip).
+				WithDetails(map[string]interface{}{"host": host, "address": ip.String()})
+		}
+	}
+	return nil
+}
+
+// permitted reports whether deliveries may reach ip.
+func permitted(ip net.IP, allowed []*net.IPNet) bool {
+	if isPublic(ip) {
+		return true
+	}
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublic reports whether ip is a unicast address on the internet.
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, reserved := range reservedNets {
+		if reserved.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
@@ -0,0 +1,255 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Dispatcher delivers outbox events to webhooks. Several dispatchers may
+// share a database: each claims its batch of events and deliveries with
+// SKIP LOCKED where the database supports it, and a claimed delivery is
+// pushed past the lease before it is attempted.
+type Dispatcher struct {
+	DB *gorm.DB
+	// Client makes the deliveries; NewClient's reaches only public and
+	// allowed addresses and does not follow redirects.
+	Client *http.Client
+	// Interval is how often Run polls the outbox.
+	Interval time.Duration
+	// The n-th failed attempt of a delivery is retried after BaseDelay *
+	// 2^(n-1), at most MaxDelay; after MaxAttempts it is dead.
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+	BatchSize   int
+	// Retention is how long delivered deliveries and dispatched events are
+	// kept. Dead deliveries and their events are kept until retried or
+	// their webhook is deleted.
+	Retention time.Duration
+}
+
+// NewDispatcher returns a Dispatcher with the default schedule: retries
+// after 30s, 1m, 2m, ... up to 6h between attempts, dead after 10 attempts.
+// Besides public addresses it delivers to those in allowed.
+func NewDispatcher(database *gorm.DB, allowed []*net.IPNet) *Dispatcher {
+	return &Dispatcher{
+		DB:          database,
+		Client:      NewClient(10*time.Second, allowed),
+		Interval:    2 * time.Second,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    6 * time.Hour,
+		MaxAttempts: 10,
+		BatchSize:   100,
+		Retention:   7 * 24 * time.Hour,
+	}
+}
+
+// Run dispatches until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Webhook dispatch failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce fans out the undispatched events, attempts the deliveries that
+// are due and prunes what is past retention.
+func (d *Dispatcher) RunOnce(ctx context.Context) error {
+	if err := d.fanOut(ctx); err != nil {
+		return fmt.Errorf("fan out events: %w", err)
+	}
+	if err := d.deliverDue(ctx); err != nil {
+		return fmt.Errorf("deliver: %w", err)
+	}
+	if err := d.prune(ctx); err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	return nil
+}
+
+// fanOut creates a delivery of each undispatched event for every webhook
+// of its family that subscribes to it. Webhooks added later do not receive
+// earlier events.
+func (d *Dispatcher) fanOut(ctx context.Context) error {
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var events []db.OutboxEvent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("dispatched_at IS NULL").Order("id ASC").Limit(d.BatchSize).Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		webhooksOf := map[uint64][]db.Webhook{}
+		now := time.Now()
+		ids := make([]uint64, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+			webhooks, ok := webhooksOf[event.FamilyID]
+			if !ok {
+				if err := tx.Where("family_id = ?", event.FamilyID).Find(&webhooks).Error; err != nil {
+					return err
+				}
+				webhooksOf[event.FamilyID] = webhooks
+			}
+			for j := range webhooks {
+				if !subscribed(&webhooks[j], event.Type) {
+					continue
+				}
+				delivery := &db.WebhookDelivery{WebhookID: webhooks[j].ID, EventID: event.ID, Status: StatusPending, NextAttemptAt: now}
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(delivery).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&db.OutboxEvent{}).Where("id IN ?", ids).Update("dispatched_at", now).Error
+	})
+}
+
+// deliverDue claims the pending deliveries that are due and attempts them
+// outside of any transaction.
+func (d *Dispatcher) deliverDue(ctx context.Context) error {
+	var deliveries []db.WebhookDelivery
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", StatusPending, now).
+			Order("next_attempt_at ASC").Limit(d.BatchSize).Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+		ids := make([]uint64, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+		}
+		// A dispatcher that dies mid-attempt leaves the delivery to be
+		// retried once the lease has passed.
+		lease := now.Add(2 * d.Client.Timeout)
+		return tx.Model(&db.WebhookDelivery{}).Where("id IN ?", ids).Update("next_attempt_at", lease).Error
+	})
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		if err := d.DB.WithContext(ctx).Preload("Webhook").Preload("Event").First(delivery, delivery.ID).Error; err != nil {
+			// Deleted with its webhook since it was claimed.
+			continue
+		}
+		statusCode, err := d.attempt(ctx, delivery)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := d.record(ctx, delivery, statusCode, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt POSTs the delivery's event and returns the response status.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *db.WebhookDelivery) (int, error) {
+	event := &delivery.Event
+	body, err := json.Marshal(services.NewEventEnvelope(event))
+	if err != nil {
+		return 0, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "kudo-webhook/1")
+	request.Header.Set("X-Kudo-Event", event.Type)
+	request.Header.Set("X-Kudo-Delivery", strconv.FormatUint(delivery.ID, 10))
+	request.Header.Set("X-Kudo-Timestamp", strconv.FormatInt(timestamp, 10))
+	request.Header.Set("X-Kudo-Signature", Sign(delivery.Webhook.Secret, timestamp, body))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// record saves the outcome of an attempt and schedules the next one.
+func (d *Dispatcher) record(ctx context.Context, delivery *db.WebhookDelivery, statusCode int, attemptErr error) error {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastStatus = statusCode
+	delivery.LastError = ""
+	switch {
+	case attemptErr == nil:
+		delivery.Status, delivery.DeliveredAt = StatusDelivered, &now
+	case delivery.Attempts >= d.MaxAttempts:
+		delivery.Status = StatusDead
+		log.Printf("Webhook delivery %d of event %d to webhook %d is dead after %d attempts: %v",
+			delivery.ID, delivery.EventID, delivery.WebhookID, delivery.Attempts, attemptErr)
+	default:
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+	}
+	if attemptErr != nil {
+		delivery.LastError = attemptErr.Error()
+		if len(delivery.LastError) > 512 {
+			delivery.LastError = delivery.LastError[:512]
+		}
+	}
+	return d.DB.WithContext(ctx).Model(&db.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status": delivery.Status, "attempts": delivery.Attempts, "next_attempt_at": delivery.NextAttemptAt,
+		"last_status": delivery.LastStatus, "last_error": delivery.LastError, "delivered_at": delivery.DeliveredAt,
+	}).Error
+}
+
+// backoff is the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxDelay {
+		delay = d.MaxDelay
+	}
+	return delay
+}
+
+// prune deletes delivered deliveries and dispatched events past retention.
+// An event stays while any of its deliveries does, and until it has been
+// notified.
+func (d *Dispatcher) prune(ctx context.Context) error {
+	cutoff := time.Now().Add(-d.Retention)
+	database := d.DB.WithContext(ctx)
+	if err := database.Where("status = ? AND delivered_at < ?", StatusDelivered, cutoff).Delete(&db.WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+	return database.Where("dispatched_at < ? AND notified_at IS NOT NULL", cutoff).
+		Where("NOT EXISTS (?)", database.Model(&db.WebhookDelivery{}).Select("1").Where("webhook_deliveries.event_id = outbox_events.id")).
+		Delete(&db.OutboxEvent{}).Error
+}
@@ -0,0 +1,258 @@
+// Package webhook delivers a family's domain events to the URLs the family
+// configured. The services write each event to the outbox in the
+// transaction of its change; the Dispatcher fans it out into one delivery
+// per subscribed webhook and POSTs it, signed with the webhook's secret,
+// retrying failures with exponential backoff until a delivery succeeds or
+// is given up as dead.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+	"reward-system/internal/storage"
+
+	"gorm.io/gorm"
+)
+
+// Actions of the audit logs of webhook changes.
+const (
+	ActionWebhookCreated = "webhook.created"
+	ActionWebhookDeleted = "webhook.deleted"
+)
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Sign returns the X-Kudo-Signature of a delivery: the hex HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the webhook's secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSnapshot is what audit logs keep of a webhook; never the secret.
+type webhookSnapshot struct {
+	ID     uint64 `json:"id"`
+	URL    string `json:"url"`
+	Events string `json:"events,omitempty"`
+}
+
+// Create adds a webhook receiving the family's events of the given types,
+// or all of them when events is empty, and generates its secret. Its host
+// must be public or in allowed, as for delivery. Webhooks are managed by
+// the family's guardians.
+func Create(ctx context.Context, database *gorm.DB, familyID uint64, rawURL string, events []string, allowed []*net.IPNet) (*db.Webhook, error) {
+	if err := services.AuthorizeGuardian(ctx, familyID); err != nil {
+		return nil, err
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, services.Validationf("webhook url must be an absolute http or https URL")
+	}
+	if len(rawURL) > 512 {
+		return nil, services.Validationf("webhook url must be at most 512 characters")
+	}
+	if err := checkDestination(ctx, parsed.Hostname(), allowed); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if !knownEvent(event) {
+			return nil, services.Validationf("unknown event type %q", event).WithDetails(map[string]interface{}{"event_types": services.EventTypes})
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	webhook := &db.Webhook{FamilyID: familyID, URL: rawURL, Secret: hex.EncodeToString(secret), Events: strings.Join(events, ",")}
+	err = database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&db.Family{}, familyID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("family %d not found", familyID)
+			}
+			return err
+		}
+		if err := tx.Create(webhook).Error; err != nil {
+			return err
+		}
+		return audit(ctx, tx, webhook, ActionWebhookCreated, nil, snapshot(webhook))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// List returns the family's webhooks.
+func List(ctx context.Context, database *gorm.DB, familyID uint64) ([]db.Webhook, error) {
+	if err := services.AuthorizeGuardian(ctx, familyID); err != nil {
+		return nil, err
+	}
+	webhooks := []db.Webhook{}
+	err := database.WithContext(ctx).Where("family_id = ?", familyID).Order("id ASC").Find(&webhooks).Error
+	return webhooks, err
+}
+
+// Delete removes a webhook together with its deliveries, including the
+// dead ones.
+func Delete(ctx context.Context, database *gorm.DB, webhookID uint64) error {
+	return database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var webhook db.Webhook
+		if err := tx.First(&webhook, webhookID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("webhook %d not found", webhookID)
+			}
+			return err
+		}
+		if err := services.AuthorizeGuardian(ctx, webhook.FamilyID); err != nil {
+			return err
+		}
+		if err := tx.Where("webhook_id = ?", webhookID).Delete(&db.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&webhook).Error; err != nil {
+			return err
+		}
+		return audit(ctx, tx, &webhook, ActionWebhookDeleted, snapshot(&webhook), nil)
+	})
+}
+
+// DeliveryFilter selects deliveries of a family's webhooks, newest first.
+type DeliveryFilter struct {
+	FamilyID  uint64
+	WebhookID uint64
+	Status    string
+	BeforeID  uint64
+	Limit     int
+}
+
+// DeliveryPage is a page of deliveries, newest first. NextCursor is the
+// BeforeID of the next page, or 0 on the last page.
+type DeliveryPage struct {
+	Deliveries []db.WebhookDelivery
+	NextCursor uint64
+}
+
+// ListDeliveries returns matching deliveries with their webhook and event.
+// Filtering by StatusDead gives the dead-letter view. The limit defaults
+// to 50 and is capped at 200.
+func ListDeliveries(ctx context.Context, database *gorm.DB, filter DeliveryFilter) (*DeliveryPage, error) {
+	if err := services.AuthorizeGuardian(ctx, filter.FamilyID); err != nil {
+		return nil, err
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 50
+	}
+	if filter.Limit > 200 {
+		filter.Limit = 200
+	}
+	switch filter.Status {
+	case "", StatusPending, StatusDelivered, StatusDead:
+	default:
+		return nil, services.Validationf("status must be one of %s, %s or %s", StatusPending, StatusDelivered, StatusDead)
+	}
+
+	query := database.WithContext(ctx).Preload("Webhook").Preload("Event").
+		Where("webhook_id IN (?)", database.Model(&db.Webhook{}).Select("id").Where("family_id = ?", filter.FamilyID))
+	if filter.WebhookID > 0 {
+		query = query.Where("webhook_id = ?", filter.WebhookID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.BeforeID > 0 {
+		query = query.Where("id < ?", filter.BeforeID)
+	}
+	deliveries := []db.WebhookDelivery{}
+	if err := query.Order("id DESC").Limit(filter.Limit).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	page := &DeliveryPage{Deliveries: deliveries}
+	if len(deliveries) == filter.Limit {
+		page.NextCursor = deliveries[len(deliveries)-1].ID
+	}
+	return page, nil
+}
+
+// Retry puts a dead delivery back in the queue for an immediate attempt,
+// with a fresh allowance of attempts.
+func Retry(ctx context.Context, database *gorm.DB, deliveryID uint64) (*db.WebhookDelivery, error) {
+	var delivery db.WebhookDelivery
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&delivery, deliveryID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return services.NotFoundf("webhook delivery %d not found", deliveryID)
+			}
+			return err
+		}
+		var webhook db.Webhook
+		if err := tx.First(&webhook, delivery.WebhookID).Error; err != nil {
+			return err
+		}
+		if err := services.AuthorizeGuardian(ctx, webhook.FamilyID); err != nil {
+			return err
+		}
+		if delivery.Status != StatusDead {
+			return services.Conflictf("webhook delivery %d is %s, only dead deliveries can be retried", deliveryID, delivery.Status)
+		}
+		delivery.Status, delivery.Attempts, delivery.NextAttemptAt = StatusPending, 0, time.Now()
+		return tx.Model(&delivery).Select("status", "attempts", "next_attempt_at").Updates(&delivery).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func knownEvent(event string) bool {
+	for _, known := range services.EventTypes {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed reports whether the webhook receives events of the type.
+func subscribed(webhook *db.Webhook, eventType string) bool {
+	if webhook.Events == "" {
+		return true
+	}
+	for _, event := range strings.Split(webhook.Events, ",") {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func snapshot(webhook *db.Webhook) *webhookSnapshot {
+	return &webhookSnapshot{ID: webhook.ID, URL: webhook.URL, Events: webhook.Events}
+}
+
+func audit(ctx context.Context, tx *gorm.DB, webhook *db.Webhook, action string, before, after interface{}) error {
+	auditLog, err := services.NewAuditLog(ctx, webhook.FamilyID, action, before, after)
+	if err != nil {
+		return err
+	}
+	return services.AppendAuditLog(ctx, storage.NewGorm(tx), auditLog)
+}
@@ -0,0 +1,232 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"reward-system/internal/db"
+	"reward-system/internal/services"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := database.AutoMigrate(db.Models()...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return database
+}
+
+// receiver is a stand-in webhook endpoint that answers with status and
+// records the requests it verified.
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	secret   string
+	received []services.EventEnvelope
+	t        *testing.T
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := io.ReadAll(req.Body)
+	timestamp, _ := strconv.ParseInt(req.Header.Get("X-Kudo-Timestamp"), 10, 64)
+	if got := req.Header.Get("X-Kudo-Signature"); got != Sign(r.secret, timestamp, body) {
+		r.t.Errorf("Invalid signature %q", got)
+	}
+	var p services.EventEnvelope
+	if err := json.Unmarshal(body, &p); err != nil || req.Header.Get("X-Kudo-Event") != p.Type {
+		r.t.Errorf("Unexpected delivery %s: %v", body, err)
+	}
+	r.received = append(r.received, p)
+	w.WriteHeader(r.status)
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func TestDispatcher(t *testing.T) {
+	database := setupTestDB(t)
+	ctx := services.WithActor(context.Background(), services.OperatorActor(services.SourceCLI))
+	service := services.NewRewardService(database)
+
+	family := &db.Family{Name: "Test Family"}
+	database.Create(family)
+	child := &db.User{FamilyID: family.ID, Role: "child", DisplayName: "Kid", IsActive: true}
+	database.Create(child)
+	rewardType := &db.RewardType{FamilyID: family.ID, Name: "Stars", UnitKind: "points"}
+	if err := service.CreateRewardType(ctx, rewardType); err != nil {
+		t.Fatalf("CreateRewardType: %v", err)
+	}
+
+	endpoint := &receiver{status: http.StatusNoContent, t: t}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	// The test endpoint listens on loopback, which must be allowed.
+	allowed, err := ParseAllowedNets("127.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatalf("ParseAllowedNets: %v", err)
+	}
+	if _, err := Create(ctx, database, family.ID, "ftp://example.com", nil, allowed); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for a non-http URL, got %v", err)
+	}
+	if _, err := Create(ctx, database, family.ID, server.URL, []string{"reward.stolen"}, allowed); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for an unknown event, got %v", err)
+	}
+	if _, err := Create(ctx, database, family.ID, server.URL, nil, nil); !errors.Is(err, services.ErrValidation) {
+		t.Errorf("Expected a validation error for a loopback URL that is not allowed, got %v", err)
+	}
+	webhook, err := Create(ctx, database, family.ID, server.URL, []string{services.EventRewardGranted, services.EventRewardSpent}, allowed)
+	if err != nil || len(webhook.Secret) != 64 {
+		t.Fatalf("Create: %+v, %v", webhook, err)
+	}
+	endpoint.secret = webhook.Secret
+
+	dispatcher := NewDispatcher(database, allowed)
+	dispatcher.BaseDelay, dispatcher.MaxAttempts = time.Millisecond, 2
+	if _, err := service.GrantReward(ctx, family.ID, child.ID, rewardType.ID, 10, "chores", ""); err != nil {
+		t.Fatalf("GrantReward: %v", err)
+	}
+	// A failed spend writes no event.
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 100, "", ""); !errors.Is(err, services.ErrInsufficientBalance) {
+		t.Fatalf("Expected insufficient balance, got %v", err)
+	}
+	if err := dispatcher.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+
+	// reward_type.created happened before the webhook existed.
+	if len(endpoint.received) != 1 || endpoint.received[0].Type != services.EventRewardGranted {
+		t.Fatalf("Expected the grant to be delivered, got %+v", endpoint.received)
+	}
+	var event services.LedgerEvent
+	if err := json.Unmarshal(endpoint.received[0].Data, &event); err != nil || event.ChildID != child.ID || event.Value != 10 || event.Balance != 10 {
+		t.Errorf("Unexpected event data %s: %v", endpoint.received[0].Data, err)
+	}
+	page, _ := ListDeliveries(ctx, database, DeliveryFilter{FamilyID: family.ID})
+	if len(page.Deliveries) != 1 || page.Deliveries[0].Status != StatusDelivered || page.Deliveries[0].LastStatus != http.StatusNoContent {
+		t.Fatalf("Expected a delivered delivery, got %+v", page.Deliveries)
+	}
+
+	// A failing endpoint is retried with backoff, then given up on.
+	endpoint.setStatus(http.StatusInternalServerError)
+	if _, err := service.SpendReward(ctx, family.ID, child.ID, rewardType.ID, 4, "", ""); err != nil {
+		t.Fatalf("SpendReward: %v", err)
+	}
+	dispatcher.RunOnce(ctx)
+	page, _ = ListDeliveries(ctx, database, DeliveryFilter{FamilyID: family.ID, Status: StatusPending})
+	if len(page.Deliveries) != 1 || page.Deliveries[0].Attempts != 1 || page.Deliveries[0].LastStatus != http.StatusInternalServerError {
+		t.Fatalf("Expected a pending delivery after one failure, got %+v", page.Deliveries)
+	}
+	time.Sleep(5 * time.Millisecond)
+	dispatcher.RunOnce(ctx)
+	dead, _ := ListDeliveries(ctx, database, DeliveryFilter{FamilyID: family.ID, Status: StatusDead})
+	if len(dead.Deliveries) != 1 || dead.Deliveries[0].Event.Type != services.EventRewardSpent || dead.Deliveries[0].LastError == "" {
+		t.Fatalf("Expected a dead delivery after %d attempts, got %+v", dispatcher.MaxAttempts, dead.Deliveries)
+	}
+	dispatcher.RunOnce(ctx)
+	if len(endpoint.received) != 3 {
+		t.Errorf("Expected dead deliveries not to be attempted, got %d requests", len(endpoint.received))
+	}
+
+	// A retried dead delivery goes out again.
+	endpoint.setStatus(http.StatusOK)
+	if _, err := Retry(ctx, database, page.Deliveries[0].ID); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if _, err := Retry(ctx, database, page.Deliveries[0].ID); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("Expected a conflict retrying a pending delivery, got %v", err)
+	}
+	dispatcher.RunOnce(ctx)
+	if dead, _ := ListDeliveries(ctx, database, DeliveryFilter{FamilyID: family.ID, Status: StatusDead}); len(dead.Deliveries) != 0 || len(endpoint.received) != 4 {
+		t.Errorf("Expected the retried delivery to succeed, got %+v", dead.Deliveries)
+	}
+
+	if err := Delete(ctx, database, webhook.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	var deliveries int64
+	database.Model(&db.WebhookDelivery{}).Count(&deliveries)
+	if deliveries != 0 {
+		t.Errorf("Expected the deliveries to go with the webhook, got %d", deliveries)
+	}
+}
+
+func TestClient(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":      true,
+		"2606:4700::1111":    true,
+		"127.0.0.1":          false,
+		"::1":                false,
+		"10.1.2.3":           false,
+		"172.16.0.1":         false,
+		"192.168.1.1":        false,
+		"169.254.169.254":    false,
+		"fe80::1":            false,
+		"fd00::1":            false,
+		"100.64.0.1":         false,
+		"0.0.0.0":            false,
+		"::ffff:127.0.0.1":   false,
+		"64:ff9b::a9fe:a9fe": false,
+	} {
+		if got := isPublic(net.ParseIP(address)); got != public {
+			t.Errorf("isPublic(%s) = %v, want %v", address, got, public)
+		}
+	}
+
+	allowed, err := ParseAllowedNets(" 192.168.1.0/24, 10.0.0.5 ,")
+	if err != nil || len(allowed) != 2 {
+		t.Fatalf("ParseAllowedNets: %v, %v", allowed, err)
+	}
+	for address, want := range map[string]bool{"192.168.1.20": true, "10.0.0.5": true, "10.0.0.6": false, "8.8.8.8": true} {
+		if got := permitted(net.ParseIP(address), allowed); got != want {
+			t.Errorf("permitted(%s) = %v, want %v", address, got, want)
+		}
+	}
+	if _, err := ParseAllowedNets("192.168.1.0/33"); err == nil {
+		t.Error("Expected an invalid CIDR to be refused")
+	}
+
+	// The dispatcher's client neither reaches the loopback endpoint nor
+	// follows redirects.
+	server := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	defer server.Close()
+	client := NewDispatcher(nil, nil).Client
+	if response, err := client.Post(server.URL, "application/json", nil); err == nil || !strings.Contains(err.Error(), "not public") {
+		if response != nil {
+			response.Body.Close()
+		}
+		t.Errorf("Expected the loopback endpoint refused, got %v", err)
+	}
+	if err := client.CheckRedirect(nil, nil); err != http.ErrUseLastResponse {
+		t.Errorf("Expected redirects not to be followed, got %v", err)
+	}
+}
+
+func TestDispatcher_Backoff(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil)
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 5: 8 * time.Minute, 10: 256 * time.Minute, 11: 6 * time.Hour, 40: 6 * time.Hour} {
+		if got := dispatcher.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+-- 回滚 003：删除幂等键表
+
+DROP TABLE IF EXISTS idempotency_records;
@@ -0,0 +1,17 @@
+-- 幂等键表：记录带 Idempotency-Key 的写请求响应，重试时直接回放
+
+CREATE TABLE IF NOT EXISTS idempotency_records (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    idempotency_key VARCHAR(128) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT NOT NULL DEFAULT 0,
+    content_type VARCHAR(128),
+    response_body MEDIUMTEXT,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    UNIQUE KEY uniq_idempotency_key (idempotency_key),
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='HTTP 幂等键表';
@@ -0,0 +1,3 @@
+-- 回滚 004：删除奖励类型单笔上限
+
+ALTER TABLE reward_types DROP COLUMN max_value;
@@ -0,0 +1,4 @@
+-- 奖励类型单笔上限：单笔授予/消费的最大值（以基本单位计，0 表示不限）
+
+ALTER TABLE reward_types
+    ADD COLUMN max_value BIGINT NOT NULL DEFAULT 0 COMMENT '单笔最大值（分/分钟/积分），0 表示不限' AFTER unit_label;
@@ -0,0 +1,8 @@
+-- 奖励类型的币种与小数位：数值以 value / 10^scale 的定点小数存储，
+-- 例如 scale=2 时 125 表示 1.25；现有 money 类型沿用人民币“分”（scale=2）
+
+ALTER TABLE reward_types
+    ADD COLUMN currency CHAR(3) NULL COMMENT '币种代码（仅 money 类型）：CNY/USD/HKD' AFTER unit_label,
+    ADD COLUMN scale TINYINT UNSIGNED NOT NULL DEFAULT 0 COMMENT '小数位数，time 类型固定为 0' AFTER currency;
+
+UPDATE reward_types SET currency = 'CNY', scale = 2 WHERE unit_kind = 'money';
@@ -0,0 +1,5 @@
+-- 回滚 006：删除归档时间；已归档的用户仍保持停用
+
+ALTER TABLE users
+    DROP INDEX idx_archived_at,
+    DROP COLUMN archived_at;
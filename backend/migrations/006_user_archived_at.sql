@@ -0,0 +1,6 @@
+-- 用户生命周期：停用（is_active = 0）与归档（另记 archived_at，账本冻结）取代物理删除，
+-- 删除用户会级联删除孩子的账户与交易记录
+
+ALTER TABLE users
+    ADD COLUMN archived_at DATETIME NULL COMMENT '归档时间，NULL 表示未归档' AFTER is_active,
+    ADD INDEX idx_archived_at (archived_at);
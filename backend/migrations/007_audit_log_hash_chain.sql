@@ -0,0 +1,13 @@
+-- 审计日志哈希链：每个家庭的审计日志依次链接，hash 为 SHA-256(上一条的 hash + 本条内容)，
+-- 任何修改或删除都会使校验失败（cmd/audit verify）。此前写入的日志没有 hash，不参与校验
+
+ALTER TABLE audit_logs
+    ADD COLUMN prev_hash CHAR(64) NULL COMMENT '同一家庭上一条日志的 hash，链首为空' AFTER payload,
+    ADD COLUMN hash CHAR(64) NULL COMMENT 'SHA-256(prev_hash + 日志内容)' AFTER prev_hash;
+
+CREATE TABLE IF NOT EXISTS audit_chains (
+    family_id BIGINT PRIMARY KEY COMMENT '家庭 ID，0 表示不属于任何家庭的日志',
+    length BIGINT NOT NULL DEFAULT 0 COMMENT '链上的日志条数',
+    head CHAR(64) NOT NULL COMMENT '最新一条日志的 hash',
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='审计日志哈希链链头';
@@ -0,0 +1,49 @@
+-- 事务性发件箱与出站 Webhook：领域事件与变更在同一事务中写入 outbox_events，
+-- 由分发器按家庭配置的 URL 投递（HMAC 签名，失败按指数退避重试，超过次数进入死信）
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    family_id BIGINT NOT NULL,
+    type VARCHAR(32) NOT NULL COMMENT '事件类型，如 reward.granted',
+    payload JSON,
+    dispatched_at DATETIME NULL COMMENT '分发为投递任务的时间，NULL 表示待分发',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (family_id) REFERENCES families(id),
+    INDEX idx_family_id (family_id),
+    INDEX idx_dispatched_at (dispatched_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='领域事件发件箱';
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    family_id BIGINT NOT NULL,
+    url VARCHAR(512) NOT NULL,
+    secret VARCHAR(64) NOT NULL COMMENT 'HMAC-SHA256 签名密钥',
+    events VARCHAR(255) COMMENT '订阅的事件类型，逗号分隔，为空表示全部',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (family_id) REFERENCES families(id),
+    INDEX idx_family_id (family_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='出站 Webhook';
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    webhook_id BIGINT NOT NULL,
+    event_id BIGINT NOT NULL,
+    status VARCHAR(16) NOT NULL COMMENT 'pending、delivered 或 dead（死信）',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_status INT COMMENT '最近一次投递的 HTTP 状态码',
+    last_error VARCHAR(512),
+    delivered_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id),
+    FOREIGN KEY (event_id) REFERENCES outbox_events(id),
+    UNIQUE KEY uniq_webhook_event (webhook_id, event_id),
+    INDEX idx_event_id (event_id),
+    INDEX idx_status_next_attempt (status, next_attempt_at),
+    CONSTRAINT chk_delivery_status CHECK (status IN ('pending', 'delivered', 'dead'))
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='Webhook 投递记录';
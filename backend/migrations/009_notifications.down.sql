@@ -0,0 +1,7 @@
+-- 回滚 009：删除通知偏好、余额提醒线与通知进度
+
+DROP TABLE IF EXISTS notification_preferences;
+
+ALTER TABLE reward_types DROP COLUMN low_balance_threshold;
+
+ALTER TABLE outbox_events DROP INDEX idx_notified_at, DROP COLUMN notified_at;
@@ -0,0 +1,22 @@
+-- 通知：按用户偏好把奖励、消费、余额不足与待审批通过微信客服消息、邮件或日志告知家长和孩子；
+-- 通知器读取发件箱中 notified_at 为空的事件
+
+ALTER TABLE outbox_events
+    ADD COLUMN notified_at DATETIME NULL COMMENT '已通知的时间，NULL 表示待通知' AFTER dispatched_at,
+    ADD INDEX idx_notified_at (notified_at);
+
+ALTER TABLE reward_types
+    ADD COLUMN low_balance_threshold BIGINT NOT NULL DEFAULT 0 COMMENT '余额低于此值时提醒（分/分钟/积分），0 表示不提醒' AFTER max_value;
+
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id BIGINT PRIMARY KEY,
+    grants BOOLEAN NOT NULL DEFAULT TRUE COMMENT '获得奖励时通知',
+    spends BOOLEAN NOT NULL DEFAULT TRUE COMMENT '消费时通知',
+    low_balance BOOLEAN NOT NULL DEFAULT TRUE COMMENT '余额不足时通知',
+    approvals BOOLEAN NOT NULL DEFAULT TRUE COMMENT '有待审批时通知',
+    channels VARCHAR(64) NOT NULL COMMENT '通知渠道，逗号分隔：wechat、email、log',
+    email VARCHAR(254) COMMENT '邮件渠道的收件地址',
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (user_id) REFERENCES users(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='用户通知偏好';
@@ -0,0 +1,6 @@
+-- 回滚 010：删除摘要设置与发送记录
+
+ALTER TABLE notification_preferences DROP COLUMN digests;
+
+DROP TABLE IF EXISTS digest_runs;
+DROP TABLE IF EXISTS digest_settings;
@@ -0,0 +1,27 @@
+-- 摘要：按家庭设定的时间与时区发送每日或每周摘要（各孩子按奖励类型的获得、使用与余额）；
+-- digest_runs 记录已发送的周期，服务重启也不会重复发送
+
+CREATE TABLE IF NOT EXISTS digest_settings (
+    family_id BIGINT PRIMARY KEY,
+    frequency VARCHAR(8) NOT NULL COMMENT 'off、daily 或 weekly',
+    time VARCHAR(5) NOT NULL COMMENT '发送时间（当地时间 HH:MM）',
+    weekday INT NOT NULL COMMENT '每周摘要的发送日，0 为周日',
+    timezone VARCHAR(64) NOT NULL COMMENT 'IANA 时区，如 Asia/Shanghai',
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (family_id) REFERENCES families(id),
+    CONSTRAINT chk_digest_frequency CHECK (frequency IN ('off', 'daily', 'weekly'))
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='家庭摘要设置';
+
+CREATE TABLE IF NOT EXISTS digest_runs (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    family_id BIGINT NOT NULL,
+    period VARCHAR(32) NOT NULL COMMENT '摘要周期，如 daily/2024-06-10T20:00',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (family_id) REFERENCES families(id),
+    UNIQUE KEY uniq_family_period (family_id, period)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='已发送的摘要';
+
+ALTER TABLE notification_preferences
+    ADD COLUMN digests BOOLEAN NOT NULL DEFAULT TRUE COMMENT '接收家庭摘要' AFTER approvals;
@@ -0,0 +1,5 @@
+-- 回滚 011：删除登录会话与用户凭据
+
+DROP TABLE IF EXISTS sessions;
+
+ALTER TABLE users DROP INDEX idx_users_username, DROP COLUMN password_hash, DROP COLUMN username;
@@ -0,0 +1,21 @@
+-- 用户登录：监护人与孩子以用户名和密码（bcrypt 散列）登录，获得短期 JWT 与刷新令牌；
+-- sessions 记录每次登录，刷新令牌只保存 SHA-256 散列，撤销会话即令其访问令牌失效
+
+ALTER TABLE users
+    ADD COLUMN username VARCHAR(64) NULL COMMENT '登录用户名，NULL 表示不能登录' AFTER wechat_openid,
+    ADD COLUMN password_hash VARCHAR(255) NOT NULL DEFAULT '' COMMENT '密码的 bcrypt 散列' AFTER username,
+    ADD UNIQUE INDEX idx_users_username (username);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    refresh_token_hash VARCHAR(64) NOT NULL COMMENT '刷新令牌的 SHA-256 散列，每次刷新更换',
+    expires_at DATETIME NOT NULL COMMENT '刷新令牌的过期时间',
+    revoked_at DATETIME NULL COMMENT '登出或撤销的时间',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_user_id (user_id),
+    UNIQUE KEY idx_sessions_refresh_token_hash (refresh_token_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='登录会话';
@@ -0,0 +1,3 @@
+-- 回滚 012：删除孩子自行消费开关
+
+ALTER TABLE reward_types DROP COLUMN children_may_spend;
@@ -0,0 +1,4 @@
+-- 权限：监护人可允许孩子自己消费某一奖励类型的余额，默认只有监护人可以扣除
+
+ALTER TABLE reward_types
+    ADD COLUMN children_may_spend BOOLEAN NOT NULL DEFAULT FALSE COMMENT '孩子可以自己消费此类奖励' AFTER low_balance_threshold;
@@ -0,0 +1,32 @@
+-- 回滚 013：没有操作人的交易重新记为孩子本人，created_by 恢复为必填
+
+UPDATE transactions t
+JOIN accounts a ON t.account_id = a.id
+SET t.created_by = a.child_id
+WHERE t.created_by IS NULL;
+
+ALTER TABLE transactions MODIFY COLUMN created_by BIGINT NOT NULL;
+
+CREATE OR REPLACE VIEW transaction_history AS
+SELECT
+    t.id as transaction_id,
+    t.account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name as child_name,
+    a.reward_type_id,
+    rt.name as reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    t.type,
+    t.value,
+    t.note,
+    t.created_by,
+    creator.display_name as creator_name,
+    t.idempotency_key,
+    t.created_at
+FROM transactions t
+JOIN accounts a ON t.account_id = a.id
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id
+JOIN users creator ON t.created_by = creator.id;
@@ -0,0 +1,38 @@
+-- 交易操作人：created_by 记录实际授予或消费的用户，此前一律填写孩子本人；
+-- 通过 API Token 或命令行产生的交易没有操作人，记为 NULL。
+-- 已有交易按审计日志中记录的操作人回填，无从查证的置为 NULL
+
+ALTER TABLE transactions
+    MODIFY COLUMN created_by BIGINT NULL COMMENT '操作人，NULL 表示 API Token 或命令行';
+
+UPDATE transactions SET created_by = NULL;
+
+UPDATE transactions t
+JOIN audit_logs l ON l.action IN ('reward.granted', 'reward.spent')
+    AND JSON_EXTRACT(l.payload, '$.after.transaction_id') = t.id
+SET t.created_by = l.user_id
+WHERE l.user_id IS NOT NULL;
+
+CREATE OR REPLACE VIEW transaction_history AS
+SELECT
+    t.id as transaction_id,
+    t.account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name as child_name,
+    a.reward_type_id,
+    rt.name as reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    t.type,
+    t.value,
+    t.note,
+    t.created_by,
+    creator.display_name as creator_name,
+    t.idempotency_key,
+    t.created_at
+FROM transactions t
+JOIN accounts a ON t.account_id = a.id
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id
+LEFT JOIN users creator ON t.created_by = creator.id;
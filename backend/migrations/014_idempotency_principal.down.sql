@@ -0,0 +1,8 @@
+-- 回滚 014：幂等键重新全局唯一
+
+DELETE FROM idempotency_records;
+
+ALTER TABLE idempotency_records
+    DROP INDEX uniq_idempotency_key,
+    DROP COLUMN principal,
+    ADD UNIQUE KEY uniq_idempotency_key (idempotency_key);
@@ -0,0 +1,9 @@
+-- 幂等键按调用者区分：不同用户使用同一个键互不影响，响应只回放给发起请求的调用者
+-- 已有记录没有调用者，无法再回放，直接清除
+
+DELETE FROM idempotency_records;
+
+ALTER TABLE idempotency_records
+    ADD COLUMN principal VARCHAR(64) NOT NULL COMMENT '发起请求的调用者，如 user:1 或 operator' AFTER id,
+    DROP INDEX uniq_idempotency_key,
+    ADD UNIQUE KEY uniq_idempotency_key (principal, idempotency_key);
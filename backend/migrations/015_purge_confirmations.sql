@@ -0,0 +1,18 @@
+-- 删除家庭的确认：每次请求签发一个限时 token，只保存 SHA-256 散列；
+-- 监护人带回 token 即记为同意，家庭的所有在用监护人都同意后才执行删除，运维者的确认可直接删除
+
+CREATE TABLE IF NOT EXISTS purge_confirmations (
+    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+    family_id BIGINT NOT NULL,
+    user_id BIGINT NULL COMMENT '请求删除的监护人，NULL 表示运维者',
+    token_hash VARCHAR(64) NOT NULL COMMENT '确认 token 的 SHA-256 散列',
+    expires_at DATETIME NOT NULL COMMENT '未确认时为 token 的过期时间，确认后为同意的有效期',
+    confirmed_at DATETIME NULL COMMENT '带回 token 确认的时间',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (family_id) REFERENCES families(id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_family_id (family_id),
+    INDEX idx_user_id (user_id),
+    UNIQUE KEY idx_purge_confirmations_token_hash (token_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci COMMENT='删除家庭的确认';
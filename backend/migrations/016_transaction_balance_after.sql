@@ -0,0 +1,14 @@
+-- 交易后余额：balance_after 记录每笔交易完成时账户的余额，幂等重试据此回放原始结果，而不是当前余额。
+-- 已有交易按账户内的交易顺序累计回填
+
+ALTER TABLE transactions
+    ADD COLUMN balance_after BIGINT NOT NULL DEFAULT 0 COMMENT '交易完成时账户的余额' AFTER value;
+
+UPDATE transactions t
+JOIN (
+    SELECT t1.id, SUM(CASE WHEN t2.type = 'credit' THEN t2.value ELSE -t2.value END) AS balance
+    FROM transactions t1
+    JOIN transactions t2 ON t2.account_id = t1.account_id AND t2.id <= t1.id
+    GROUP BY t1.id
+) b ON b.id = t.id
+SET t.balance_after = b.balance;
@@ -0,0 +1,12 @@
+// Package migrations embeds the versioned SQL schema so that the binaries
+// can migrate a database without the repository checked out next to them.
+// MySQL migrations live in this directory and their PostgreSQL equivalents
+// under postgres/, with the same file names. SQLite, supported later, starts
+// from a baseline under sqlite/ that equals all migrations up to its version;
+// the migrations after it exist for all three.
+package migrations
+
+import "embed"
+
+//go:embed *.sql postgres/*.sql sqlite/*.sql
+var FS embed.FS
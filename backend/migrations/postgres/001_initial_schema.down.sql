@@ -0,0 +1,11 @@
+-- 回滚 001：删除视图与全部业务表
+
+DROP VIEW IF EXISTS transaction_history;
+DROP VIEW IF EXISTS account_balances;
+
+DROP TABLE IF EXISTS audit_logs;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS accounts;
+DROP TABLE IF EXISTS reward_types;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS families;
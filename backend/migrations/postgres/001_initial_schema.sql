@@ -0,0 +1,142 @@
+-- 奖励系统数据库迁移脚本
+-- 基于 PostgreSQL 13+，与 ../001_initial_schema.sql（MySQL）等价：
+-- ENUM 改为 CHECK 约束，JSON 改为 JSONB，列/表注释使用 COMMENT ON
+
+-- 家庭表
+CREATE TABLE IF NOT EXISTS families (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_families_created_at ON families (created_at);
+
+-- 用户表
+CREATE TABLE IF NOT EXISTS users (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL CHECK (role IN ('guardian', 'child')),
+    display_name VARCHAR(64) NOT NULL,
+    wechat_openid VARCHAR(128) UNIQUE,
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_family_role ON users (family_id, role);
+CREATE INDEX IF NOT EXISTS idx_users_is_active ON users (is_active);
+
+-- 奖励类型表
+CREATE TABLE IF NOT EXISTS reward_types (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    unit_kind VARCHAR(16) NOT NULL CHECK (unit_kind IN ('money', 'time', 'points', 'custom')),
+    unit_label VARCHAR(32),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT uniq_family_name UNIQUE (family_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reward_types_unit_kind ON reward_types (unit_kind);
+
+-- 账户表（孩子在每种奖励类型上的账户）
+CREATE TABLE IF NOT EXISTS accounts (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id) ON DELETE CASCADE,
+    child_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reward_type_id BIGINT NOT NULL REFERENCES reward_types(id) ON DELETE CASCADE,
+    balance BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT uniq_child_reward_type UNIQUE (child_id, reward_type_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_accounts_family_id ON accounts (family_id);
+CREATE INDEX IF NOT EXISTS idx_accounts_reward_type_id ON accounts (reward_type_id);
+
+-- 交易记录表
+CREATE TABLE IF NOT EXISTS transactions (
+    id BIGSERIAL PRIMARY KEY,
+    account_id BIGINT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+    type VARCHAR(16) NOT NULL CHECK (type IN ('credit', 'debit')),
+    value BIGINT NOT NULL,
+    note VARCHAR(255),
+    created_by BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(64),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_created_by ON transactions (created_by);
+CREATE INDEX IF NOT EXISTS idx_transactions_created_at ON transactions (created_at);
+CREATE INDEX IF NOT EXISTS idx_transactions_idempotency_key ON transactions (idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_transactions_account_created ON transactions (account_id, created_at DESC);
+
+-- 审计日志表
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT REFERENCES families(id) ON DELETE SET NULL,
+    user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(32) NOT NULL,
+    payload JSONB,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_logs_family_id ON audit_logs (family_id);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_user_id ON audit_logs (user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_action ON audit_logs (action);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_created_at ON audit_logs (created_at);
+
+-- 创建视图：账户余额汇总
+CREATE OR REPLACE VIEW account_balances AS
+SELECT
+    a.id AS account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name AS child_name,
+    a.reward_type_id,
+    rt.name AS reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    a.balance,
+    a.created_at,
+    a.updated_at
+FROM accounts a
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id;
+
+-- 创建视图：交易历史（带详细信息）
+CREATE OR REPLACE VIEW transaction_history AS
+SELECT
+    t.id AS transaction_id,
+    t.account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name AS child_name,
+    a.reward_type_id,
+    rt.name AS reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    t.type,
+    t.value,
+    t.note,
+    t.created_by,
+    creator.display_name AS creator_name,
+    t.idempotency_key,
+    t.created_at
+FROM transactions t
+JOIN accounts a ON t.account_id = a.id
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id
+JOIN users creator ON t.created_by = creator.id;
+
+-- 添加注释
+COMMENT ON TABLE families IS '家庭信息表';
+COMMENT ON TABLE users IS '用户信息表（监护人和孩子）';
+COMMENT ON TABLE reward_types IS '奖励类型定义表';
+COMMENT ON TABLE accounts IS '孩子账户表（按奖励类型）';
+COMMENT ON TABLE transactions IS '交易记录表';
+COMMENT ON TABLE audit_logs IS '审计日志表';
@@ -0,0 +1,20 @@
+-- 幂等键表：记录带 Idempotency-Key 的写请求响应，重试时直接回放
+
+CREATE TABLE IF NOT EXISTS idempotency_records (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_key VARCHAR(128) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT NOT NULL DEFAULT 0,
+    content_type VARCHAR(128),
+    response_body TEXT,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT uniq_idempotency_key UNIQUE (idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_records_expires_at ON idempotency_records (expires_at);
+
+COMMENT ON TABLE idempotency_records IS 'HTTP 幂等键表';
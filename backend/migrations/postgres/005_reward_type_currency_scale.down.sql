@@ -0,0 +1,5 @@
+-- 回滚 005：删除币种与小数位；数值仍以基本单位（分）保存
+
+ALTER TABLE reward_types
+    DROP COLUMN scale,
+    DROP COLUMN currency;
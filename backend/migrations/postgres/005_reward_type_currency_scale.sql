@@ -0,0 +1,11 @@
+-- 奖励类型的币种与小数位：数值以 value / 10^scale 的定点小数存储，
+-- 例如 scale=2 时 125 表示 1.25；现有 money 类型沿用人民币“分”（scale=2）
+
+ALTER TABLE reward_types
+    ADD COLUMN currency VARCHAR(3) NULL,
+    ADD COLUMN scale SMALLINT NOT NULL DEFAULT 0 CHECK (scale >= 0);
+
+COMMENT ON COLUMN reward_types.currency IS '币种代码（仅 money 类型）：CNY/USD/HKD';
+COMMENT ON COLUMN reward_types.scale IS '小数位数，time 类型固定为 0';
+
+UPDATE reward_types SET currency = 'CNY', scale = 2 WHERE unit_kind = 'money';
@@ -0,0 +1,5 @@
+-- 回滚 006：删除归档时间；已归档的用户仍保持停用
+
+DROP INDEX IF EXISTS idx_users_archived_at;
+
+ALTER TABLE users DROP COLUMN archived_at;
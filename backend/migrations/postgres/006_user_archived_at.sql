@@ -0,0 +1,8 @@
+-- 用户生命周期：停用（is_active = FALSE）与归档（另记 archived_at，账本冻结）取代物理删除，
+-- 删除用户会级联删除孩子的账户与交易记录
+
+ALTER TABLE users ADD COLUMN archived_at TIMESTAMPTZ NULL;
+
+COMMENT ON COLUMN users.archived_at IS '归档时间，NULL 表示未归档';
+
+CREATE INDEX IF NOT EXISTS idx_users_archived_at ON users (archived_at);
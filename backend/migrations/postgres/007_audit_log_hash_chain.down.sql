@@ -0,0 +1,7 @@
+-- 回滚 007：删除哈希链
+
+DROP TABLE IF EXISTS audit_chains;
+
+ALTER TABLE audit_logs
+    DROP COLUMN hash,
+    DROP COLUMN prev_hash;
@@ -0,0 +1,21 @@
+-- 审计日志哈希链：每个家庭的审计日志依次链接，hash 为 SHA-256(上一条的 hash + 本条内容)，
+-- 任何修改或删除都会使校验失败（cmd/audit verify）。此前写入的日志没有 hash，不参与校验
+
+ALTER TABLE audit_logs
+    ADD COLUMN prev_hash VARCHAR(64) NULL,
+    ADD COLUMN hash CHAR(64) NULL;
+
+COMMENT ON COLUMN audit_logs.prev_hash IS '同一家庭上一条日志的 hash，链首为空';
+COMMENT ON COLUMN audit_logs.hash IS 'SHA-256(prev_hash + 日志内容)';
+
+CREATE TABLE IF NOT EXISTS audit_chains (
+    family_id BIGINT PRIMARY KEY,
+    length BIGINT NOT NULL DEFAULT 0,
+    head VARCHAR(64) NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE audit_chains IS '审计日志哈希链链头';
+COMMENT ON COLUMN audit_chains.family_id IS '家庭 ID，0 表示不属于任何家庭的日志';
+COMMENT ON COLUMN audit_chains.length IS '链上的日志条数';
+COMMENT ON COLUMN audit_chains.head IS '最新一条日志的 hash';
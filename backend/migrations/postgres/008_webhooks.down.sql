@@ -0,0 +1,5 @@
+-- 回滚 008：删除发件箱与 Webhook
+
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS outbox_events;
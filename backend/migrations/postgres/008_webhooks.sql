@@ -0,0 +1,57 @@
+-- 事务性发件箱与出站 Webhook：领域事件与变更在同一事务中写入 outbox_events，
+-- 由分发器按家庭配置的 URL 投递（HMAC 签名，失败按指数退避重试，超过次数进入死信）
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id),
+    type VARCHAR(32) NOT NULL,
+    payload JSONB,
+    dispatched_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_events_family_id ON outbox_events (family_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_dispatched_at ON outbox_events (dispatched_at);
+
+COMMENT ON TABLE outbox_events IS '领域事件发件箱';
+COMMENT ON COLUMN outbox_events.type IS '事件类型，如 reward.granted';
+COMMENT ON COLUMN outbox_events.dispatched_at IS '分发为投递任务的时间，NULL 表示待分发';
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id),
+    url VARCHAR(512) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    events VARCHAR(255),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_family_id ON webhooks (family_id);
+
+COMMENT ON TABLE webhooks IS '出站 Webhook';
+COMMENT ON COLUMN webhooks.secret IS 'HMAC-SHA256 签名密钥';
+COMMENT ON COLUMN webhooks.events IS '订阅的事件类型，逗号分隔，为空表示全部';
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT NOT NULL REFERENCES webhooks(id),
+    event_id BIGINT NOT NULL REFERENCES outbox_events(id),
+    status VARCHAR(16) NOT NULL CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_status INT,
+    last_error VARCHAR(512),
+    delivered_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT uniq_webhook_event UNIQUE (webhook_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_event_id ON webhook_deliveries (event_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status_next_attempt ON webhook_deliveries (status, next_attempt_at);
+
+COMMENT ON TABLE webhook_deliveries IS 'Webhook 投递记录';
+COMMENT ON COLUMN webhook_deliveries.status IS 'pending、delivered 或 dead（死信）';
+COMMENT ON COLUMN webhook_deliveries.last_status IS '最近一次投递的 HTTP 状态码';
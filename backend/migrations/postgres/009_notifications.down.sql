@@ -0,0 +1,9 @@
+-- 回滚 009：删除通知偏好、余额提醒线与通知进度
+
+DROP TABLE IF EXISTS notification_preferences;
+
+ALTER TABLE reward_types DROP COLUMN low_balance_threshold;
+
+DROP INDEX IF EXISTS idx_outbox_events_notified_at;
+
+ALTER TABLE outbox_events DROP COLUMN notified_at;
@@ -0,0 +1,27 @@
+-- 通知：按用户偏好把奖励、消费、余额不足与待审批通过微信客服消息、邮件或日志告知家长和孩子；
+-- 通知器读取发件箱中 notified_at 为空的事件
+
+ALTER TABLE outbox_events ADD COLUMN notified_at TIMESTAMPTZ NULL;
+
+COMMENT ON COLUMN outbox_events.notified_at IS '已通知的时间，NULL 表示待通知';
+
+CREATE INDEX IF NOT EXISTS idx_outbox_events_notified_at ON outbox_events (notified_at);
+
+ALTER TABLE reward_types ADD COLUMN low_balance_threshold BIGINT NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN reward_types.low_balance_threshold IS '余额低于此值时提醒（分/分钟/积分），0 表示不提醒';
+
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id),
+    grants BOOLEAN NOT NULL DEFAULT TRUE,
+    spends BOOLEAN NOT NULL DEFAULT TRUE,
+    low_balance BOOLEAN NOT NULL DEFAULT TRUE,
+    approvals BOOLEAN NOT NULL DEFAULT TRUE,
+    channels VARCHAR(64) NOT NULL,
+    email VARCHAR(254),
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE notification_preferences IS '用户通知偏好';
+COMMENT ON COLUMN notification_preferences.channels IS '通知渠道，逗号分隔：wechat、email、log';
+COMMENT ON COLUMN notification_preferences.email IS '邮件渠道的收件地址';
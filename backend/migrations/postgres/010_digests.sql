@@ -0,0 +1,32 @@
+-- 摘要：按家庭设定的时间与时区发送每日或每周摘要（各孩子按奖励类型的获得、使用与余额）；
+-- digest_runs 记录已发送的周期，服务重启也不会重复发送
+
+CREATE TABLE IF NOT EXISTS digest_settings (
+    family_id BIGINT PRIMARY KEY REFERENCES families(id),
+    frequency VARCHAR(8) NOT NULL CHECK (frequency IN ('off', 'daily', 'weekly')),
+    time VARCHAR(5) NOT NULL,
+    weekday INT NOT NULL,
+    timezone VARCHAR(64) NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE digest_settings IS '家庭摘要设置';
+COMMENT ON COLUMN digest_settings.frequency IS 'off、daily 或 weekly';
+COMMENT ON COLUMN digest_settings.time IS '发送时间（当地时间 HH:MM）';
+COMMENT ON COLUMN digest_settings.weekday IS '每周摘要的发送日，0 为周日';
+COMMENT ON COLUMN digest_settings.timezone IS 'IANA 时区，如 Asia/Shanghai';
+
+CREATE TABLE IF NOT EXISTS digest_runs (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id),
+    period VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT uniq_family_period UNIQUE (family_id, period)
+);
+
+COMMENT ON TABLE digest_runs IS '已发送的摘要';
+COMMENT ON COLUMN digest_runs.period IS '摘要周期，如 daily/2024-06-10T20:00';
+
+ALTER TABLE notification_preferences ADD COLUMN digests BOOLEAN NOT NULL DEFAULT TRUE;
+
+COMMENT ON COLUMN notification_preferences.digests IS '接收家庭摘要';
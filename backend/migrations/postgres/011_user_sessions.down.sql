@@ -0,0 +1,8 @@
+-- 回滚 011：删除登录会话与用户凭据
+
+DROP TABLE IF EXISTS sessions;
+
+DROP INDEX IF EXISTS idx_users_username;
+
+ALTER TABLE users DROP COLUMN password_hash;
+ALTER TABLE users DROP COLUMN username;
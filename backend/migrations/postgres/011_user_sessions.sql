@@ -0,0 +1,28 @@
+-- 用户登录：监护人与孩子以用户名和密码（bcrypt 散列）登录，获得短期 JWT 与刷新令牌；
+-- sessions 记录每次登录，刷新令牌只保存 SHA-256 散列，撤销会话即令其访问令牌失效
+
+ALTER TABLE users ADD COLUMN username VARCHAR(64) NULL;
+ALTER TABLE users ADD COLUMN password_hash VARCHAR(255) NOT NULL DEFAULT '';
+
+COMMENT ON COLUMN users.username IS '登录用户名，NULL 表示不能登录';
+COMMENT ON COLUMN users.password_hash IS '密码的 bcrypt 散列';
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    refresh_token_hash VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE sessions IS '登录会话';
+COMMENT ON COLUMN sessions.refresh_token_hash IS '刷新令牌的 SHA-256 散列，每次刷新更换';
+COMMENT ON COLUMN sessions.expires_at IS '刷新令牌的过期时间';
+COMMENT ON COLUMN sessions.revoked_at IS '登出或撤销的时间';
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_refresh_token_hash ON sessions (refresh_token_hash);
@@ -0,0 +1,34 @@
+-- 回滚 013：没有操作人的交易重新记为孩子本人，created_by 恢复为必填
+
+UPDATE transactions t
+SET created_by = a.child_id
+FROM accounts a
+WHERE t.account_id = a.id AND t.created_by IS NULL;
+
+ALTER TABLE transactions ALTER COLUMN created_by SET NOT NULL;
+
+COMMENT ON COLUMN transactions.created_by IS NULL;
+
+CREATE OR REPLACE VIEW transaction_history AS
+SELECT
+    t.id AS transaction_id,
+    t.account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name AS child_name,
+    a.reward_type_id,
+    rt.name AS reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    t.type,
+    t.value,
+    t.note,
+    t.created_by,
+    creator.display_name AS creator_name,
+    t.idempotency_key,
+    t.created_at
+FROM transactions t
+JOIN accounts a ON t.account_id = a.id
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id
+JOIN users creator ON t.created_by = creator.id;
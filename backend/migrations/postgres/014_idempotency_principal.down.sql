@@ -0,0 +1,7 @@
+-- 回滚 014：幂等键重新全局唯一
+
+DELETE FROM idempotency_records;
+
+ALTER TABLE idempotency_records DROP CONSTRAINT uniq_idempotency_key;
+ALTER TABLE idempotency_records DROP COLUMN principal;
+ALTER TABLE idempotency_records ADD CONSTRAINT uniq_idempotency_key UNIQUE (idempotency_key);
@@ -0,0 +1,10 @@
+-- 幂等键按调用者区分：不同用户使用同一个键互不影响，响应只回放给发起请求的调用者
+-- 已有记录没有调用者，无法再回放，直接清除
+
+DELETE FROM idempotency_records;
+
+ALTER TABLE idempotency_records ADD COLUMN principal VARCHAR(64) NOT NULL;
+ALTER TABLE idempotency_records DROP CONSTRAINT uniq_idempotency_key;
+ALTER TABLE idempotency_records ADD CONSTRAINT uniq_idempotency_key UNIQUE (principal, idempotency_key);
+
+COMMENT ON COLUMN idempotency_records.principal IS '发起请求的调用者，如 user:1 或 operator';
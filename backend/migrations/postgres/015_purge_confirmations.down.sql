@@ -0,0 +1,3 @@
+-- 回滚 015：删除家庭删除确认
+
+DROP TABLE IF EXISTS purge_confirmations;
@@ -0,0 +1,22 @@
+-- 删除家庭的确认：每次请求签发一个限时 token，只保存 SHA-256 散列；
+-- 监护人带回 token 即记为同意，家庭的所有在用监护人都同意后才执行删除，运维者的确认可直接删除
+
+CREATE TABLE IF NOT EXISTS purge_confirmations (
+    id BIGSERIAL PRIMARY KEY,
+    family_id BIGINT NOT NULL REFERENCES families(id),
+    user_id BIGINT NULL REFERENCES users(id),
+    token_hash VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    confirmed_at TIMESTAMPTZ NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE purge_confirmations IS '删除家庭的确认';
+COMMENT ON COLUMN purge_confirmations.user_id IS '请求删除的监护人，NULL 表示运维者';
+COMMENT ON COLUMN purge_confirmations.token_hash IS '确认 token 的 SHA-256 散列';
+COMMENT ON COLUMN purge_confirmations.expires_at IS '未确认时为 token 的过期时间，确认后为同意的有效期';
+COMMENT ON COLUMN purge_confirmations.confirmed_at IS '带回 token 确认的时间';
+
+CREATE INDEX IF NOT EXISTS idx_purge_confirmations_family_id ON purge_confirmations (family_id);
+CREATE INDEX IF NOT EXISTS idx_purge_confirmations_user_id ON purge_confirmations (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_purge_confirmations_token_hash ON purge_confirmations (token_hash);
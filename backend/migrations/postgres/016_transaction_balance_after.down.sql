@@ -0,0 +1,3 @@
+-- 回滚 016：删除交易后余额
+
+ALTER TABLE transactions DROP COLUMN balance_after;
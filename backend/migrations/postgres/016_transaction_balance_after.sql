@@ -0,0 +1,14 @@
+-- 交易后余额：balance_after 记录每笔交易完成时账户的余额，幂等重试据此回放原始结果，而不是当前余额。
+-- 已有交易按账户内的交易顺序累计回填
+
+ALTER TABLE transactions ADD COLUMN balance_after BIGINT NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN transactions.balance_after IS '交易完成时账户的余额';
+
+UPDATE transactions t
+SET balance_after = b.balance
+FROM (
+    SELECT id, SUM(CASE WHEN type = 'credit' THEN value ELSE -value END) OVER (PARTITION BY account_id ORDER BY id) AS balance
+    FROM transactions
+) b
+WHERE b.id = t.id;
@@ -0,0 +1,21 @@
+-- 回滚 SQLite 基线：删除全部视图与表
+
+DROP VIEW IF EXISTS transaction_history;
+DROP VIEW IF EXISTS account_balances;
+
+DROP TABLE IF EXISTS idempotency_records;
+DROP TABLE IF EXISTS purge_confirmations;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS digest_runs;
+DROP TABLE IF EXISTS digest_settings;
+DROP TABLE IF EXISTS notification_preferences;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS outbox_events;
+DROP TABLE IF EXISTS audit_chains;
+DROP TABLE IF EXISTS audit_logs;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS accounts;
+DROP TABLE IF EXISTS reward_types;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS families;
@@ -0,0 +1,274 @@
+-- SQLite 表结构基线，与 MySQL / PostgreSQL 的 001 至 015 迁移合并后的结构等价：
+-- 自增主键使用 INTEGER PRIMARY KEY AUTOINCREMENT，时间列为 DATETIME，布尔列为 BOOLEAN，
+-- JSON 以 TEXT 保存；外键只在连接开启 foreign_keys 时生效。
+-- 索引沿用此前按模型建表时的名称，因此在这类数据库上执行时已有的表和索引保持不变，只补上缺少的部分。
+-- 之后的迁移在三种数据库下使用相同的版本号。
+
+-- 家庭表
+CREATE TABLE IF NOT EXISTS families (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 用户表（监护人和孩子）
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('guardian', 'child')),
+    display_name TEXT NOT NULL,
+    wechat_openid TEXT,
+    username TEXT,
+    password_hash TEXT NOT NULL DEFAULT '',
+    is_active BOOLEAN DEFAULT TRUE,
+    archived_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_family_id ON users (family_id);
+CREATE INDEX IF NOT EXISTS idx_users_archived_at ON users (archived_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_wechat_open_id ON users (wechat_openid);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
+
+-- 奖励类型定义表
+CREATE TABLE IF NOT EXISTS reward_types (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    unit_kind TEXT NOT NULL CHECK (unit_kind IN ('money', 'time', 'points', 'custom')),
+    unit_label TEXT,
+    currency TEXT,
+    scale INTEGER NOT NULL DEFAULT 0 CHECK (scale >= 0),
+    max_value INTEGER NOT NULL DEFAULT 0,
+    low_balance_threshold INTEGER NOT NULL DEFAULT 0,
+    children_may_spend BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_family_name ON reward_types (family_id, name);
+
+-- 孩子账户表（按奖励类型）
+CREATE TABLE IF NOT EXISTS accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id) ON DELETE CASCADE,
+    child_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reward_type_id INTEGER NOT NULL REFERENCES reward_types(id) ON DELETE CASCADE,
+    balance INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_accounts_family_id ON accounts (family_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_acc ON accounts (child_id, reward_type_id);
+
+-- 交易记录表；created_by 为 NULL 表示 API Token 或命令行
+CREATE TABLE IF NOT EXISTS transactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+    type TEXT NOT NULL CHECK (type IN ('credit', 'debit')),
+    value INTEGER NOT NULL,
+    note TEXT,
+    created_by INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    idempotency_key TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_account_id ON transactions (account_id);
+CREATE INDEX IF NOT EXISTS idx_transactions_created_by ON transactions (created_by);
+CREATE INDEX IF NOT EXISTS idx_transactions_idempotency_key ON transactions (idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_transactions_account_created ON transactions (account_id, created_at DESC);
+
+-- 审计日志表，按家庭以 SHA-256 串成哈希链
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER REFERENCES families(id) ON DELETE SET NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    payload TEXT,
+    prev_hash TEXT,
+    hash TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_logs_family_id ON audit_logs (family_id);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_user_id ON audit_logs (user_id);
+
+-- 每个家庭审计日志哈希链的链头，family_id 为 0 的是不属于任何家庭的日志
+CREATE TABLE IF NOT EXISTS audit_chains (
+    family_id INTEGER PRIMARY KEY,
+    length INTEGER NOT NULL DEFAULT 0,
+    head TEXT NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 领域事件发件箱，与产生它的变更在同一事务中写入
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id),
+    type TEXT NOT NULL,
+    payload TEXT,
+    dispatched_at DATETIME,
+    notified_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_events_family_id ON outbox_events (family_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_dispatched_at ON outbox_events (dispatched_at);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_notified_at ON outbox_events (notified_at);
+
+-- 家庭配置的 Webhook
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id),
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_family_id ON webhooks (family_id);
+
+-- 每个事件向每个 Webhook 的投递
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id),
+    event_id INTEGER NOT NULL REFERENCES outbox_events(id),
+    status TEXT NOT NULL CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_status INTEGER,
+    last_error TEXT,
+    delivered_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_webhook_event ON webhook_deliveries (webhook_id, event_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_event_id ON webhook_deliveries (event_id);
+CREATE INDEX IF NOT EXISTS idx_status_next_attempt ON webhook_deliveries (status, next_attempt_at);
+
+-- 用户的通知偏好
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id),
+    grants BOOLEAN NOT NULL DEFAULT TRUE,
+    spends BOOLEAN NOT NULL DEFAULT TRUE,
+    low_balance BOOLEAN NOT NULL DEFAULT TRUE,
+    approvals BOOLEAN NOT NULL DEFAULT TRUE,
+    digests BOOLEAN NOT NULL DEFAULT TRUE,
+    channels TEXT NOT NULL,
+    email TEXT,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 家庭摘要设置与已发送的摘要
+CREATE TABLE IF NOT EXISTS digest_settings (
+    family_id INTEGER PRIMARY KEY REFERENCES families(id),
+    frequency TEXT NOT NULL CHECK (frequency IN ('off', 'daily', 'weekly')),
+    time TEXT NOT NULL,
+    weekday INTEGER NOT NULL,
+    timezone TEXT NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS digest_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id),
+    period TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_family_period ON digest_runs (family_id, period);
+
+-- 登录会话，刷新令牌只保存 SHA-256 散列
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    refresh_token_hash TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    revoked_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_refresh_token_hash ON sessions (refresh_token_hash);
+
+-- 删除家庭的确认，token 只保存 SHA-256 散列；user_id 为 NULL 表示运维者
+CREATE TABLE IF NOT EXISTS purge_confirmations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    family_id INTEGER NOT NULL REFERENCES families(id),
+    user_id INTEGER REFERENCES users(id),
+    token_hash TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    confirmed_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_purge_confirmations_family_id ON purge_confirmations (family_id);
+CREATE INDEX IF NOT EXISTS idx_purge_confirmations_user_id ON purge_confirmations (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_purge_confirmations_token_hash ON purge_confirmations (token_hash);
+
+-- 幂等键记录，按调用者区分
+CREATE TABLE IF NOT EXISTS idempotency_records (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    principal TEXT NOT NULL,
+    idempotency_key TEXT NOT NULL,
+    method TEXT NOT NULL,
+    path TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    content_type TEXT,
+    response_body TEXT,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_idempotency_key ON idempotency_records (principal, idempotency_key);
+CREATE INDEX IF NOT EXISTS idx_idempotency_records_expires_at ON idempotency_records (expires_at);
+
+-- 视图：账户余额汇总
+CREATE VIEW IF NOT EXISTS account_balances AS
+SELECT
+    a.id AS account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name AS child_name,
+    a.reward_type_id,
+    rt.name AS reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    a.balance,
+    a.created_at,
+    a.updated_at
+FROM accounts a
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id;
+
+-- 视图：交易历史（带详细信息）
+CREATE VIEW IF NOT EXISTS transaction_history AS
+SELECT
+    t.id AS transaction_id,
+    t.account_id,
+    a.family_id,
+    a.child_id,
+    u.display_name AS child_name,
+    a.reward_type_id,
+    rt.name AS reward_type_name,
+    rt.unit_kind,
+    rt.unit_label,
+    t.type,
+    t.value,
+    t.note,
+    t.created_by,
+    creator.display_name AS creator_name,
+    t.idempotency_key,
+    t.created_at
+FROM transactions t
+JOIN accounts a ON t.account_id = a.id
+JOIN users u ON a.child_id = u.id
+JOIN reward_types rt ON a.reward_type_id = rt.id
+LEFT JOIN users creator ON t.created_by = creator.id;
@@ -0,0 +1,11 @@
+-- 交易后余额：balance_after 记录每笔交易完成时账户的余额，幂等重试据此回放原始结果，而不是当前余额。
+-- 已有交易按账户内的交易顺序累计回填
+
+ALTER TABLE transactions ADD COLUMN balance_after INTEGER NOT NULL DEFAULT 0;
+
+UPDATE transactions
+SET balance_after = (
+    SELECT SUM(CASE WHEN p.type = 'credit' THEN p.value ELSE -p.value END)
+    FROM transactions p
+    WHERE p.account_id = transactions.account_id AND p.id <= transactions.id
+);
@@ -5,10 +5,11 @@ import Header from './components/Header'
 import Dashboard from './pages/Dashboard'
 import RewardTypes from './pages/RewardTypes'
 import Transactions from './pages/Transactions'
+import Login from './pages/Login'
 import { useAuthStore } from './stores/authStore'
 
 function App() {
-  const { checkAuth } = useAuthStore()
+  const { checkAuth, isAuthenticated } = useAuthStore()
   const [loading, setLoading] = useState(true)
 
   useEffect(() => {
@@ -24,6 +25,15 @@ function App() {
     )
   }
 
+  if (!isAuthenticated) {
+    return (
+      <div className="min-h-screen bg-gray-50">
+        <Login />
+        <Toaster position="top-right" />
+      </div>
+    )
+  }
+
   return (
     <div className="min-h-screen bg-gray-50">
       <Header />
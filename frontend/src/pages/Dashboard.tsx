@@ -17,6 +17,7 @@ export default function Dashboard() {
     fetchUsers, 
     fetchRewardTypes,
     fetchBalance,
+    subscribeEvents,
     grantReward,
     spendReward,
     addChild,
@@ -57,6 +58,12 @@ export default function Dashboard() {
     }
   }, [users, rewardTypes, fetchBalance])
 
+  useEffect(() => {
+    if (currentFamily) {
+      return subscribeEvents(currentFamily.id)
+    }
+  }, [currentFamily, subscribeEvents])
+
   const getUnitIcon = (unitKind: string) => {
     switch (unitKind) {
       case 'money':
@@ -0,0 +1,63 @@
+import { useState } from 'react'
+import { toast } from 'sonner'
+import { useAuthStore } from '../stores/authStore'
+
+export default function Login() {
+  const { login } = useAuthStore()
+  const [username, setUsername] = useState('')
+  const [password, setPassword] = useState('')
+  const [submitting, setSubmitting] = useState(false)
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault()
+
+    if (!username.trim() || !password) {
+      toast.error('请输入用户名和密码')
+      return
+    }
+
+    setSubmitting(true)
+    try {
+      await login(username.trim(), password)
+    } catch (error: any) {
+      toast.error(error.response?.status === 401 ? '用户名或密码错误' : '登录失败')
+    } finally {
+      setSubmitting(false)
+    }
+  }
+
+  return (
+    <div className="flex items-center justify-center min-h-screen">
+      <form onSubmit={handleSubmit} className="bg-white shadow-sm border rounded-lg p-8 w-full max-w-sm space-y-4">
+        <h1 className="text-2xl font-bold text-gray-900 text-center">奖励系统</h1>
+        <div>
+          <label className="block text-sm font-medium text-gray-700 mb-1">用户名</label>
+          <input
+            type="text"
+            value={username}
+            onChange={(e) => setUsername(e.target.value)}
+            autoComplete="username"
+            className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-primary-500"
+          />
+        </div>
+        <div>
+          <label className="block text-sm font-medium text-gray-700 mb-1">密码</label>
+          <input
+            type="password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            autoComplete="current-password"
+            className="w-full px-3 py-2 border border-gray-300 rounded-md focus:outline-none focus:ring-2 focus:ring-primary-500"
+          />
+        </div>
+        <button
+          type="submit"
+          disabled={submitting}
+          className="w-full px-4 py-2 bg-primary-500 text-white rounded-lg hover:bg-primary-600 transition-colors disabled:opacity-50"
+        >
+          {submitting ? '登录中…' : '登录'}
+        </button>
+      </form>
+    </div>
+  )
+}
@@ -11,6 +11,7 @@ interface Transaction {
   note?: string
   created_at: string
   account_id: number
+  creator_name?: string
 }
 
 export default function Transactions() {
@@ -166,6 +167,11 @@ export default function Transactions() {
                             <User className="h-3 w-3" />
                             <span>{child?.display_name || '未知'}</span>
                           </div>
+                          {transaction.creator_name && (
+                            <div className="text-gray-500">
+                              操作人: {transaction.creator_name}
+                            </div>
+                          )}
                           {transaction.note && (
                             <div className="text-gray-500">
                               备注: {transaction.note}
@@ -1,27 +1,85 @@
 import { create } from 'zustand'
+import axios from 'axios'
+
+interface AuthUser {
+  id: number
+  family_id: number
+  role: 'guardian' | 'child'
+  display_name: string
+}
+
+interface Tokens {
+  access_token: string
+  refresh_token: string
+  user: AuthUser
+}
 
 interface AuthState {
   token: string | null
+  user: AuthUser | null
   isAuthenticated: boolean
-  login: (token: string) => void
-  logout: () => void
+  login: (username: string, password: string) => Promise<void>
+  refresh: () => Promise<string | null>
+  logout: () => Promise<void>
   checkAuth: () => void
 }
 
-export const useAuthStore = create<AuthState>((set) => ({
-  token: localStorage.getItem('token') || 'demo-token',
-  isAuthenticated: true,
-  login: (token: string) => {
-    localStorage.setItem('token', token)
-    set({ token, isAuthenticated: true })
+const saveTokens = (tokens: Tokens) => {
+  localStorage.setItem('token', tokens.access_token)
+  localStorage.setItem('refresh_token', tokens.refresh_token)
+  localStorage.setItem('user', JSON.stringify(tokens.user))
+}
+
+const clearTokens = () => {
+  localStorage.removeItem('token')
+  localStorage.removeItem('refresh_token')
+  localStorage.removeItem('user')
+}
+
+// refreshing is the refresh in flight, shared by the requests that found
+// the access token expired at the same time: a refresh token works once.
+let refreshing: Promise<string | null> | null = null
+
+export const useAuthStore = create<AuthState>((set, get) => ({
+  token: localStorage.getItem('token'),
+  user: JSON.parse(localStorage.getItem('user') || 'null'),
+  isAuthenticated: !!localStorage.getItem('token'),
+  login: async (username: string, password: string) => {
+    const res = await axios.post('/api/v1/auth/login', { username, password })
+    saveTokens(res.data.data)
+    set({ token: res.data.data.access_token, user: res.data.data.user, isAuthenticated: true })
+  },
+  refresh: () => {
+    if (!refreshing) {
+      refreshing = (async () => {
+        const refreshToken = localStorage.getItem('refresh_token')
+        try {
+          if (!refreshToken) throw new Error('not logged in')
+          const res = await axios.post('/api/v1/auth/refresh', { refresh_token: refreshToken })
+          saveTokens(res.data.data)
+          set({ token: res.data.data.access_token, user: res.data.data.user, isAuthenticated: true })
+          return res.data.data.access_token as string
+        } catch {
+          clearTokens()
+          set({ token: null, user: null, isAuthenticated: false })
+          return null
+        } finally {
+          refreshing = null
+        }
+      })()
+    }
+    return refreshing
   },
-  logout: () => {
-    localStorage.removeItem('token')
-    set({ token: null, isAuthenticated: false })
+  logout: async () => {
+    const token = get().token
+    if (token) {
+      await axios.post('/api/v1/auth/logout', null, { headers: { Authorization: `Bearer ${token}` } }).catch(() => {})
+    }
+    clearTokens()
+    set({ token: null, user: null, isAuthenticated: false })
   },
   checkAuth: () => {
-    const token = localStorage.getItem('token') || 'demo-token'
-    localStorage.setItem('token', token)
-    set({ token, isAuthenticated: true })
+    const token = localStorage.getItem('token')
+    set({ token, user: JSON.parse(localStorage.getItem('user') || 'null'), isAuthenticated: !!token })
   },
-}))
\ No newline at end of file
+}))
@@ -1,5 +1,6 @@
 import { create } from 'zustand'
 import axios from 'axios'
+import { useAuthStore } from './authStore'
 
 interface Family {
   id: number
@@ -40,6 +41,7 @@ interface FamilyStore {
   fetchUsers: (familyId: number) => Promise<void>
   fetchRewardTypes: (familyId: number) => Promise<void>
   fetchBalance: (childId: number, rewardTypeId: number) => Promise<void>
+  subscribeEvents: (familyId: number) => () => void
   createFamily: (name: string) => Promise<void>
   createRewardType: (data: any) => Promise<void>
   addChild: (familyId: number, displayName: string) => Promise<void>
@@ -53,11 +55,34 @@ const API_BASE = '/api/v1'
 export const api = axios.create({
   baseURL: API_BASE,
   headers: {
-    'Authorization': `Bearer ${localStorage.getItem('token') || ''}`,
     'Content-Type': 'application/json',
   },
 })
 
+api.interceptors.request.use((config) => {
+  const token = useAuthStore.getState().token
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`
+  }
+  return config
+})
+
+// An expired access token is refreshed once and the request retried; if
+// the session has ended the user is sent back to the login page.
+api.interceptors.response.use(undefined, async (error) => {
+  const config = error.config
+  if (error.response?.status !== 401 || !config || config._retried) {
+    throw error
+  }
+  const token = await useAuthStore.getState().refresh()
+  if (!token) {
+    throw error
+  }
+  config._retried = true
+  config.headers.Authorization = `Bearer ${token}`
+  return api(config)
+})
+
 export const useFamilyStore = create<FamilyStore>((set, get) => ({
   families: [],
   users: [],
@@ -130,6 +155,51 @@ export const useFamilyStore = create<FamilyStore>((set, get) => ({
     }
   },
 
+  // Keeps balances current from the family's event stream instead of
+  // polling. EventSource reconnects by itself with Last-Event-ID; when the
+  // stream is refused (e.g. the stream token expired) a new token is fetched.
+  subscribeEvents: (familyId: number) => {
+    let source: EventSource | null = null
+    let retry: ReturnType<typeof setTimeout> | undefined
+    let closed = false
+
+    const onLedgerEvent = (e: MessageEvent) => {
+      const { data } = JSON.parse(e.data)
+      set(state => ({
+        balances: {
+          ...state.balances,
+          [`${data.child_id}-${data.reward_type_id}`]: { balance: data.balance },
+        },
+      }))
+    }
+
+    const connect = async () => {
+      try {
+        const res = await api.post('/stream/tokens', { family_id: familyId })
+        if (closed) return
+        source = new EventSource(`${API_BASE}/stream?family_id=${familyId}&token=${encodeURIComponent(res.data.data.token)}`)
+        for (const type of ['reward.granted', 'reward.spent', 'transaction.adjusted']) {
+          source.addEventListener(type, onLedgerEvent as EventListener)
+        }
+        source.onerror = () => {
+          if (source?.readyState === EventSource.CLOSED && !closed) {
+            retry = setTimeout(connect, 5000)
+          }
+        }
+      } catch (error) {
+        console.error('订阅实时更新失败:', error)
+        if (!closed) retry = setTimeout(connect, 5000)
+      }
+    }
+    connect()
+
+    return () => {
+      closed = true
+      clearTimeout(retry)
+      source?.close()
+    }
+  },
+
   createFamily: async (name: string) => {
     set({ loading: true, error: null })
     try {